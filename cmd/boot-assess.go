@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+
+	"github.com/rancher/elemental-cli/cmd/config"
+	"github.com/rancher/elemental-cli/pkg/action"
+)
+
+// NewBootAssessCmd returns a new instance of the boot-assess subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewBootAssessCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "boot-assess",
+		Short: "Manage the boot assessment of the upgraded system",
+		Args:  cobra.ExactArgs(0),
+	}
+	markGood := &cobra.Command{
+		Use:     "mark-good",
+		Short:   "Mark the current boot as healthy and clear the boot attempts counter",
+		Args:    cobra.ExactArgs(0),
+		PreRunE: bootAssessPreRun(addCheckRoot),
+		RunE:    bootAssessRun(func(b *action.BootAssessAction) error { return b.MarkGood() }),
+	}
+	check := &cobra.Command{
+		Use:     "check",
+		Short:   "Record a failed boot assessment if the system booted from the fallback entry",
+		Args:    cobra.ExactArgs(0),
+		PreRunE: bootAssessPreRun(addCheckRoot),
+		RunE:    bootAssessRun(func(b *action.BootAssessAction) error { return b.Check() }),
+	}
+	root.AddCommand(c)
+	c.AddCommand(markGood)
+	c.AddCommand(check)
+	return c
+}
+
+func bootAssessPreRun(addCheckRoot bool) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		if addCheckRoot {
+			return CheckRoot()
+		}
+		return nil
+	}
+}
+
+func bootAssessRun(run func(b *action.BootAssessAction) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		cmd.SilenceUsage = true
+		spec, err := config.ReadBootAssessSpec(cfg)
+		if err != nil {
+			cfg.Logger.Errorf("invalid boot-assess command setup %v", err)
+			return err
+		}
+
+		return run(action.NewBootAssessAction(cfg, spec))
+	}
+}
+
+// register the subcommand into rootCmd
+var _ = NewBootAssessCmd(rootCmd, true)
@@ -56,6 +56,10 @@ func NewBuildDisk(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			err = validateProgressFlags(cfg.Logger, flags)
+			if err != nil {
+				return err
+			}
 
 			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
 			cmd.SilenceUsage = true
@@ -92,7 +96,9 @@ func NewBuildDisk(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return fmt.Errorf("output file %s exists, refusing to continue", output)
 			}
 
-			err = action.BuildDiskRun(cfg, specArch, imgType, oemLabel, recoveryLabel, output)
+			err = runWithProgress(&cfg.Config, flags, func() error {
+				return action.BuildDiskRun(cfg, specArch, imgType, oemLabel, recoveryLabel, output)
+			})
 			if err != nil {
 				return err
 			}
@@ -108,6 +114,7 @@ func NewBuildDisk(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	c.Flags().String("recovery_label", "COS_RECOVERY", "Recovery partition label")
 	addArchFlags(c)
 	addCosignFlags(c)
+	addProgressFlags(c)
 	return c
 }
 
@@ -66,6 +66,10 @@ func NewBuildISO(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			err = validateProgressFlags(cfg.Logger, flags)
+			if err != nil {
+				return err
+			}
 
 			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
 			cmd.SilenceUsage = true
@@ -126,7 +130,7 @@ func NewBuildISO(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			}
 
 			buildISO := action.NewBuildISOAction(cfg, spec)
-			err = buildISO.ISORun()
+			err = runWithProgress(&cfg.Config, flags, buildISO.ISORun)
 			if err != nil {
 				cfg.Logger.Errorf(err.Error())
 				return err
@@ -154,6 +158,7 @@ func NewBuildISO(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	addCosignFlags(c)
 	addSquashFsCompressionFlags(c)
 	addLocalImageFlag(c)
+	addProgressFlags(c)
 	return c
 }
 
@@ -262,6 +262,69 @@ func ReadUpgradeSpec(r *v1.RunConfig, flags *pflag.FlagSet) (*v1.UpgradeSpec, er
 	return upgrade, err
 }
 
+func ReadRollbackSpec(r *v1.RunConfig, flags *pflag.FlagSet) (*v1.RollbackSpec, error) {
+	rollback, err := config.NewRollbackSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing rollback spec: %v", err)
+	}
+	vp := viper.Sub("rollback")
+	if vp == nil {
+		vp = viper.New()
+	}
+	// Bind rollback cmd flags
+	bindGivenFlags(vp, flags)
+	// Bind rollback env vars
+	viperReadEnv(vp, "ROLLBACK", constants.GetRollbackKeyEnvMap())
+
+	err = vp.Unmarshal(rollback, setDecoder, decodeHook)
+	if err != nil {
+		r.Logger.Warnf("error unmarshalling RollbackSpec: %s", err)
+	}
+	err = rollback.Sanitize()
+	r.Logger.Debugf("Loaded rollback spec: %s", litter.Sdump(rollback))
+	return rollback, err
+}
+
+func ReadBootAssessSpec(r *v1.RunConfig) (*v1.BootAssessSpec, error) {
+	bootAssess, err := config.NewBootAssessSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing boot assessment spec: %v", err)
+	}
+	err = bootAssess.Sanitize()
+	r.Logger.Debugf("Loaded boot assessment spec: %s", litter.Sdump(bootAssess))
+	return bootAssess, err
+}
+
+func ReadSnapshotsSpec(r *v1.RunConfig) (*v1.SnapshotsSpec, error) {
+	snapshots, err := config.NewSnapshotsSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing snapshots spec: %v", err)
+	}
+	err = snapshots.Sanitize()
+	r.Logger.Debugf("Loaded snapshots spec: %s", litter.Sdump(snapshots))
+	return snapshots, err
+}
+
+func ReadRecoveryBackupSpec(r *v1.RunConfig) (*v1.RecoveryBackupSpec, error) {
+	backup, err := config.NewRecoveryBackupSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing recovery backup spec: %v", err)
+	}
+	err = backup.Sanitize()
+	r.Logger.Debugf("Loaded recovery backup spec: %s", litter.Sdump(backup))
+	return backup, err
+}
+
+func ReadStatusSpec(r *v1.RunConfig) (*v1.StatusSpec, error) {
+	status, err := config.NewStatusSpec(r.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed initializing status spec: %v", err)
+	}
+	err = status.Sanitize()
+	r.Logger.Debugf("Loaded status spec: %s", litter.Sdump(status))
+	return status, err
+}
+
 func ReadBuildISO(b *v1.BuildConfig, flags *pflag.FlagSet) (*v1.LiveISO, error) {
 	iso := config.NewISO()
 	vp := viper.Sub("iso")
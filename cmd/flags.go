@@ -56,9 +56,17 @@ func addResetFlags(cmd *cobra.Command) {
 	cmd.Flags().String("system.uri", "", "Sets the system image source and its type (e.g. 'docker:registry.org/image:tag')")
 	cmd.Flags().Bool("verify", false, "Enable mtree checksum verification (requires images manifests generated with mtree separately)")
 	cmd.Flags().Bool("strict", false, "Enable strict check of hooks (They need to exit with 0)")
+	cmd.Flags().Bool("dry-run", false, "Print the changes to apply, in order, without applying them")
 
 	addCosignFlags(cmd)
 	addPowerFlags(cmd)
+	addProgressFlags(cmd)
+}
+
+// addProgressFlags adds flags related to the machine readable progress events
+func addProgressFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("progress-fd", -1, "Write progress events as JSON lines to the given open file descriptor")
+	cmd.Flags().String("progress-socket", "", "Write progress events as JSON lines to the given unix socket")
 }
 
 // addLocalImageFlag add local image flag shared between install, pull-image, upgrade
@@ -127,6 +135,18 @@ func validatePowerFlags(log v1.Logger, flags *pflag.FlagSet) error {
 	return nil
 }
 
+func validateProgressFlags(log v1.Logger, flags *pflag.FlagSet) error {
+	fd, _ := flags.GetInt("progress-fd")
+	socket, _ := flags.GetString("progress-socket")
+	if flags.Changed("progress-fd") && socket != "" {
+		return errors.New("'progress-fd' and 'progress-socket' are mutually exclusive options")
+	}
+	if flags.Changed("progress-fd") && fd < 0 {
+		return fmt.Errorf("invalid 'progress-fd' file descriptor %d", fd)
+	}
+	return nil
+}
+
 // validateUpgradeFlags is a helper call to check all the flags for the upgrade command
 func validateInstallUpgradeFlags(log v1.Logger, flags *pflag.FlagSet) error {
 	if err := validateSourceFlags(log, flags); err != nil {
@@ -138,6 +158,9 @@ func validateInstallUpgradeFlags(log v1.Logger, flags *pflag.FlagSet) error {
 	if err := validatePowerFlags(log, flags); err != nil {
 		return err
 	}
+	if err := validateProgressFlags(log, flags); err != nil {
+		return err
+	}
 	return nil
 }
 
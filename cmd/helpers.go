@@ -18,7 +18,16 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+
+	"github.com/spf13/pflag"
+
+	"github.com/rancher/elemental-cli/pkg/dryrun"
+	"github.com/rancher/elemental-cli/pkg/http"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 )
 
 // CheckRoot is a helper to return on PreRunE, so we can add it to commands that require root
@@ -28,3 +37,69 @@ func CheckRoot() error {
 	}
 	return nil
 }
+
+// runAction runs the given action, or if the dry-run flag is set it prints the plan of the
+// changes the action would apply to the given writer
+func runAction(cfg *v1.Config, flags *pflag.FlagSet, out io.Writer, run func() error) (err error) {
+	if dryRun, _ := flags.GetBool("dry-run"); !dryRun {
+		return runWithProgress(cfg, flags, run)
+	}
+
+	plan, cleanup, err := dryrun.Setup(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := cleanup(); err == nil {
+			err = cErr
+		}
+	}()
+
+	cfg.Logger.Infof("Dry run, no changes will be applied")
+	err = runWithProgress(cfg, flags, run)
+	if err != nil {
+		return err
+	}
+	return plan.Print(out)
+}
+
+// runWithProgress runs the given action reporting its progress events to the file descriptor
+// or the unix socket set on the progress flags, if any
+func runWithProgress(cfg *v1.Config, flags *pflag.FlagSet, run func() error) (err error) {
+	w, closeProgress, err := progressWriter(flags)
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		return run()
+	}
+	defer func() {
+		if cErr := closeProgress(); err == nil {
+			err = cErr
+		}
+	}()
+
+	cfg.Progress = v1.NewProgress(w)
+	if client, ok := cfg.Client.(*http.Client); ok {
+		client.SetProgress(cfg.Progress)
+	}
+	return run()
+}
+
+// progressWriter opens the progress events output set on the progress flags, if any. Flags are
+// already validated. File descriptors are owned by the caller, so only sockets are closed.
+func progressWriter(flags *pflag.FlagSet) (io.Writer, func() error, error) {
+	fd, _ := flags.GetInt("progress-fd")
+	socket, _ := flags.GetString("progress-socket")
+	switch {
+	case flags.Changed("progress-fd"):
+		return os.NewFile(uintptr(fd), "progress"), func() error { return nil }, nil
+	case socket != "":
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed connecting to progress socket %s: %w", socket, err)
+		}
+		return conn, conn.Close, nil
+	}
+	return nil, nil, nil
+}
@@ -74,30 +74,36 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 			}
 
 			if len(args) == 1 {
+				if spec.Mirror != "" {
+					return errors.New("target devices of mirrored installations are set with 'targets'")
+				}
+				if spec.TargetSelector != nil {
+					return errors.New("target device and target-selector are mutually exclusive")
+				}
 				spec.Target = args[0]
 			}
 
-			if spec.Target == "" {
+			if spec.Target == "" && spec.TargetSelector == nil {
 				return errors.New("at least a target device must be supplied")
 			}
 
 			cfg.Logger.Infof("Install called")
 			install := action.NewInstallAction(cfg, spec)
-			err = install.Run()
-			if err != nil {
-				return err
-			}
-			return nil
+			return runAction(&cfg.Config, cmd.Flags(), cmd.OutOrStdout(), install.Run)
 		},
 	}
 	firmType := newEnumFlag([]string{v1.EFI, v1.BIOS}, v1.EFI)
 	pTableType := newEnumFlag([]string{v1.GPT, v1.MSDOS}, v1.GPT)
+	mirrorType := newEnumFlag([]string{v1.RAID1}, "")
+	wipeType := newEnumFlag([]string{v1.WipeSignatures, v1.WipeDiscard, v1.WipeZeroHeaders, v1.WipeFull}, "")
 
 	root.AddCommand(c)
 	c.Flags().StringSliceP("cloud-init", "c", []string{}, "Cloud-init config files")
 	c.Flags().StringP("iso", "i", "", "Performs an installation from the ISO url")
 	c.Flags().StringP("partition-layout", "p", "", "Partitioning layout file")
 	_ = c.Flags().MarkDeprecated("partition-layout", "'partition-layout' is deprecated and ignored please use a config file instead")
+	c.Flags().Bool("keep-persistent", false, "Formats the existing layout of the target in place, except the persistent partition which is kept untouched")
+	c.Flags().Var(wipeType, "wipe", "Wipes the target devices before partitioning: 'signatures', 'discard', 'zero-headers' or 'full'")
 	c.Flags().Bool("no-format", false, "Don’t format disks. It is implied that COS_STATE, COS_RECOVERY, COS_PERSISTENT, COS_OEM are already existing")
 
 	c.Flags().Bool("force-efi", false, "Forces an EFI installation")
@@ -108,6 +114,11 @@ func NewInstallCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 	_ = c.Flags().MarkDeprecated("force-gpt", "'force-gpt' is deprecated please use 'part-table' instead")
 	c.Flags().Var(pTableType, "part-table", "Partition table type to use")
 
+	c.Flags().String("target", "", "Target device or disk image file to install to, same as the DEVICE argument")
+	c.Flags().String("image-size", "", "Creates the target as a sparse disk image file of the given size (e.g. 20G)")
+	c.Flags().StringSlice("targets", []string{}, "Target devices of a mirrored installation")
+	c.Flags().Var(mirrorType, "mirror", "Mirroring mode across the target devices: 'raid1'")
+
 	c.Flags().String("tty", "", "Add named tty to grub")
 	c.Flags().Bool("force", false, "Force install")
 	c.Flags().Bool("eject-cd", false, "Try to eject the cd on reboot, only valid if booting from iso")
@@ -59,4 +59,10 @@ var _ = Describe("Install", Label("install", "cmd"), func() {
 		Expect(buf.String()).To(ContainSubstring("Usage:"))
 		Expect(err.Error()).To(ContainSubstring("'reboot' and 'poweroff' are mutually exclusive options"))
 	})
+	It("Errors out setting progress-fd and progress-socket at the same time", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "install", "--progress-fd", "3", "--progress-socket", "/run/progress.sock", "/dev/whatever")
+		Expect(err).ToNot(BeNil())
+		Expect(buf.String()).To(ContainSubstring("Usage:"))
+		Expect(err.Error()).To(ContainSubstring("'progress-fd' and 'progress-socket' are mutually exclusive options"))
+	})
 })
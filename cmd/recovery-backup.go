@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+
+	"github.com/rancher/elemental-cli/cmd/config"
+	"github.com/rancher/elemental-cli/pkg/action"
+)
+
+// NewRecoveryBackupCmd returns a new instance of the recovery-backup subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewRecoveryBackupCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "recovery-backup",
+		Short: "Manage the previous recovery image retained on recovery upgrades",
+		Args:  cobra.ExactArgs(0),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+	}
+
+	// newAction sets up the recovery backup action from the current config and host state
+	newAction := func(cmd *cobra.Command) (*action.RecoveryBackupAction, error) {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return nil, err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		cmd.SilenceUsage = true
+		spec, err := config.ReadRecoveryBackupSpec(cfg)
+		if err != nil {
+			cfg.Logger.Errorf("invalid recovery-backup command setup %v", err)
+			return nil, err
+		}
+		return action.NewRecoveryBackupAction(cfg, spec), nil
+	}
+
+	restore := &cobra.Command{
+		Use:   "restore",
+		Short: "Replace the current recovery image with the recovery backup",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backup, err := newAction(cmd)
+			if err != nil {
+				return err
+			}
+			return backup.Restore()
+		},
+	}
+	remove := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove the recovery backup once the current recovery image is confirmed to work",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backup, err := newAction(cmd)
+			if err != nil {
+				return err
+			}
+			return backup.Remove()
+		},
+	}
+	root.AddCommand(c)
+	c.AddCommand(restore, remove)
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewRecoveryBackupCmd(rootCmd, true)
@@ -66,7 +66,7 @@ func NewResetCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 
 			cfg.Logger.Infof("Reset called")
 			reset := action.NewResetAction(cfg, spec)
-			return reset.Run()
+			return runAction(&cfg.Config, cmd.Flags(), cmd.OutOrStdout(), reset.Run)
 		},
 	}
 	root.AddCommand(c)
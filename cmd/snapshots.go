@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/mount-utils"
+
+	"github.com/rancher/elemental-cli/cmd/config"
+	"github.com/rancher/elemental-cli/pkg/action"
+)
+
+// NewSnapshotsCmd returns a new instance of the snapshots subcommand and appends it to
+// the root command. requireRoot is to initiate it with or without the CheckRoot
+// pre-run check. This method is mostly used for testing purposes.
+func NewSnapshotsCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "snapshots",
+		Short: "Manage the system snapshots retained on upgrades",
+		Args:  cobra.ExactArgs(0),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if addCheckRoot {
+				return CheckRoot()
+			}
+			return nil
+		},
+	}
+
+	// newAction sets up the snapshots action from the current config and host state
+	newAction := func(cmd *cobra.Command) (*action.SnapshotsAction, error) {
+		path, err := exec.LookPath("mount")
+		if err != nil {
+			return nil, err
+		}
+		mounter := mount.New(path)
+
+		cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+		if err != nil {
+			cfg.Logger.Errorf("Error reading config: %s\n", err)
+		}
+
+		cmd.SilenceUsage = true
+		spec, err := config.ReadSnapshotsSpec(cfg)
+		if err != nil {
+			cfg.Logger.Errorf("invalid snapshots command setup %v", err)
+			return nil, err
+		}
+		return action.NewSnapshotsAction(cfg, spec), nil
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the system images stored in the state partition",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshots, err := newAction(cmd)
+			if err != nil {
+				return err
+			}
+			images, err := snapshots.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tLABEL\tSOURCE\tDEFAULT")
+			for _, img := range images {
+				var src, def string
+				if img.Source != nil {
+					src = img.Source.String()
+				}
+				if img.Default {
+					def = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Name, img.Label, src, def)
+			}
+			return w.Flush()
+		},
+	}
+	del := &cobra.Command{
+		Use:   "delete SNAPSHOT",
+		Short: "Delete the given snapshot, the active image and the booted image can't be deleted",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshots, err := newAction(cmd)
+			if err != nil {
+				return err
+			}
+			return snapshots.Delete(args[0])
+		},
+	}
+	setDefault := &cobra.Command{
+		Use:   "set-default SNAPSHOT",
+		Short: "Set the given snapshot as the default boot entry",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshots, err := newAction(cmd)
+			if err != nil {
+				return err
+			}
+			return snapshots.SetDefault(args[0])
+		},
+	}
+	root.AddCommand(c)
+	c.AddCommand(list, del, setDefault)
+	return c
+}
+
+// register the subcommand into rootCmd
+var _ = NewSnapshotsCmd(rootCmd, true)
@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"k8s.io/mount-utils"
+
+	"github.com/rancher/elemental-cli/cmd/config"
+	"github.com/rancher/elemental-cli/pkg/action"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// NewStatusCmd returns a new instance of the status subcommand and appends it to
+// the root command.
+func NewStatusCmd(root *cobra.Command) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "status",
+		Short: "Report the state of the deployed system",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			output, _ := cmd.Flags().GetString("output")
+			if output != "human" && output != "json" && output != "yaml" {
+				return fmt.Errorf("invalid output format '%s', supported formats are human, json and yaml", output)
+			}
+
+			path, err := exec.LookPath("mount")
+			if err != nil {
+				return err
+			}
+			mounter := mount.New(path)
+
+			cfg, err := config.ReadConfigRun(viper.GetString("config-dir"), cmd.Flags(), mounter)
+			if err != nil {
+				cfg.Logger.Errorf("Error reading config: %s\n", err)
+			}
+
+			cmd.SilenceUsage = true
+			spec, err := config.ReadStatusSpec(cfg)
+			if err != nil {
+				cfg.Logger.Errorf("invalid status command setup %v", err)
+				return err
+			}
+
+			status, err := action.NewStatusAction(cfg, spec).Status()
+			if err != nil {
+				return err
+			}
+
+			switch output {
+			case "json":
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(status)
+			case "yaml":
+				return yaml.NewEncoder(cmd.OutOrStdout()).Encode(status)
+			default:
+				return printStatus(cmd.OutOrStdout(), status)
+			}
+		},
+	}
+	root.AddCommand(c)
+	c.Flags().StringP("output", "o", "human", "Output format: human, json or yaml")
+	return c
+}
+
+// printStatus writes the given system status in a human readable format
+func printStatus(out io.Writer, status *v1.SystemStatus) error {
+	mib := func(size uint) string {
+		return units.BytesSize(float64(size) * 1024 * 1024)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Booted from:\t%s\n", orUnknown(status.BootedFrom))
+	fmt.Fprintf(w, "Default entry:\t%s\n", orUnknown(status.DefaultEntry))
+	fmt.Fprintf(w, "State date:\t%s\n", orUnknown(status.Date))
+	if status.Staged != nil {
+		fmt.Fprintf(w, "Staged upgrade:\t%s\n", orUnknown(status.Staged.Date))
+	} else {
+		fmt.Fprintln(w, "Staged upgrade:\tnone")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "IMAGE\tPARTITION\tLABEL\tSOURCE\tDIGEST\tVERSION")
+	for _, img := range status.Images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", img.Name, img.Partition, img.Label, img.Source, img.Digest, img.Version)
+	}
+	if status.Staged != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "STAGED IMAGE\tPARTITION\tLABEL\tSOURCE\tDIGEST\tVERSION")
+		for _, img := range status.Staged.Images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", img.Name, img.Partition, img.Label, img.Source, img.Digest, img.Version)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "PARTITION\tLABEL\tDEVICE\tFS\tMOUNTPOINT\tSIZE\tFREE")
+	for _, part := range status.Partitions {
+		var free string
+		if part.MountPoint != "" {
+			free = mib(part.Free)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", part.Name, part.Label, part.Device, part.FS, part.MountPoint, mib(part.Size), free)
+	}
+	return w.Flush()
+}
+
+// orUnknown returns the given value or 'unknown' if it is empty
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// register the subcommand into rootCmd
+var _ = NewStatusCmd(rootCmd)
@@ -0,0 +1,60 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+var _ = Describe("Status", Label("status", "cmd"), func() {
+	BeforeEach(func() {
+		rootCmd = NewRootCmd()
+		_ = NewStatusCmd(rootCmd)
+	})
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("Returns error if the output format is not supported", Label("flags"), func() {
+		_, _, err := executeCommandC(rootCmd, "status", "-o", "xml")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid output format"))
+	})
+	It("Prints the system status in a human readable format", func() {
+		out := &bytes.Buffer{}
+		err := printStatus(out, &v1.SystemStatus{
+			BootedFrom: "active",
+			Images: []*v1.ImageStatus{
+				{Name: "active", Partition: "state", Source: "oci://registry.org/os:v2", Digest: "sha256:aaaa"},
+			},
+			Partitions: []*v1.PartitionStatus{
+				{Name: "device2", Label: "COS_STATE", Device: "/dev/device2", MountPoint: "/run/initramfs/cos-state", Size: 1024, Free: 512},
+			},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(out.String()).To(MatchRegexp(`Booted from:\s+active`))
+		Expect(out.String()).To(MatchRegexp(`Default entry:\s+unknown`))
+		Expect(out.String()).To(MatchRegexp(`Staged upgrade:\s+none`))
+		Expect(out.String()).To(MatchRegexp(`active\s+state\s+oci://registry.org/os:v2\s+sha256:aaaa`))
+		Expect(out.String()).To(MatchRegexp(`device2\s+COS_STATE\s+/dev/device2\s+/run/initramfs/cos-state\s+1GiB\s+512MiB`))
+	})
+})
@@ -17,7 +17,9 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"os/exec"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -71,13 +73,41 @@ func NewUpgradeCmd(root *cobra.Command, addCheckRoot bool) *cobra.Command {
 				return err
 			}
 
-			cfg.Logger.Infof("Upgrade called")
 			upgrade := action.NewUpgradeAction(cfg, spec)
-			return upgrade.Run()
+			if spec.ListVersions {
+				versions, err := upgrade.ListVersions()
+				if err != nil {
+					return err
+				}
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "PACKAGE\tVERSION\tINSTALLED")
+				for _, v := range versions {
+					var installed string
+					if v.Installed {
+						installed = "*"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", v.Package, v.Version, installed)
+				}
+				return w.Flush()
+			}
+
+			cfg.Logger.Infof("Upgrade called")
+			return runAction(&cfg.Config, cmd.Flags(), cmd.OutOrStdout(), upgrade.Run)
 		},
 	}
 	root.AddCommand(c)
 	c.Flags().Bool("recovery", false, "Upgrade the recovery")
+	c.Flags().Bool("all", false, "Upgrade both the system and the recovery within a single transaction")
+	c.Flags().Bool("recover", false, "Only resume or revert an interrupted upgrade, no new upgrade is performed")
+	c.Flags().Int("boot-assessment-tries", 0, "Boot attempts of the upgraded system before falling back to passive (0 disables it)")
+	c.Flags().StringP("iso", "i", "", "Performs an upgrade from the ISO path or url")
+	c.Flags().Int("snapshots", 1, "Number of previous system images to retain, including the passive image")
+	c.Flags().Bool("delta", false, "Seed the new image from the current one, only pulling the container image layers added on top of it")
+	c.Flags().Bool("list-versions", false, "List the versions of the system and recovery channel packages available in the repositories")
+	c.Flags().String("version", "", "Version of the channel package to upgrade to, the latest one if not set")
+	c.Flags().Bool("stage", false, "Deploy the upgrade images without switching to them, they are switched with --apply-staged")
+	c.Flags().Bool("apply-staged", false, "Switch to the images of a previously staged upgrade")
+	c.Flags().Bool("discard-staged", false, "Remove the images of a previously staged upgrade")
 	addSharedInstallUpgradeFlags(c)
 	addLocalImageFlag(c)
 	return c
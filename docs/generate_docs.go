@@ -29,6 +29,7 @@ func main() {
 	rootCmd := cmd.NewRootCmd()
 	for _, command := range []*cobra.Command{
 		rootCmd,
+		cmd.NewBootAssessCmd(rootCmd, false),
 		cmd.NewBuildDisk(rootCmd, false),
 		cmd.NewBuildISO(rootCmd, false),
 		cmd.NewCloudInitCmd(rootCmd),
@@ -36,8 +37,12 @@ func main() {
 		cmd.NewInstallCmd(rootCmd, false),
 		cmd.NewDerivativeCmd(rootCmd),
 		cmd.NewPullImageCmd(rootCmd, false),
+		cmd.NewRecoveryBackupCmd(rootCmd, false),
 		cmd.NewResetCmd(rootCmd, false),
+		cmd.NewRollbackCmd(rootCmd, false),
 		cmd.NewRunStage(rootCmd),
+		cmd.NewSnapshotsCmd(rootCmd, false),
+		cmd.NewStatusCmd(rootCmd),
 		cmd.NewUpgradeCmd(rootCmd, false),
 		cmd.NewVersionCmd(rootCmd),
 	} {
@@ -2,9 +2,6 @@ module github.com/rancher/elemental-cli
 
 go 1.17
 
-// until https://github.com/zloylos/grsync/pull/20 is merged we need to use our fork
-replace github.com/zloylos/grsync v1.6.1 => github.com/rancher-sandbox/grsync v1.6.2-0.20220526080038-4032e9b0e97c
-
 // This fixes incompatibilities between nullbot and its requireds deps.
 // nullboot requires this for tpm2 support, but the required version is broken
 // This is directly coming from nullboot go.mod
@@ -20,6 +17,7 @@ require (
 	github.com/distribution/distribution v2.8.1+incompatible
 	github.com/docker/docker v20.10.17+incompatible
 	github.com/docker/go-units v0.4.0
+	github.com/google/go-containerregistry v0.7.0
 	github.com/hashicorp/go-getter v1.6.1
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/jaypipes/ghw v0.9.1-0.20220511134554-dac2f19e1c76
@@ -36,7 +34,6 @@ require (
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.10.0
 	github.com/twpayne/go-vfs v1.7.2
-	github.com/zloylos/grsync v1.6.1
 	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/mount-utils v0.23.0
 )
@@ -101,7 +98,6 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/btree v1.0.1 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
-	github.com/google/go-containerregistry v0.7.0 // indirect
 	github.com/google/pprof v0.0.0-20210720184732-4bb14d4b1be1 // indirect
 	github.com/google/renameio v1.0.0 // indirect
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510 // indirect
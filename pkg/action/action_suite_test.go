@@ -16,13 +16,67 @@ limitations under the License.
 package action_test
 
 import (
+	"path/filepath"
 	"testing"
 
+	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
 )
 
 func TestActionSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Actions test suite")
 }
+
+// mockElementalDisk mocks a disk with the state and recovery partitions mounted as in a running system,
+// followed by the given partitions, and creates the images directory of both partitions
+func mockElementalDisk(fs vfs.FS, parts ...*block.Partition) v1mock.GhwMock {
+	disk := block.Disk{
+		Name: "device",
+		Partitions: append([]*block.Partition{
+			{
+				Name:            "device2",
+				FilesystemLabel: "COS_STATE",
+				Type:            "ext4",
+				MountPoint:      constants.RunningStateDir,
+			},
+			{
+				Name:            "device3",
+				FilesystemLabel: "COS_RECOVERY",
+				Type:            "ext4",
+				MountPoint:      constants.LiveDir,
+			},
+		}, parts...),
+	}
+	ghwTest := v1mock.GhwMock{}
+	ghwTest.AddDisk(disk)
+	ghwTest.CreateDevices()
+
+	Expect(utils.MkdirAll(fs, filepath.Join(constants.RunningStateDir, "cOS"), constants.DirPerm)).To(Succeed())
+	Expect(utils.MkdirAll(fs, filepath.Join(constants.LiveDir, "cOS"), constants.DirPerm)).To(Succeed())
+	return ghwTest
+}
+
+// writeInstallState stores the given installation state in the state and recovery partitions of a running system
+func writeInstallState(config *v1.RunConfig, state *v1.InstallState) {
+	Expect(config.WriteInstallState(
+		state, filepath.Join(constants.RunningStateDir, constants.InstallStateFile),
+		filepath.Join(constants.LiveDir, constants.InstallStateFile),
+	)).To(Succeed())
+}
+
+// moveFile fakes moving the given source file to the given target as 'mv -f' does
+func moveFile(fs vfs.FS, source, target string) ([]byte, error) {
+	data, err := fs.ReadFile(source)
+	if err != nil {
+		return []byte{}, err
+	}
+	_ = fs.WriteFile(target, data, constants.FilePerm)
+	return []byte{}, fs.RemoveAll(source)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/elemental"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+// BootAssessAction represents the struct that will handle the boot assessment of the active image
+type BootAssessAction struct {
+	config *v1.RunConfig
+	spec   *v1.BootAssessSpec
+}
+
+func NewBootAssessAction(config *v1.RunConfig, spec *v1.BootAssessSpec) *BootAssessAction {
+	return &BootAssessAction{config: config, spec: spec}
+}
+
+// updateInstallStateYaml sets the given boot assessment status in the state.yaml file
+func (b *BootAssessAction) updateInstallStateYaml(status string) error {
+	if b.spec.State == nil {
+		b.spec.State = &v1.InstallState{
+			Partitions: map[string]*v1.PartitionState{},
+		}
+	}
+	if b.spec.State.BootAssessment == nil {
+		b.spec.State.BootAssessment = &v1.BootAssessmentState{}
+	}
+	b.spec.State.BootAssessment.Status = status
+	b.spec.State.BootAssessment.Date = time.Now().Format(time.RFC3339)
+
+	return b.config.WriteInstallState(
+		b.spec.State,
+		filepath.Join(b.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(b.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+}
+
+// mountPartitions mounts RW the state and recovery partitions, unmount jobs are pushed to the given cleanup stack
+func (b *BootAssessAction) mountPartitions(e *elemental.Elemental, cleanup *utils.CleanStack) error {
+	umount, err := e.MountRWPartition(b.spec.Partitions.State)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	umount, err = e.MountRWPartition(b.spec.Partitions.Recovery)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	return nil
+}
+
+// readBootAssessment returns the boot assessment variables of the grub environment file,
+// nil if no boot assessment is in progress
+func (b *BootAssessAction) readBootAssessment(grub *utils.Grub) (map[string]string, error) {
+	grubEnvFile := filepath.Join(b.spec.Partitions.State.MountPoint, constants.GrubOEMEnv)
+	if exists, _ := utils.Exists(b.config.Fs, grubEnvFile); !exists {
+		return nil, nil
+	}
+
+	vars, err := grub.ReadPersistentVariables(grubEnvFile)
+	if err != nil {
+		return nil, err
+	}
+	if vars[constants.BootAssessTriesVar] == "" {
+		return nil, nil
+	}
+	return vars, nil
+}
+
+// recordFailure sets the boot assessment as failed in the state.yaml file, the boot assessment
+// check is no longer needed once the failure is recorded
+func (b *BootAssessAction) recordFailure() error {
+	b.config.Logger.Warnf("Boot attempts of the active image exhausted, the system booted from the fallback entry")
+	if b.spec.State == nil || b.spec.State.BootAssessment == nil || b.spec.State.BootAssessment.Status != constants.BootAssessFailed {
+		err := b.updateInstallStateYaml(constants.BootAssessFailed)
+		if err != nil {
+			b.config.Logger.Errorf("failed updating installation metadata")
+			return err
+		}
+	}
+	err := setBootAssessCheck(&b.config.Config, b.spec.Partitions.OEM, false)
+	if err != nil {
+		b.config.Logger.Warnf("failed removing boot assessment check: %v", err)
+	}
+	return nil
+}
+
+// MarkGood clears the boot attempts counter set on upgrade, so the active image is considered
+// healthy. If the counter was already exhausted the failure is recorded and the counter is kept,
+// hence the fallback entry remains selected.
+func (b *BootAssessAction) MarkGood() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&b.config.Config)
+	err = b.mountPartitions(e, cleanup)
+	if err != nil {
+		return err
+	}
+
+	grub := utils.NewGrub(&b.config.Config)
+	vars, err := b.readBootAssessment(grub)
+	if err != nil {
+		return err
+	}
+	if vars == nil {
+		b.config.Logger.Infof("No boot assessment in progress")
+		return nil
+	}
+
+	if vars[constants.BootAssessFailedVar] == "yes" {
+		return b.recordFailure()
+	}
+
+	b.config.Logger.Infof("Marking active image boot as good")
+	err = grub.SetBootAssessment(b.spec.Partitions.State.MountPoint, b.spec.Partitions.State.FilesystemLabel, 0)
+	if err != nil {
+		b.config.Logger.Errorf("failed clearing boot assessment")
+		return err
+	}
+
+	err = b.updateInstallStateYaml(constants.BootAssessGood)
+	if err != nil {
+		b.config.Logger.Errorf("failed updating installation metadata")
+		return err
+	}
+
+	err = setBootAssessCheck(&b.config.Config, b.spec.Partitions.OEM, false)
+	if err != nil {
+		b.config.Logger.Warnf("failed removing boot assessment check: %v", err)
+	}
+	return nil
+}
+
+// Check records the failure of the boot assessment if the boot attempts of the active image were
+// exhausted. It runs on each boot while a boot assessment is in progress, so booting from the
+// fallback entry is recorded without any user intervention.
+func (b *BootAssessAction) Check() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&b.config.Config)
+	err = b.mountPartitions(e, cleanup)
+	if err != nil {
+		return err
+	}
+
+	vars, err := b.readBootAssessment(utils.NewGrub(&b.config.Config))
+	if err != nil {
+		return err
+	}
+	if vars == nil || vars[constants.BootAssessFailedVar] != "yes" {
+		b.config.Logger.Debugf("No failed boot assessment found")
+		return nil
+	}
+	return b.recordFailure()
+}
+
+// setBootAssessCheck writes into the OEM partition the cloud-config running the boot assessment check
+// on boot, or removes it if disabled. It does nothing if there is no OEM partition.
+func setBootAssessCheck(cfg *v1.Config, oem *v1.Partition, enable bool) (err error) {
+	if oem == nil {
+		cfg.Logger.Debugf("No OEM partition found, skipping boot assessment check setup")
+		return nil
+	}
+	oem = &v1.Partition{Path: oem.Path, FilesystemLabel: oem.FilesystemLabel, MountPoint: oem.MountPoint}
+	if oem.MountPoint == "" {
+		oem.MountPoint = constants.OEMDir
+	}
+
+	// OEM partition is already mounted RW on a running system
+	if mnt, _ := utils.IsMounted(cfg, oem); !mnt {
+		e := elemental.NewElemental(cfg)
+		err = e.MountPartition(oem, "rw")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			uErr := e.UnmountPartition(oem)
+			if err == nil {
+				err = uErr
+			}
+		}()
+	}
+
+	checkFile := filepath.Join(oem.MountPoint, constants.BootAssessCheckFile)
+	if !enable {
+		if exists, _ := utils.Exists(cfg.Fs, checkFile); exists {
+			return cfg.Fs.Remove(checkFile)
+		}
+		return nil
+	}
+	cfg.Logger.Debugf("Writing boot assessment check to %s", checkFile)
+	return cfg.Fs.WriteFile(checkFile, []byte(bootAssessCheckConfig), constants.FilePerm)
+}
+
+// bootAssessCheckConfig is the cloud-config running the boot assessment check on boot
+const bootAssessCheckConfig = `# Autogenerated file by elemental client, do not edit
+name: "Elemental boot assessment"
+stages:
+  boot:
+    - name: "Record failed boot assessment"
+      commands:
+        - elemental boot-assess check
+`
@@ -0,0 +1,169 @@
+/*
+   Copyright © 2022 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/action"
+	conf "github.com/rancher/elemental-cli/pkg/config"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Boot assessment action tests", func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var logger v1.Logger
+	var mounter *v1mock.ErrorMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest v1mock.GhwMock
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		mounter = v1mock.NewErrorMounter()
+		memLog = &bytes.Buffer{}
+		logger = v1.NewBufferLogger(memLog)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+	})
+
+	AfterEach(func() { cleanup() })
+
+	Describe("Boot assessment", Label("bootassess"), func() {
+		var spec *v1.BootAssessSpec
+		var bootAssess *action.BootAssessAction
+		var grubEnv, grubEnvVars, checkFile string
+		var err error
+
+		BeforeEach(func() {
+			ghwTest = mockElementalDisk(fs, &block.Partition{
+				Name:            "device1",
+				FilesystemLabel: "COS_OEM",
+				Type:            "ext4",
+				MountPoint:      constants.OEMPath,
+			})
+
+			grubEnv = filepath.Join(constants.RunningStateDir, constants.GrubOEMEnv)
+			checkFile = filepath.Join(constants.OEMPath, constants.BootAssessCheckFile)
+			Expect(utils.MkdirAll(fs, constants.OEMPath, constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(checkFile, []byte{}, constants.FilePerm)).To(Succeed())
+
+			spec, err = conf.NewBootAssessSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			grubEnvVars = ""
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "grub2-editenv" && args[1] == "list" {
+					return []byte(grubEnvVars), nil
+				}
+				return []byte{}, nil
+			}
+			bootAssess = action.NewBootAssessAction(config, spec)
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Does nothing if there is no grub environment file", func() {
+			Expect(bootAssess.MarkGood()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv"}})).NotTo(Succeed())
+		})
+		It("Does nothing if there is no boot assessment in progress", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			grubEnvVars = "default_menu_entry=cOS\n"
+			Expect(bootAssess.MarkGood()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "unset"}})).NotTo(Succeed())
+			_, err := fs.Stat(filepath.Join(constants.RunningStateDir, constants.InstallStateFile))
+			Expect(err).To(HaveOccurred())
+		})
+		It("Clears the boot attempts counter", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			grubEnvVars = "boot_assessment_tries=2\nboot_assessment_failed=no\n"
+			Expect(bootAssess.MarkGood()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", grubEnv, "unset", constants.BootAssessTriesVar},
+				{"grub2-editenv", grubEnv, "unset", constants.BootAssessFailedVar},
+			})).To(Succeed())
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(state.BootAssessment.Status).To(Equal(constants.BootAssessGood))
+			_, err = fs.Stat(checkFile)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Records the failure and keeps the counter if boot attempts are exhausted", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			grubEnvVars = "boot_assessment_tries=0\nboot_assessment_failed=yes\n"
+			Expect(bootAssess.MarkGood()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "unset"}})).NotTo(Succeed())
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(state.BootAssessment.Status).To(Equal(constants.BootAssessFailed))
+			recoveryState, err := fs.ReadFile(filepath.Join(constants.LiveDir, constants.InstallStateFile))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(recoveryState)).To(ContainSubstring("status: failed"))
+		})
+		It("Records the failure on boot check if boot attempts are exhausted", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			grubEnvVars = "boot_assessment_tries=0\nboot_assessment_failed=yes\n"
+			Expect(bootAssess.Check()).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "unset"}})).NotTo(Succeed())
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(state.BootAssessment.Status).To(Equal(constants.BootAssessFailed))
+			_, err = fs.Stat(checkFile)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Does nothing on boot check if boot attempts are not exhausted", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			grubEnvVars = "boot_assessment_tries=1\nboot_assessment_failed=no\n"
+			Expect(bootAssess.Check()).To(Succeed())
+			_, err := fs.Stat(filepath.Join(constants.RunningStateDir, constants.InstallStateFile))
+			Expect(err).To(HaveOccurred())
+			_, err = fs.Stat(checkFile)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("Fails reading the grub environment file", func() {
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "grub2-editenv" {
+					return []byte{}, errors.New("grub error")
+				}
+				return []byte{}, nil
+			}
+			Expect(bootAssess.MarkGood()).NotTo(Succeed())
+		})
+	})
+})
@@ -38,6 +38,9 @@ const (
 )
 
 func BuildDiskRun(cfg *v1.BuildConfig, spec *v1.RawDiskArchEntry, imgType string, oemLabel string, recoveryLabel string, output string) (err error) {
+	cfg.Progress.Start("build-disk")
+	defer func() { cfg.Progress.Done(err) }()
+
 	cfg.Logger.Infof("Building disk image type %s for arch %s", imgType, cfg.Arch)
 
 	if len(spec.Packages) == 0 {
@@ -82,6 +85,7 @@ func BuildDiskRun(cfg *v1.BuildConfig, spec *v1.RawDiskArchEntry, imgType string
 	oemPart := filepath.Join(diskTempDir, "oem.part")
 	efiPart := filepath.Join(diskTempDir, "efi.part")
 	// Extract required packages to basedir
+	cfg.Progress.Phase(v1.PhaseDeploy)
 	for _, pkg := range spec.Packages {
 		err = os.MkdirAll(filepath.Join(baseDir, pkg.Target), constants.DirPerm)
 		if err != nil {
@@ -104,6 +108,7 @@ func BuildDiskRun(cfg *v1.BuildConfig, spec *v1.RawDiskArchEntry, imgType string
 	}
 
 	// Create rootfs.part
+	cfg.Progress.Phase(v1.PhasePartition)
 	err = CreatePart(
 		cfg,
 		rootfsPart,
@@ -157,6 +162,7 @@ func BuildDiskRun(cfg *v1.BuildConfig, spec *v1.RawDiskArchEntry, imgType string
 	}
 
 	// Create final image
+	cfg.Progress.Phase(v1.PhaseImage)
 	err = CreateFinalImage(cfg, output, efiPart, oemPart, rootfsPart)
 	if err != nil {
 		cfg.Logger.Error(err)
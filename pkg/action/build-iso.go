@@ -63,6 +63,9 @@ func NewBuildISOAction(cfg *v1.BuildConfig, spec *v1.LiveISO, opts ...BuildISOAc
 
 // BuildISORun will install the system from a given configuration
 func (b *BuildISOAction) ISORun() (err error) {
+	b.cfg.Progress.Start("build-iso")
+	defer func() { b.cfg.Progress.Done(err) }()
+
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
@@ -98,6 +101,7 @@ func (b *BuildISOAction) ISORun() (err error) {
 		}
 	}
 
+	b.cfg.Progress.Phase(v1.PhaseDeploy)
 	b.cfg.Logger.Infof("Preparing squashfs root...")
 	err = b.applySources(rootDir, b.spec.RootFS...)
 	if err != nil {
@@ -111,6 +115,7 @@ func (b *BuildISOAction) ISORun() (err error) {
 	}
 
 	if b.spec.Firmware == v1.EFI {
+		b.cfg.Progress.Phase(v1.PhaseBootloader)
 		b.cfg.Logger.Infof("Preparing EFI image...")
 		if b.spec.BootloaderInRootFs {
 			err = b.liveBoot.PrepareEFI(rootDir, uefiDir)
@@ -126,6 +131,7 @@ func (b *BuildISOAction) ISORun() (err error) {
 		}
 	}
 
+	b.cfg.Progress.Phase(v1.PhaseImage)
 	b.cfg.Logger.Infof("Preparing ISO image root tree...")
 	if b.spec.BootloaderInRootFs {
 		err = b.liveBoot.PrepareISO(rootDir, isoDir)
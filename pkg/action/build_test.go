@@ -94,6 +94,8 @@ var _ = Describe("Runtime Actions", func() {
 				case "xorriso":
 					err := fs.WriteFile(filepath.Join(tmpDir, "elemental.iso"), []byte("profound thoughts"), constants.FilePerm)
 					return []byte{}, err
+				case "rsync":
+					return (&v1.RealRunner{Logger: logger}).Run(cmd, args...)
 				default:
 					return []byte{}, nil
 				}
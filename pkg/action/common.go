@@ -30,6 +30,7 @@ func Hook(config *v1.Config, hook string, strict bool, cloudInitPaths ...string)
 	config.Logger.SetLevel(logrus.ErrorLevel)
 	err := utils.RunStage(config, hook, strict, cloudInitPaths...)
 	config.Logger.SetLevel(oldLevel)
+	config.Progress.Hook(hook, err)
 	if !strict {
 		err = nil
 	}
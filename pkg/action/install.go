@@ -21,8 +21,11 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/docker/go-units"
+
 	cnst "github.com/rancher/elemental-cli/pkg/constants"
 	"github.com/rancher/elemental-cli/pkg/elemental"
+	"github.com/rancher/elemental-cli/pkg/partitioner"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 )
@@ -56,10 +59,12 @@ func (i *InstallAction) createInstallStateYaml(sysMeta, recMeta interface{}) err
 	}
 
 	installState := &v1.InstallState{
-		Date: time.Now().Format(time.RFC3339),
+		Date:   time.Now().Format(time.RFC3339),
+		Target: i.disk,
 		Partitions: map[string]*v1.PartitionState{
 			cnst.StatePartName: {
 				FSLabel: i.spec.Partitions.State.FilesystemLabel,
+				Members: i.spec.Partitions.State.Members,
 				Images: map[string]*v1.ImageState{
 					cnst.ActiveImgName: {
 						Source:         i.spec.Active.Source,
@@ -77,6 +82,7 @@ func (i *InstallAction) createInstallStateYaml(sysMeta, recMeta interface{}) err
 			},
 			cnst.RecoveryPartName: {
 				FSLabel: i.spec.Partitions.Recovery.FilesystemLabel,
+				Members: i.spec.Partitions.Recovery.Members,
 				Images: map[string]*v1.ImageState{
 					cnst.RecoveryImgName: {
 						Source:         recSource,
@@ -91,13 +97,34 @@ func (i *InstallAction) createInstallStateYaml(sysMeta, recMeta interface{}) err
 	if i.spec.Partitions.OEM != nil {
 		installState.Partitions[cnst.OEMPartName] = &v1.PartitionState{
 			FSLabel: i.spec.Partitions.OEM.FilesystemLabel,
+			Members: i.spec.Partitions.OEM.Members,
 		}
 	}
 	if i.spec.Partitions.Persistent != nil {
 		installState.Partitions[cnst.PersistentPartName] = &v1.PartitionState{
 			FSLabel: i.spec.Partitions.Persistent.FilesystemLabel,
+			Members: i.spec.Partitions.Persistent.Members,
 		}
 	}
+	// Encrypted partitions, logical volumes and subvolumes are recorded so they can be found on reset
+	for _, part := range i.spec.Partitions.PartitionsByInstallOrder(i.spec.ExtraPartitions) {
+		var vg string
+		if i.spec.VolumeGroup != nil && i.isLogicalVolume(part) {
+			vg = i.spec.VolumeGroup.Name
+		}
+		if part.Encryption == nil && vg == "" && len(part.Subvolumes) == 0 {
+			continue
+		}
+		pState := installState.Partitions[part.Name]
+		if pState == nil {
+			pState = &v1.PartitionState{FSLabel: part.FilesystemLabel}
+			installState.Partitions[part.Name] = pState
+		}
+		pState.FS = part.FS
+		pState.Encryption = part.Encryption
+		pState.VolumeGroup = vg
+		pState.Subvolumes = part.Subvolumes
+	}
 
 	return i.cfg.WriteInstallState(
 		installState,
@@ -106,9 +133,115 @@ func (i *InstallAction) createInstallStateYaml(sysMeta, recMeta interface{}) err
 	)
 }
 
+// encryptedPartitions returns the partitions to install which are encrypted
+func (i *InstallAction) encryptedPartitions() v1.PartitionList {
+	var parts v1.PartitionList
+	for _, part := range i.spec.Partitions.PartitionsByInstallOrder(i.spec.ExtraPartitions) {
+		if part.Encryption != nil {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// isLogicalVolume checks if the given partition is created as a logical volume of the volume group
+func (i *InstallAction) isLogicalVolume(part *v1.Partition) bool {
+	if part == i.spec.Partitions.Persistent {
+		return true
+	}
+	for _, extra := range i.spec.ExtraPartitions {
+		if part == extra {
+			return true
+		}
+	}
+	return false
+}
+
+// installMirrorBootloader makes each disk of a mirrored installation bootable on its own. The EFI
+// partition set up on the first disk is copied to the other disks, each one with its own boot entry,
+// or, on non-efi systems, grub is installed on the boot sector of the other disks.
+func (i *InstallAction) installMirrorBootloader(e *elemental.Elemental, grub *utils.Grub) error {
+	if i.spec.Firmware == v1.EFI {
+		if i.spec.Partitions.EFI == nil {
+			return nil
+		}
+		err := grub.SetEFIModules(i.spec.Partitions.EFI.MountPoint, "mdraid1x")
+		if err != nil {
+			return err
+		}
+		return e.SyncPartitionMembers(i.spec.Partitions.EFI, func(mountPoint string) error {
+			if i.spec.DisableBootEntry {
+				return nil
+			}
+			return grub.CreateMemberBootEntry(mountPoint)
+		})
+	}
+	for _, target := range i.spec.Targets {
+		if target == i.spec.Target {
+			continue
+		}
+		err := grub.InstallBIOS(target, i.spec.Active.MountPoint, i.spec.Partitions.State.MountPoint)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMirrorBoot writes the mdadm.conf of the created arrays into the active image and sets the kernel
+// command line to assemble them at boot.
+func (i *InstallAction) setMirrorBoot(grub *utils.Grub) error {
+	conf, err := partitioner.ScanRAIDArrays(i.cfg.Runner)
+	if err != nil {
+		return err
+	}
+	confFile := filepath.Join(i.spec.Active.MountPoint, cnst.MdadmConf)
+	err = utils.MkdirAll(i.cfg.Fs, filepath.Dir(confFile), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	err = i.cfg.Fs.WriteFile(confFile, []byte(conf), cnst.FilePerm)
+	if err != nil {
+		return err
+	}
+	return grub.SetPersistentVariables(
+		filepath.Join(i.spec.Partitions.State.MountPoint, cnst.GrubOEMEnv),
+		map[string]string{cnst.GrubExtraCmdlineVar: cnst.MirrorKernelCmdline},
+	)
+}
+
+// attachDiskImage creates the target disk image file and sets its loop device as the installation
+// target. The loop device is detached on cleanup, once the volume group on it is deactivated.
+func (i *InstallAction) attachDiskImage(e *elemental.Elemental, cleanup *utils.CleanStack) error {
+	if exists, _ := utils.Exists(i.cfg.Fs, i.spec.Target); exists && !i.spec.Force {
+		return fmt.Errorf("disk image %s already exists, use `force` flag to overwrite it", i.spec.Target)
+	}
+	size, err := units.RAMInBytes(i.spec.ImageSize)
+	if err != nil {
+		return err
+	}
+	loop, err := e.AttachDiskImage(i.spec.Target, size)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(func() error {
+		if i.spec.VolumeGroup != nil {
+			err := partitioner.DeactivateVolumeGroup(i.cfg.Runner, i.spec.VolumeGroup.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return e.DetachDiskImage(loop)
+	})
+	i.spec.Target = loop
+	return nil
+}
+
 type InstallAction struct {
 	cfg  *v1.RunConfig
 	spec *v1.InstallSpec
+	// disk chosen by the target selector
+	disk *v1.DiskState
 }
 
 func NewInstallAction(cfg *v1.RunConfig, spec *v1.InstallSpec) *InstallAction {
@@ -117,12 +250,42 @@ func NewInstallAction(cfg *v1.RunConfig, spec *v1.InstallSpec) *InstallAction {
 
 // InstallRun will install the system from a given configuration
 func (i InstallAction) Run() (err error) {
+	i.cfg.Progress.Start("install")
+	defer func() { i.cfg.Progress.Done(err) }()
+
 	e := elemental.NewElemental(&i.cfg.Config)
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
+	// Select the target disk
+	i.cfg.Progress.Phase(v1.PhaseRequirements)
+	if i.spec.TargetSelector != nil {
+		i.disk, err = utils.SelectDisk(i.spec.TargetSelector)
+		if err != nil {
+			return err
+		}
+		i.cfg.Logger.Infof("Selected target disk %s (model: '%s', serial: '%s', size: %s)",
+			i.disk.Device, i.disk.Model, i.disk.Serial, units.BytesSize(float64(i.disk.Size)))
+		i.spec.Target = i.disk.Device
+	}
+
+	// Validate the host and the targets before any destructive step
+	err = i.checkRequirements()
+	if err != nil {
+		return err
+	}
+
+	// Install into a new disk image file attached to a loop device
+	if i.spec.ImageSize != "" {
+		err = i.attachDiskImage(e, cleanup)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Set installation sources from a downloaded ISO
 	if i.spec.Iso != "" {
+		i.cfg.Progress.Phase(v1.PhaseDownload)
 		tmpDir, err := e.GetIso(i.spec.Iso)
 		if err != nil {
 			return err
@@ -135,25 +298,43 @@ func (i InstallAction) Run() (err error) {
 	}
 
 	// Check no-format flag
+	i.cfg.Progress.Phase(v1.PhasePartition)
 	if i.spec.NoFormat {
 		// Check force flag against current device
 		labels := []string{i.spec.Active.Label, i.spec.Recovery.Label}
 		if e.CheckActiveDeployment(labels) && !i.spec.Force {
 			return fmt.Errorf("use `force` flag to run an installation over the current running deployment")
 		}
-	} else {
-		// Deactivate any active volume on target
-		err = e.DeactivateDevices()
+	} else if len(i.spec.KeptPartitions()) > 0 {
+		// Format the existing layout preserving the kept partitions
+		labels := []string{i.spec.Active.Label, i.spec.Recovery.Label}
+		if e.CheckActiveDeployment(labels) && !i.spec.Force {
+			return fmt.Errorf("use `force` flag to run an installation over the current running deployment")
+		}
+		err = e.FormatExistingLayout(i.spec)
 		if err != nil {
 			return err
 		}
+	} else {
+		// Deactivate any active volume on target, disk images are new loop devices
+		if i.spec.ImageSize == "" {
+			err = e.DeactivateDevices()
+			if err != nil {
+				return err
+			}
+		}
 		// Partition device
 		err = e.PartitionAndFormatDevice(i.spec)
 		if err != nil {
 			return err
 		}
+		for _, part := range i.encryptedPartitions() {
+			part := part
+			cleanup.Push(func() error { return e.LockPartition(part) })
+		}
 	}
 
+	i.cfg.Progress.Phase(v1.PhaseMount)
 	err = e.MountPartitions(i.spec.Partitions.PartitionsByMountPoint(false))
 	if err != nil {
 		return err
@@ -162,7 +343,18 @@ func (i InstallAction) Run() (err error) {
 		return e.UnmountPartitions(i.spec.Partitions.PartitionsByMountPoint(true))
 	})
 
+	// Check there is enough space for the images before deploying them
+	err = e.CheckAvailableSpace(i.spec.Partitions.State.MountPoint, &i.spec.Active, &i.spec.Passive)
+	if err != nil {
+		return err
+	}
+	err = e.CheckAvailableSpace(i.spec.Partitions.Recovery.MountPoint, &i.spec.Recovery)
+	if err != nil {
+		return err
+	}
+
 	// Before install hook happens after partitioning but before the image OS is applied
+	i.cfg.Progress.Phase(v1.PhaseDeploy)
 	err = i.installHook(cnst.BeforeInstallHook, false)
 	if err != nil {
 		return err
@@ -180,7 +372,20 @@ func (i InstallAction) Run() (err error) {
 	if err != nil {
 		return err
 	}
+
+	// Set the encrypted partitions to be unlocked on boot
+	if encrypted := i.encryptedPartitions(); len(encrypted) > 0 {
+		var oemDir string
+		if i.spec.Partitions.OEM != nil {
+			oemDir = i.spec.Partitions.OEM.MountPoint
+		}
+		err = e.WriteCrypttab(i.spec.Active.MountPoint, oemDir, encrypted)
+		if err != nil {
+			return err
+		}
+	}
 	// Install grub
+	i.cfg.Progress.Phase(v1.PhaseBootloader)
 	grub := utils.NewGrub(&i.cfg.Config)
 	err = grub.Install(
 		i.spec.Target,
@@ -196,6 +401,26 @@ func (i InstallAction) Run() (err error) {
 	if err != nil {
 		return err
 	}
+	if i.spec.Mirror != "" {
+		err = i.installMirrorBootloader(e, grub)
+		if err != nil {
+			return err
+		}
+		err = i.setMirrorBoot(grub)
+		if err != nil {
+			return err
+		}
+	}
+	if i.spec.VolumeGroup != nil {
+		// Activate the volume group early at boot, so the logical volumes are found by label
+		err = grub.SetPersistentVariables(
+			filepath.Join(i.spec.Partitions.State.MountPoint, cnst.GrubOEMEnv),
+			map[string]string{cnst.GrubExtraCmdlineVar: cnst.LVMKernelCmdline + i.spec.VolumeGroup.Name},
+		)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Relabel SELinux
 	binds := map[string]string{}
@@ -233,16 +458,19 @@ func (i InstallAction) Run() (err error) {
 		return err
 	}
 	// Install Recovery
+	i.cfg.Progress.Phase(v1.PhaseRecovery)
 	recoveryMeta, err := e.DeployImage(&i.spec.Recovery, false)
 	if err != nil {
 		return err
 	}
 	// Install Passive
+	i.cfg.Progress.Phase(v1.PhasePassive)
 	_, err = e.DeployImage(&i.spec.Passive, false)
 	if err != nil {
 		return err
 	}
 
+	i.cfg.Progress.Phase(v1.PhaseFinalize)
 	err = i.installHook(cnst.AfterInstallHook, false)
 	if err != nil {
 		return err
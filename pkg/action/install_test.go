@@ -18,9 +18,11 @@ package action_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 
@@ -29,11 +31,13 @@ import (
 	"github.com/rancher/elemental-cli/pkg/action"
 	conf "github.com/rancher/elemental-cli/pkg/config"
 	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/dryrun"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 	v1mock "github.com/rancher/elemental-cli/tests/mocks"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
 )
 
 const printOutput = `BYT;
@@ -96,8 +100,8 @@ var _ = Describe("Install action tests", func() {
 			_, err = fs.Create(device)
 			Expect(err).ShouldNot(HaveOccurred())
 
-			partNum := 0
-			partedOut := printOutput
+			// Keep a simulated partition table per disk
+			partedOuts := map[string]string{}
 			cmdFail = ""
 			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
 				if cmdFail == cmd {
@@ -105,6 +109,10 @@ var _ = Describe("Install action tests", func() {
 				}
 				switch cmd {
 				case "parted":
+					dev := args[3]
+					if _, ok := partedOuts[dev]; !ok {
+						partedOuts[dev] = printOutput
+					}
 					idx := 0
 					for i, arg := range args {
 						if arg == "mkpart" {
@@ -113,11 +121,11 @@ var _ = Describe("Install action tests", func() {
 						}
 					}
 					if idx > 0 {
-						partNum++
-						partedOut += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
-						_, _ = fs.Create(fmt.Sprintf("/some/device%d", partNum))
+						partNum := strings.Count(partedOuts[dev], "\n")
+						partedOuts[dev] += fmt.Sprintf(partTmpl, partNum, args[idx+3], args[idx+4])
+						_, _ = fs.Create(fmt.Sprintf("%s%d", dev, partNum))
 					}
-					return []byte(partedOut), nil
+					return []byte(partedOuts[dev]), nil
 				case "lsblk":
 					return []byte(`{
 "blockdevices":
@@ -212,6 +220,185 @@ var _ = Describe("Install action tests", func() {
 			Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}}))
 		})
 
+		It("Successfully installs a mirrored system", Label("mirror"), func() {
+			_, err := fs.Create("/some/mirror")
+			Expect(err).ToNot(HaveOccurred())
+			spec.Mirror = v1.RAID1
+			spec.Targets = []string{device, "/some/mirror"}
+			spec.Target = device
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"mdadm", "--create", "/dev/md/state"},
+				{"grub2-install", fmt.Sprintf("--root-directory=%s", spec.Active.MountPoint)},
+				{"grub2-install", fmt.Sprintf("--root-directory=%s", spec.Active.MountPoint), fmt.Sprintf("--boot-directory=%s", spec.Partitions.State.MountPoint), "--target=i386-pc", "/some/mirror"},
+				{"mdadm", "--detail", "--scan"},
+				{"grub2-editenv", filepath.Join(spec.Partitions.State.MountPoint, constants.GrubOEMEnv), "set", "extra_cmdline=rd.auto=1 rd.md=1"},
+			})).To(BeNil())
+			exists, _ := utils.Exists(fs, filepath.Join(spec.Active.MountPoint, constants.MdadmConf))
+			Expect(exists).To(BeTrue())
+			Expect(spec.Partitions.State.Members).To(Equal([]string{"/some/device3", "/some/mirror3"}))
+		})
+
+		It("Successfully installs an encrypted persistent partition", Label("encryption"), func() {
+			spec.Target = device
+			spec.Partitions.Persistent.Encryption = &v1.PartitionEncryption{KeyFile: "/keyfile"}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "/keyfile"},
+				{"cryptsetup", "open", "--key-file", "/keyfile"},
+				{"mkfs.ext4", "-L", constants.PersistentLabel, "/dev/mapper/cos_persistent"},
+				{"cryptsetup", "close", "cos_persistent"},
+			})).To(BeNil())
+			crypttab, err := fs.ReadFile(filepath.Join(spec.Active.MountPoint, constants.CrypttabFile))
+			Expect(err).To(BeNil())
+			Expect(string(crypttab)).To(HavePrefix("cos_persistent UUID="))
+			exists, _ := utils.Exists(fs, filepath.Join(spec.Partitions.OEM.MountPoint, constants.UnlockConfigFile))
+			Expect(exists).To(BeTrue())
+
+			state := &v1.InstallState{}
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).To(BeNil())
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.PersistentPartName].FS).To(Equal("ext4"))
+			Expect(state.Partitions[constants.PersistentPartName].Encryption.KeyFile).To(Equal("/keyfile"))
+		})
+
+		It("Successfully installs the persistent partition as a logical volume", Label("lvm"), func() {
+			spec.Target = device
+			spec.VolumeGroup = &v1.VolumeGroup{Name: "elemental"}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"vgcreate", "--yes", "elemental"},
+				{"lvcreate", "--yes", "--wipesignatures", "y", "--name", "persistent"},
+				{"mkfs.ext4", "-L", constants.PersistentLabel, "/dev/elemental/persistent"},
+				{"grub2-editenv", filepath.Join(spec.Partitions.State.MountPoint, constants.GrubOEMEnv), "set", "extra_cmdline=rd.lvm.vg=elemental"},
+			})).To(BeNil())
+
+			state := &v1.InstallState{}
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).To(BeNil())
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.PersistentPartName].FS).To(Equal("ext4"))
+			Expect(state.Partitions[constants.PersistentPartName].VolumeGroup).To(Equal("elemental"))
+			Expect(state.Partitions[constants.OEMPartName].VolumeGroup).To(BeEmpty())
+		})
+
+		It("Successfully installs a btrfs persistent partition with subvolumes", Label("btrfs"), func() {
+			spec.Target = device
+			spec.Partitions.Persistent.FS = constants.Btrfs
+			spec.Partitions.Persistent.Subvolumes = []*v1.Subvolume{{Path: "@home", Compression: "zstd"}}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"mkfs.btrfs", "-L", constants.PersistentLabel},
+				{"btrfs", "subvolume", "create"},
+				{"btrfs", "property", "set"},
+			})).To(BeNil())
+
+			state := &v1.InstallState{}
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).To(BeNil())
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.PersistentPartName].FS).To(Equal(constants.Btrfs))
+			Expect(state.Partitions[constants.PersistentPartName].Subvolumes).To(HaveLen(1))
+		})
+
+		It("Successfully installs into a new disk image file", Label("image"), func() {
+			spec.Target = "/images/disk.img"
+			spec.ImageSize = "1G"
+			// The partitions must fit in the disk image
+			spec.Partitions.State.Size = 512
+			spec.Partitions.Recovery.Size = 256
+			Expect(spec.Sanitize()).To(Succeed())
+			runFunc := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "losetup" && len(args) > 2 && args[2] == "--partscan" {
+					_, err := fs.Create("/some/loopdisk")
+					return []byte("/some/loopdisk\n"), err
+				}
+				return runFunc(cmd, args...)
+			}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"losetup", "--show", "-f", "--partscan", "/images/disk.img"},
+				{"parted", "--script", "--machine", "--", "/some/loopdisk", "unit", "s", "mklabel", "gpt"},
+				{"grub2-install"},
+				{"losetup", "-d", "/some/loopdisk"},
+			})).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"blkdeactivate"}})).NotTo(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"efibootmgr"}})).NotTo(BeNil())
+			info, err := fs.Stat("/images/disk.img")
+			Expect(err).To(BeNil())
+			Expect(info.Size()).To(Equal(int64(1024 * 1024 * 1024)))
+		})
+
+		It("Fails to install over an existing disk image file without force", Label("image"), func() {
+			Expect(utils.MkdirAll(fs, "/images", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/images/disk.img")
+			Expect(err).To(BeNil())
+			spec.Target = "/images/disk.img"
+			spec.ImageSize = "1G"
+			// The partitions must fit in the disk image
+			spec.Partitions.State.Size = 512
+			spec.Partitions.Recovery.Size = 256
+			err = installer.Run()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("already exists"))
+			Expect(runner.IncludesCmds([][]string{{"losetup"}})).NotTo(BeNil())
+		})
+
+		It("Successfully installs to the disk chosen by the target selector", Label("target-selector"), func() {
+			ghwTest := v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{Name: "sdx", SizeBytes: 64 * 1024 * 1024 * 1024, SerialNumber: "1234"})
+			ghwTest.CreateDevices()
+			defer ghwTest.Clean()
+			Expect(utils.MkdirAll(fs, "/dev", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/dev/sdx")
+			Expect(err).To(BeNil())
+
+			spec.TargetSelector = &v1.TargetSelector{Serial: "1234", Policy: v1.SelectFirst}
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"parted", "--script", "--machine", "--", "/dev/sdx", "unit", "s", "mklabel", "gpt"},
+			})).To(BeNil())
+
+			state := &v1.InstallState{}
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).To(BeNil())
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Target).To(Equal(&v1.DiskState{Device: "/dev/sdx", Size: 64 * 1024 * 1024 * 1024, Serial: "1234"}))
+		})
+
+		It("Records the installation plan on dry runs without applying it", Label("dry-run"), func() {
+			spec.Target = device
+			plan, closeDryRun, err := dryrun.Setup(&config.Config)
+			Expect(err).To(BeNil())
+			defer closeDryRun()
+
+			Expect(installer.Run()).To(BeNil())
+
+			// Only the partition table was read from the device
+			Expect(runner.CmdsMatch([][]string{
+				{"parted", "--script", "--machine", "--", device, "unit", "s", "print"},
+			})).To(BeNil())
+			Expect(cloudInit.ExecStages).To(BeEmpty())
+			exists, _ := utils.Exists(fs, filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(exists).To(BeFalse())
+			exists, _ = utils.Exists(fs, fmt.Sprintf("%s1", device))
+			Expect(exists).To(BeFalse())
+
+			out := &bytes.Buffer{}
+			Expect(plan.Print(out)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[disk] parted --script --machine -- %s unit s mklabel gpt", device)))
+			Expect(out.String()).To(ContainSubstring("mkpart oem ext4 2048 133119"))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[format] mkfs.ext4 -L COS_OEM %s1", device)))
+			Expect(out.String()).To(ContainSubstring("[hook] run 'before-install' stage"))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[file] sync directory %s into %s", constants.IsoBaseTree, spec.Active.MountPoint)))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[grub] grub2-install --root-directory=%s", spec.Active.MountPoint)))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[file] create %s", filepath.Join(spec.Partitions.State.MountPoint, "grub2/grub.cfg"))))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[file] copy %s into %s", spec.Active.File, spec.Passive.File)))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[state] write %s", filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))))
+		})
+
 		It("Sets the executable /run/cos/ejectcd so systemd can eject the cd on restart", func() {
 			_ = utils.MkdirAll(fs, "/usr/lib/systemd/system-shutdown", constants.DirPerm)
 			_, err := fs.Stat("/usr/lib/systemd/system-shutdown/eject")
@@ -256,6 +443,82 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).To(BeNil())
 		})
 
+		It("Successfully installs keeping the existing persistent partition", Label("keep-persistent", "disk"), func() {
+			Expect(utils.MkdirAll(fs, "/dev", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/dev/device")
+			Expect(err).ToNot(HaveOccurred())
+			spec.Target = "/dev/device"
+			spec.KeepPersistent = true
+			spec.Force = true
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"parted", "--script", "--machine", "--", "/dev/device", "unit", "s", "mklabel"}})).NotTo(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", constants.PersistentLabel}})).NotTo(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", constants.StateLabel, "/dev/device2"}})).To(BeNil())
+			Expect(spec.Partitions.Persistent.Path).To(Equal("/dev/device3"))
+		})
+
+		It("Fails to keep the persistent partition over the running deployment without force", Label("keep-persistent", "disk"), func() {
+			Expect(utils.MkdirAll(fs, "/dev", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/dev/device")
+			Expect(err).ToNot(HaveOccurred())
+			spec.Target = "/dev/device"
+			spec.KeepPersistent = true
+			err = installer.Run()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("force"))
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4"}})).NotTo(BeNil())
+		})
+
+		Describe("Checking the installation requirements", Label("requirements"), func() {
+			BeforeEach(func() {
+				spec.Target = device
+				Expect(utils.MkdirAll(fs, "/sys/class/block/device", constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, "/proc", constants.DirPerm)).To(Succeed())
+				// 32GiB disk and 4GiB of memory
+				Expect(fs.WriteFile("/sys/class/block/device/size", []byte("67108864\n"), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile(constants.MemInfoFile, []byte("MemTotal:        4194304 kB\nMemFree:         1048576 kB\n"), constants.FilePerm)).To(Succeed())
+			})
+			It("Reports the checks and installs if all of them pass", func() {
+				Expect(installer.Run()).To(BeNil())
+				Expect(memLog.String()).To(ContainSubstring("[PASS] size of /some/device: 32GiB available"))
+				Expect(memLog.String()).To(ContainSubstring("[PASS] memory: 4GiB available, 1GiB required"))
+				Expect(memLog.String()).To(ContainSubstring("[PASS] firmware: host boots with bios, installing for bios"))
+				Expect(memLog.String()).To(ContainSubstring("[PASS] secure boot: disabled, no state required"))
+			})
+			It("Fails before partitioning if the target is too small", func() {
+				Expect(fs.WriteFile("/sys/class/block/device/size", []byte("8388608\n"), constants.FilePerm)).To(Succeed())
+				err := installer.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("size of /some/device"))
+				Expect(memLog.String()).To(ContainSubstring("[FAIL] size of /some/device: 4GiB available"))
+				Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(BeNil())
+			})
+			It("Fails on low memory or a firmware mismatch", func() {
+				spec.Requirements.MinMemory = "8G"
+				spec.Firmware = v1.EFI
+				err := installer.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("memory, firmware"))
+				Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(BeNil())
+			})
+			It("Fails if the Secure Boot state is not the required one", func() {
+				Expect(utils.MkdirAll(fs, filepath.Dir(constants.SecureBootVar), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(constants.SecureBootVar, []byte{6, 0, 0, 0, 1}, constants.FilePerm)).To(Succeed())
+				spec.Firmware = v1.EFI
+				disabled := false
+				spec.Requirements.SecureBoot = &disabled
+				err := installer.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(memLog.String()).To(ContainSubstring("[FAIL] secure boot: enabled but required to be disabled"))
+			})
+			It("Installs despite failed checks if forced", func() {
+				spec.Requirements.MinMemory = "8G"
+				spec.Force = true
+				Expect(installer.Run()).To(BeNil())
+				Expect(memLog.String()).To(ContainSubstring("[FAIL] memory"))
+			})
+		})
+
 		It("Successfully installs a docker image", Label("docker"), func() {
 			spec.Target = device
 			spec.Active.Source = v1.NewDockerSrc("my/image:latest")
@@ -275,6 +538,56 @@ var _ = Describe("Install action tests", func() {
 			Expect(client.WasGetCalledWith("http://my.config.org")).To(BeTrue())
 		})
 
+		Describe("Reporting the progress", Label("progress"), func() {
+			var events *bytes.Buffer
+			// progressEvents returns the event, phase, hook and result of each reported progress event
+			progressEvents := func() []string {
+				var reported []string
+				for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+					var event v1.ProgressEvent
+					Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+					Expect(event.Action).To(Equal("install"))
+					fields := strings.Fields(strings.Join([]string{event.Event, event.Phase, event.Hook, event.Result}, " "))
+					reported = append(reported, strings.Join(fields, " "))
+				}
+				return reported
+			}
+			BeforeEach(func() {
+				events = &bytes.Buffer{}
+				config.Progress = v1.NewProgress(events)
+				spec.Target = device
+			})
+			It("Reports the phases and hooks of the installation", func() {
+				Expect(installer.Run()).To(BeNil())
+				Expect(progressEvents()).To(Equal([]string{
+					"start",
+					"phase-start requirements", "phase-end requirements success",
+					"phase-start partition", "phase-end partition success",
+					"phase-start mount", "phase-end mount success",
+					"phase-start deploy", "hook deploy before-install success", "phase-end deploy success",
+					"phase-start bootloader", "hook bootloader after-install-chroot success", "phase-end bootloader success",
+					"phase-start recovery", "phase-end recovery success",
+					"phase-start passive", "phase-end passive success",
+					"phase-start finalize", "hook finalize after-install success", "phase-end finalize success",
+					"end success",
+				}))
+			})
+			It("Reports the failed phase and hook", func() {
+				config.Strict = true
+				cloudInit.Error = true
+				Expect(installer.Run()).NotTo(BeNil())
+				Expect(progressEvents()).To(Equal([]string{
+					"start",
+					"phase-start requirements", "phase-end requirements success",
+					"phase-start partition", "phase-end partition success",
+					"phase-start mount", "phase-end mount success",
+					"phase-start deploy", "hook deploy before-install failure", "phase-end deploy failure",
+					"error deploy",
+					"end failure",
+				}))
+			})
+		})
+
 		It("Fails if disk doesn't exist", Label("disk"), func() {
 			spec.Target = "nonexistingdisk"
 			Expect(installer.Run()).NotTo(BeNil())
@@ -315,6 +628,14 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).NotTo(BeNil())
 		})
 
+		It("Fails if there is not enough space for the images", Label("disk", "space"), func() {
+			spec.Target = device
+			syscall.FreeSpace = 1024
+			err := installer.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not enough space"))
+		})
+
 		It("Fails on blkdeactivate errors", Label("disk", "partitions"), func() {
 			spec.Target = device
 			cmdFail = "blkdeactivate"
@@ -0,0 +1,210 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/elemental"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+// The recovery backup is the previous recovery image, kept in the recovery partition on recovery upgrades.
+// It has its own grub menu entry until it is restored or removed.
+
+// recoveryBackupFile returns the backup file of the given recovery image file
+func recoveryBackupFile(recovery string) string {
+	if filepath.Ext(recovery) == filepath.Ext(constants.RecoverySquashFile) {
+		return filepath.Join(filepath.Dir(recovery), constants.RecoveryBackupSqshFile)
+	}
+	return filepath.Join(filepath.Dir(recovery), constants.RecoveryBackupImgFile)
+}
+
+// findRecoveryBackup returns the recovery backup file found in the given recovery partition root, empty if there is none
+func findRecoveryBackup(fs v1.FS, recoveryDir string) string {
+	for _, f := range []string{constants.RecoveryBackupSqshFile, constants.RecoveryBackupImgFile} {
+		backup := filepath.Join(recoveryDir, "cOS", f)
+		if exists, _ := utils.Exists(fs, backup); exists {
+			return backup
+		}
+	}
+	return ""
+}
+
+// setRecoveryBackupMenu updates the grub menu entry of the recovery backup found in the recovery partition
+func setRecoveryBackupMenu(config *v1.Config, parts v1.ElementalPartitions) error {
+	var label string
+	backup := findRecoveryBackup(config.Fs, parts.Recovery.MountPoint)
+	if backup != "" && filepath.Ext(backup) != filepath.Ext(constants.RecoverySquashFile) {
+		label = constants.SystemLabel
+	}
+	grub := utils.NewGrub(config)
+	return grub.SetRecoveryBackupMenu(parts.State.MountPoint, parts.Recovery.FilesystemLabel, backup, label)
+}
+
+// removeRecoveryBackup removes the recovery backup image, if any, its grub menu entry and its installation state data
+func removeRecoveryBackup(config *v1.Config, parts v1.ElementalPartitions, state *v1.InstallState) error {
+	backup := findRecoveryBackup(config.Fs, parts.Recovery.MountPoint)
+	if backup != "" {
+		config.Logger.Infof("Removing recovery backup %s", backup)
+		err := config.Fs.Remove(backup)
+		if err != nil {
+			config.Logger.Errorf("Failed removing %s: %v", backup, err)
+			return err
+		}
+	}
+	err := setRecoveryBackupMenu(config, parts)
+	if err != nil {
+		return err
+	}
+
+	if state == nil || state.Partitions[constants.RecoveryPartName] == nil {
+		return nil
+	}
+	recoveryPart := state.Partitions[constants.RecoveryPartName]
+	if recoveryPart.Images[constants.RecoveryBackupImgName] == nil {
+		return nil
+	}
+	delete(recoveryPart.Images, constants.RecoveryBackupImgName)
+	state.Date = time.Now().Format(time.RFC3339)
+	return config.WriteInstallState(
+		state,
+		filepath.Join(parts.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(parts.Recovery.MountPoint, constants.InstallStateFile),
+	)
+}
+
+// RecoveryBackupAction represents the struct that will manage the recovery backup
+type RecoveryBackupAction struct {
+	config *v1.RunConfig
+	spec   *v1.RecoveryBackupSpec
+}
+
+func NewRecoveryBackupAction(config *v1.RunConfig, spec *v1.RecoveryBackupSpec) *RecoveryBackupAction {
+	return &RecoveryBackupAction{config: config, spec: spec}
+}
+
+func (r RecoveryBackupAction) Info(msg string, args ...interface{}) {
+	r.config.Logger.Infof(msg, args...)
+}
+
+func (r RecoveryBackupAction) Error(msg string, args ...interface{}) {
+	r.config.Logger.Errorf(msg, args...)
+}
+
+// mountPartitions mounts the state and recovery partitions, or remounts them, in read-write mode
+func (r *RecoveryBackupAction) mountPartitions(e *elemental.Elemental, cleanup *utils.CleanStack) error {
+	for _, part := range []*v1.Partition{r.spec.Partitions.State, r.spec.Partitions.Recovery} {
+		umount, err := e.MountRWPartition(part)
+		if err != nil {
+			return err
+		}
+		cleanup.Push(umount)
+	}
+	return nil
+}
+
+// Restore replaces the current recovery image with the recovery backup
+func (r *RecoveryBackupAction) Restore() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&r.config.Config)
+
+	err = r.mountPartitions(e, cleanup)
+	if err != nil {
+		return err
+	}
+
+	backup := findRecoveryBackup(r.config.Fs, r.spec.Partitions.Recovery.MountPoint)
+	if backup == "" {
+		return fmt.Errorf("no recovery backup found")
+	}
+
+	// The recovery image is expected to be either a squashfs or a filesystem image, never both
+	target := filepath.Join(filepath.Dir(backup), constants.RecoveryImgFile)
+	other := filepath.Join(filepath.Dir(backup), constants.RecoverySquashFile)
+	if filepath.Ext(backup) == filepath.Ext(constants.RecoverySquashFile) {
+		target, other = other, target
+	}
+	if exists, _ := utils.Exists(r.config.Fs, other); exists {
+		r.Info("Removing %s", other)
+		err = r.config.Fs.Remove(other)
+		if err != nil {
+			r.Error("Failed removing %s: %v", other, err)
+			return err
+		}
+	}
+
+	r.Info("Restoring recovery backup, moving %s to %s", backup, target)
+	_, err = r.config.Runner.Run("mv", "-f", backup, target)
+	if err != nil {
+		r.Error("Failed to move %s to %s: %s", backup, target, err)
+		return err
+	}
+	_, _ = r.config.Runner.Run("sync")
+
+	err = setRecoveryBackupMenu(&r.config.Config, r.spec.Partitions)
+	if err != nil {
+		return err
+	}
+
+	if r.spec.State == nil || r.spec.State.Partitions[constants.RecoveryPartName] == nil {
+		return nil
+	}
+	recoveryPart := r.spec.State.Partitions[constants.RecoveryPartName]
+	if recoveryPart.Images[constants.RecoveryBackupImgName] != nil {
+		recoveryPart.Images[constants.RecoveryImgName] = recoveryPart.Images[constants.RecoveryBackupImgName]
+		delete(recoveryPart.Images, constants.RecoveryBackupImgName)
+	}
+	r.spec.State.Date = time.Now().Format(time.RFC3339)
+	err = r.config.WriteInstallState(
+		r.spec.State,
+		filepath.Join(r.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(r.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+	if err != nil {
+		r.Error("failed updating installation metadata")
+	}
+	return err
+}
+
+// Remove deletes the recovery backup, meant to be called once the current recovery image is known to be good
+func (r *RecoveryBackupAction) Remove() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&r.config.Config)
+
+	err = r.mountPartitions(e, cleanup)
+	if err != nil {
+		return err
+	}
+
+	if findRecoveryBackup(r.config.Fs, r.spec.Partitions.Recovery.MountPoint) == "" {
+		return fmt.Errorf("no recovery backup found")
+	}
+	err = removeRecoveryBackup(&r.config.Config, r.spec.Partitions, r.spec.State)
+	if err != nil {
+		r.Error("failed removing recovery backup")
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/action"
+	conf "github.com/rancher/elemental-cli/pkg/config"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Recovery backup action tests", func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var logger v1.Logger
+	var mounter *v1mock.ErrorMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest v1mock.GhwMock
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		mounter = v1mock.NewErrorMounter()
+		memLog = &bytes.Buffer{}
+		logger = v1.NewBufferLogger(memLog)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+	})
+
+	AfterEach(func() { cleanup() })
+
+	Describe("Recovery backup management", Label("recovery-backup"), func() {
+		var spec *v1.RecoveryBackupSpec
+		var backup *action.RecoveryBackupAction
+		var recoveryDir, backupImg, recoveryImg, recoverySquash, menu string
+		var err error
+
+		BeforeEach(func() {
+			ghwTest = mockElementalDisk(fs)
+
+			recoveryDir = filepath.Join(constants.LiveDir, "cOS")
+			backupImg = filepath.Join(recoveryDir, constants.RecoveryBackupImgFile)
+			recoveryImg = filepath.Join(recoveryDir, constants.RecoveryImgFile)
+			recoverySquash = filepath.Join(recoveryDir, constants.RecoverySquashFile)
+			menu = filepath.Join(constants.RunningStateDir, constants.GrubRecoveryBackup)
+			Expect(fs.WriteFile(recoveryImg, []byte("recovery"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(backupImg, []byte("backup"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(menu, []byte("menuentry"), constants.FilePerm)).To(Succeed())
+
+			spec, err = conf.NewRecoveryBackupSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.RecoveryPartName: {
+						FSLabel: "COS_RECOVERY",
+						Images: map[string]*v1.ImageState{
+							constants.RecoveryImgName:       {Source: v1.NewDockerSrc("registry.org/recovery:v2")},
+							constants.RecoveryBackupImgName: {Source: v1.NewDockerSrc("registry.org/recovery:v1")},
+						},
+					},
+				},
+			}
+
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "mv" && len(args) == 3 {
+					return moveFile(fs, args[1], args[2])
+				}
+				return []byte{}, nil
+			}
+			backup = action.NewRecoveryBackupAction(config, spec)
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Restores the recovery backup", func() {
+			Expect(backup.Restore()).To(Succeed())
+
+			f, _ := fs.ReadFile(recoveryImg)
+			Expect(f).To(ContainSubstring("backup"))
+			_, err = fs.Stat(backupImg)
+			Expect(err).To(HaveOccurred())
+			_, err = fs.Stat(menu)
+			Expect(err).To(HaveOccurred())
+
+			state, err := config.LoadInstallState()
+			Expect(err).ToNot(HaveOccurred())
+			images := state.Partitions[constants.RecoveryPartName].Images
+			Expect(images[constants.RecoveryImgName].Source.Value()).To(Equal("registry.org/recovery:v1"))
+			Expect(images[constants.RecoveryBackupImgName]).To(BeNil())
+		})
+		It("Restores a recovery backup of a different image type", func() {
+			Expect(fs.Rename(recoveryImg, recoverySquash)).To(Succeed())
+			Expect(backup.Restore()).To(Succeed())
+
+			f, _ := fs.ReadFile(recoveryImg)
+			Expect(f).To(ContainSubstring("backup"))
+			_, err = fs.Stat(recoverySquash)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Removes the recovery backup", func() {
+			Expect(backup.Remove()).To(Succeed())
+
+			f, _ := fs.ReadFile(recoveryImg)
+			Expect(f).To(ContainSubstring("recovery"))
+			_, err = fs.Stat(backupImg)
+			Expect(err).To(HaveOccurred())
+			_, err = fs.Stat(menu)
+			Expect(err).To(HaveOccurred())
+
+			state, err := config.LoadInstallState()
+			Expect(err).ToNot(HaveOccurred())
+			images := state.Partitions[constants.RecoveryPartName].Images
+			Expect(images[constants.RecoveryImgName].Source.Value()).To(Equal("registry.org/recovery:v2"))
+			Expect(images[constants.RecoveryBackupImgName]).To(BeNil())
+		})
+		It("Fails if there is no recovery backup", func() {
+			Expect(fs.Remove(backupImg)).To(Succeed())
+			Expect(backup.Restore()).NotTo(Succeed())
+			Expect(backup.Remove()).NotTo(Succeed())
+			f, _ := fs.ReadFile(recoveryImg)
+			Expect(f).To(ContainSubstring("recovery"))
+		})
+	})
+})
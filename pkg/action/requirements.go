@@ -0,0 +1,229 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+
+	cnst "github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+const (
+	checkPass = "PASS"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+
+	// partTableReserve is the disk space in MiB not available to partitions, it covers
+	// the partition table headers and the alignment of the first partition
+	partTableReserve = 2
+)
+
+// requirementCheck is the result of a single installation requirement check
+type requirementCheck struct {
+	name   string
+	status string
+	detail string
+}
+
+// checkRequirements validates the host and the target devices against the installation requirements
+// and logs a report of all the checks. It fails if any check fails, unless the installation is forced.
+// Disk images are built for other hosts, so only their size is checked.
+func (i *InstallAction) checkRequirements() error {
+	checks := i.checkTargetSizes()
+	if i.spec.ImageSize == "" {
+		checks = append(checks, i.checkMemory(), i.checkArch(), i.checkFirmware(), i.checkSecureBoot())
+	}
+
+	var failed []string
+	i.cfg.Logger.Info("Installation requirements:")
+	for _, check := range checks {
+		i.cfg.Logger.Infof("  [%s] %s: %s", check.status, check.name, check.detail)
+		if check.status == checkFail {
+			failed = append(failed, check.name)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if i.spec.Force {
+		i.cfg.Logger.Warnf("Forcing the installation despite the failed requirements: %s", strings.Join(failed, ", "))
+		return nil
+	}
+	return fmt.Errorf("installation requirements not met: %s, use `force` flag to install anyway", strings.Join(failed, ", "))
+}
+
+// checkTargetSizes checks each target device, or the disk image, can hold all the partitions of the layout
+func (i *InstallAction) checkTargetSizes() []requirementCheck {
+	if i.spec.NoFormat || len(i.spec.KeptPartitions()) > 0 {
+		return []requirementCheck{{"target size", checkSkip, "the existing partitions are reused"}}
+	}
+
+	required := uint64(partTableReserve)
+	for _, part := range i.spec.Partitions.PartitionsByInstallOrder(i.spec.ExtraPartitions) {
+		required += uint64(part.Size)
+	}
+	required *= 1024 * 1024
+
+	if i.spec.ImageSize != "" {
+		// The image size is already validated on sanitize
+		size, _ := units.RAMInBytes(i.spec.ImageSize)
+		return []requirementCheck{sizeCheck("disk image size", uint64(size), required)}
+	}
+
+	targets := []string{i.spec.Target}
+	if i.spec.Mirror != "" {
+		targets = i.spec.Targets
+	}
+	var checks []requirementCheck
+	for _, target := range targets {
+		name := fmt.Sprintf("size of %s", target)
+		size, err := utils.DiskSize(i.cfg.Fs, target)
+		if err != nil {
+			checks = append(checks, requirementCheck{name, checkSkip, fmt.Sprintf("unknown size: %v", err)})
+			continue
+		}
+		checks = append(checks, sizeCheck(name, size, required))
+	}
+	return checks
+}
+
+// checkMemory checks the host memory against the minimum required
+func (i *InstallAction) checkMemory() requirementCheck {
+	check := requirementCheck{name: "memory"}
+	if i.spec.Requirements.MinMemory == "" {
+		check.status, check.detail = checkSkip, "no minimum required"
+		return check
+	}
+	// The minimum memory is already validated on sanitize
+	minMemory, _ := units.RAMInBytes(i.spec.Requirements.MinMemory)
+	total, err := hostMemory(i.cfg.Fs)
+	if err != nil {
+		check.status, check.detail = checkSkip, fmt.Sprintf("unknown host memory: %v", err)
+		return check
+	}
+	return sizeCheck(check.name, total, uint64(minMemory))
+}
+
+// checkArch checks the host CPU architecture matches the configured one
+func (i *InstallAction) checkArch() requirementCheck {
+	check := requirementCheck{name: "architecture"}
+	arch, err := utils.GolangArchToArch(runtime.GOARCH)
+	if err != nil {
+		check.status, check.detail = checkSkip, fmt.Sprintf("unknown host architecture %s", runtime.GOARCH)
+		return check
+	}
+	check.detail = fmt.Sprintf("host is %s, installing %s", arch, i.cfg.Arch)
+	check.status = checkPass
+	if arch != i.cfg.Arch {
+		check.status = checkFail
+	}
+	return check
+}
+
+// checkFirmware checks the host firmware matches the firmware installed for
+func (i *InstallAction) checkFirmware() requirementCheck {
+	check := requirementCheck{name: "firmware"}
+	host := v1.BIOS
+	if efi, _ := utils.Exists(i.cfg.Fs, cnst.EfiDevice); efi {
+		host = v1.EFI
+	}
+	check.detail = fmt.Sprintf("host boots with %s, installing for %s", host, i.spec.Firmware)
+	check.status = checkPass
+	if host != i.spec.Firmware {
+		check.status = checkFail
+	}
+	return check
+}
+
+// checkSecureBoot checks the Secure Boot state of the host if a state is required, otherwise it is only reported
+func (i *InstallAction) checkSecureBoot() requirementCheck {
+	check := requirementCheck{name: "secure boot", status: checkPass}
+	enabled, err := secureBootEnabled(i.cfg.Fs)
+	required := i.spec.Requirements.SecureBoot
+	switch {
+	case err != nil:
+		check.status, check.detail = checkSkip, fmt.Sprintf("unknown state: %v", err)
+	case required == nil:
+		check.detail = fmt.Sprintf("%s, no state required", enabledState(enabled))
+	case *required == enabled:
+		check.detail = fmt.Sprintf("%s as required", enabledState(enabled))
+	default:
+		check.status = checkFail
+		check.detail = fmt.Sprintf("%s but required to be %s", enabledState(enabled), enabledState(*required))
+	}
+	return check
+}
+
+// sizeCheck checks the given size in bytes is at least the required one
+func sizeCheck(name string, size, required uint64) requirementCheck {
+	check := requirementCheck{
+		name:   name,
+		status: checkPass,
+		detail: fmt.Sprintf("%s available, %s required", units.BytesSize(float64(size)), units.BytesSize(float64(required))),
+	}
+	if size < required {
+		check.status = checkFail
+	}
+	return check
+}
+
+// secureBootEnabled reads the Secure Boot state of the host, it is always disabled on BIOS hosts
+func secureBootEnabled(fs v1.FS) (bool, error) {
+	if efi, _ := utils.Exists(fs, cnst.EfiDevice); !efi {
+		return false, nil
+	}
+	data, err := fs.ReadFile(cnst.SecureBootVar)
+	if err != nil {
+		return false, err
+	}
+	// EFI variables start with 4 bytes of attributes followed by the value
+	return len(data) > 4 && data[4] == 1, nil
+}
+
+// enabledState describes the given state
+func enabledState(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// hostMemory returns the total memory of the host in bytes as reported in /proc/meminfo
+func hostMemory(fs v1.FS) (uint64, error) {
+	data, err := fs.ReadFile(cnst.MemInfoFile)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed parsing %s: %w", cnst.MemInfoFile, err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no total memory found in %s", cnst.MemInfoFile)
+}
@@ -19,6 +19,7 @@ package action
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"time"
 
 	cnst "github.com/rancher/elemental-cli/pkg/constants"
@@ -89,8 +90,27 @@ func (r *ResetAction) updateInstallState(e *elemental.Elemental, cleanup *utils.
 			FSLabel: r.spec.Partitions.Persistent.FilesystemLabel,
 		}
 	}
+	if r.spec.State != nil {
+		installState.Target = r.spec.State.Target
+	}
 	if r.spec.State != nil && r.spec.State.Partitions != nil {
 		installState.Partitions[cnst.RecoveryPartName] = r.spec.State.Partitions[cnst.RecoveryPartName]
+		// Mirror members, encryption, volume groups and subvolumes are not modified on reset
+		for name, prev := range r.spec.State.Partitions {
+			if prev == nil {
+				continue
+			}
+			part := installState.Partitions[name]
+			if part == nil {
+				if prev.Encryption != nil || prev.VolumeGroup != "" || len(prev.Subvolumes) > 0 {
+					installState.Partitions[name] = prev
+				}
+				continue
+			}
+			part.Members = prev.Members
+			part.FS, part.Encryption, part.VolumeGroup = prev.FS, prev.Encryption, prev.VolumeGroup
+			part.Subvolumes = prev.Subvolumes
+		}
 	}
 
 	umount, err := e.MountRWPartition(r.spec.Partitions.Recovery)
@@ -106,18 +126,48 @@ func (r *ResetAction) updateInstallState(e *elemental.Elemental, cleanup *utils.
 	)
 }
 
+// encryptedPartitions returns the encrypted partitions recorded in the installation state
+func (r *ResetAction) encryptedPartitions() v1.PartitionList {
+	var parts v1.PartitionList
+	if r.spec.State == nil {
+		return parts
+	}
+	for name, pState := range r.spec.State.Partitions {
+		if pState != nil && pState.Encryption != nil {
+			parts = append(parts, &v1.Partition{
+				Name: name, FilesystemLabel: pState.FSLabel, FS: pState.FS, Encryption: pState.Encryption,
+			})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+	return parts
+}
+
 // ResetRun will reset the cos system to by following several steps
 func (r ResetAction) Run() (err error) {
+	r.cfg.Progress.Start("reset")
+	defer func() { r.cfg.Progress.Done(err) }()
+
 	e := elemental.NewElemental(&r.cfg.Config)
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
 	// Unmount partitions if any is already mounted before formatting
+	r.cfg.Progress.Phase(v1.PhasePartition)
 	err = e.UnmountPartitions(r.spec.Partitions.PartitionsByMountPoint(true, r.spec.Partitions.Recovery))
 	if err != nil {
 		return err
 	}
 
+	// Unlock the encrypted persistent partition, if it was not unlocked on boot
+	if persistent := r.spec.Partitions.Persistent; persistent != nil && persistent.Encryption != nil {
+		lock, err := e.UnlockPartition(persistent)
+		if err != nil {
+			return err
+		}
+		cleanup.Push(lock)
+	}
+
 	// Reformat state partition
 	err = e.FormatPartition(r.spec.Partitions.State)
 	if err != nil {
@@ -127,7 +177,12 @@ func (r ResetAction) Run() (err error) {
 	// Reformat persistent partition
 	if r.spec.FormatPersistent {
 		persistent := r.spec.Partitions.Persistent
-		if persistent != nil {
+		if persistent != nil && len(persistent.Subvolumes) > 0 {
+			err = e.ResetSubvolumes(persistent)
+			if err != nil {
+				return err
+			}
+		} else if persistent != nil {
 			err = e.FormatPartition(persistent)
 			if err != nil {
 				return err
@@ -146,6 +201,7 @@ func (r ResetAction) Run() (err error) {
 		}
 	}
 	// Mount configured partitions
+	r.cfg.Progress.Phase(v1.PhaseMount)
 	err = e.MountPartitions(r.spec.Partitions.PartitionsByMountPoint(false, r.spec.Partitions.Recovery))
 	if err != nil {
 		return err
@@ -154,7 +210,14 @@ func (r ResetAction) Run() (err error) {
 		return e.UnmountPartitions(r.spec.Partitions.PartitionsByMountPoint(true, r.spec.Partitions.Recovery))
 	})
 
+	// Check there is enough space for the images before deploying them
+	err = e.CheckAvailableSpace(r.spec.Partitions.State.MountPoint, &r.spec.Active, &r.spec.Passive)
+	if err != nil {
+		return err
+	}
+
 	// Before reset hook happens once partitions are aready and before deploying the OS image
+	r.cfg.Progress.Phase(v1.PhaseDeploy)
 	err = r.resetHook(cnst.BeforeResetHook, false)
 	if err != nil {
 		return err
@@ -167,7 +230,20 @@ func (r ResetAction) Run() (err error) {
 	}
 	cleanup.Push(func() error { return e.UnmountImage(&r.spec.Active) })
 
+	// Set the encrypted partitions to be unlocked on boot
+	if encrypted := r.encryptedPartitions(); len(encrypted) > 0 {
+		var oemDir string
+		if r.spec.Partitions.OEM != nil {
+			oemDir = r.spec.Partitions.OEM.MountPoint
+		}
+		err = e.WriteCrypttab(r.spec.Active.MountPoint, oemDir, encrypted)
+		if err != nil {
+			return err
+		}
+	}
+
 	// install grub
+	r.cfg.Progress.Phase(v1.PhaseBootloader)
 	grub := utils.NewGrub(&r.cfg.Config)
 	err = grub.Install(
 		r.spec.Target,
@@ -224,11 +300,13 @@ func (r ResetAction) Run() (err error) {
 	}
 
 	// Install Passive
+	r.cfg.Progress.Phase(v1.PhasePassive)
 	_, err = e.DeployImage(&r.spec.Passive, false)
 	if err != nil {
 		return err
 	}
 
+	r.cfg.Progress.Phase(v1.PhaseFinalize)
 	err = r.resetHook(cnst.AfterResetHook, false)
 	if err != nil {
 		return err
@@ -19,6 +19,7 @@ package action_test
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"path/filepath"
 
 	"github.com/jaypipes/ghw/pkg/block"
@@ -27,11 +28,13 @@ import (
 	"github.com/rancher/elemental-cli/pkg/action"
 	conf "github.com/rancher/elemental-cli/pkg/config"
 	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/dryrun"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 	v1mock "github.com/rancher/elemental-cli/tests/mocks"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
 )
 
 var _ = Describe("Reset action tests", func() {
@@ -151,6 +154,9 @@ var _ = Describe("Reset action tests", func() {
 				if cmdFail == cmd {
 					return []byte{}, errors.New("Command failed")
 				}
+				if cmd == "cp" {
+					return (&v1.RealRunner{Logger: logger}).Run(cmd, args...)
+				}
 				return []byte{}, nil
 			}
 			reset = action.NewResetAction(config, spec)
@@ -172,6 +178,65 @@ var _ = Describe("Reset action tests", func() {
 			Expect(reset.Run()).To(BeNil())
 			Expect(runner.IncludesCmds([][]string{{"poweroff", "-f"}}))
 		})
+		It("Successfully resets an encrypted persistent partition", Label("encryption"), func() {
+			encryption := &v1.PartitionEncryption{KeyFile: "/keyfile", UUID: "1234"}
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.PersistentPartName: {
+						FSLabel: constants.PersistentLabel, FS: "ext4", Encryption: encryption,
+					},
+				},
+			}
+			spec.Partitions.Persistent = &v1.Partition{
+				Name:            constants.PersistentPartName,
+				FilesystemLabel: constants.PersistentLabel,
+				FS:              "ext4",
+				MountPoint:      constants.PersistentDir,
+				Path:            "/dev/disk/by-uuid/1234",
+				Encryption:      encryption,
+			}
+			spec.FormatPersistent = true
+			Expect(reset.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"cryptsetup", "open", "--key-file", "/keyfile", "/dev/disk/by-uuid/1234", "cos_persistent"},
+				{"mkfs.ext4", "-L", constants.PersistentLabel, "/dev/mapper/cos_persistent"},
+				{"cryptsetup", "close", "cos_persistent"},
+			})).To(BeNil())
+			crypttab, err := fs.ReadFile(filepath.Join(spec.Active.MountPoint, constants.CrypttabFile))
+			Expect(err).To(BeNil())
+			Expect(string(crypttab)).To(Equal("cos_persistent UUID=1234 /keyfile luks\n"))
+		})
+		It("Successfully resets the subvolumes of the persistent partition", Label("btrfs"), func() {
+			subvolumes := []*v1.Subvolume{{Path: "@home", Compression: "zstd"}}
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.PersistentPartName: {
+						FSLabel: constants.PersistentLabel, FS: constants.Btrfs, Subvolumes: subvolumes,
+					},
+				},
+			}
+			spec.Partitions.Persistent = &v1.Partition{
+				Name:            constants.PersistentPartName,
+				FilesystemLabel: constants.PersistentLabel,
+				FS:              constants.Btrfs,
+				MountPoint:      constants.PersistentDir,
+				Path:            "/dev/device5",
+				Subvolumes:      subvolumes,
+			}
+			spec.FormatPersistent = true
+			Expect(reset.Run()).To(BeNil())
+			Expect(runner.MatchMilestones([][]string{
+				{"btrfs", "subvolume", "create"},
+				{"btrfs", "property", "set"},
+			})).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.btrfs"}})).NotTo(BeNil())
+
+			state := &v1.InstallState{}
+			data, err := fs.ReadFile(filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))
+			Expect(err).To(BeNil())
+			Expect(yaml.Unmarshal(data, state)).To(Succeed())
+			Expect(state.Partitions[constants.PersistentPartName].Subvolumes).To(Equal(subvolumes))
+		})
 		It("Successfully resets from a squashfs recovery image", Label("channel"), func() {
 			err := utils.MkdirAll(config.Fs, constants.IsoBaseTree, constants.DirPerm)
 			Expect(err).ShouldNot(HaveOccurred())
@@ -196,6 +261,29 @@ var _ = Describe("Reset action tests", func() {
 			Expect(reset.Run()).To(BeNil())
 			Expect(luet.UnpackChannelCalled()).To(BeTrue())
 		})
+		It("Records the reset plan on dry runs without applying it", Label("dry-run"), func() {
+			spec.FormatPersistent = true
+			plan, closeDryRun, err := dryrun.Setup(&config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer closeDryRun()
+			runner.ClearCmds()
+
+			Expect(reset.Run()).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+			Expect(cloudInit.ExecStages).To(BeEmpty())
+
+			out := &bytes.Buffer{}
+			Expect(plan.Print(out)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring(
+				fmt.Sprintf("[format] mkfs.ext4 -L %s %s", spec.Partitions.State.FilesystemLabel, spec.Partitions.State.Path),
+			))
+			Expect(out.String()).To(ContainSubstring(
+				fmt.Sprintf("[format] mkfs.ext4 -L %s %s", spec.Partitions.Persistent.FilesystemLabel, spec.Partitions.Persistent.Path),
+			))
+			Expect(out.String()).To(ContainSubstring("[hook] run 'before-reset' stage"))
+			Expect(out.String()).To(ContainSubstring("[grub] grub2-install"))
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[state] write %s", filepath.Join(spec.Partitions.State.MountPoint, constants.InstallStateFile))))
+		})
 		It("Fails installing grub", func() {
 			cmdFail = "grub2-install"
 			Expect(reset.Run()).NotTo(BeNil())
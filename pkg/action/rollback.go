@@ -0,0 +1,260 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/elemental"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+// RollbackAction represents the struct that will run the rollback from start to finish
+type RollbackAction struct {
+	config *v1.RunConfig
+	spec   *v1.RollbackSpec
+}
+
+func NewRollbackAction(config *v1.RunConfig, spec *v1.RollbackSpec) *RollbackAction {
+	return &RollbackAction{config: config, spec: spec}
+}
+
+func (r RollbackAction) Info(s string, args ...interface{}) {
+	r.config.Logger.Infof(s, args...)
+}
+
+func (r RollbackAction) Debug(s string, args ...interface{}) {
+	r.config.Logger.Debugf(s, args...)
+}
+
+func (r RollbackAction) Error(s string, args ...interface{}) {
+	r.config.Logger.Errorf(s, args...)
+}
+
+// swapInstallStateYaml swaps active and passive image entries in the state.yaml file
+func (r *RollbackAction) swapInstallStateYaml() error {
+	if r.spec.State == nil {
+		r.spec.State = &v1.InstallState{
+			Partitions: map[string]*v1.PartitionState{},
+		}
+	}
+
+	statePart := r.spec.State.Partitions[constants.StatePartName]
+	if statePart == nil {
+		statePart = &v1.PartitionState{
+			FSLabel: r.spec.Partitions.State.FilesystemLabel,
+			Images:  map[string]*v1.ImageState{},
+		}
+		r.spec.State.Partitions[constants.StatePartName] = statePart
+	}
+
+	if statePart.Images == nil {
+		statePart.Images = map[string]*v1.ImageState{}
+	}
+	active := statePart.Images[constants.PassiveImgName]
+	passive := statePart.Images[constants.ActiveImgName]
+	delete(statePart.Images, constants.ActiveImgName)
+	delete(statePart.Images, constants.PassiveImgName)
+	if active != nil {
+		active.Label = r.spec.Active.Label
+		statePart.Images[constants.ActiveImgName] = active
+	}
+	if passive != nil {
+		passive.Label = r.spec.Passive.Label
+		statePart.Images[constants.PassiveImgName] = passive
+	}
+	r.spec.State.BootAssessment = nil
+	r.spec.State.Date = time.Now().Format(time.RFC3339)
+
+	return r.config.WriteInstallState(
+		r.spec.State,
+		filepath.Join(r.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+		filepath.Join(r.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+	)
+}
+
+// moveAndLabel moves the given image file to the given target and sets the given filesystem label to it
+func (r *RollbackAction) moveAndLabel(source, target, label string) error {
+	r.Info("Moving %s to %s", source, target)
+	_, err := r.config.Runner.Run("mv", "-f", source, target)
+	if err != nil {
+		r.Error("Failed to move %s to %s: %s", source, target, err)
+		return err
+	}
+	out, err := r.config.Runner.Run("tune2fs", "-L", label, target)
+	if err != nil {
+		r.Error("Error while labeling the image %s: %s", target, err)
+		r.Debug("Error while labeling the image %s, command output: %s", target, out)
+		return err
+	}
+	return nil
+}
+
+// swapImages swaps active and passive image files and fixes their filesystem labels.
+// In case of failure it tries to restore the original layout before returning.
+func (r *RollbackAction) swapImages() error {
+	tmpFile := filepath.Join(filepath.Dir(r.spec.Active.File), constants.RollbackImgFile)
+
+	err := r.moveAndLabel(r.spec.Active.File, tmpFile, r.spec.Passive.Label)
+	if err != nil {
+		if exists, _ := utils.Exists(r.config.Fs, tmpFile); exists {
+			_, _ = r.config.Runner.Run("mv", "-f", tmpFile, r.spec.Active.File)
+		}
+		return err
+	}
+	err = r.moveAndLabel(r.spec.Passive.File, r.spec.Active.File, r.spec.Active.Label)
+	if err != nil {
+		r.Error("Failed setting passive as the active image, restoring previous active image")
+		_ = r.moveAndLabel(tmpFile, r.spec.Active.File, r.spec.Active.Label)
+		return err
+	}
+	r.Info("Moving %s to %s", tmpFile, r.spec.Passive.File)
+	_, err = r.config.Runner.Run("mv", "-f", tmpFile, r.spec.Passive.File)
+	if err != nil {
+		r.Error("Failed to move %s to %s: %s", tmpFile, r.spec.Passive.File, err)
+		r.Error("Failed setting former active as the passive image, restoring previous images")
+		_ = r.moveAndLabel(r.spec.Active.File, r.spec.Passive.File, r.spec.Passive.Label)
+		_ = r.moveAndLabel(tmpFile, r.spec.Active.File, r.spec.Active.Label)
+		return err
+	}
+	_, _ = r.config.Runner.Run("sync")
+	return nil
+}
+
+func (r *RollbackAction) Run() (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&r.config.Config)
+
+	umount, err := e.MountRWPartition(r.spec.Partitions.State)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	umount, err = e.MountRWPartition(r.spec.Partitions.Recovery)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+
+	// A staged upgrade is computed against the installation state in place once applied, so it
+	// can be kept across rollbacks. Any other transaction has to be recovered first.
+	journal, err := LoadUpgradeJournal(r.config.Fs, filepath.Join(r.spec.Partitions.State.MountPoint, constants.UpgradeJournalFile))
+	if err != nil {
+		r.Error("Failed reading upgrade journal: %s", err)
+		return err
+	}
+	if journal != nil && journal.Phase == constants.UpgradeStaged {
+		r.Info("The upgrade staged on %s is kept, apply it with 'elemental upgrade --apply-staged' or discard it with 'elemental upgrade --discard-staged'", journal.Date)
+	} else if journal != nil {
+		r.Error("Found a pending upgrade transaction, run 'elemental upgrade --recover' before rolling back")
+		return fmt.Errorf("pending upgrade transaction found")
+	}
+
+	for _, img := range []string{r.spec.Active.File, r.spec.Passive.File} {
+		if exists, _ := utils.Exists(r.config.Fs, img); !exists {
+			r.Error("Image %s not found, can't rollback", img)
+			return fmt.Errorf("image %s not found", img)
+		}
+	}
+
+	err = Hook(&r.config.Config, constants.BeforeRollbackHook, r.config.Strict, r.config.CloudInitPaths...)
+	if err != nil {
+		r.Error("Error while running hook before-rollback: %s", err)
+		return err
+	}
+
+	r.Info("Swapping active and passive images")
+	err = r.swapImages()
+	if err != nil {
+		return err
+	}
+	// Swap the images back if the rollback fails before the installation state is updated
+	swapped := true
+	cleanup.Push(func() error {
+		if err == nil || !swapped {
+			return nil
+		}
+		r.Error("Rollback failed, restoring previous images")
+		return r.swapImages()
+	})
+
+	// Rebrand according to the new active image
+	err = e.MountImage(&r.spec.Active, "ro")
+	if err != nil {
+		r.Error("Failed mounting new active image: %s", err)
+		return err
+	}
+	cleanup.Push(func() error { return e.UnmountImage(&r.spec.Active) })
+	err = e.SetDefaultGrubEntry(r.spec.Partitions.State.MountPoint, r.spec.Active.MountPoint, r.spec.GrubDefEntry)
+	if err != nil {
+		r.Error("failed setting default entry")
+		return err
+	}
+	err = e.UnmountImage(&r.spec.Active)
+	if err != nil {
+		r.Error("failed unmounting new active image")
+		return err
+	}
+
+	// Any boot assessment in progress refers to the former active image
+	grub := utils.NewGrub(&r.config.Config)
+	err = grub.SetBootAssessment(r.spec.Partitions.State.MountPoint, r.spec.Partitions.State.FilesystemLabel, 0)
+	if err != nil {
+		r.Error("failed clearing boot assessment")
+		return err
+	}
+	err = setBootAssessCheck(&r.config.Config, r.spec.Partitions.OEM, false)
+	if err != nil {
+		r.config.Logger.Warnf("failed removing boot assessment check: %v", err)
+	}
+
+	// The installation state is only updated once the rollback is fully applied
+	err = r.swapInstallStateYaml()
+	if err != nil {
+		r.Error("failed updating installation metadata")
+		return err
+	}
+	swapped = false
+
+	err = Hook(&r.config.Config, constants.AfterRollbackHook, r.config.Strict, r.config.CloudInitPaths...)
+	if err != nil {
+		r.Error("Error running hook after-rollback: %s", err)
+		return err
+	}
+
+	r.Info("Rollback completed")
+
+	// Do not reboot/poweroff on cleanup errors
+	err = cleanup.Cleanup(err)
+	if err != nil {
+		return err
+	}
+	if r.config.Reboot {
+		r.Info("Rebooting in 5 seconds")
+		return utils.Reboot(r.config.Runner, 5)
+	} else if r.config.PowerOff {
+		r.Info("Shutting down in 5 seconds")
+		return utils.Shutdown(r.config.Runner, 5)
+	}
+	return err
+}
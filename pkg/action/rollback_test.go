@@ -0,0 +1,243 @@
+/*
+   Copyright © 2022 SUSE LLC
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/action"
+	conf "github.com/rancher/elemental-cli/pkg/config"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Rollback action tests", func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var logger v1.Logger
+	var mounter *v1mock.ErrorMounter
+	var cloudInit *v1mock.FakeCloudInitRunner
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest v1mock.GhwMock
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		mounter = v1mock.NewErrorMounter()
+		memLog = &bytes.Buffer{}
+		logger = v1.NewBufferLogger(memLog)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		cloudInit = &v1mock.FakeCloudInitRunner{}
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+			conf.WithCloudInitRunner(cloudInit),
+		)
+	})
+
+	AfterEach(func() { cleanup() })
+
+	Describe("Rollback Action", Label("rollback"), func() {
+		var spec *v1.RollbackSpec
+		var rollback *action.RollbackAction
+		var cmdFail string
+		var activeImg, passiveImg string
+		var err error
+
+		BeforeEach(func() {
+			ghwTest = mockElementalDisk(fs)
+
+			spec, err = conf.NewRollbackSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			activeImg = spec.Active.File
+			passiveImg = spec.Passive.File
+			Expect(fs.WriteFile(activeImg, []byte("active"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(passiveImg, []byte("passive"), constants.FilePerm)).To(Succeed())
+
+			cmdFail = ""
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == cmdFail {
+					return []byte{}, errors.New("command failed")
+				}
+				if cmd == "mv" && len(args) == 3 {
+					return moveFile(fs, args[1], args[2])
+				}
+				return []byte{}, nil
+			}
+			rollback = action.NewRollbackAction(config, spec)
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Successfully swaps active and passive images", func() {
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.StatePartName: {
+						FSLabel: constants.StateLabel,
+						Images: map[string]*v1.ImageState{
+							constants.ActiveImgName: {
+								Label:  constants.ActiveLabel,
+								Source: v1.NewDockerSrc("registry.org/image:new"),
+							},
+							constants.PassiveImgName: {
+								Label:  constants.PassiveLabel,
+								Source: v1.NewDockerSrc("registry.org/image:old"),
+							},
+						},
+					},
+				},
+			}
+			Expect(rollback.Run()).To(Succeed())
+
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("passive"))
+			data, err = fs.ReadFile(passiveImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+
+			Expect(runner.IncludesCmds([][]string{
+				{"tune2fs", "-L", constants.PassiveLabel},
+				{"tune2fs", "-L", constants.ActiveLabel, activeImg},
+			})).To(Succeed())
+
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			images := state.Partitions[constants.StatePartName].Images
+			Expect(images[constants.ActiveImgName].Source.Value()).To(Equal("registry.org/image:old"))
+			Expect(images[constants.ActiveImgName].Label).To(Equal(constants.ActiveLabel))
+			Expect(images[constants.PassiveImgName].Source.Value()).To(Equal("registry.org/image:new"))
+			Expect(images[constants.PassiveImgName].Label).To(Equal(constants.PassiveLabel))
+			Expect(fs.Stat(filepath.Join(constants.LiveDir, constants.InstallStateFile))).ToNot(BeNil())
+		})
+		It("Successfully swaps images without a previous install state", func() {
+			spec.State = nil
+			Expect(rollback.Run()).To(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("passive"))
+		})
+		It("Fails if there is no passive image", func() {
+			Expect(fs.RemoveAll(passiveImg)).To(Succeed())
+			Expect(rollback.Run()).NotTo(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+		})
+		It("Fails if there is a pending upgrade transaction", func() {
+			journal := filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile)
+			Expect(fs.WriteFile(journal, []byte("phase: prepared"), constants.FilePerm)).To(Succeed())
+			Expect(rollback.Run()).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+		})
+		It("Keeps a staged upgrade in place", func() {
+			journal := filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile)
+			Expect(fs.WriteFile(journal, []byte("phase: staged"), constants.FilePerm)).To(Succeed())
+			Expect(rollback.Run()).To(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("passive"))
+			_, err = fs.Stat(journal)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Fails if some hook fails and strict is set", func() {
+			config.Strict = true
+			cloudInit.Error = true
+			Expect(rollback.Run()).NotTo(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+		})
+		It("Restores the original images if labeling fails", func() {
+			cmdFail = "tune2fs"
+			Expect(rollback.Run()).NotTo(Succeed())
+			_, err := fs.Stat(filepath.Join(filepath.Dir(activeImg), constants.RollbackImgFile))
+			Expect(err).Should(HaveOccurred())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+		})
+		It("Restores the original images if setting the default grub entry fails", func() {
+			cmdFail = "grub2-editenv"
+			Expect(rollback.Run()).NotTo(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+			data, err = fs.ReadFile(passiveImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("passive"))
+			_, err = fs.Stat(filepath.Join(constants.RunningStateDir, constants.InstallStateFile))
+			Expect(err).Should(HaveOccurred())
+		})
+		It("Restores the original images if setting the passive image fails", func() {
+			tmpFile := filepath.Join(filepath.Dir(activeImg), constants.RollbackImgFile)
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "mv" && len(args) == 3 && args[1] == tmpFile && args[2] == passiveImg {
+					return []byte{}, errors.New("command failed")
+				}
+				return sideEffect(cmd, args...)
+			}
+			Expect(rollback.Run()).NotTo(Succeed())
+			data, err := fs.ReadFile(activeImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("active"))
+			data, err = fs.ReadFile(passiveImg)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("passive"))
+		})
+		It("Does not write missing image entries into the install state", func() {
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.StatePartName: {
+						FSLabel: constants.StateLabel,
+						Images: map[string]*v1.ImageState{
+							constants.ActiveImgName: {
+								Label:  constants.ActiveLabel,
+								Source: v1.NewDockerSrc("registry.org/image:new"),
+							},
+						},
+					},
+				},
+			}
+			Expect(rollback.Run()).To(Succeed())
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			images := state.Partitions[constants.StatePartName].Images
+			Expect(images).NotTo(HaveKey(constants.ActiveImgName))
+			Expect(images[constants.PassiveImgName].Source.Value()).To(Equal("registry.org/image:new"))
+		})
+		It("Fails mounting the new active image", func() {
+			cmdFail = "losetup"
+			Expect(rollback.Run()).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,338 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/elemental"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+// Snapshots are the system images retained in the state partition besides the active image.
+// They are handled as numbered slots, being slot 0 the passive image and the higher the slot
+// number the older the image.
+
+// snapshotName returns the image name of the given slot as stored in the installation state
+func snapshotName(slot int) string {
+	if slot == 0 {
+		return constants.PassiveImgName
+	}
+	return fmt.Sprintf(constants.SnapshotImgName, slot)
+}
+
+// snapshotFile returns the image file of the given slot, passive is the image file of slot 0
+func snapshotFile(passive string, slot int) string {
+	if slot == 0 {
+		return passive
+	}
+	return filepath.Join(filepath.Dir(passive), fmt.Sprintf(constants.SnapshotImgFile, slot))
+}
+
+// snapshotLabel returns the filesystem label of the given slot, passiveLabel is the label of slot 0
+func snapshotLabel(passiveLabel string, slot int) string {
+	if slot == 0 {
+		return passiveLabel
+	}
+	return fmt.Sprintf(constants.SnapshotLabel, slot)
+}
+
+// snapshotEntryID returns the grub menu entry id booting the given snapshot
+func snapshotEntryID(name string) string {
+	if name == constants.PassiveImgName {
+		return constants.GrubFallbackEntryID
+	}
+	return name
+}
+
+// snapshotSlots returns the sorted list of numbered snapshot slots found next to the given passive image file
+func snapshotSlots(fs v1.FS, passive string) []int {
+	slots := []int{}
+	files, err := fs.ReadDir(filepath.Dir(passive))
+	if err != nil {
+		return slots
+	}
+	for _, f := range files {
+		var slot int
+		if n, _ := fmt.Sscanf(f.Name(), constants.SnapshotImgFile, &slot); n == 1 && slot > 0 && !f.IsDir() &&
+			f.Name() == fmt.Sprintf(constants.SnapshotImgFile, slot) {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// snapshotStateSlots returns the sorted list of numbered snapshot slots found in the given partition state
+func snapshotStateSlots(part *v1.PartitionState) []int {
+	slots := []int{}
+	if part == nil {
+		return slots
+	}
+	for name := range part.Images {
+		var slot int
+		if n, _ := fmt.Sscanf(name, constants.SnapshotImgName, &slot); n == 1 && slot > 0 &&
+			name == fmt.Sprintf(constants.SnapshotImgName, slot) {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// setSnapshotsMenu updates the grub menu entries of the numbered snapshots found next to the given passive image file
+func setSnapshotsMenu(config *v1.Config, statePart *v1.Partition, passive string) error {
+	grub := utils.NewGrub(config)
+	return grub.SetSnapshotsMenu(statePart.MountPoint, statePart.FilesystemLabel, snapshotSlots(config.Fs, passive)...)
+}
+
+// SnapshotsAction represents the struct that will manage the system snapshots
+type SnapshotsAction struct {
+	config *v1.RunConfig
+	spec   *v1.SnapshotsSpec
+}
+
+func NewSnapshotsAction(config *v1.RunConfig, spec *v1.SnapshotsSpec) *SnapshotsAction {
+	return &SnapshotsAction{config: config, spec: spec}
+}
+
+func (s SnapshotsAction) Info(msg string, args ...interface{}) {
+	s.config.Logger.Infof(msg, args...)
+}
+
+func (s SnapshotsAction) Error(msg string, args ...interface{}) {
+	s.config.Logger.Errorf(msg, args...)
+}
+
+// imagesDir returns the directory of the system images within the state partition
+func (s *SnapshotsAction) imagesDir() string {
+	return filepath.Join(s.spec.Partitions.State.MountPoint, "cOS")
+}
+
+// passiveFile returns the passive image file, which is the reference to locate all other snapshots
+func (s *SnapshotsAction) passiveFile() string {
+	return filepath.Join(s.imagesDir(), constants.PassiveImgFile)
+}
+
+// grubEnvFile returns the grub environment file of the state partition
+func (s *SnapshotsAction) grubEnvFile() string {
+	return filepath.Join(s.spec.Partitions.State.MountPoint, constants.GrubOEMEnv)
+}
+
+// savedEntry returns the grub menu entry id set as default, empty means the active image is the default
+func (s *SnapshotsAction) savedEntry() (string, error) {
+	if exists, _ := utils.Exists(s.config.Fs, s.grubEnvFile()); !exists {
+		return "", nil
+	}
+	grub := utils.NewGrub(&s.config.Config)
+	vars, err := grub.ReadPersistentVariables(s.grubEnvFile())
+	if err != nil {
+		return "", err
+	}
+	return vars[constants.GrubSavedEntryVar], nil
+}
+
+// statePartition returns the state partition data of the installation state, nil if there is none
+func (s *SnapshotsAction) statePartition() *v1.PartitionState {
+	if s.spec.State == nil {
+		return nil
+	}
+	return s.spec.State.Partitions[constants.StatePartName]
+}
+
+// snapshots returns the snapshots found in the state partition, starting with the active image
+func (s *SnapshotsAction) snapshots() ([]*v1.Snapshot, error) {
+	list := []*v1.Snapshot{}
+	statePart := s.statePartition()
+
+	defEntry, err := s.savedEntry()
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(name, file, label string) {
+		if exists, _ := utils.Exists(s.config.Fs, file); !exists {
+			return
+		}
+		snap := &v1.Snapshot{Name: name, File: file, Label: label}
+		if statePart != nil && statePart.Images[name] != nil {
+			snap.Source = statePart.Images[name].Source
+		}
+		if name == constants.ActiveImgName {
+			snap.Default = defEntry == ""
+		} else {
+			snap.Default = defEntry == snapshotEntryID(name)
+		}
+		list = append(list, snap)
+	}
+
+	add(constants.ActiveImgName, filepath.Join(s.imagesDir(), constants.ActiveImgFile), constants.ActiveLabel)
+	add(snapshotName(0), s.passiveFile(), snapshotLabel(constants.PassiveLabel, 0))
+	for _, slot := range snapshotSlots(s.config.Fs, s.passiveFile()) {
+		add(snapshotName(slot), snapshotFile(s.passiveFile(), slot), snapshotLabel(constants.PassiveLabel, slot))
+	}
+	return list, nil
+}
+
+// findSnapshot returns the snapshot matching the given name, fails if not found
+func (s *SnapshotsAction) findSnapshot(name string) (*v1.Snapshot, error) {
+	list, err := s.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range list {
+		if snap.Name == name {
+			return snap, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot '%s' not found", name)
+}
+
+// mountState mounts the state partition, or remounts it, with the given mount option
+func (s *SnapshotsAction) mountState(e *elemental.Elemental, rw bool) (umount func() error, err error) {
+	if rw {
+		return e.MountRWPartition(s.spec.Partitions.State)
+	}
+	if mnt, _ := utils.IsMounted(&s.config.Config, s.spec.Partitions.State); mnt {
+		return func() error { return nil }, nil
+	}
+	err = e.MountPartition(s.spec.Partitions.State, "ro")
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return e.UnmountPartition(s.spec.Partitions.State) }, nil
+}
+
+// List returns the system images stored in the state partition, including the active image
+func (s *SnapshotsAction) List() (list []*v1.Snapshot, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&s.config.Config)
+
+	umount, err := s.mountState(e, false)
+	if err != nil {
+		return nil, err
+	}
+	cleanup.Push(umount)
+
+	return s.snapshots()
+}
+
+// Delete removes the given snapshot image, its grub menu entry and its installation state data.
+// Neither the active image nor the currently booted image can be deleted.
+func (s *SnapshotsAction) Delete(name string) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	if name == constants.ActiveImgName {
+		return fmt.Errorf("the active image can't be deleted")
+	}
+
+	e := elemental.NewElemental(&s.config.Config)
+
+	umount, err := s.mountState(e, true)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	umount, err = e.MountRWPartition(s.spec.Partitions.Recovery)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+
+	snap, err := s.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	if utils.BootedFrom(s.config.Runner, snap.Label) {
+		return fmt.Errorf("snapshot '%s' is currently booted, it can't be deleted", name)
+	}
+
+	if snap.Default {
+		s.Info("Snapshot '%s' was the default boot entry, setting the active image as default", name)
+		grub := utils.NewGrub(&s.config.Config)
+		err = grub.UnsetPersistentVariables(s.grubEnvFile(), constants.GrubSavedEntryVar)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Info("Deleting snapshot '%s'", name)
+	err = s.config.Fs.Remove(snap.File)
+	if err != nil {
+		s.Error("Failed removing %s: %v", snap.File, err)
+		return err
+	}
+
+	err = setSnapshotsMenu(&s.config.Config, s.spec.Partitions.State, s.passiveFile())
+	if err != nil {
+		return err
+	}
+
+	if statePart := s.statePartition(); statePart != nil && statePart.Images[name] != nil {
+		delete(statePart.Images, name)
+		s.spec.State.Date = time.Now().Format(time.RFC3339)
+		err = s.config.WriteInstallState(
+			s.spec.State,
+			filepath.Join(s.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+			filepath.Join(s.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+		)
+		if err != nil {
+			s.Error("failed updating installation metadata")
+			return err
+		}
+	}
+	return nil
+}
+
+// SetDefault sets the grub menu entry of the given snapshot as the default boot entry
+func (s *SnapshotsAction) SetDefault(name string) (err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	e := elemental.NewElemental(&s.config.Config)
+
+	umount, err := s.mountState(e, true)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+
+	_, err = s.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	grub := utils.NewGrub(&s.config.Config)
+	s.Info("Setting snapshot '%s' as the default boot entry", name)
+	if name == constants.ActiveImgName {
+		if exists, _ := utils.Exists(s.config.Fs, s.grubEnvFile()); !exists {
+			return nil
+		}
+		return grub.UnsetPersistentVariables(s.grubEnvFile(), constants.GrubSavedEntryVar)
+	}
+	return grub.SetPersistentVariables(s.grubEnvFile(), map[string]string{
+		constants.GrubSavedEntryVar: snapshotEntryID(name),
+	})
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/action"
+	conf "github.com/rancher/elemental-cli/pkg/config"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Snapshots action tests", func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var logger v1.Logger
+	var mounter *v1mock.ErrorMounter
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest v1mock.GhwMock
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		mounter = v1mock.NewErrorMounter()
+		memLog = &bytes.Buffer{}
+		logger = v1.NewBufferLogger(memLog)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithMounter(mounter),
+		)
+	})
+
+	AfterEach(func() { cleanup() })
+
+	Describe("Snapshots management", Label("snapshots"), func() {
+		var spec *v1.SnapshotsSpec
+		var snapshots *action.SnapshotsAction
+		var grubEnv, grubEnvVars, cmdline, imgsDir string
+		var err error
+
+		BeforeEach(func() {
+			ghwTest = mockElementalDisk(fs)
+
+			imgsDir = filepath.Join(constants.RunningStateDir, "cOS")
+			for _, img := range []string{constants.ActiveImgFile, constants.PassiveImgFile, "snapshot-1.img", "snapshot-2.img"} {
+				Expect(fs.WriteFile(filepath.Join(imgsDir, img), []byte(img), constants.FilePerm)).To(Succeed())
+			}
+			grubEnv = filepath.Join(constants.RunningStateDir, constants.GrubOEMEnv)
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+
+			spec, err = conf.NewSnapshotsSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.State = &v1.InstallState{
+				Partitions: map[string]*v1.PartitionState{
+					constants.StatePartName: {
+						FSLabel: "COS_STATE",
+						Images: map[string]*v1.ImageState{
+							constants.ActiveImgName:  {Source: v1.NewDockerSrc("registry.org/os:v3")},
+							constants.PassiveImgName: {Source: v1.NewDockerSrc("registry.org/os:v2")},
+							"snapshot-1":             {Source: v1.NewDockerSrc("registry.org/os:v1")},
+							"snapshot-2":             {Source: v1.NewDockerSrc("registry.org/os:v0")},
+						},
+					},
+				},
+			}
+
+			grubEnvVars = ""
+			cmdline = constants.ActiveLabel
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "grub2-editenv" && args[1] == "list" {
+					return []byte(grubEnvVars), nil
+				}
+				if cmd == "cat" && args[0] == "/proc/cmdline" {
+					return []byte(cmdline), nil
+				}
+				return []byte{}, nil
+			}
+			snapshots = action.NewSnapshotsAction(config, spec)
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Lists all system images", func() {
+			list, err := snapshots.List()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(len(list)).To(Equal(4))
+			Expect(list[0].Name).To(Equal(constants.ActiveImgName))
+			Expect(list[0].Default).To(BeTrue())
+			Expect(list[1].Name).To(Equal(constants.PassiveImgName))
+			Expect(list[1].Label).To(Equal(constants.PassiveLabel))
+			Expect(list[3].Name).To(Equal("snapshot-2"))
+			Expect(list[3].Label).To(Equal("COS_SNAPSHOT_2"))
+			Expect(list[3].Source.String()).To(Equal("oci://registry.org/os:v0"))
+			Expect(list[3].Default).To(BeFalse())
+		})
+		It("Lists the default snapshot", func() {
+			grubEnvVars = "saved_entry=fallback\n"
+			list, err := snapshots.List()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(list[0].Default).To(BeFalse())
+			Expect(list[1].Default).To(BeTrue())
+		})
+		It("Deletes a snapshot", func() {
+			Expect(snapshots.Delete("snapshot-1")).To(Succeed())
+			Expect(utils.Exists(fs, filepath.Join(imgsDir, "snapshot-1.img"))).To(BeFalse())
+
+			menu, err := fs.ReadFile(filepath.Join(constants.RunningStateDir, constants.GrubSnapshots))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(menu)).To(ContainSubstring("--id snapshot-2"))
+			Expect(string(menu)).NotTo(ContainSubstring("--id snapshot-1"))
+
+			state, err := config.LoadInstallState()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(state.Partitions[constants.StatePartName].Images["snapshot-1"]).To(BeNil())
+			Expect(state.Partitions[constants.StatePartName].Images["snapshot-2"]).NotTo(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "unset"}})).NotTo(Succeed())
+		})
+		It("Deletes the default snapshot and sets the active image as default", func() {
+			grubEnvVars = "saved_entry=snapshot-2\n"
+			Expect(snapshots.Delete("snapshot-2")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", grubEnv, "unset", constants.GrubSavedEntryVar},
+			})).To(Succeed())
+		})
+		It("Fails to delete the active image", func() {
+			Expect(snapshots.Delete(constants.ActiveImgName)).NotTo(Succeed())
+		})
+		It("Fails to delete the booted snapshot", func() {
+			cmdline = "root=LABEL=COS_SNAPSHOT_1"
+			Expect(snapshots.Delete("snapshot-1")).NotTo(Succeed())
+			Expect(utils.Exists(fs, filepath.Join(imgsDir, "snapshot-1.img"))).To(BeTrue())
+		})
+		It("Fails to delete an unknown snapshot", func() {
+			Expect(snapshots.Delete("snapshot-3")).NotTo(Succeed())
+		})
+		It("Sets a snapshot as the default boot entry", func() {
+			Expect(snapshots.SetDefault("snapshot-1")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", grubEnv, "set", "saved_entry=snapshot-1"},
+			})).To(Succeed())
+		})
+		It("Sets the passive image as the default boot entry", func() {
+			Expect(snapshots.SetDefault(constants.PassiveImgName)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", grubEnv, "set", "saved_entry=fallback"},
+			})).To(Succeed())
+		})
+		It("Sets the active image as the default boot entry", func() {
+			Expect(snapshots.SetDefault(constants.ActiveImgName)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"grub2-editenv", grubEnv, "unset", constants.GrubSavedEntryVar},
+			})).To(Succeed())
+		})
+		It("Fails to set an unknown snapshot as the default boot entry", func() {
+			Expect(snapshots.SetDefault("snapshot-3")).NotTo(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", grubEnv, "set"}})).NotTo(Succeed())
+		})
+	})
+})
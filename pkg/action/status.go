@@ -0,0 +1,205 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+)
+
+// StatusAction represents the struct that will report the deployed system state.
+// It is a read-only action, nothing is mounted nor modified.
+type StatusAction struct {
+	config *v1.RunConfig
+	spec   *v1.StatusSpec
+}
+
+func NewStatusAction(config *v1.RunConfig, spec *v1.StatusSpec) *StatusAction {
+	return &StatusAction{config: config, spec: spec}
+}
+
+// bootedFrom returns the image the system is currently booted from, empty if unknown
+func (s *StatusAction) bootedFrom() string {
+	switch {
+	case utils.BootedFrom(s.config.Runner, constants.ActiveLabel):
+		return constants.ActiveImgName
+	case utils.BootedFrom(s.config.Runner, constants.PassiveLabel):
+		return constants.PassiveImgName
+	case utils.BootedFrom(s.config.Runner, constants.RecoverySquashFile),
+		utils.BootedFrom(s.config.Runner, constants.SystemLabel):
+		return constants.RecoveryImgName
+	}
+	return ""
+}
+
+// defaultEntry returns the grub menu entry id set as default. It can only be read if the
+// state partition is mounted, an unset saved entry means the active image is the default.
+func (s *StatusAction) defaultEntry() string {
+	state := v1.NewElementalPartitionsFromList(s.spec.Partitions).State
+	if state == nil || state.MountPoint == "" {
+		s.config.Logger.Warnf("state partition not mounted, can't read the default boot entry")
+		return ""
+	}
+	grubEnvFile := filepath.Join(state.MountPoint, constants.GrubOEMEnv)
+	if exists, _ := utils.Exists(s.config.Fs, grubEnvFile); !exists {
+		return constants.ActiveImgName
+	}
+	vars, err := utils.NewGrub(&s.config.Config).ReadPersistentVariables(grubEnvFile)
+	if err != nil {
+		s.config.Logger.Warnf("failed reading grub environment %s: %v", grubEnvFile, err)
+		return ""
+	}
+	if entry := vars[constants.GrubSavedEntryVar]; entry != "" {
+		return entry
+	}
+	return constants.ActiveImgName
+}
+
+// freeSpace returns the available space in MiB of the given mount point
+func (s *StatusAction) freeSpace(mountPoint string) (uint, error) {
+	rawPath, err := s.config.Fs.RawPath(mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	stat := &syscall.Statfs_t{}
+	err = s.config.Syscall.Statfs(rawPath, stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint(stat.Bavail * uint64(stat.Bsize) / (1024 * 1024)), nil
+}
+
+// partitions returns the status of all host partitions
+func (s *StatusAction) partitions() []*v1.PartitionStatus {
+	list := []*v1.PartitionStatus{}
+	for _, part := range s.spec.Partitions {
+		p := &v1.PartitionStatus{
+			Name:       part.Name,
+			Label:      part.FilesystemLabel,
+			Device:     part.Path,
+			FS:         part.FS,
+			MountPoint: part.MountPoint,
+			Size:       part.Size,
+		}
+		if part.MountPoint != "" {
+			free, err := s.freeSpace(part.MountPoint)
+			if err != nil {
+				s.config.Logger.Warnf("failed checking available space in %s: %v", part.MountPoint, err)
+			}
+			p.Free = free
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+// images returns the status of the deployed images according to the installation state
+func (s *StatusAction) images() []*v1.ImageStatus {
+	list := []*v1.ImageStatus{}
+	if s.spec.State == nil {
+		return list
+	}
+
+	partNames := []string{}
+	for name := range s.spec.State.Partitions {
+		partNames = append(partNames, name)
+	}
+	sort.Strings(partNames)
+
+	for _, partName := range partNames {
+		part := s.spec.State.Partitions[partName]
+		if part == nil {
+			continue
+		}
+		imgNames := []string{}
+		for name := range part.Images {
+			imgNames = append(imgNames, name)
+		}
+		sort.Strings(imgNames)
+
+		for _, imgName := range imgNames {
+			if img := part.Images[imgName]; img != nil {
+				list = append(list, imageStatus(partName, imgName, img))
+			}
+		}
+	}
+	return list
+}
+
+// imageStatus returns the status of the given image state
+func imageStatus(partName, imgName string, img *v1.ImageState) *v1.ImageStatus {
+	i := &v1.ImageStatus{Name: imgName, Partition: partName, Label: img.Label}
+	if img.Source != nil {
+		i.Source = img.Source.String()
+	}
+	switch meta := img.SourceMetadata.(type) {
+	case *v1.DockerImageMeta:
+		i.Digest = meta.Digest
+	case *v1.ChannelImageMeta:
+		i.Version = meta.Version
+	case *v1.IsoImageMeta:
+		i.Digest = meta.Checksum
+	case *v1.HTTPImageMeta:
+		i.Digest = meta.Checksum
+	}
+	return i
+}
+
+// staged returns the status of the upgrade staged in the state partition, nil if there is none
+func (s *StatusAction) staged() *v1.StagedStatus {
+	state := v1.NewElementalPartitionsFromList(s.spec.Partitions).State
+	if state == nil || state.MountPoint == "" {
+		return nil
+	}
+	j, err := LoadUpgradeJournal(s.config.Fs, filepath.Join(state.MountPoint, constants.UpgradeJournalFile))
+	if err != nil {
+		s.config.Logger.Warnf("failed reading upgrade journal: %v", err)
+		return nil
+	}
+	if j == nil || j.Phase != constants.UpgradeStaged {
+		return nil
+	}
+
+	staged := &v1.StagedStatus{Date: j.Date, Images: []*v1.ImageStatus{}}
+	if img := j.Images[constants.ActiveImgName]; img != nil {
+		staged.Images = append(staged.Images, imageStatus(constants.StatePartName, constants.ActiveImgName, img))
+	}
+	if img := j.Images[constants.RecoveryImgName]; img != nil {
+		staged.Images = append(staged.Images, imageStatus(constants.RecoveryPartName, constants.RecoveryImgName, img))
+	}
+	return staged
+}
+
+// Status returns the current state of the deployed system
+func (s *StatusAction) Status() (*v1.SystemStatus, error) {
+	status := &v1.SystemStatus{
+		BootedFrom:   s.bootedFrom(),
+		DefaultEntry: s.defaultEntry(),
+		Images:       s.images(),
+		Partitions:   s.partitions(),
+		Staged:       s.staged(),
+	}
+	if s.spec.State != nil {
+		status.Date = s.spec.State.Date
+	}
+	return status, nil
+}
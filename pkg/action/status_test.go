@@ -0,0 +1,196 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action_test
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rancher/elemental-cli/pkg/action"
+	conf "github.com/rancher/elemental-cli/pkg/config"
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+)
+
+var _ = Describe("Status action tests", func() {
+	var config *v1.RunConfig
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var logger v1.Logger
+	var syscall *v1mock.FakeSyscall
+	var cleanup func()
+	var memLog *bytes.Buffer
+	var ghwTest v1mock.GhwMock
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		syscall = &v1mock.FakeSyscall{}
+		memLog = &bytes.Buffer{}
+		logger = v1.NewBufferLogger(memLog)
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+
+		config = conf.NewRunConfig(
+			conf.WithFs(fs),
+			conf.WithRunner(runner),
+			conf.WithLogger(logger),
+			conf.WithSyscall(syscall),
+			conf.WithMounter(v1mock.NewErrorMounter()),
+		)
+	})
+
+	AfterEach(func() { cleanup() })
+
+	Describe("System status", Label("status"), func() {
+		var spec *v1.StatusSpec
+		var status *action.StatusAction
+		var grubEnvVars, cmdline string
+		var err error
+
+		BeforeEach(func() {
+			ghwTest = mockElementalDisk(fs, &block.Partition{
+				Name:            "device4",
+				FilesystemLabel: "COS_OEM",
+				Type:            "ext4",
+			})
+
+			grubEnv := filepath.Join(constants.RunningStateDir, constants.GrubOEMEnv)
+			Expect(fs.WriteFile(grubEnv, []byte{}, constants.FilePerm)).To(Succeed())
+
+			spec, err = conf.NewStatusSpec(config.Config)
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.State = &v1.InstallState{
+				Date: "2022-08-01T10:00:00Z",
+				Partitions: map[string]*v1.PartitionState{
+					constants.StatePartName: {
+						FSLabel: "COS_STATE",
+						Images: map[string]*v1.ImageState{
+							constants.ActiveImgName: {
+								Source:         v1.NewDockerSrc("registry.org/os:v2"),
+								SourceMetadata: &v1.DockerImageMeta{Digest: "sha256:aaaa"},
+								Label:          constants.ActiveLabel,
+							},
+							constants.PassiveImgName: {
+								Source:         v1.NewChannelSrc("system/cos"),
+								SourceMetadata: &v1.ChannelImageMeta{Name: "cos", Category: "system", Version: "0.8.14"},
+								Label:          constants.PassiveLabel,
+							},
+						},
+					},
+				},
+			}
+
+			grubEnvVars = ""
+			cmdline = constants.PassiveLabel
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "grub2-editenv" && args[1] == "list" {
+					return []byte(grubEnvVars), nil
+				}
+				if cmd == "cat" && args[0] == "/proc/cmdline" {
+					return []byte(cmdline), nil
+				}
+				return []byte{}, nil
+			}
+			status = action.NewStatusAction(config, spec)
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Reports the deployed system state", func() {
+			syscall.FreeSpace = 512 * 1024 * 1024
+			st, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(st.BootedFrom).To(Equal(constants.PassiveImgName))
+			Expect(st.DefaultEntry).To(Equal(constants.ActiveImgName))
+			Expect(st.Date).To(Equal("2022-08-01T10:00:00Z"))
+
+			Expect(len(st.Images)).To(Equal(2))
+			Expect(st.Images[0].Name).To(Equal(constants.ActiveImgName))
+			Expect(st.Images[0].Partition).To(Equal(constants.StatePartName))
+			Expect(st.Images[0].Source).To(Equal("oci://registry.org/os:v2"))
+			Expect(st.Images[0].Digest).To(Equal("sha256:aaaa"))
+			Expect(st.Images[1].Name).To(Equal(constants.PassiveImgName))
+			Expect(st.Images[1].Version).To(Equal("0.8.14"))
+
+			Expect(len(st.Partitions)).To(Equal(3))
+			Expect(st.Partitions[0].MountPoint).To(Equal(constants.RunningStateDir))
+			Expect(st.Partitions[0].Free).To(Equal(uint(512)))
+			Expect(st.Partitions[2].Label).To(Equal("COS_OEM"))
+			Expect(st.Partitions[2].Device).To(Equal("/dev/device4"))
+			Expect(st.Partitions[2].Free).To(Equal(uint(0)))
+		})
+		It("Reports the saved grub entry as the default one", func() {
+			grubEnvVars = "saved_entry=fallback"
+			cmdline = constants.RecoverySquashFile
+			st, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(st.DefaultEntry).To(Equal(constants.GrubFallbackEntryID))
+			Expect(st.BootedFrom).To(Equal(constants.RecoveryImgName))
+		})
+		It("Reports the partitions even without installation state", func() {
+			spec.State = nil
+			cmdline = ""
+			st, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(st.BootedFrom).To(BeEmpty())
+			Expect(st.Date).To(BeEmpty())
+			Expect(len(st.Images)).To(Equal(0))
+			Expect(len(st.Partitions)).To(Equal(3))
+		})
+		It("Reports the staged upgrade", Label("stage"), func() {
+			Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+				Phase:      constants.UpgradeStaged,
+				Date:       "2022-08-02T10:00:00Z",
+				Transition: filepath.Join("cOS", constants.TransitionImgFile),
+				Target:     filepath.Join("cOS", constants.ActiveImgFile),
+				Images: map[string]*v1.ImageState{
+					constants.ActiveImgName: {
+						Source:         v1.NewDockerSrc("registry.org/os:v3"),
+						SourceMetadata: &v1.DockerImageMeta{Digest: "sha256:bbbb"},
+					},
+				},
+			}, filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile))).To(Succeed())
+			st, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(st.Staged).NotTo(BeNil())
+			Expect(st.Staged.Date).To(Equal("2022-08-02T10:00:00Z"))
+			Expect(len(st.Staged.Images)).To(Equal(1))
+			Expect(st.Staged.Images[0].Source).To(Equal("oci://registry.org/os:v3"))
+			Expect(st.Staged.Images[0].Digest).To(Equal("sha256:bbbb"))
+		})
+		It("Does not report upgrade transactions in progress as staged", Label("stage"), func() {
+			Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+				Phase: constants.UpgradePrepared,
+			}, filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile))).To(Succeed())
+			st, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(st.Staged).To(BeNil())
+		})
+		It("Does not mount nor modify anything", func() {
+			_, err := status.Status()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{{"grub2-editenv", filepath.Join(constants.RunningStateDir, constants.GrubOEMEnv), "set"}})).NotTo(Succeed())
+		})
+	})
+})
@@ -0,0 +1,590 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/elemental"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadUpgradeJournal loads the upgrade journal from the given path, returns nil if there is no journal
+func LoadUpgradeJournal(fs v1.FS, path string) (*v1.UpgradeJournal, error) {
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	journal := &v1.UpgradeJournal{}
+	err = yaml.Unmarshal(data, journal)
+	if err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// journalPath returns the path of the upgrade transaction journal, it is always kept in the state partition
+func (u *UpgradeAction) journalPath() string {
+	return filepath.Join(u.spec.Partitions.State.MountPoint, constants.UpgradeJournalFile)
+}
+
+// imagesRoot returns the mountpoint of the partition holding the images swapped by the transaction
+func (u *UpgradeAction) imagesRoot(j *v1.UpgradeJournal) string {
+	if j.RecoveryUpgrade {
+		return u.spec.Partitions.Recovery.MountPoint
+	}
+	return u.spec.Partitions.State.MountPoint
+}
+
+// setPhase stores the journal with the given phase
+func (u *UpgradeAction) setPhase(j *v1.UpgradeJournal, phase string) error {
+	u.Debug("Upgrade transaction phase: %s", phase)
+	j.Phase = phase
+	j.Date = time.Now().Format(time.RFC3339)
+	return u.config.WriteUpgradeJournal(j, u.journalPath())
+}
+
+// newTransaction starts an upgrade transaction to replace the target images with the given
+// transition images, the system image goes first if both are upgraded. The upgraded installation
+// state is kept within the journal. Transactions recorded in staged phase are only committed on demand,
+// they keep the deployed images data instead, as the installation state may change until then.
+func (u *UpgradeAction) newTransaction(images []*upgradeImage, phase string) (*v1.UpgradeJournal, error) {
+	var err error
+
+	j := &v1.UpgradeJournal{
+		RecoveryUpgrade: images[0].recovery,
+	}
+	for _, i := range images {
+		if phase == constants.UpgradeStaged {
+			if j.Images == nil {
+				j.Images = map[string]*v1.ImageState{}
+			}
+			name := constants.ActiveImgName
+			if i.recovery {
+				name = constants.RecoveryImgName
+			}
+			j.Images[name] = i.state()
+			continue
+		}
+		err = u.upgradeInstallState(i.state(), i.recovery, i.final)
+		if err != nil {
+			u.Error("failed upgrading installation metadata")
+			return nil, err
+		}
+		j.State = u.spec.State
+	}
+	j.Transition, j.Target, err = relativeSwap(u.imagesRoot(j), images[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(images) > 1 {
+		j.RecoveryTransition, j.RecoveryTarget, err = relativeSwap(u.spec.Partitions.Recovery.MountPoint, images[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, i := range images {
+		if i.recovery {
+			j.RecoveryBackup, err = filepath.Rel(u.spec.Partitions.Recovery.MountPoint, recoveryBackupFile(i.final))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !j.RecoveryUpgrade {
+		j.Passive, err = filepath.Rel(u.imagesRoot(j), u.spec.Passive.File)
+		if err != nil {
+			return nil, err
+		}
+		j.Snapshots = u.spec.Snapshots
+	}
+
+	// Make sure the transition images are fully written before recording the transaction
+	_, _ = u.config.Runner.Run("sync")
+	return j, u.setPhase(j, phase)
+}
+
+// stagedInstallState computes the upgraded installation state of the given staged transaction
+// from the installation state in place
+func (u *UpgradeAction) stagedInstallState(j *v1.UpgradeJournal) error {
+	if j.Passive != "" {
+		u.spec.Snapshots = j.Snapshots
+	}
+	for _, name := range []string{constants.ActiveImgName, constants.RecoveryImgName} {
+		img := j.Images[name]
+		if img == nil {
+			continue
+		}
+		recovery := name == constants.RecoveryImgName
+		final := filepath.Join(u.imagesRoot(j), j.Target)
+		if recovery && j.RecoveryTarget != "" {
+			final = filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTarget)
+		}
+		err := u.upgradeInstallState(img, recovery, final)
+		if err != nil {
+			return err
+		}
+		j.State = u.spec.State
+	}
+	return nil
+}
+
+// relativeSwap returns the transition and target files of the given image relative to the given root
+func relativeSwap(root string, img *upgradeImage) (transition, target string, err error) {
+	transition, err = filepath.Rel(root, img.img.File)
+	if err != nil {
+		return "", "", err
+	}
+	target, err = filepath.Rel(root, img.final)
+	return transition, target, err
+}
+
+// backupRecovery moves the given current recovery image to the recovery backup file of the transaction.
+// Any previous recovery backup is replaced, so the journal records it before touching the backups.
+func (u *UpgradeAction) backupRecovery(j *v1.UpgradeJournal, target string) error {
+	if j.RecoveryBackup == "" {
+		return nil
+	}
+	if exists, _ := utils.Exists(u.config.Fs, target); !exists {
+		return nil
+	}
+	if !j.RecoveryBackedUp {
+		j.RecoveryBackedUp = true
+		err := u.setPhase(j, j.Phase)
+		if err != nil {
+			return err
+		}
+	}
+	backup := filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryBackup)
+	if previous := findRecoveryBackup(u.config.Fs, u.spec.Partitions.Recovery.MountPoint); previous != "" && previous != backup {
+		u.Info("Removing previous recovery backup %s", previous)
+		err := u.remove(previous)
+		if err != nil {
+			return err
+		}
+	}
+	u.Info("Backing up current recovery image")
+	u.Info("Moving %s to %s", target, backup)
+	_, err := u.config.Runner.Run("mv", "-f", target, backup)
+	if err != nil {
+		u.Error("Failed to move %s to %s: %s", target, backup, err)
+	}
+	return err
+}
+
+// restoreRecovery moves the recovery backup file of the transaction back to the given recovery image,
+// once the current image was moved to the backup file or replaced by the given transition image
+func (u *UpgradeAction) restoreRecovery(j *v1.UpgradeJournal, transition, target string) error {
+	if !j.RecoveryBackedUp {
+		return nil
+	}
+	backup := filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryBackup)
+	targetExists, _ := utils.Exists(u.config.Fs, target)
+	transitionExists, _ := utils.Exists(u.config.Fs, transition)
+	backupExists, _ := utils.Exists(u.config.Fs, backup)
+	if !backupExists || (targetExists && transitionExists) {
+		return nil
+	}
+	u.Info("Restoring %s from %s", target, backup)
+	_, err := u.config.Runner.Run("mv", "-f", backup, target)
+	if err != nil {
+		u.Error("Failed to move %s to %s: %s", backup, target, err)
+		return err
+	}
+	_, _ = u.config.Runner.Run("sync")
+	return nil
+}
+
+// revertRecoveryBackup drops the previous recovery backup, replaced by a reverted transaction, from
+// the grub menu and the installation state stored in the state partition
+func (u *UpgradeAction) revertRecoveryBackup() error {
+	if findRecoveryBackup(u.config.Fs, u.spec.Partitions.Recovery.MountPoint) != "" {
+		return nil
+	}
+	var state *v1.InstallState
+	data, err := u.config.Fs.ReadFile(filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile))
+	if err == nil {
+		state = &v1.InstallState{}
+		err = yaml.Unmarshal(data, state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		u.Error("Failed reading installation state: %s", err)
+		return err
+	}
+	return removeRecoveryBackup(&u.config.Config, u.spec.Partitions, state)
+}
+
+// recoverySwapPending checks if the given transaction includes a recovery image swap not done yet
+func (u *UpgradeAction) recoverySwapPending(j *v1.UpgradeJournal) bool {
+	if j.RecoveryTransition == "" {
+		return false
+	}
+	exists, _ := utils.Exists(u.config.Fs, filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTransition))
+	return exists
+}
+
+// commitTransaction backs up the current image, if any, and moves the transition image in place.
+// It can be safely called again over a previously interrupted transaction.
+func (u *UpgradeAction) commitTransaction(j *v1.UpgradeJournal) error {
+	root := u.imagesRoot(j)
+	transition := filepath.Join(root, j.Transition)
+	target := filepath.Join(root, j.Target)
+
+	transitionExists, _ := utils.Exists(u.config.Fs, transition)
+
+	if j.Passive != "" && j.Phase == constants.UpgradePrepared {
+		passive := filepath.Join(root, j.Passive)
+		targetExists, _ := utils.Exists(u.config.Fs, target)
+		if passiveExists, _ := utils.Exists(u.config.Fs, passive); passiveExists && targetExists && transitionExists {
+			err := u.rotateSnapshots(passive, j.Snapshots)
+			if err != nil {
+				return err
+			}
+		}
+		if targetExists && transitionExists {
+			// backup current active.img to passive.img before overwriting the active.img
+			u.Info("Backing up current active image")
+			u.Info("Moving %s to %s", target, passive)
+			_, err := u.config.Runner.Run("mv", "-f", target, passive)
+			if err != nil {
+				u.Error("Failed to move %s to %s: %s", target, passive, err)
+				return err
+			}
+			u.Info("Finished moving %s to %s", target, passive)
+		}
+		if passiveExists, _ := utils.Exists(u.config.Fs, passive); passiveExists {
+			// Label the image to passive!
+			out, err := u.config.Runner.Run("tune2fs", "-L", u.spec.Passive.Label, passive)
+			if err != nil {
+				u.Error("Error while labeling the passive image %s: %s", passive, err)
+				u.Debug("Error while labeling the passive image %s, command output: %s", passive, out)
+				return err
+			}
+		}
+		_, _ = u.config.Runner.Run("sync")
+
+		err := u.setPhase(j, constants.UpgradeBackedUp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The current recovery image is moved to the recovery backup file, reverting restores it from there
+	if u.recoverySwapPending(j) {
+		recTransition := filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTransition)
+		recTarget := filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTarget)
+		err := u.backupRecovery(j, recTarget)
+		if err != nil {
+			return err
+		}
+		u.Info("Moving %s to %s", recTransition, recTarget)
+		_, err = u.config.Runner.Run("mv", "-f", recTransition, recTarget)
+		if err != nil {
+			u.Error("Failed to move %s to %s: %s", recTransition, recTarget, err)
+			return err
+		}
+		_, _ = u.config.Runner.Run("sync")
+	}
+
+	if transitionExists {
+		if j.RecoveryUpgrade {
+			err := u.backupRecovery(j, target)
+			if err != nil {
+				return err
+			}
+		}
+		u.Info("Moving %s to %s", transition, target)
+		_, err := u.config.Runner.Run("mv", "-f", transition, target)
+		if err != nil {
+			u.Error("Failed to move %s to %s: %s", transition, target, err)
+			return err
+		}
+		u.Info("Finished moving %s to %s", transition, target)
+		_, _ = u.config.Runner.Run("sync")
+	}
+
+	return u.setPhase(j, constants.UpgradeCommitted)
+}
+
+// completeTransaction stores the upgraded installation state and removes the journal
+func (u *UpgradeAction) completeTransaction(j *v1.UpgradeJournal) error {
+	if u.spec.Partitions.Recovery == nil {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	if j.State != nil {
+		u.spec.State = j.State
+		err := u.config.WriteInstallState(
+			u.spec.State,
+			filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile),
+			filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if j.RecoveryBackup != "" {
+		err := setRecoveryBackupMenu(&u.config.Config, u.spec.Partitions)
+		if err != nil {
+			return err
+		}
+	}
+	if j.Passive != "" {
+		// The upgraded image becomes the default boot entry
+		err := u.setSnapshotsMenu(filepath.Join(u.imagesRoot(j), j.Passive))
+		if err != nil {
+			return err
+		}
+		err = u.setDefaultGrubEntry(filepath.Join(u.imagesRoot(j), j.Target))
+		if err != nil {
+			return err
+		}
+	}
+	return u.remove(u.journalPath())
+}
+
+// setDefaultGrubEntry sets the default grub entry name from the given upgraded system image
+func (u *UpgradeAction) setDefaultGrubEntry(file string) (err error) {
+	e := elemental.NewElemental(&u.config.Config)
+	img := u.spec.Active
+	img.File = file
+
+	u.Info("rebranding")
+	err = e.MountImage(&img, "ro")
+	if err != nil {
+		u.Error("failed mounting upgraded image: %s", err)
+		return err
+	}
+	defer func() {
+		if uErr := e.UnmountImage(&img); uErr != nil && err == nil {
+			u.Error("failed unmounting upgraded image")
+			err = uErr
+		}
+	}()
+	err = e.SetDefaultGrubEntry(u.spec.Partitions.State.MountPoint, img.MountPoint, u.spec.GrubDefEntry)
+	if err != nil {
+		u.Error("failed setting default entry")
+	}
+	return err
+}
+
+// setSnapshotsMenu updates the grub menu entries of the numbered snapshots and unsets any
+// snapshot set as the default boot entry
+func (u *UpgradeAction) setSnapshotsMenu(passive string) error {
+	err := setSnapshotsMenu(&u.config.Config, u.spec.Partitions.State, passive)
+	if err != nil {
+		return err
+	}
+	grubEnvFile := filepath.Join(u.spec.Partitions.State.MountPoint, constants.GrubOEMEnv)
+	if exists, _ := utils.Exists(u.config.Fs, grubEnvFile); !exists {
+		return nil
+	}
+	grub := utils.NewGrub(&u.config.Config)
+	return grub.UnsetPersistentVariables(grubEnvFile, constants.GrubSavedEntryVar)
+}
+
+// moveSnapshot labels the snapshot image of the given source slot with the label of the given
+// target slot and moves it in place. Labelling first keeps it safe to repeat after an interruption.
+func (u *UpgradeAction) moveSnapshot(passive string, source, target int) error {
+	src := snapshotFile(passive, source)
+	dst := snapshotFile(passive, target)
+	label := snapshotLabel(u.spec.Passive.Label, target)
+
+	out, err := u.config.Runner.Run("tune2fs", "-L", label, src)
+	if err != nil {
+		u.Error("Error while labeling the image %s: %s", src, err)
+		u.Debug("Error while labeling the image %s, command output: %s", src, out)
+		return err
+	}
+	u.Info("Moving %s to %s", src, dst)
+	_, err = u.config.Runner.Run("mv", "-f", src, dst)
+	if err != nil {
+		u.Error("Failed to move %s to %s: %s", src, dst, err)
+		return err
+	}
+	return nil
+}
+
+// rotateSnapshots makes room for a new passive image by moving each retained snapshot one slot
+// up, the oldest snapshot exceeding the given retention count is overwritten. It can be safely
+// called again over a previously interrupted rotation, as long as the passive image is still present.
+func (u *UpgradeAction) rotateSnapshots(passive string, snapshots int) error {
+	for _, slot := range snapshotSlots(u.config.Fs, passive) {
+		if slot >= snapshots {
+			err := u.remove(snapshotFile(passive, slot))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for slot := snapshots - 2; slot >= 0; slot-- {
+		if exists, _ := utils.Exists(u.config.Fs, snapshotFile(passive, slot)); !exists {
+			continue
+		}
+		err := u.moveSnapshot(passive, slot, slot+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unrotateSnapshots reverts a snapshots rotation by moving each snapshot one slot down, as
+// long as the lower slot is empty, starting with the passive image slot.
+func (u *UpgradeAction) unrotateSnapshots(passive string, snapshots int) error {
+	for slot := 1; slot < snapshots; slot++ {
+		prevExists, _ := utils.Exists(u.config.Fs, snapshotFile(passive, slot-1))
+		exists, _ := utils.Exists(u.config.Fs, snapshotFile(passive, slot))
+		if prevExists || !exists {
+			return nil
+		}
+		err := u.moveSnapshot(passive, slot, slot-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revertTransaction restores the backed up image, if needed, and discards the transition image
+func (u *UpgradeAction) revertTransaction(j *v1.UpgradeJournal) error {
+	root := u.imagesRoot(j)
+	target := filepath.Join(root, j.Target)
+
+	if j.Passive != "" {
+		passive := filepath.Join(root, j.Passive)
+		targetExists, _ := utils.Exists(u.config.Fs, target)
+		passiveExists, _ := utils.Exists(u.config.Fs, passive)
+		if !targetExists && passiveExists {
+			u.Info("Restoring %s from %s", target, passive)
+			_, err := u.config.Runner.Run("mv", "-f", passive, target)
+			if err != nil {
+				u.Error("Failed to move %s to %s: %s", passive, target, err)
+				return err
+			}
+			out, err := u.config.Runner.Run("tune2fs", "-L", u.spec.Active.Label, target)
+			if err != nil {
+				u.Error("Error while labeling the active image %s: %s", target, err)
+				u.Debug("Error while labeling the active image %s, command output: %s", target, out)
+				return err
+			}
+			_, _ = u.config.Runner.Run("sync")
+		}
+		err := u.unrotateSnapshots(passive, j.Snapshots)
+		if err != nil {
+			return err
+		}
+	}
+
+	if j.RecoveryUpgrade {
+		err := u.restoreRecovery(j, filepath.Join(root, j.Transition), target)
+		if err != nil {
+			return err
+		}
+	}
+	if j.RecoveryTransition != "" {
+		err := u.restoreRecovery(
+			j, filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTransition),
+			filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTarget),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if j.RecoveryBackedUp {
+		err := u.revertRecoveryBackup()
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.discardTransaction(j)
+}
+
+// recoverTransaction checks for an upgrade transaction interrupted in a previous run. The
+// transaction is completed if the transition image is still around or already in place,
+// otherwise it is reverted.
+func (u *UpgradeAction) recoverTransaction() error {
+	j, err := LoadUpgradeJournal(u.config.Fs, u.journalPath())
+	if err != nil {
+		u.Error("Failed reading upgrade journal: %s", err)
+		return err
+	}
+	if j == nil {
+		u.Debug("No pending upgrade transaction found")
+		return nil
+	}
+	if j.Phase == constants.UpgradeStaged {
+		u.Debug("Staged upgrade found, leaving it in place")
+		return nil
+	}
+
+	root := u.imagesRoot(j)
+	transitionExists, _ := utils.Exists(u.config.Fs, filepath.Join(root, j.Transition))
+	targetExists, _ := utils.Exists(u.config.Fs, filepath.Join(root, j.Target))
+
+	switch {
+	case j.Phase == constants.UpgradeCommitted:
+		u.Info("Completing interrupted upgrade transaction")
+	case transitionExists, u.recoverySwapPending(j), j.Phase == constants.UpgradeBackedUp && targetExists:
+		u.Info("Resuming interrupted upgrade transaction from '%s' phase", j.Phase)
+		err = u.commitTransaction(j)
+		if err != nil {
+			return err
+		}
+	default:
+		u.Info("Reverting interrupted upgrade transaction from '%s' phase", j.Phase)
+		return u.revertTransaction(j)
+	}
+	return u.completeTransaction(j)
+}
+
+// stagedTransaction returns the staged upgrade transaction, nil if there is none
+func (u *UpgradeAction) stagedTransaction() (*v1.UpgradeJournal, error) {
+	j, err := LoadUpgradeJournal(u.config.Fs, u.journalPath())
+	if err != nil {
+		u.Error("Failed reading upgrade journal: %s", err)
+		return nil, err
+	}
+	if j == nil || j.Phase != constants.UpgradeStaged {
+		return nil, nil
+	}
+	return j, nil
+}
+
+// discardTransaction removes the transition images of a transaction not committed yet and its journal
+func (u *UpgradeAction) discardTransaction(j *v1.UpgradeJournal) error {
+	err := u.remove(filepath.Join(u.imagesRoot(j), j.Transition))
+	if err != nil {
+		return err
+	}
+	if j.RecoveryTransition != "" {
+		err = u.remove(filepath.Join(u.spec.Partitions.Recovery.MountPoint, j.RecoveryTransition))
+		if err != nil {
+			return err
+		}
+	}
+	return u.remove(u.journalPath())
+}
@@ -17,8 +17,10 @@ limitations under the License.
 package action
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rancher/elemental-cli/pkg/constants"
@@ -27,6 +29,14 @@ import (
 	"github.com/rancher/elemental-cli/pkg/utils"
 )
 
+// upgradeImage is an image deployed by the upgrade along with the image file it replaces
+type upgradeImage struct {
+	img      v1.Image
+	final    string
+	recovery bool
+	meta     interface{}
+}
+
 // UpgradeAction represents the struct that will run the upgrade from start to finish
 type UpgradeAction struct {
 	config *v1.RunConfig
@@ -69,7 +79,19 @@ func (u UpgradeAction) upgradeHook(hook string, chroot bool) error {
 	return Hook(&u.config.Config, hook, u.config.Strict, u.config.CloudInitPaths...)
 }
 
-func (u *UpgradeAction) upgradeInstallStateYaml(meta interface{}, img v1.Image) error {
+// state returns the installation state data of the image
+func (i upgradeImage) state() *v1.ImageState {
+	return &v1.ImageState{
+		Source:         i.img.Source,
+		SourceMetadata: i.meta,
+		Label:          i.img.Label,
+		FS:             i.img.FS,
+	}
+}
+
+// upgradeInstallState updates the installation state data with the given upgraded image replacing
+// the final image file, data is stored in state.yaml once the upgrade transaction is completed
+func (u *UpgradeAction) upgradeInstallState(imgState *v1.ImageState, recovery bool, final string) error {
 	if u.spec.Partitions.Recovery == nil || u.spec.Partitions.State == nil {
 		return fmt.Errorf("undefined state or recovery partition")
 	}
@@ -81,13 +103,7 @@ func (u *UpgradeAction) upgradeInstallStateYaml(meta interface{}, img v1.Image)
 	}
 
 	u.spec.State.Date = time.Now().Format(time.RFC3339)
-	imgState := &v1.ImageState{
-		Source:         img.Source,
-		SourceMetadata: meta,
-		Label:          img.Label,
-		FS:             img.FS,
-	}
-	if u.spec.RecoveryUpgrade {
+	if recovery {
 		recoveryPart := u.spec.State.Partitions[constants.RecoveryPartName]
 		if recoveryPart == nil {
 			recoveryPart = &v1.PartitionState{
@@ -95,6 +111,12 @@ func (u *UpgradeAction) upgradeInstallStateYaml(meta interface{}, img v1.Image)
 			}
 			u.spec.State.Partitions[constants.RecoveryPartName] = recoveryPart
 		}
+		// The current recovery image is kept as a backup on commit
+		if current := recoveryPart.Images[constants.RecoveryImgName]; current != nil {
+			if exists, _ := utils.Exists(u.config.Fs, final); exists {
+				recoveryPart.Images[constants.RecoveryBackupImgName] = current
+			}
+		}
 		recoveryPart.Images[constants.RecoveryImgName] = imgState
 	} else {
 		statePart := u.spec.State.Partitions[constants.StatePartName]
@@ -104,51 +126,286 @@ func (u *UpgradeAction) upgradeInstallStateYaml(meta interface{}, img v1.Image)
 			}
 			u.spec.State.Partitions[constants.StatePartName] = statePart
 		}
-		statePart.Images[constants.PassiveImgName] = statePart.Images[constants.ActiveImgName]
+		// Drop snapshots exceeding the retention count and shift the retained ones
+		for _, slot := range snapshotStateSlots(statePart) {
+			if slot >= u.spec.Snapshots {
+				delete(statePart.Images, snapshotName(slot))
+			}
+		}
+		for slot := u.spec.Snapshots - 1; slot > 0; slot-- {
+			snapshot := statePart.Images[snapshotName(slot-1)]
+			if snapshot == nil {
+				continue
+			}
+			snapshot.Label = snapshotLabel(u.spec.Passive.Label, slot)
+			statePart.Images[snapshotName(slot)] = snapshot
+			delete(statePart.Images, snapshotName(slot-1))
+		}
+		passive := statePart.Images[constants.ActiveImgName]
+		if passive != nil {
+			passive.Label = u.spec.Passive.Label
+		}
+		statePart.Images[constants.PassiveImgName] = passive
 		statePart.Images[constants.ActiveImgName] = imgState
+		u.spec.State.BootAssessment = nil
+		if u.spec.BootAssessTries > 0 {
+			u.spec.State.BootAssessment = &v1.BootAssessmentState{
+				Tries:  u.spec.BootAssessTries,
+				Status: constants.BootAssessPending,
+				Date:   u.spec.State.Date,
+			}
+		}
+	}
+	return nil
+}
+
+// setIsoSources downloads and mounts the ISO and sets it as the source of the image to upgrade,
+// the ISO is unmounted and removed on cleanup. Returns the ISO metadata to keep in the installation state.
+func (u *UpgradeAction) setIsoSources(e *elemental.Elemental, cleanup *utils.CleanStack) (*v1.IsoImageMeta, error) {
+	u.Info("Upgrading from ISO %s", u.spec.Iso)
+	tmpDir, err := e.GetIso(u.spec.Iso)
+	if err != nil {
+		u.Error("failed getting ISO %s", u.spec.Iso)
+		return nil, err
+	}
+	cleanup.Push(func() error { return u.config.Fs.RemoveAll(tmpDir) })
+	cleanup.Push(func() error { return e.UnmountIso(tmpDir) })
+
+	meta, err := e.GetIsoMeta(u.spec.Iso, tmpDir)
+	if err != nil {
+		return nil, err
 	}
 
-	return u.config.WriteInstallState(
-		u.spec.State,
-		filepath.Join(u.spec.Partitions.State.MountPoint, constants.InstallStateFile),
-		filepath.Join(u.spec.Partitions.Recovery.MountPoint, constants.InstallStateFile),
-	)
+	switch {
+	case u.spec.All:
+		err = e.UpdateSourcesFormDownloadedISO(tmpDir, &u.spec.Active, &u.spec.Recovery)
+	case u.spec.RecoveryUpgrade:
+		err = e.UpdateSourcesFormDownloadedISO(tmpDir, nil, &u.spec.Recovery)
+	default:
+		err = e.UpdateSourcesFormDownloadedISO(tmpDir, &u.spec.Active, nil)
+	}
+	if err != nil {
+		u.Error("failed setting upgrade sources from ISO %s", u.spec.Iso)
+		return nil, err
+	}
+	return meta, nil
 }
 
-func (u *UpgradeAction) Run() (err error) {
-	var upgradeImg v1.Image
-	var finalImageFile string
+// channelPackage returns the package of the given channel source, without version selector
+func channelPackage(src string) string {
+	return strings.Split(src, "@")[0]
+}
 
-	cleanup := utils.NewCleanStack()
-	defer func() { err = cleanup.Cleanup(err) }()
+// installedChannelMeta returns the channel metadata of the given image in the installation state,
+// nil if the image was not deployed from a channel
+func (u *UpgradeAction) installedChannelMeta(part, image string) *v1.ChannelImageMeta {
+	img := u.installedImage(part, image)
+	if img == nil {
+		return nil
+	}
+	meta, _ := img.SourceMetadata.(*v1.ChannelImageMeta)
+	return meta
+}
 
-	e := elemental.NewElemental(&u.config.Config)
+// installedImage returns the state of the given image in the installation state, nil if not found
+func (u *UpgradeAction) installedImage(part, image string) *v1.ImageState {
+	if u.spec.State == nil || u.spec.State.Partitions[part] == nil {
+		return nil
+	}
+	return u.spec.State.Partitions[part].Images[image]
+}
 
-	if u.spec.RecoveryUpgrade {
-		upgradeImg = u.spec.Recovery
-		if upgradeImg.FS == constants.SquashFs {
-			finalImageFile = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoverySquashFile)
+// ListVersions returns the versions of the system and recovery packages available in the configured repositories.
+// Packages are taken from the channel upgrade sources or, if not set, from the installation state.
+func (u *UpgradeAction) ListVersions() ([]*v1.PackageVersion, error) {
+	list := []*v1.PackageVersion{}
+	listed := map[string]bool{}
+
+	images := []struct {
+		src  *v1.ImageSource
+		part string
+		name string
+	}{
+		{u.spec.Active.Source, constants.StatePartName, constants.ActiveImgName},
+		{u.spec.Recovery.Source, constants.RecoveryPartName, constants.RecoveryImgName},
+	}
+	for _, img := range images {
+		var pkg, installedPkg string
+		repos := u.config.Repos
+		installed := u.installedChannelMeta(img.part, img.name)
+		if installed != nil {
+			installedPkg = installed.Name
+			if installed.Category != "" {
+				installedPkg = fmt.Sprintf("%s/%s", installed.Category, installed.Name)
+			}
+		}
+
+		switch {
+		case img.src != nil && img.src.IsChannel():
+			pkg = channelPackage(img.src.Value())
+		case installed != nil:
+			pkg = installedPkg
+		default:
+			continue
+		}
+		if listed[pkg] {
+			continue
+		}
+		listed[pkg] = true
+
+		// Fallback to the repositories the installed package was deployed from
+		if len(repos) == 0 && installed != nil {
+			repos = installed.Repos
+		}
+		versions, err := u.config.Luet.PackageVersions(pkg, repos...)
+		if err != nil {
+			u.Error("failed listing versions of package %s: %v", pkg, err)
+			return nil, err
+		}
+		for _, v := range versions {
+			list = append(list, &v1.PackageVersion{
+				Package:   pkg,
+				Version:   v,
+				Installed: pkg == installedPkg && installed.Version == v,
+			})
+		}
+	}
+	if len(listed) == 0 {
+		return nil, fmt.Errorf("no channel package found for the system or the recovery images")
+	}
+	return list, nil
+}
+
+// deployImage deploys the upgrade image and leaves it mounted. On delta upgrades the image is seeded
+// from the current image file, if it can't be reused a full deployment is done instead.
+func (u *UpgradeAction) deployImage(e *elemental.Elemental, i *upgradeImage) (interface{}, error) {
+	img := &i.img
+	if u.spec.Delta {
+		exists, _ := utils.Exists(u.config.Fs, i.final)
+		if exists && strings.HasPrefix(img.FS, "ext") {
+			part, name := constants.StatePartName, constants.ActiveImgName
+			if i.recovery {
+				part, name = constants.RecoveryPartName, constants.RecoveryImgName
+			}
+			u.Info("delta upgrade, reusing %s", i.final)
+			meta, err := e.DeployImageDelta(img, i.final, u.installedImage(part, name))
+			if !errors.Is(err, elemental.ErrNoDelta) {
+				return meta, err
+			}
+		}
+		u.config.Logger.Warnf("can't do a delta upgrade from %s, doing a full upgrade", i.final)
+	}
+	return e.DeployImage(img, true)
+}
+
+// upgradeImages returns the images to upgrade, the system image goes first if both are upgraded
+func (u *UpgradeAction) upgradeImages() []*upgradeImage {
+	images := []*upgradeImage{}
+	if !u.spec.RecoveryUpgrade {
+		images = append(images, &upgradeImage{
+			img:   u.spec.Active,
+			final: filepath.Join(u.spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile),
+		})
+	}
+	if u.spec.RecoveryUpgrade || u.spec.All {
+		recovery := &upgradeImage{img: u.spec.Recovery, recovery: true}
+		if recovery.img.FS == constants.SquashFs {
+			recovery.final = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoverySquashFile)
 		} else {
-			finalImageFile = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoveryImgFile)
+			recovery.final = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoveryImgFile)
 		}
-	} else {
-		upgradeImg = u.spec.Active
-		finalImageFile = filepath.Join(u.spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile)
+		images = append(images, recovery)
 	}
+	if u.spec.Version != "" {
+		for _, i := range images {
+			i.img.Source = v1.NewChannelSrc(fmt.Sprintf("%s@%s", channelPackage(i.img.Source.Value()), u.spec.Version))
+		}
+	}
+	return images
+}
 
-	umount, err := e.MountRWPartition(u.spec.Partitions.State)
+// deployUpgradeImage deploys the given image as a transition image, it is left unmounted.
+// The after-upgrade-chroot hook runs within the system image or, on recovery upgrades, within the recovery image.
+func (u *UpgradeAction) deployUpgradeImage(e *elemental.Elemental, i *upgradeImage, cleanup *utils.CleanStack) (err error) {
+	img := &i.img
+
+	u.Info("deploying image %s to %s", img.Source.Value(), img.File)
+	i.meta, err = u.deployImage(e, i)
 	if err != nil {
+		u.Error("Failed deploying image to file '%s': %s", img.File, err)
 		return err
 	}
-	cleanup.Push(umount)
-	umount, err = e.MountRWPartition(u.spec.Partitions.Recovery)
+	cleanup.Push(func() error { return e.UnmountImage(img) })
+
+	// Selinux relabel
+	// Doesn't make sense to relabel a readonly filesystem
+	if img.FS != constants.SquashFs {
+		// Relabel SELinux
+		// TODO probably relabelling persistent volumes should be an opt in feature, it could
+		// have undesired effects in case of failures
+		binds := map[string]string{}
+		if mnt, _ := utils.IsMounted(&u.config.Config, u.spec.Partitions.Persistent); mnt {
+			binds[u.spec.Partitions.Persistent.MountPoint] = constants.UsrLocalPath
+		}
+		if mnt, _ := utils.IsMounted(&u.config.Config, u.spec.Partitions.OEM); mnt {
+			binds[u.spec.Partitions.OEM.MountPoint] = constants.OEMPath
+		}
+		err = utils.ChrootedCallback(
+			&u.config.Config, img.MountPoint, binds,
+			func() error { return e.SelinuxRelabel("/", true) },
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !i.recovery || !u.spec.All {
+		err = u.upgradeHook(constants.AfterUpgradeChrootHook, true)
+		if err != nil {
+			u.Error("Error running hook after-upgrade-chroot: %s", err)
+			return err
+		}
+	}
+
+	err = e.UnmountImage(img)
 	if err != nil {
+		u.Error("failed unmounting transition image")
 		return err
 	}
-	cleanup.Push(umount)
+	return nil
+}
 
-	// Cleanup transition image file before leaving
-	cleanup.Push(func() error { return u.remove(upgradeImg.File) })
+// prepareTransaction deploys the upgrade images as transition images and records the upgrade transaction.
+// On staged upgrades the transaction is recorded in staged phase and transition images are kept in place.
+func (u *UpgradeAction) prepareTransaction(e *elemental.Elemental, isoMeta *v1.IsoImageMeta, cleanup *utils.CleanStack) (*v1.UpgradeJournal, error) {
+	var err error
+	var staged bool
+
+	images := u.upgradeImages()
+
+	// Current images stay in place until the swap, so only room for the new images is required.
+	// Any previous recovery backup is only replaced once the transaction is committed.
+	for _, i := range images {
+		if i.recovery {
+			err = e.CheckAvailableSpace(u.spec.Partitions.Recovery.MountPoint, &i.img)
+		} else {
+			err = e.CheckAvailableSpace(u.spec.Partitions.State.MountPoint, &i.img)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Cleanup transition image files before leaving, unless staged
+	for _, i := range images {
+		file := i.img.File
+		cleanup.Push(func() error {
+			if staged {
+				return nil
+			}
+			return u.remove(file)
+		})
+	}
 
 	// Recovery does not mount persistent, so try to mount it. Ignore errors, as it's not mandatory.
 	persistentPart := u.spec.Partitions.Persistent
@@ -157,7 +414,7 @@ func (u *UpgradeAction) Run() (err error) {
 		_ = utils.MkdirAll(u.config.Fs, persistentPart.MountPoint, constants.DirPerm)
 		if mnt, err := utils.IsMounted(&u.config.Config, persistentPart); !mnt && err == nil {
 			u.Debug("mounting persistent partition")
-			umount, err = e.MountRWPartition(persistentPart)
+			umount, err := e.MountRWPartition(persistentPart)
 			if err != nil {
 				u.config.Logger.Warn("could not mount persistent partition: %s", err.Error())
 			} else {
@@ -175,94 +432,169 @@ func (u *UpgradeAction) Run() (err error) {
 	err = u.upgradeHook(constants.BeforeUpgradeHook, false)
 	if err != nil {
 		u.Error("Error while running hook before-upgrade: %s", err)
+		return nil, err
+	}
+
+	// All images are deployed before the transaction starts, so a failure leaves current images untouched
+	for _, i := range images {
+		err = u.deployUpgradeImage(e, i, cleanup)
+		if err != nil {
+			return nil, err
+		}
+		if isoMeta != nil {
+			i.meta = isoMeta
+		}
+	}
+
+	phase := constants.UpgradePrepared
+	if u.spec.Stage {
+		phase = constants.UpgradeStaged
+	}
+	journal, err := u.newTransaction(images, phase)
+	if err != nil {
+		u.Error("failed starting upgrade transaction")
+		return nil, err
+	}
+	staged = u.spec.Stage
+	return journal, nil
+}
+
+// applyTransaction commits the given upgrade transaction, or reverts it on failure, and stores the
+// upgraded installation state
+func (u *UpgradeAction) applyTransaction(j *v1.UpgradeJournal) error {
+	err := u.commitTransaction(j)
+	if err != nil {
+		u.Error("failed committing upgrade transaction, reverting it")
+		if rErr := u.revertTransaction(j); rErr != nil {
+			u.Error("failed reverting upgrade transaction: %s", rErr)
+		}
 		return err
 	}
 
-	u.Info("deploying image %s to %s", upgradeImg.Source.Value(), upgradeImg.File)
-	upgradeMeta, err := e.DeployImage(&upgradeImg, true)
+	// Update state.yaml file on recovery and state partitions
+	err = u.completeTransaction(j)
 	if err != nil {
-		u.Error("Failed deploying image to file '%s': %s", upgradeImg.File, err)
+		u.Error("failed upgrading installation metadata")
 		return err
 	}
-	cleanup.Push(func() error { return e.UnmountImage(&upgradeImg) })
 
-	// Selinux relabel
-	// Doesn't make sense to relabel a readonly filesystem
-	if upgradeImg.FS != constants.SquashFs {
-		// Relabel SELinux
-		// TODO probably relabelling persistent volumes should be an opt in feature, it could
-		// have undesired effects in case of failures
-		binds := map[string]string{}
-		if mnt, _ := utils.IsMounted(&u.config.Config, u.spec.Partitions.Persistent); mnt {
-			binds[u.spec.Partitions.Persistent.MountPoint] = constants.UsrLocalPath
-		}
-		if mnt, _ := utils.IsMounted(&u.config.Config, u.spec.Partitions.OEM); mnt {
-			binds[u.spec.Partitions.OEM.MountPoint] = constants.OEMPath
+	// Systems installed before grub.cfg included the elemental grub scripts get the include here
+	grub := utils.NewGrub(&u.config.Config)
+	err = grub.SetScriptsInclude(u.spec.Partitions.State.MountPoint, u.spec.Partitions.State.FilesystemLabel)
+	if err != nil {
+		u.Error("failed including the elemental grub scripts into grub.cfg")
+		return err
+	}
+
+	// Only arm the boot assessment for system upgrades
+	if !j.RecoveryUpgrade {
+		var tries int
+		if j.State != nil && j.State.BootAssessment != nil {
+			tries = j.State.BootAssessment.Tries
 		}
-		err = utils.ChrootedCallback(
-			&u.config.Config, upgradeImg.MountPoint, binds,
-			func() error { return e.SelinuxRelabel("/", true) },
-		)
+		err = grub.SetBootAssessment(u.spec.Partitions.State.MountPoint, u.spec.Partitions.State.FilesystemLabel, tries)
 		if err != nil {
+			u.Error("failed setting boot assessment")
 			return err
 		}
+		err = setBootAssessCheck(&u.config.Config, u.spec.Partitions.OEM, tries > 0)
+		if err != nil {
+			u.config.Logger.Warnf("failed setting boot assessment check, boot failures will only be recorded on 'boot-assess mark-good': %v", err)
+		}
 	}
+	return nil
+}
 
-	err = u.upgradeHook(constants.AfterUpgradeChrootHook, true)
-	if err != nil {
-		u.Error("Error running hook after-upgrade-chroot: %s", err)
-		return err
-	}
+func (u *UpgradeAction) Run() (err error) {
+	u.config.Progress.Start("upgrade")
+	defer func() { u.config.Progress.Done(err) }()
 
-	// Only apply rebrand stage for system upgrades
-	if !u.spec.RecoveryUpgrade {
-		u.Info("rebranding")
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
 
-		err = e.SetDefaultGrubEntry(u.spec.Partitions.State.MountPoint, upgradeImg.MountPoint, u.spec.GrubDefEntry)
+	e := elemental.NewElemental(&u.config.Config)
+
+	// Set upgrade sources from a downloaded ISO, pending and staged transactions are handled without it
+	var isoMeta *v1.IsoImageMeta
+	if u.spec.Iso != "" && !u.spec.Recover && !u.spec.ApplyStaged && !u.spec.DiscardStaged {
+		u.config.Progress.Phase(v1.PhaseDownload)
+		isoMeta, err = u.setIsoSources(e, cleanup)
 		if err != nil {
-			u.Error("failed setting default entry")
 			return err
 		}
 	}
 
-	err = e.UnmountImage(&upgradeImg)
+	u.config.Progress.Phase(v1.PhaseMount)
+	umount, err := e.MountRWPartition(u.spec.Partitions.State)
 	if err != nil {
-		u.Error("failed unmounting transition image")
 		return err
 	}
+	cleanup.Push(umount)
+	umount, err = e.MountRWPartition(u.spec.Partitions.Recovery)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
 
-	// If not upgrading recovery, backup active into passive
-	if !u.spec.RecoveryUpgrade {
-		//TODO this step could be part of elemental package
-		// backup current active.img to passive.img before overwriting the active.img
-		u.Info("Backing up current active image")
-		source := filepath.Join(u.spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile)
-		u.Info("Moving %s to %s", source, u.spec.Passive.File)
-		_, err := u.config.Runner.Run("mv", "-f", source, u.spec.Passive.File)
+	// Resume or revert any upgrade transaction interrupted in a previous run
+	err = u.recoverTransaction()
+	if err != nil {
+		u.Error("failed recovering pending upgrade transaction")
+		return err
+	}
+	if u.spec.Recover {
+		return nil
+	}
+
+	staged, err := u.stagedTransaction()
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.spec.DiscardStaged:
+		if staged == nil {
+			u.Info("No staged upgrade found")
+			return nil
+		}
+		u.Info("Discarding upgrade staged on %s", staged.Date)
+		return u.discardTransaction(staged)
+	case u.spec.ApplyStaged && staged == nil:
+		return fmt.Errorf("no staged upgrade found")
+	case !u.spec.ApplyStaged && staged != nil:
+		return fmt.Errorf("an upgrade staged on %s is pending, apply it with 'upgrade --apply-staged' or discard it with 'upgrade --discard-staged'", staged.Date)
+	}
+
+	u.config.Progress.Phase(v1.PhaseDeploy)
+	var journal *v1.UpgradeJournal
+	if u.spec.ApplyStaged {
+		u.Info("Applying upgrade staged on %s", staged.Date)
+		journal = staged
+		err = u.stagedInstallState(journal)
 		if err != nil {
-			u.Error("Failed to move %s to %s: %s", source, u.spec.Passive.File, err)
+			u.Error("failed upgrading installation metadata")
 			return err
 		}
-		u.Info("Finished moving %s to %s", source, u.spec.Passive.File)
-		// Label the image to passive!
-		out, err := u.config.Runner.Run("tune2fs", "-L", u.spec.Passive.Label, u.spec.Passive.File)
+		err = u.setPhase(journal, constants.UpgradePrepared)
 		if err != nil {
-			u.Error("Error while labeling the passive image %s: %s", u.spec.Passive.File, err)
-			u.Debug("Error while labeling the passive image %s, command output: %s", out)
+			u.Error("failed starting upgrade transaction")
 			return err
 		}
-		_, _ = u.config.Runner.Run("sync")
+	} else {
+		journal, err = u.prepareTransaction(e, isoMeta, cleanup)
+		if err != nil {
+			return err
+		}
+		if u.spec.Stage {
+			u.Info("Upgrade staged, apply it with 'upgrade --apply-staged'")
+			return nil
+		}
 	}
 
-	u.Info("Moving %s to %s", upgradeImg.File, finalImageFile)
-	_, err = u.config.Runner.Run("mv", "-f", upgradeImg.File, finalImageFile)
+	u.config.Progress.Phase(v1.PhaseFinalize)
+	err = u.applyTransaction(journal)
 	if err != nil {
-		u.Error("Failed to move %s to %s: %s", upgradeImg.File, finalImageFile, err)
 		return err
 	}
-	u.Info("Finished moving %s to %s", upgradeImg.File, finalImageFile)
-
-	_, _ = u.config.Runner.Run("sync")
 
 	err = u.upgradeHook(constants.AfterUpgradeHook, false)
 	if err != nil {
@@ -270,13 +602,6 @@ func (u *UpgradeAction) Run() (err error) {
 		return err
 	}
 
-	// Update state.yaml file on recovery and state partitions
-	err = u.upgradeInstallStateYaml(upgradeMeta, upgradeImg)
-	if err != nil {
-		u.Error("failed upgrading installation metadata")
-		return err
-	}
-
 	u.Info("Upgrade completed")
 
 	// Do not reboot/poweroff on cleanup errors
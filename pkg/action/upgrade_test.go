@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jaypipes/ghw/pkg/block"
 	. "github.com/onsi/ginkgo/v2"
@@ -27,6 +28,7 @@ import (
 	"github.com/rancher/elemental-cli/pkg/action"
 	conf "github.com/rancher/elemental-cli/pkg/config"
 	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/dryrun"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 	v1mock "github.com/rancher/elemental-cli/tests/mocks"
@@ -169,6 +171,9 @@ var _ = Describe("Runtime Actions", func() {
 						_ = fs.WriteFile(activeImg, source, constants.FilePerm)
 						_ = fs.RemoveAll(spec.Active.File)
 					}
+					if command == "cp" {
+						return (&v1.RealRunner{Logger: logger}).Run(command, args...)
+					}
 					return []byte{}, nil
 				}
 				config.Runner = runner
@@ -231,6 +236,184 @@ var _ = Describe("Runtime Actions", func() {
 				_, err = fs.Stat(spec.Active.File)
 				Expect(err).To(HaveOccurred())
 			})
+			It("Records the upgrade plan on dry runs without applying it", Label("docker", "dry-run"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				plan, closeDryRun, err := dryrun.Setup(&config.Config)
+				Expect(err).ToNot(HaveOccurred())
+				defer closeDryRun()
+
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(l.UnpackCalled()).To(BeFalse())
+				Expect(cloudInit.ExecStages).To(BeEmpty())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(Equal([]byte("active")))
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(Equal([]byte("passive")))
+				_, err = fs.Stat(spec.Active.File)
+				Expect(err).To(HaveOccurred())
+
+				out := &bytes.Buffer{}
+				Expect(plan.Print(out)).To(Succeed())
+				Expect(out.String()).To(ContainSubstring("[hook] run 'before-upgrade' stage"))
+				Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[format] mkfs.ext2 -L %s %s", spec.Active.Label, spec.Active.File)))
+				Expect(out.String()).To(ContainSubstring("[image] unpack image alpine"))
+				Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[run] mv -f %s %s", activeImg, passiveImg)))
+				Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[run] mv -f %s %s", spec.Active.File, activeImg)))
+				Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[state] write %s", filepath.Join(constants.RunningStateDir, constants.InstallStateFile))))
+			})
+			Describe("On delta mode", Label("delta"), func() {
+				var baseDigest string
+				BeforeEach(func() {
+					baseDigest = "sha256:" + strings.Repeat("a", 64)
+					spec.Active.Source = v1.NewDockerSrc("registry.org/my/image:new")
+					spec.Delta = true
+					spec.State = &v1.InstallState{
+						Partitions: map[string]*v1.PartitionState{
+							constants.StatePartName: {
+								Images: map[string]*v1.ImageState{
+									constants.ActiveImgName: {
+										Source:         v1.NewDockerSrc("registry.org/my/image:old"),
+										SourceMetadata: &v1.DockerImageMeta{Digest: baseDigest},
+									},
+								},
+							},
+						},
+					}
+					l.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+						if image == "registry.org/my/image@"+baseDigest {
+							return &v1.DockerImageMeta{Digest: baseDigest, Layers: []string{"sha256:base"}}, nil
+						}
+						return &v1.DockerImageMeta{Digest: "sha256:new", Layers: []string{"sha256:base", "sha256:added"}}, nil
+					}
+				})
+				It("Only applies the layers added on top of the current image", Label("docker"), func() {
+					var from int
+					l.UnpackLayersSideEffect = func(target, image string, local bool, f int) (*v1.DockerImageMeta, error) {
+						from = f
+						return &v1.DockerImageMeta{Digest: "sha256:new"}, nil
+					}
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(l.UnpackCalled()).To(BeFalse())
+					Expect(l.UnpackLayersCalled()).To(BeTrue())
+					Expect(from).To(Equal(1))
+					Expect(runner.IncludesCmds([][]string{
+						{"cp", "--sparse=always"},
+						{"e2fsck", "-fy", spec.Active.File},
+						{"resize2fs", spec.Active.File, "16M"},
+						{"tune2fs", "-L", spec.Active.Label, spec.Active.File},
+					})).To(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).NotTo(Succeed())
+
+					// The new active image was seeded from the former one
+					f, _ := fs.ReadFile(activeImg)
+					Expect(f).To(Equal([]byte("active")))
+					f, _ = fs.ReadFile(passiveImg)
+					Expect(f).To(Equal([]byte("active")))
+					_, err = fs.Stat(spec.Active.File)
+					Expect(err).To(HaveOccurred())
+
+					state, err := config.LoadInstallState()
+					Expect(err).ToNot(HaveOccurred())
+					img := state.Partitions[constants.StatePartName].Images[constants.ActiveImgName]
+					Expect(img.SourceMetadata).To(Equal(&v1.DockerImageMeta{Digest: "sha256:new"}))
+				})
+				It("Falls back to a full upgrade if the current image layers are not reused", Label("docker"), func() {
+					l.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+						return &v1.DockerImageMeta{Layers: []string{"sha256:" + image}}, nil
+					}
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(l.UnpackCalled()).To(BeTrue())
+					Expect(l.UnpackLayersCalled()).To(BeFalse())
+					Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).To(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"cp"}})).NotTo(Succeed())
+					Expect(memLog).To(ContainSubstring("doing a full upgrade"))
+				})
+				It("Falls back to a full upgrade if the current image was not deployed from a container image", Label("docker"), func() {
+					spec.State = nil
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(l.UnpackCalled()).To(BeTrue())
+					Expect(l.UnpackLayersCalled()).To(BeFalse())
+					Expect(memLog).To(ContainSubstring("doing a full upgrade"))
+				})
+				It("Falls back to a full upgrade if there is no image to reuse", Label("docker"), func() {
+					Expect(fs.RemoveAll(activeImg)).To(Succeed())
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(l.UnpackCalled()).To(BeTrue())
+					Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).To(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"resize2fs"}})).NotTo(Succeed())
+					Expect(memLog).To(ContainSubstring("doing a full upgrade"))
+
+					info, err := fs.Stat(activeImg)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(info.Size()).To(BeNumerically("==", int64(spec.Active.Size*1024*1024)))
+				})
+				It("Records the delta upgrade plan on dry runs", Label("docker", "dry-run"), func() {
+					plan, closeDryRun, err := dryrun.Setup(&config.Config)
+					Expect(err).ToNot(HaveOccurred())
+					defer closeDryRun()
+
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(l.UnpackLayersCalled()).To(BeFalse())
+					f, _ := fs.ReadFile(activeImg)
+					Expect(f).To(Equal([]byte("active")))
+					_, err = fs.Stat(spec.Active.File)
+					Expect(err).To(HaveOccurred())
+
+					out := &bytes.Buffer{}
+					Expect(plan.Print(out)).To(Succeed())
+					Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[file] copy %s into %s", activeImg, spec.Active.File)))
+					Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[run] resize2fs %s 16M", spec.Active.File)))
+					Expect(out.String()).To(ContainSubstring(fmt.Sprintf("[image] apply 1 of 2 layers of image registry.org/my/image:new (sha256:new) into %s", spec.Active.MountPoint)))
+					Expect(out.String()).NotTo(ContainSubstring("mkfs.ext2"))
+				})
+			})
+			It("Includes the elemental grub scripts into the grub.cfg of systems installed without it", Label("docker", "bootassess"), func() {
+				grubCfg := filepath.Join(constants.RunningStateDir, "grub2", "grub.cfg")
+				Expect(utils.MkdirAll(fs, filepath.Dir(grubCfg), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(grubCfg, []byte("set timeout=10\n"), constants.FilePerm)).To(Succeed())
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				content, err := fs.ReadFile(grubCfg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(HavePrefix("set timeout=10\n"))
+				Expect(string(content)).To(ContainSubstring(fmt.Sprintf("for elemental_script in %s", constants.GrubBootAssessment)))
+			})
+			It("Successfully upgrades setting the boot assessment", Label("docker", "bootassess"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.BootAssessTries = 3
+				upgrade = action.NewUpgradeAction(config, spec)
+				err := upgrade.Run()
+				Expect(err).ToNot(HaveOccurred())
+
+				grubEnv := filepath.Join(constants.RunningStateDir, constants.GrubOEMEnv)
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", grubEnv, "set", "boot_assessment_tries=3"},
+					{"grub2-editenv", grubEnv, "set", "boot_assessment_failed=no"},
+				})).To(BeNil())
+				_, err = fs.Stat(filepath.Join(constants.RunningStateDir, constants.GrubBootAssessment))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = fs.Stat(filepath.Join(constants.OEMDir, constants.BootAssessCheckFile))
+				Expect(err).ToNot(HaveOccurred())
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.BootAssessment.Tries).To(Equal(3))
+				Expect(state.BootAssessment.Status).To(Equal(constants.BootAssessPending))
+			})
 			It("Successfully reboots after upgrade from docker image", Label("docker"), func() {
 				spec.Active.Source = v1.NewDockerSrc("alpine")
 				config.Reboot = true
@@ -375,6 +558,174 @@ var _ = Describe("Runtime Actions", func() {
 				_, err = fs.Stat(spec.Active.File)
 				Expect(err).To(HaveOccurred())
 			})
+			It("Successfully upgrades to a pinned channel version", Label("channel", "version"), func() {
+				var unpacked string
+				l.UnpackFromChannelSideEffect = func(target string, pkg string, repos ...v1.Repository) (*v1.ChannelImageMeta, error) {
+					unpacked = pkg
+					return &v1.ChannelImageMeta{
+						Category: "system", Name: "cos-config", Version: "1.2.0", FingerPrint: "cos-config-system-1.2.0",
+					}, nil
+				}
+				spec.Active.Source = v1.NewChannelSrc("system/cos-config@1.3.0")
+				spec.Version = "1.2.0"
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(unpacked).To(Equal("system/cos-config@1.2.0"))
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				active := state.Partitions[constants.StatePartName].Images[constants.ActiveImgName]
+				Expect(active.Source.Value()).To(Equal("system/cos-config@1.2.0"))
+				meta, ok := active.SourceMetadata.(*v1.ChannelImageMeta)
+				Expect(ok).To(BeTrue())
+				Expect(meta.Version).To(Equal("1.2.0"))
+				Expect(meta.FingerPrint).To(Equal("cos-config-system-1.2.0"))
+			})
+			It("Lists the available versions of the channel packages", Label("channel", "version"), func() {
+				l.PackageVersionsSideEffect = func(pkg string, repos ...v1.Repository) ([]string, error) {
+					switch pkg {
+					case "system/cos-config":
+						Expect(repos).To(BeEmpty())
+						return []string{"1.1.0", "1.2.0"}, nil
+					case "recovery/cos-img":
+						Expect(repos).To(HaveLen(1))
+						return []string{"1.0.0"}, nil
+					}
+					return nil, fmt.Errorf("unexpected package %s", pkg)
+				}
+				spec.ListVersions = true
+				spec.State = &v1.InstallState{
+					Partitions: map[string]*v1.PartitionState{
+						constants.StatePartName: {
+							Images: map[string]*v1.ImageState{
+								constants.ActiveImgName: {
+									SourceMetadata: &v1.ChannelImageMeta{Category: "system", Name: "cos-config", Version: "1.1.0"},
+								},
+							},
+						},
+						constants.RecoveryPartName: {
+							Images: map[string]*v1.ImageState{
+								constants.RecoveryImgName: {
+									SourceMetadata: &v1.ChannelImageMeta{
+										Category: "recovery", Name: "cos-img", Version: "1.0.0",
+										Repos: []v1.Repository{{URI: "quay.io/some/repo"}},
+									},
+								},
+							},
+						},
+					},
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				versions, err := upgrade.ListVersions()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]*v1.PackageVersion{
+					{Package: "system/cos-config", Version: "1.1.0", Installed: true},
+					{Package: "system/cos-config", Version: "1.2.0"},
+					{Package: "recovery/cos-img", Version: "1.0.0", Installed: true},
+				}))
+			})
+			It("Fails to list versions without channel packages", Label("version"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.ListVersions = true
+				upgrade = action.NewUpgradeAction(config, spec)
+				_, err := upgrade.ListVersions()
+				Expect(err).To(HaveOccurred())
+			})
+			It("Successfully upgrades system and recovery in a single transaction", Label("docker", "all"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.All = true
+				Expect(spec.Sanitize()).To(Succeed())
+				recoveryFile := spec.Recovery.File
+				recoveryTarget := recoveryImg
+				if spec.Recovery.FS == constants.SquashFs {
+					recoveryTarget = recoveryImgSquash
+				}
+
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{
+					{"mv", "-f", activeImg, passiveImg},
+					{"mv", "-f", recoveryFile, recoveryTarget},
+					{"mv", "-f", spec.Active.File, activeImg},
+				})).To(Succeed())
+
+				// Hooks run once for the whole upgrade, as the before-upgrade hook does
+				runs := func(hook string) (n int) {
+					for _, stage := range cloudInit.ExecStages {
+						if stage == hook {
+							n++
+						}
+					}
+					return n
+				}
+				Expect(runs(constants.BeforeUpgradeHook)).To(BeNumerically(">", 0))
+				Expect(runs(constants.AfterUpgradeChrootHook)).To(Equal(runs(constants.BeforeUpgradeHook)))
+				Expect(runs(constants.AfterUpgradeHook)).To(Equal(runs(constants.BeforeUpgradeHook)))
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Partitions[constants.StatePartName].Images[constants.ActiveImgName].Source.Value()).To(HavePrefix("alpine"))
+				Expect(state.Partitions[constants.RecoveryPartName].Images[constants.RecoveryImgName].Source.Value()).To(HavePrefix("alpine"))
+			})
+			It("Leaves current images untouched if the recovery image fails to deploy", Label("docker", "all"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Recovery.Source = v1.NewDockerSrc("recovery")
+				spec.All = true
+				Expect(spec.Sanitize()).To(Succeed())
+				l.UnpackSideEffect = func(target string, image string, local bool) (*v1.DockerImageMeta, error) {
+					if image == "recovery" {
+						return nil, fmt.Errorf("unpack failed")
+					}
+					return nil, nil
+				}
+
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).NotTo(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(Equal([]byte("active")))
+				_, err = fs.Stat(spec.Active.File)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile))
+				Expect(err).To(HaveOccurred())
+			})
+			It("Restores the recovery image from its backup if the system image can't be swapped", Label("docker", "all", "backup"), func() {
+				backupImg := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupImgFile)
+				defer fs.RemoveAll(recoveryImg)
+				_ = fs.WriteFile(recoveryImg, []byte("recovery"), constants.FilePerm)
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Recovery.Source = v1.NewDockerSrc("registry.org/recovery:v2")
+				spec.All = true
+				Expect(spec.Sanitize()).To(Succeed())
+				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					if command == "mv" && len(args) == 3 {
+						if args[1] == spec.Active.File {
+							return []byte{}, fmt.Errorf("mv failed")
+						}
+						return moveFile(fs, args[1], args[2])
+					}
+					return []byte{}, nil
+				}
+
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).NotTo(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{
+					{"mv", "-f", recoveryImg, backupImg},
+					{"mv", "-f", spec.Recovery.File, recoveryImg},
+					{"mv", "-f", backupImg, recoveryImg},
+				})).To(Succeed())
+				f, _ := fs.ReadFile(recoveryImg)
+				Expect(f).To(Equal([]byte("recovery")))
+				f, _ = fs.ReadFile(activeImg)
+				Expect(f).To(Equal([]byte("active")))
+				_, err := fs.Stat(backupImg)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile))
+				Expect(err).To(HaveOccurred())
+			})
 			It("Successfully upgrades with cosign", Pending, Label("channel", "cosign"), func() {})
 			It("Successfully upgrades with mtree", Pending, Label("channel", "mtree"), func() {})
 			It("Successfully upgrades with strict", Pending, Label("channel", "strict"), func() {})
@@ -484,6 +835,9 @@ var _ = Describe("Runtime Actions", func() {
 							_ = fs.WriteFile(recoveryImgSquash, f, constants.FilePerm)
 							_ = fs.RemoveAll(spec.Recovery.File)
 						}
+						if command == "cp" {
+							return (&v1.RealRunner{Logger: logger}).Run(command, args...)
+						}
 						return []byte{}, nil
 					}
 					config.Runner = runner
@@ -519,6 +873,48 @@ var _ = Describe("Runtime Actions", func() {
 					Expect(err).To(HaveOccurred())
 
 				})
+				It("Successfully upgrades recovery from an ISO", Label("iso"), func() {
+					iso := "/some/elemental.iso"
+					Expect(utils.MkdirAll(fs, filepath.Dir(iso), constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(iso, []byte("iso"), constants.FilePerm)).To(Succeed())
+					config.Mounter = &isoMounter{ErrorMounter: mounter, fs: fs}
+
+					spec.Iso = iso
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					f, _ := fs.ReadFile(recoveryImgSquash)
+					Expect(f).To(Equal([]byte("new recovery")))
+
+					// The ISO is unmounted and its checksum stored in the installation state
+					mnts, _ := mounter.FakeMounter.List()
+					for _, mnt := range mnts {
+						Expect(mnt.Device).NotTo(HaveSuffix(constants.IsoFile))
+					}
+					state, err := config.LoadInstallState()
+					Expect(err).ToNot(HaveOccurred())
+					img := state.Partitions[constants.RecoveryPartName].Images[constants.RecoveryImgName]
+					Expect(img.FS).To(Equal(constants.SquashFs))
+					Expect(img.SourceMetadata).To(Equal(&v1.IsoImageMeta{
+						Iso:      iso,
+						Checksum: "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac",
+					}))
+				})
+				It("Fails to upgrade recovery from an ISO without a recovery image", Label("iso"), func() {
+					iso := "/some/elemental.iso"
+					Expect(utils.MkdirAll(fs, filepath.Dir(iso), constants.DirPerm)).To(Succeed())
+					Expect(fs.WriteFile(iso, []byte("iso"), constants.FilePerm)).To(Succeed())
+
+					spec.Iso = iso
+					upgrade = action.NewUpgradeAction(config, spec)
+					err := upgrade.Run()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("can't set recovery image from ISO"))
+					mnts, _ := mounter.FakeMounter.List()
+					for _, mnt := range mnts {
+						Expect(mnt.Device).NotTo(HaveSuffix(constants.IsoFile))
+					}
+				})
 				It("Successfully upgrades recovery from directory", Label("directory"), func() {
 					srcDir, _ := utils.TempDir(fs, "", "elemental")
 					// create a random file on it
@@ -684,7 +1080,646 @@ var _ = Describe("Runtime Actions", func() {
 						Expect(err).To(HaveOccurred())
 					}
 				})
+				It("Keeps the current recovery image as a backup", Label("docker", "backup"), func() {
+					backupImg := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupImgFile)
+					defer fs.RemoveAll(backupImg)
+					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						if command == "cat" && args[0] == "/proc/cmdline" {
+							return []byte(constants.RecoveryLabel), nil
+						}
+						if command == "mv" && len(args) == 3 {
+							return moveFile(fs, args[1], args[2])
+						}
+						return []byte{}, nil
+					}
+					spec.State = &v1.InstallState{
+						Partitions: map[string]*v1.PartitionState{
+							constants.RecoveryPartName: {
+								Images: map[string]*v1.ImageState{
+									constants.RecoveryImgName: {Source: v1.NewDockerSrc("registry.org/recovery:v1")},
+								},
+							},
+						},
+					}
+					spec.Recovery.Source = v1.NewDockerSrc("registry.org/recovery:v2")
+
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					Expect(runner.IncludesCmds([][]string{
+						{"mv", "-f", recoveryImg, backupImg},
+						{"mv", "-f", spec.Recovery.File, recoveryImg},
+					})).To(Succeed())
+					f, _ := fs.ReadFile(backupImg)
+					Expect(f).To(ContainSubstring("recovery"))
+					info, err := fs.Stat(recoveryImg)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(info.Size()).To(BeNumerically("==", int64(spec.Recovery.Size*1024*1024)))
+
+					menu, err := fs.ReadFile(filepath.Join(constants.RunningStateDir, constants.GrubRecoveryBackup))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(menu)).To(ContainSubstring("set img=/cOS/" + constants.RecoveryBackupImgFile))
+
+					state, err := config.LoadInstallState()
+					Expect(err).ToNot(HaveOccurred())
+					images := state.Partitions[constants.RecoveryPartName].Images
+					Expect(images[constants.RecoveryBackupImgName].Source.Value()).To(Equal("registry.org/recovery:v1"))
+					Expect(images[constants.RecoveryImgName].Source.Value()).To(Equal("registry.org/recovery:v2"))
+				})
+				It("Replaces the previous recovery backup only once the upgrade is applied", Label("docker", "backup", "stage"), func() {
+					backupImg := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupImgFile)
+					previousBackup := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupSqshFile)
+					defer fs.RemoveAll(backupImg)
+					_ = fs.WriteFile(previousBackup, []byte("previous backup"), constants.FilePerm)
+					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						if command == "mv" && len(args) == 3 {
+							return moveFile(fs, args[1], args[2])
+						}
+						return []byte{}, nil
+					}
+					spec.Stage = true
+					spec.Recovery.Source = v1.NewDockerSrc("registry.org/recovery:v2")
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					f, _ := fs.ReadFile(previousBackup)
+					Expect(f).To(Equal([]byte("previous backup")))
+
+					spec.Stage = false
+					spec.ApplyStaged = true
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					_, err := fs.Stat(previousBackup)
+					Expect(err).To(HaveOccurred())
+					f, _ = fs.ReadFile(backupImg)
+					Expect(f).To(Equal([]byte("recovery")))
+				})
+				It("Drops the previous recovery backup if the upgrade is reverted", Label("docker", "backup"), func() {
+					previousBackup := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupImgFile)
+					menuFile := filepath.Join(constants.RunningStateDir, constants.GrubRecoveryBackup)
+					_ = fs.WriteFile(previousBackup, []byte("previous backup"), constants.FilePerm)
+					_ = fs.WriteFile(menuFile, []byte("menu"), constants.FilePerm)
+					spec.State = &v1.InstallState{
+						Partitions: map[string]*v1.PartitionState{
+							constants.RecoveryPartName: {
+								Images: map[string]*v1.ImageState{
+									constants.RecoveryImgName:       {Source: v1.NewDockerSrc("registry.org/recovery:v1")},
+									constants.RecoveryBackupImgName: {Source: v1.NewDockerSrc("registry.org/recovery:v0")},
+								},
+							},
+						},
+					}
+					writeInstallState(config, spec.State)
+					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						if command == "mv" && len(args) == 3 {
+							if args[1] == spec.Recovery.File {
+								return []byte{}, fmt.Errorf("mv failed")
+							}
+							return moveFile(fs, args[1], args[2])
+						}
+						return []byte{}, nil
+					}
+					spec.Recovery.Source = v1.NewDockerSrc("registry.org/recovery:v2")
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).NotTo(Succeed())
+
+					f, _ := fs.ReadFile(recoveryImg)
+					Expect(f).To(Equal([]byte("recovery")))
+					_, err := fs.Stat(previousBackup)
+					Expect(err).To(HaveOccurred())
+					_, err = fs.Stat(menuFile)
+					Expect(err).To(HaveOccurred())
+					state, err := config.LoadInstallState()
+					Expect(err).ToNot(HaveOccurred())
+					images := state.Partitions[constants.RecoveryPartName].Images
+					Expect(images[constants.RecoveryImgName].Source.Value()).To(Equal("registry.org/recovery:v1"))
+					Expect(images[constants.RecoveryBackupImgName]).To(BeNil())
+				})
+				It("Restores the current recovery image if the new one can't be moved in place", Label("docker", "backup"), func() {
+					backupImg := filepath.Join(constants.LiveDir, "cOS", constants.RecoveryBackupImgFile)
+					defer fs.RemoveAll(backupImg)
+					runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+						if command == "mv" && len(args) == 3 {
+							if args[1] == spec.Recovery.File {
+								return []byte{}, fmt.Errorf("mv failed")
+							}
+							return moveFile(fs, args[1], args[2])
+						}
+						return []byte{}, nil
+					}
+					spec.Recovery.Source = v1.NewDockerSrc("registry.org/recovery:v2")
+
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).NotTo(Succeed())
+
+					Expect(runner.IncludesCmds([][]string{{"mv", "-f", backupImg, recoveryImg}})).To(Succeed())
+					f, _ := fs.ReadFile(recoveryImg)
+					Expect(f).To(ContainSubstring("recovery"))
+					_, err = fs.Stat(backupImg)
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+		Describe("Upgrade transaction journal", Label("journal"), func() {
+			var err error
+			var journal string
+			var cmdFail string
+			var transitionImg string
+			BeforeEach(func() {
+				spec, err = conf.NewUpgradeSpec(config.Config)
+				Expect(err).ShouldNot(HaveOccurred())
+				spec.Recover = true
+				Expect(spec.Sanitize()).To(Succeed())
+
+				transitionImg = spec.Active.File
+				journal = filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile)
+
+				cmdFail = ""
+				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					if command == cmdFail {
+						return []byte{}, fmt.Errorf("%s failed", command)
+					}
+					if command == "mv" && len(args) == 3 {
+						return moveFile(fs, args[1], args[2])
+					}
+					return []byte{}, nil
+				}
+				_ = fs.WriteFile(activeImg, []byte("active"), constants.FilePerm)
+				_ = fs.WriteFile(passiveImg, []byte("passive"), constants.FilePerm)
+			})
+			AfterEach(func() {
+				_ = fs.RemoveAll(activeImg)
+				_ = fs.RemoveAll(passiveImg)
+				_ = fs.RemoveAll(transitionImg)
+				_ = fs.RemoveAll(journal)
+			})
+			writeJournal := func(phase string) {
+				Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+					Phase:      phase,
+					Transition: filepath.Join("cOS", constants.TransitionImgFile),
+					Target:     filepath.Join("cOS", constants.ActiveImgFile),
+					Passive:    filepath.Join("cOS", constants.PassiveImgFile),
+					State: &v1.InstallState{
+						Date: "upgraded",
+					},
+				}, journal)).To(Succeed())
+			}
+			It("Does nothing if there is no pending transaction", func() {
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+			})
+			It("Resumes a prepared transaction", func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				writeJournal(constants.UpgradePrepared)
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("transition"))
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("active"))
+				Expect(runner.IncludesCmds([][]string{{"tune2fs", "-L", constants.PassiveLabel, passiveImg}})).To(Succeed())
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Date).To(Equal("upgraded"))
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Resumes a transaction interrupted after backing up the active image", func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				Expect(fs.Rename(activeImg, passiveImg)).To(Succeed())
+				writeJournal(constants.UpgradePrepared)
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("transition"))
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Resumes a transaction interrupted before swapping the recovery image", Label("all"), func() {
+				recoveryTransition := filepath.Join(constants.LiveDir, "cOS", constants.TransitionImgFile)
+				defer fs.RemoveAll(recoveryTransition)
+				defer fs.RemoveAll(recoveryImg)
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				_ = fs.WriteFile(recoveryTransition, []byte("recovery transition"), constants.FilePerm)
+				_ = fs.WriteFile(recoveryImg, []byte("recovery"), constants.FilePerm)
+				Expect(fs.Rename(activeImg, passiveImg)).To(Succeed())
+				Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+					Phase:              constants.UpgradeBackedUp,
+					Transition:         filepath.Join("cOS", constants.TransitionImgFile),
+					Target:             filepath.Join("cOS", constants.ActiveImgFile),
+					Passive:            filepath.Join("cOS", constants.PassiveImgFile),
+					RecoveryTransition: filepath.Join("cOS", constants.TransitionImgFile),
+					RecoveryTarget:     filepath.Join("cOS", constants.RecoveryImgFile),
+				}, journal)).To(Succeed())
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("transition"))
+				f, _ = fs.ReadFile(recoveryImg)
+				Expect(f).To(ContainSubstring("recovery transition"))
+				_, err = fs.Stat(recoveryTransition)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Completes a committed transaction", func() {
+				writeJournal(constants.UpgradeCommitted)
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Date).To(Equal("upgraded"))
+				_, err = fs.Stat(filepath.Join(constants.LiveDir, constants.InstallStateFile))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Reverts a transaction without transition image", func() {
+				Expect(fs.Rename(activeImg, passiveImg)).To(Succeed())
+				writeJournal(constants.UpgradeBackedUp)
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				Expect(runner.IncludesCmds([][]string{{"tune2fs", "-L", constants.ActiveLabel, activeImg}})).To(Succeed())
+				_, err = fs.Stat(filepath.Join(constants.RunningStateDir, constants.InstallStateFile))
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Keeps the journal if the transaction can't be recovered", func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				writeJournal(constants.UpgradePrepared)
+				cmdFail = "mv"
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).NotTo(Succeed())
+				_, err = fs.Stat(journal)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			It("Reverts the upgrade if the transition image can't be moved in place", Label("docker"), func() {
+				spec.Recover = false
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Active.Size = 16
+				runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+					if command == "mv" && len(args) == 3 {
+						if args[1] == transitionImg {
+							return []byte{}, fmt.Errorf("mv failed")
+						}
+						return moveFile(fs, args[1], args[2])
+					}
+					return []byte{}, nil
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).NotTo(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err = fs.Stat(transitionImg)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Stages an upgrade and applies it later", Label("docker", "stage"), func() {
+				spec.Recover = false
+				spec.Stage = true
+				spec.Active.Source = v1.NewDockerSrc("registry.org/os:v2")
+				spec.Active.Size = 16
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err = fs.Stat(transitionImg)
+				Expect(err).ToNot(HaveOccurred())
+				j, err := action.LoadUpgradeJournal(fs, journal)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(j.Phase).To(Equal(constants.UpgradeStaged))
+
+				runner.ClearCmds()
+				spec.Stage = false
+				spec.ApplyStaged = true
+				spec.Active.Source = v1.NewEmptySrc()
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{
+					{"mv", "-f", activeImg, passiveImg},
+					{"mv", "-f", transitionImg, activeImg},
+				})).To(Succeed())
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("active"))
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Partitions[constants.StatePartName].Images[constants.ActiveImgName].Source.Value()).To(Equal("registry.org/os:v2"))
+				_, err = fs.Stat(transitionImg)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Computes the installation state of a staged upgrade once it is applied", Label("docker", "stage"), func() {
+				Expect(utils.MkdirAll(fs, filepath.Join(spec.Active.MountPoint, "etc"), constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(
+					filepath.Join(spec.Active.MountPoint, "etc", "os-release"),
+					[]byte("GRUB_ENTRY_NAME=STAGED"), constants.FilePerm,
+				)).To(Succeed())
+				installState := func(active, passive string) *v1.InstallState {
+					return &v1.InstallState{
+						Partitions: map[string]*v1.PartitionState{
+							constants.StatePartName: {
+								Images: map[string]*v1.ImageState{
+									constants.ActiveImgName:  {Label: constants.ActiveLabel, Source: v1.NewDockerSrc(active)},
+									constants.PassiveImgName: {Label: constants.PassiveLabel, Source: v1.NewDockerSrc(passive)},
+								},
+							},
+						},
+					}
+				}
+				spec.State = installState("registry.org/os:v1", "registry.org/os:v0")
+				writeInstallState(config, spec.State)
+
+				spec.Recover = false
+				spec.Stage = true
+				spec.Active.Source = v1.NewDockerSrc("registry.org/os:v2")
+				spec.Active.Size = 16
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(memLog.String()).NotTo(ContainSubstring("Setting default grub entry to STAGED"))
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(state.Partitions[constants.StatePartName].Images[constants.ActiveImgName].Source.Value()).To(Equal("registry.org/os:v1"))
+
+				// The installation state changes before applying the staged upgrade, as on rollbacks
+				spec.State = installState("registry.org/os:v0", "registry.org/os:v1")
+				writeInstallState(config, spec.State)
+				spec.Stage = false
+				spec.ApplyStaged = true
+				spec.Active.Source = v1.NewEmptySrc()
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(memLog.String()).To(ContainSubstring("Setting default grub entry to STAGED"))
+
+				state, err = config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				images := state.Partitions[constants.StatePartName].Images
+				Expect(images[constants.ActiveImgName].Source.Value()).To(Equal("registry.org/os:v2"))
+				Expect(images[constants.PassiveImgName].Source.Value()).To(Equal("registry.org/os:v0"))
+			})
+			It("Leaves a staged upgrade in place when recovering transactions", Label("stage"), func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				writeJournal(constants.UpgradeStaged)
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				_, err = fs.Stat(transitionImg)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			It("Fails to upgrade while an upgrade is staged", Label("docker", "stage"), func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				writeJournal(constants.UpgradeStaged)
+				spec.Recover = false
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				upgrade = action.NewUpgradeAction(config, spec)
+				err = upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("--apply-staged"))
+
+				Expect(l.UnpackCalled()).To(BeFalse())
+				f, _ := fs.ReadFile(transitionImg)
+				Expect(f).To(ContainSubstring("transition"))
+			})
+			It("Fails to apply a staged upgrade if there is none", Label("stage"), func() {
+				spec.Recover = false
+				spec.ApplyStaged = true
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).NotTo(Succeed())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+			})
+			It("Discards a staged upgrade", Label("stage"), func() {
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				writeJournal(constants.UpgradeStaged)
+				spec.Recover = false
+				spec.DiscardStaged = true
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				Expect(runner.IncludesCmds([][]string{{"mv"}})).NotTo(Succeed())
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err = fs.Stat(transitionImg)
+				Expect(err).To(HaveOccurred())
+				_, err = fs.Stat(journal)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Retains the configured number of snapshots", Label("docker", "snapshots"), func() {
+				snapshot := func(i int) string {
+					return filepath.Join(filepath.Dir(passiveImg), fmt.Sprintf(constants.SnapshotImgFile, i))
+				}
+				_ = fs.WriteFile(snapshot(1), []byte("snapshot-1"), constants.FilePerm)
+				_ = fs.WriteFile(snapshot(2), []byte("snapshot-2"), constants.FilePerm)
+				_ = fs.WriteFile(snapshot(3), []byte("snapshot-3"), constants.FilePerm)
+				spec.Recover = false
+				spec.Snapshots = 3
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Active.Size = 16
+				spec.State = &v1.InstallState{
+					Partitions: map[string]*v1.PartitionState{
+						constants.StatePartName: {
+							Images: map[string]*v1.ImageState{
+								constants.ActiveImgName:  {Label: constants.ActiveLabel},
+								constants.PassiveImgName: {Label: constants.PassiveLabel},
+								"snapshot-1":             {Label: "COS_SNAPSHOT_1"},
+								"snapshot-2":             {Label: "COS_SNAPSHOT_2"},
+								"snapshot-3":             {Label: "COS_SNAPSHOT_3"},
+							},
+						},
+					},
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("active"))
+				f, _ = fs.ReadFile(snapshot(1))
+				Expect(f).To(ContainSubstring("passive"))
+				f, _ = fs.ReadFile(snapshot(2))
+				Expect(f).To(ContainSubstring("snapshot-1"))
+				_, err = fs.Stat(snapshot(3))
+				Expect(err).To(HaveOccurred())
+				Expect(runner.IncludesCmds([][]string{
+					{"tune2fs", "-L", "COS_SNAPSHOT_2", snapshot(1)},
+					{"tune2fs", "-L", "COS_SNAPSHOT_1", passiveImg},
+				})).To(Succeed())
+
+				menu, err := fs.ReadFile(filepath.Join(constants.RunningStateDir, constants.GrubSnapshots))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(menu)).To(ContainSubstring("--id snapshot-2"))
+				Expect(string(menu)).NotTo(ContainSubstring("--id snapshot-3"))
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				images := state.Partitions[constants.StatePartName].Images
+				Expect(images[constants.PassiveImgName].Label).To(Equal(constants.PassiveLabel))
+				Expect(images["snapshot-1"].Label).To(Equal("COS_SNAPSHOT_1"))
+				Expect(images["snapshot-2"].Label).To(Equal("COS_SNAPSHOT_2"))
+				Expect(images["snapshot-3"]).To(BeNil())
+			})
+			It("Keeps the snapshots after a gap in place", Label("docker", "snapshots"), func() {
+				snapshot := func(i int) string {
+					return filepath.Join(filepath.Dir(passiveImg), fmt.Sprintf(constants.SnapshotImgFile, i))
+				}
+				// snapshot-1 was deleted, leaving a gap between passive and snapshot-2
+				_ = fs.WriteFile(snapshot(2), []byte("snapshot-2"), constants.FilePerm)
+				spec.Recover = false
+				spec.Snapshots = 3
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Active.Size = 16
+				spec.State = &v1.InstallState{
+					Partitions: map[string]*v1.PartitionState{
+						constants.StatePartName: {
+							Images: map[string]*v1.ImageState{
+								constants.ActiveImgName:  {Label: constants.ActiveLabel, Source: v1.NewDockerSrc("registry.org/os:active")},
+								constants.PassiveImgName: {Label: constants.PassiveLabel, Source: v1.NewDockerSrc("registry.org/os:passive")},
+								"snapshot-2":             {Label: "COS_SNAPSHOT_2", Source: v1.NewDockerSrc("registry.org/os:snapshot-2")},
+							},
+						},
+					},
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(snapshot(1))
+				Expect(f).To(ContainSubstring("passive"))
+				f, _ = fs.ReadFile(snapshot(2))
+				Expect(f).To(ContainSubstring("snapshot-2"))
+
+				state, err := config.LoadInstallState()
+				Expect(err).ToNot(HaveOccurred())
+				images := state.Partitions[constants.StatePartName].Images
+				Expect(images[constants.PassiveImgName].Source.Value()).To(Equal("registry.org/os:active"))
+				Expect(images["snapshot-1"].Label).To(Equal("COS_SNAPSHOT_1"))
+				Expect(images["snapshot-1"].Source.Value()).To(Equal("registry.org/os:passive"))
+				Expect(images["snapshot-2"].Label).To(Equal("COS_SNAPSHOT_2"))
+				Expect(images["snapshot-2"].Source.Value()).To(Equal("registry.org/os:snapshot-2"))
+			})
+			It("Resumes a transaction interrupted while rotating snapshots", Label("snapshots"), func() {
+				snapshot := func(i int) string {
+					return filepath.Join(filepath.Dir(passiveImg), fmt.Sprintf(constants.SnapshotImgFile, i))
+				}
+				// snapshot-1 was already moved to snapshot-2
+				_ = fs.WriteFile(snapshot(2), []byte("snapshot-1"), constants.FilePerm)
+				_ = fs.WriteFile(transitionImg, []byte("transition"), constants.FilePerm)
+				Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+					Phase:      constants.UpgradePrepared,
+					Transition: filepath.Join("cOS", constants.TransitionImgFile),
+					Target:     filepath.Join("cOS", constants.ActiveImgFile),
+					Passive:    filepath.Join("cOS", constants.PassiveImgFile),
+					Snapshots:  3,
+				}, journal)).To(Succeed())
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("transition"))
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("active"))
+				f, _ = fs.ReadFile(snapshot(1))
+				Expect(f).To(ContainSubstring("passive"))
+				f, _ = fs.ReadFile(snapshot(2))
+				Expect(f).To(ContainSubstring("snapshot-1"))
+			})
+			It("Reverts the snapshots rotation of a transaction without transition image", Label("snapshots"), func() {
+				snapshot1 := filepath.Join(filepath.Dir(passiveImg), fmt.Sprintf(constants.SnapshotImgFile, 1))
+				Expect(fs.Rename(passiveImg, snapshot1)).To(Succeed())
+				Expect(fs.Rename(activeImg, passiveImg)).To(Succeed())
+				Expect(config.WriteUpgradeJournal(&v1.UpgradeJournal{
+					Phase:      constants.UpgradeBackedUp,
+					Transition: filepath.Join("cOS", constants.TransitionImgFile),
+					Target:     filepath.Join("cOS", constants.ActiveImgFile),
+					Passive:    filepath.Join("cOS", constants.PassiveImgFile),
+					Snapshots:  2,
+				}, journal)).To(Succeed())
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				f, _ = fs.ReadFile(passiveImg)
+				Expect(f).To(ContainSubstring("passive"))
+				_, err = fs.Stat(snapshot1)
+				Expect(err).To(HaveOccurred())
+				Expect(runner.IncludesCmds([][]string{{"tune2fs", "-L", constants.PassiveLabel, snapshot1}})).To(Succeed())
 			})
 		})
 	})
 })
+
+var _ = Describe("Upgrade journal", Label("upgrade", "journal"), func() {
+	var config *v1.RunConfig
+	var fs vfs.FS
+	var cleanup func()
+	var journalPath string
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		config = conf.NewRunConfig(conf.WithFs(fs))
+		journalPath = filepath.Join(constants.RunningStateDir, constants.UpgradeJournalFile)
+		Expect(utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)).To(Succeed())
+	})
+	AfterEach(func() { cleanup() })
+
+	It("Writes and loads an upgrade journal", func() {
+		journal, err := action.LoadUpgradeJournal(fs, journalPath)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(journal).To(BeNil())
+
+		journal = &v1.UpgradeJournal{
+			Phase:      constants.UpgradePrepared,
+			Transition: "cOS/transition.img",
+			Target:     "cOS/active.img",
+			Passive:    "cOS/passive.img",
+		}
+		Expect(config.WriteUpgradeJournal(journal, journalPath)).To(Succeed())
+		loadedJournal, err := action.LoadUpgradeJournal(fs, journalPath)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(*loadedJournal).To(Equal(*journal))
+	})
+	It("Fails loading an upgrade journal that can't be read", func() {
+		Expect(fs.WriteFile("/somefile", []byte{}, constants.FilePerm)).To(Succeed())
+		_, err := action.LoadUpgradeJournal(fs, filepath.Join("/somefile", constants.UpgradeJournalFile))
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+// isoMounter fakes the content of an ISO providing a recovery image once it is mounted
+type isoMounter struct {
+	*v1mock.ErrorMounter
+	fs vfs.FS
+}
+
+func (m isoMounter) Mount(source string, target string, fstype string, options []string) error {
+	if filepath.Base(source) == constants.IsoFile {
+		_ = m.fs.WriteFile(filepath.Join(target, constants.RecoverySquashFile), []byte("new recovery"), constants.FilePerm)
+	}
+	return m.ErrorMounter.Mount(source, target, fstype, options)
+}
@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"runtime"
 
+	"github.com/canonical/nullboot/efibootmgr"
 	"github.com/twpayne/go-vfs"
 	"k8s.io/mount-utils"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/rancher/elemental-cli/pkg/constants"
 	"github.com/rancher/elemental-cli/pkg/http"
 	"github.com/rancher/elemental-cli/pkg/luet"
+	"github.com/rancher/elemental-cli/pkg/partitioner"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 )
@@ -76,6 +78,13 @@ func WithClient(client v1.HTTPClient) func(r *v1.Config) error {
 	}
 }
 
+func WithEFIVariables(efivars efibootmgr.EFIVariables) func(r *v1.Config) error {
+	return func(r *v1.Config) error {
+		r.EFIVariables = efivars
+		return nil
+	}
+}
+
 func WithCloudInitRunner(ci v1.CloudInitRunner) func(r *v1.Config) error {
 	return func(r *v1.Config) error {
 		r.CloudInitRunner = ci
@@ -110,6 +119,7 @@ func NewConfig(opts ...GenericOptions) *v1.Config {
 		Logger:                    log,
 		Syscall:                   &v1.RealSyscall{},
 		Client:                    http.NewClient(),
+		EFIVariables:              efibootmgr.RealEFIVariables{},
 		Repos:                     []v1.Repository{},
 		Arch:                      arch,
 		SquashFsCompressionConfig: constants.GetDefaultSquashfsCompressionOptions(),
@@ -227,6 +237,9 @@ func NewInstallSpec(cfg v1.Config) *v1.InstallSpec {
 		Active:     activeImg,
 		Recovery:   recoveryImg,
 		Passive:    passiveImg,
+		Requirements: v1.InstallRequirements{
+			MinMemory: constants.MinMemory,
+		},
 	}
 }
 
@@ -336,6 +349,11 @@ func NewUpgradeSpec(cfg v1.Config) (*v1.UpgradeSpec, error) {
 		}
 	}
 
+	// Logical volumes are not listed among the host partitions, encrypted ones are already unlocked
+	if persistent := persistentFromState(installState); ep.Persistent == nil && persistent != nil && persistent.Encryption == nil {
+		ep.Persistent = persistent
+	}
+
 	// This is needed if we want to use the persistent as tmpdir for the upgrade images
 	// as tmpfs is 25% of the total RAM, we cannot rely on the tmp dir having enough space for our image
 	// This enables upgrades on low ram devices
@@ -349,12 +367,165 @@ func NewUpgradeSpec(cfg v1.Config) (*v1.UpgradeSpec, error) {
 		Active:     active,
 		Recovery:   recovery,
 		Passive:    passive,
+		Snapshots:  1,
+		Partitions: ep,
+		State:      installState,
+	}, nil
+}
+
+// getStateAndRecoveryPartitions returns the host partitions ensuring state and recovery
+// partitions are found and have a mountpoint
+func getStateAndRecoveryPartitions() (v1.ElementalPartitions, error) {
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		return v1.ElementalPartitions{}, fmt.Errorf("could not read host partitions")
+	}
+	ep := v1.NewElementalPartitionsFromList(parts)
+
+	if ep.State == nil {
+		return ep, fmt.Errorf("state partition not found")
+	}
+	if ep.State.MountPoint == "" {
+		ep.State.MountPoint = constants.StateDir
+	}
+
+	if ep.Recovery == nil {
+		return ep, fmt.Errorf("recovery partition not found")
+	}
+	if ep.Recovery.MountPoint == "" {
+		ep.Recovery.MountPoint = constants.RecoveryDir
+	}
+	return ep, nil
+}
+
+// NewRollbackSpec returns a RollbackSpec struct all based on defaults and current host state
+func NewRollbackSpec(cfg v1.Config) (*v1.RollbackSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	ep, err := getStateAndRecoveryPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.RollbackSpec{
+		GrubDefEntry: constants.GrubDefEntry,
+		Active: v1.Image{
+			File:       filepath.Join(ep.State.MountPoint, "cOS", constants.ActiveImgFile),
+			Label:      constants.ActiveLabel,
+			FS:         constants.LinuxImgFs,
+			MountPoint: constants.TransitionDir,
+		},
+		Passive: v1.Image{
+			File:  filepath.Join(ep.State.MountPoint, "cOS", constants.PassiveImgFile),
+			Label: constants.PassiveLabel,
+			FS:    constants.LinuxImgFs,
+		},
 		Partitions: ep,
 		State:      installState,
 	}, nil
 }
 
+// NewBootAssessSpec returns a BootAssessSpec struct all based on defaults and current host state
+func NewBootAssessSpec(cfg v1.Config) (*v1.BootAssessSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	ep, err := getStateAndRecoveryPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.BootAssessSpec{
+		Partitions: ep,
+		State:      installState,
+	}, nil
+}
+
+// NewSnapshotsSpec returns a SnapshotsSpec struct all based on defaults and current host state
+func NewSnapshotsSpec(cfg v1.Config) (*v1.SnapshotsSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	ep, err := getStateAndRecoveryPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.SnapshotsSpec{
+		Partitions: ep,
+		State:      installState,
+	}, nil
+}
+
+// NewRecoveryBackupSpec returns a RecoveryBackupSpec struct all based on the current host state
+func NewRecoveryBackupSpec(cfg v1.Config) (*v1.RecoveryBackupSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	ep, err := getStateAndRecoveryPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.RecoveryBackupSpec{
+		Partitions: ep,
+		State:      installState,
+	}, nil
+}
+
+// NewStatusSpec returns a StatusSpec struct all based on the current host state
+func NewStatusSpec(cfg v1.Config) (*v1.StatusSpec, error) {
+	installState, err := cfg.LoadInstallState()
+	if err != nil {
+		cfg.Logger.Warnf("failed reading installation state: %s", err.Error())
+	}
+
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("could not read host partitions")
+	}
+
+	return &v1.StatusSpec{
+		Partitions: parts,
+		State:      installState,
+	}, nil
+}
+
 // NewResetSpec returns a ResetSpec struct all based on defaults and current host state
+// persistentFromState returns the persistent partition recorded in the installation state if it
+// can't be found among the host partitions, that is if it is encrypted or a logical volume.
+func persistentFromState(installState *v1.InstallState) *v1.Partition {
+	if installState == nil {
+		return nil
+	}
+	pState := installState.Partitions[constants.PersistentPartName]
+	switch {
+	case pState != nil && pState.Encryption != nil:
+		return &v1.Partition{
+			FilesystemLabel: pState.FSLabel,
+			FS:              pState.FS,
+			Encryption:      pState.Encryption,
+			Path:            filepath.Join("/dev/disk/by-uuid", pState.Encryption.UUID),
+		}
+	case pState != nil && pState.VolumeGroup != "":
+		return &v1.Partition{
+			FilesystemLabel: pState.FSLabel,
+			FS:              pState.FS,
+			Path:            partitioner.LogicalVolumeDevice(pState.VolumeGroup, constants.PersistentPartName),
+		}
+	}
+	return nil
+}
+
 func NewResetSpec(cfg v1.Config) (*v1.ResetSpec, error) {
 	var imgSource *v1.ImageSource
 
@@ -414,6 +585,18 @@ func NewResetSpec(cfg v1.Config) (*v1.ResetSpec, error) {
 		cfg.Logger.Warnf("no OEM partition found")
 	}
 
+	// Encrypted persistent partition can't be found by label while locked
+	if persistent := persistentFromState(installState); persistent != nil {
+		ep.Persistent = persistent
+	}
+	// Subvolumes are created again on reset instead of formatting the whole partition
+	if ep.Persistent != nil && installState != nil {
+		if pState := installState.Partitions[constants.PersistentPartName]; pState != nil && len(pState.Subvolumes) > 0 {
+			ep.Persistent.FS = pState.FS
+			ep.Persistent.Subvolumes = pState.Subvolumes
+		}
+	}
+
 	// Persistent partition is not a hard requirement
 	if ep.Persistent != nil {
 		if ep.Persistent.MountPoint == "" {
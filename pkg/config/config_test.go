@@ -259,6 +259,52 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					Expect(err).ShouldNot(HaveOccurred())
 					Expect(spec.Active.Source.IsEmpty()).To(BeTrue())
 				})
+				It("sets the encrypted persistent partition from the installation state", Label("encryption"), func() {
+					err = utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = fs.WriteFile(filepath.Join(constants.RunningStateDir, constants.InstallStateFile), []byte(
+						"state:\n  label: COS_STATE\npersistent:\n  label: COS_PERSISTENT\n  fs: xfs\n"+
+							"  encryption:\n    keyfile: /keyfile\n    uuid: \"1234\"\n",
+					), constants.FilePerm)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					spec, err := config.NewResetSpec(*c)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Partitions.Persistent.Path).To(Equal("/dev/disk/by-uuid/1234"))
+					Expect(spec.Partitions.Persistent.FS).To(Equal("xfs"))
+					Expect(spec.Partitions.Persistent.Name).To(Equal(constants.PersistentPartName))
+					Expect(spec.Partitions.Persistent.MountPoint).To(Equal(constants.PersistentDir))
+					Expect(spec.Partitions.Persistent.Encryption.KeyFile).To(Equal("/keyfile"))
+				})
+				It("sets the persistent subvolumes from the installation state", Label("btrfs"), func() {
+					err = utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = fs.WriteFile(filepath.Join(constants.RunningStateDir, constants.InstallStateFile), []byte(
+						"state:\n  label: COS_STATE\npersistent:\n  label: COS_PERSISTENT\n  fs: btrfs\n"+
+							"  subvolumes:\n    - path: \"@home\"\n      compression: zstd\n",
+					), constants.FilePerm)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					spec, err := config.NewResetSpec(*c)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Partitions.Persistent.FS).To(Equal(constants.Btrfs))
+					Expect(spec.Partitions.Persistent.Subvolumes).To(Equal([]*v1.Subvolume{{Path: "@home", Compression: "zstd"}}))
+				})
+				It("sets the persistent logical volume from the installation state", Label("lvm"), func() {
+					err = utils.MkdirAll(fs, constants.RunningStateDir, constants.DirPerm)
+					Expect(err).ShouldNot(HaveOccurred())
+					err = fs.WriteFile(filepath.Join(constants.RunningStateDir, constants.InstallStateFile), []byte(
+						"state:\n  label: COS_STATE\npersistent:\n  label: COS_PERSISTENT\n  fs: xfs\n  volume-group: elemental\n",
+					), constants.FilePerm)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					spec, err := config.NewResetSpec(*c)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Partitions.Persistent.Path).To(Equal("/dev/elemental/persistent"))
+					Expect(spec.Partitions.Persistent.FS).To(Equal("xfs"))
+					Expect(spec.Partitions.Persistent.Encryption).To(BeNil())
+					Expect(spec.Partitions.Persistent.MountPoint).To(Equal(constants.PersistentDir))
+				})
 			})
 			Describe("Failures", func() {
 				var bootedFrom string
@@ -401,6 +447,68 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				})
 			})
 		})
+		Describe("RollbackSpec", Label("rollback"), func() {
+			var ghwTest v1mock.GhwMock
+			var mainDisk block.Disk
+			BeforeEach(func() {
+				mainDisk = block.Disk{
+					Name: "device",
+					Partitions: []*block.Partition{
+						{
+							Name:            "device1",
+							FilesystemLabel: constants.RecoveryLabel,
+							Type:            "ext4",
+						},
+						{
+							Name:            "device2",
+							FilesystemLabel: constants.StateLabel,
+							Type:            "ext4",
+							MountPoint:      constants.RunningStateDir,
+						},
+					},
+				}
+				ghwTest = v1mock.GhwMock{}
+			})
+			AfterEach(func() {
+				ghwTest.Clean()
+			})
+			It("sets rollback defaults", func() {
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				spec, err := config.NewRollbackSpec(*c)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Partitions.State.MountPoint).To(Equal(constants.RunningStateDir))
+				Expect(spec.Partitions.Recovery.MountPoint).To(Equal(constants.RecoveryDir))
+				Expect(spec.Active.File).To(Equal(filepath.Join(constants.RunningStateDir, "cOS", constants.ActiveImgFile)))
+				Expect(spec.Passive.File).To(Equal(filepath.Join(constants.RunningStateDir, "cOS", constants.PassiveImgFile)))
+				Expect(spec.Sanitize()).To(Succeed())
+			})
+			It("fails to set defaults if no recovery partition detected", func() {
+				mainDisk.Partitions = mainDisk.Partitions[1:]
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				_, err := config.NewRollbackSpec(*c)
+				Expect(err).Should(HaveOccurred())
+			})
+			It("sets boot assessment defaults", Label("bootassess"), func() {
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				spec, err := config.NewBootAssessSpec(*c)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Partitions.State.MountPoint).To(Equal(constants.RunningStateDir))
+				Expect(spec.Partitions.Recovery.MountPoint).To(Equal(constants.RecoveryDir))
+				Expect(spec.Sanitize()).To(Succeed())
+			})
+			It("sets snapshots defaults", Label("snapshots"), func() {
+				ghwTest.AddDisk(mainDisk)
+				ghwTest.CreateDevices()
+				spec, err := config.NewSnapshotsSpec(*c)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(spec.Partitions.State.MountPoint).To(Equal(constants.RunningStateDir))
+				Expect(spec.Partitions.Recovery.MountPoint).To(Equal(constants.RecoveryDir))
+				Expect(spec.Sanitize()).To(Succeed())
+			})
+		})
 		Describe("BuildConfig", Label("build"), func() {
 			It("initiates a new build config", func() {
 				build := config.NewBuildConfig()
@@ -25,10 +25,29 @@ const (
 	GrubConf               = "/etc/cos/grub.cfg"
 	GrubOEMEnv             = "grub_oem_env"
 	GrubDefEntry           = "cOS"
+	GrubBootAssessment     = "grub_boot_assessment"
+	BootAssessTriesVar     = "boot_assessment_tries"
+	BootAssessFailedVar    = "boot_assessment_failed"
+	BootAssessPending      = "pending"
+	BootAssessGood         = "good"
+	BootAssessFailed       = "failed"
+	BootAssessCheckFile    = "90_elemental_boot_assessment.yaml"
+	GrubSnapshots          = "grub_snapshots"
+	GrubRecoveryBackup     = "grub_recovery_backup"
+	GrubSavedEntryVar      = "saved_entry"
+	GrubFallbackEntryID    = "fallback"
+	GrubExtraCmdlineVar    = "extra_cmdline"
+	MirrorKernelCmdline    = "rd.auto=1 rd.md=1"
+	LVMKernelCmdline       = "rd.lvm.vg="
+	MdadmConf              = "/etc/mdadm.conf"
+	CrypttabFile           = "/etc/crypttab"
+	UnlockConfigFile       = "90_elemental_unlock.yaml"
 	DefaultTty             = "tty1"
 	BiosPartName           = "bios"
 	EfiLabel               = "COS_GRUB"
 	EfiPartName            = "efi"
+	LVMPartName            = "lvm"
+	VolumeGroupName        = "elemental"
 	ActiveLabel            = "COS_ACTIVE"
 	PassiveLabel           = "COS_PASSIVE"
 	SystemLabel            = "COS_SYSTEM"
@@ -37,15 +56,25 @@ const (
 	StateLabel             = "COS_STATE"
 	StatePartName          = "state"
 	InstallStateFile       = "state.yaml"
+	UpgradeJournalFile     = "upgrade-journal.yaml"
+	UpgradeStaged          = "staged"
+	UpgradePrepared        = "prepared"
+	UpgradeBackedUp        = "backed-up"
+	UpgradeCommitted       = "committed"
 	PersistentLabel        = "COS_PERSISTENT"
 	PersistentPartName     = "persistent"
 	OEMLabel               = "COS_OEM"
 	OEMPartName            = "oem"
 	MountBinary            = "/usr/bin/mount"
 	EfiDevice              = "/sys/firmware/efi"
+	SecureBootVar          = "/sys/firmware/efi/efivars/SecureBoot-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+	MemInfoFile            = "/proc/meminfo"
+	SysBlockDir            = "/sys/class/block"
+	MinMemory              = "1G"
 	LinuxFs                = "ext4"
 	LinuxImgFs             = "ext2"
 	SquashFs               = "squashfs"
+	Btrfs                  = "btrfs"
 	EfiFs                  = "vfat"
 	BiosFs                 = ""
 	EfiSize                = uint(64)
@@ -55,6 +84,7 @@ const (
 	PersistentSize         = uint(0)
 	BiosSize               = uint(1)
 	ImgSize                = uint(3072)
+	LayersExpansionFactor  = 2
 	HTTPTimeout            = 60
 	PartStage              = "partitioning"
 	LiveDir                = "/run/initramfs/live"
@@ -69,6 +99,8 @@ const (
 	ActiveImgFile          = "active.img"
 	PassiveImgFile         = "passive.img"
 	RecoveryImgFile        = "recovery.img"
+	RecoveryBackupImgFile  = "recovery-backup.img"
+	RecoveryBackupSqshFile = "recovery-backup.squashfs"
 	IsoBaseTree            = "/run/rootfsbase"
 	CosSetup               = "/usr/bin/cos-setup"
 	AfterInstallChrootHook = "after-install-chroot"
@@ -80,6 +112,8 @@ const (
 	AfterUpgradeChrootHook = "after-upgrade-chroot"
 	AfterUpgradeHook       = "after-upgrade"
 	BeforeUpgradeHook      = "before-upgrade"
+	AfterRollbackHook      = "after-rollback"
+	BeforeRollbackHook     = "before-rollback"
 	LuetCosignPlugin       = "luet-cosign"
 	LuetMtreePlugin        = "luet-mtree"
 	LuetDefaultRepoURI     = "quay.io/costoolkit/releases-green"
@@ -90,10 +124,15 @@ const (
 	ChannelSource          = "system/cos"
 	TransitionImgFile      = "transition.img"
 	TransitionSquashFile   = "transition.squashfs"
+	RollbackImgFile        = "rollback.img"
+	SnapshotImgFile        = "snapshot-%d.img"
+	SnapshotImgName        = "snapshot-%d"
+	SnapshotLabel          = "COS_SNAPSHOT_%d"
 	RunningStateDir        = "/run/initramfs/cos-state" // TODO: converge this constant with StateDir/RecoveryDir in dracut module from cos-toolkit
 	ActiveImgName          = "active"
 	PassiveImgName         = "passive"
 	RecoveryImgName        = "recovery"
+	RecoveryBackupImgName  = "recovery-backup"
 	GPT                    = "gpt"
 	BuildImgName           = "elemental"
 	UsrLocalPath           = "/usr/local"
@@ -108,6 +147,7 @@ const (
 	IsoKernelPath = "/boot/kernel"
 	IsoInitrdPath = "/boot/initrd"
 	IsoRootFile   = "rootfs.squashfs"
+	IsoFile       = "cOs.iso"
 	IsoEFIImg     = "uefi.img"
 	ISOLabel      = "COS_LIVE"
 
@@ -133,6 +173,11 @@ func GetCloudInitPaths() []string {
 	return []string{"/system/oem", "/oem/", "/usr/local/cloud-config/"}
 }
 
+// GetDirSourceExcludes returns the paths of directory sources that are not copied into images
+func GetDirSourceExcludes() []string {
+	return []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
+}
+
 // GetDefaultSquashfsOptions returns the default options to use when creating a squashfs
 func GetDefaultSquashfsOptions() []string {
 	return []string{"-b", "1024k"}
@@ -172,6 +217,8 @@ func GetRunKeyEnvMap() map[string]string {
 func GetInstallKeyEnvMap() map[string]string {
 	return map[string]string{
 		"target":              "TARGET",
+		"targets":             "TARGETS",
+		"mirror":              "MIRROR",
 		"system.uri":          "SYSTEM",
 		"recovery-system.uri": "RECOVERY_SYSTEM",
 		"cloud-init":          "CLOUD_INIT",
@@ -181,6 +228,9 @@ func GetInstallKeyEnvMap() map[string]string {
 		"no-format":           "NO_FORMAT",
 		"tty":                 "TTY",
 		"grub-entry-name":     "GRUB_ENTRY_NAME",
+		"image-size":          "IMAGE_SIZE",
+		"keep-persistent":     "KEEP_PERSISTENT",
+		"wipe":                "WIPE",
 	}
 }
 
@@ -197,9 +247,22 @@ func GetResetKeyEnvMap() map[string]string {
 // GetUpgradeKeyEnvMap returns environment variable bindings to UpgradeSpec data
 func GetUpgradeKeyEnvMap() map[string]string {
 	return map[string]string{
-		"recovery":            "RECOVERY",
-		"system.uri":          "SYSTEM",
-		"recovery-system.uri": "RECOVERY_SYSTEM",
+		"recovery":              "RECOVERY",
+		"all":                   "ALL",
+		"system.uri":            "SYSTEM",
+		"recovery-system.uri":   "RECOVERY_SYSTEM",
+		"boot-assessment-tries": "BOOT_ASSESSMENT_TRIES",
+		"snapshots":             "SNAPSHOTS",
+		"iso":                   "ISO",
+		"delta":                 "DELTA",
+		"version":               "VERSION",
+	}
+}
+
+// GetRollbackKeyEnvMap returns environment variable bindings to RollbackSpec data
+func GetRollbackKeyEnvMap() map[string]string {
+	return map[string]string{
+		"grub-entry-name": "GRUB_ENTRY_NAME",
 	}
 }
 
@@ -0,0 +1,47 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// Client records the downloads instead of fetching them, an empty file stands in for
+// the downloaded one in the upper layer
+type Client struct {
+	fs   *FS
+	plan *v1.Plan
+}
+
+// NewClient returns an HTTP client recording downloads into the given plan
+func NewClient(fs *FS, plan *v1.Plan) *Client {
+	return &Client{fs: fs, plan: plan}
+}
+
+func (c *Client) GetURL(log v1.Logger, url string, destination string) error {
+	c.plan.Record(v1.PlanFile, "download %s into %s", url, destination)
+	return c.fs.touchUpper(destination)
+}
+
+// GetURLWithChecksum records the download, the checksum is only verified once fetched
+func (c *Client) GetURLWithChecksum(log v1.Logger, url string, destination string, checksum string) error {
+	if checksum == "" {
+		return c.GetURL(log, url, destination)
+	}
+	c.plan.Record(v1.PlanFile, "download %s (%s) into %s", url, checksum, destination)
+	return c.fs.touchUpper(destination)
+}
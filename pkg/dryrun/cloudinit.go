@@ -0,0 +1,53 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"sync"
+
+	"github.com/mudler/yip/pkg/schema"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// CloudInitRunner records the cloud-init stages instead of running them. Stages are run
+// once per cloud-init source, but each stage is recorded only once.
+type CloudInitRunner struct {
+	runner v1.CloudInitRunner
+	plan   *v1.Plan
+	stages map[string]bool
+	mu     sync.Mutex
+}
+
+// NewCloudInitRunner returns a cloud-init runner wrapping the given one
+func NewCloudInitRunner(runner v1.CloudInitRunner, plan *v1.Plan) *CloudInitRunner {
+	return &CloudInitRunner{runner: runner, plan: plan, stages: map[string]bool{}}
+}
+
+func (c *CloudInitRunner) Run(stage string, _ ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stages[stage] {
+		c.stages[stage] = true
+		c.plan.Record(v1.PlanHook, "run '%s' stage", stage)
+	}
+	return nil
+}
+
+func (c *CloudInitRunner) SetModifier(m schema.Modifier) {
+	c.runner.SetModifier(m)
+}
@@ -0,0 +1,44 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// Setup wraps the interfaces of the given configuration so any change to the system is recorded
+// into a plan instead of being applied. The returned function releases the dry run resources.
+func Setup(cfg *v1.Config) (*v1.Plan, func() error, error) {
+	plan := v1.NewPlan()
+
+	fs, err := NewFS(cfg.Fs, plan)
+	if err != nil {
+		return nil, nil, err
+	}
+	mounter := NewMounter(cfg.Mounter, plan)
+
+	cfg.Fs = fs
+	cfg.Mounter = mounter
+	cfg.Runner = NewRunner(cfg.Runner, fs, plan)
+	cfg.Syscall = NewSyscall(cfg.Syscall, fs, mounter)
+	cfg.Luet = NewLuet(cfg.Luet, fs, plan)
+	cfg.CloudInitRunner = NewCloudInitRunner(cfg.CloudInitRunner, plan)
+	cfg.Client = NewClient(fs, plan)
+	cfg.EFIVariables = NewEFIVariables(cfg.EFIVariables, plan)
+
+	return plan, fs.Close, nil
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun_test
+
+import (
+	"bytes"
+	"testing"
+
+	efi "github.com/canonical/go-efilib"
+	"github.com/canonical/nullboot/efibootmgr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs"
+	"github.com/twpayne/go-vfs/vfst"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	"github.com/rancher/elemental-cli/pkg/dryrun"
+	part "github.com/rancher/elemental-cli/pkg/partitioner"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+	"github.com/rancher/elemental-cli/pkg/utils"
+	v1mock "github.com/rancher/elemental-cli/tests/mocks"
+)
+
+const printOutput = `BYT;
+/dev/loop0:50593792s:loopback:512:512:msdos:Loopback device:;
+1:2048s:98303s:96256s:ext4::type=83;`
+
+func TestDryRunSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Dry run test suite")
+}
+
+var _ = Describe("Dry run", Label("dry-run"), func() {
+	var plan *v1.Plan
+	var lower *vfst.TestFS
+	var fs *dryrun.FS
+	var cleanup func()
+	var err error
+
+	BeforeEach(func() {
+		plan = v1.NewPlan()
+		lower, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/etc/os-release": "NAME=test",
+			"/etc/hostname":   "host",
+			"/dev/loop0":      "",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		fs, err = dryrun.NewFS(lower, plan)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		Expect(fs.Close()).To(Succeed())
+		cleanup()
+	})
+
+	Describe("Plan", func() {
+		It("prints the recorded steps in order", func() {
+			plan.Record(v1.PlanDisk, "create partition %d", 1)
+			plan.RecordWithDetails(v1.PlanState, "a: 1\nb: 2\n", "write %s", "state.yaml")
+			out := &bytes.Buffer{}
+			Expect(plan.Print(out)).To(Succeed())
+			Expect(out.String()).To(Equal(
+				"  1. [disk] create partition 1\n  2. [state] write state.yaml\n       a: 1\n       b: 2\n",
+			))
+		})
+	})
+
+	Describe("Overlay filesystem", func() {
+		It("reads from the lower filesystem", func() {
+			data, err := fs.ReadFile("/etc/os-release")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("NAME=test")))
+			Expect(plan.Steps()).To(BeEmpty())
+		})
+		It("writes into the upper layer and records it", func() {
+			Expect(fs.WriteFile("/etc/os-release", []byte("NAME=new"), constants.FilePerm)).To(Succeed())
+			data, err := fs.ReadFile("/etc/os-release")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("NAME=new")))
+
+			data, err = lower.ReadFile("/etc/os-release")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("NAME=test")))
+
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{{Kind: v1.PlanFile, Description: "write /etc/os-release"}}))
+		})
+		It("hides removed files of the lower filesystem", func() {
+			Expect(fs.Remove("/etc/hostname")).To(Succeed())
+			exists, _ := utils.Exists(fs, "/etc/hostname")
+			Expect(exists).To(BeFalse())
+			exists, _ = utils.Exists(lower, "/etc/hostname")
+			Expect(exists).To(BeTrue())
+
+			Expect(fs.RemoveAll("/etc")).To(Succeed())
+			exists, _ = utils.Exists(fs, "/etc/os-release")
+			Expect(exists).To(BeFalse())
+			Expect(plan.Steps()).To(HaveLen(2))
+		})
+		It("merges directory contents of both layers", func() {
+			Expect(utils.MkdirAll(fs, "/etc/cos", constants.DirPerm)).To(Succeed())
+			Expect(fs.Remove("/etc/hostname")).To(Succeed())
+			entries, err := fs.ReadDir("/etc")
+			Expect(err).ShouldNot(HaveOccurred())
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			Expect(names).To(Equal([]string{"cos", "os-release"}))
+			exists, _ := utils.Exists(lower, "/etc/cos")
+			Expect(exists).To(BeFalse())
+		})
+		It("records installation state files including their content", func() {
+			Expect(utils.MkdirAll(fs, "/run/cos/state", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/run/cos/state/state.yaml.tmp", []byte("date: now\n"), constants.FilePerm)).To(Succeed())
+			Expect(fs.Rename("/run/cos/state/state.yaml.tmp", "/run/cos/state/state.yaml")).To(Succeed())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{{
+				Kind: v1.PlanState, Description: "write /run/cos/state/state.yaml", Details: "date: now\n",
+			}}))
+		})
+		It("reads the running system tree for content it does not fetch", func() {
+			Expect(utils.MkdirAll(fs, "/run/cos/active", constants.DirPerm)).To(Succeed())
+			fs.StandIn("/run/cos/active")
+			data, err := fs.ReadFile("/run/cos/active/etc/hostname")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("host")))
+			exists, _ := utils.Exists(fs, "/run/cos/active/dev/loop0")
+			Expect(exists).To(BeFalse())
+		})
+		It("maps raw paths to the upper layer", func() {
+			raw, err := fs.RawPath("/etc/os-release")
+			Expect(err).ShouldNot(HaveOccurred())
+			rawLower, _ := lower.RawPath("/etc/os-release")
+			Expect(raw).NotTo(Equal(rawLower))
+			Expect(fs.LowerPath(raw)).To(Equal("/etc/os-release"))
+		})
+	})
+
+	Describe("Runner", func() {
+		var runner *v1mock.FakeRunner
+		var dryRunner *dryrun.Runner
+		BeforeEach(func() {
+			runner = v1mock.NewFakeRunner()
+			runner.Logger = v1.NewNullLogger()
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "parted" {
+					return []byte(printOutput), nil
+				}
+				return []byte{}, nil
+			}
+			dryRunner = dryrun.NewRunner(runner, fs, plan)
+		})
+		It("runs read only commands and records the rest", func() {
+			_, err := dryRunner.Run("cat", "/proc/cmdline")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = dryRunner.Run("mkfs.ext4", "-L", "COS_STATE", "/dev/loop0p1")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = dryRunner.Run("sync")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(runner.CmdsMatch([][]string{{"cat", "/proc/cmdline"}})).To(Succeed())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanFormat, Description: "mkfs.ext4 -L COS_STATE /dev/loop0p1"},
+			}))
+		})
+		It("records file copies reading them from the source", func() {
+			Expect(utils.CopyImageFile(dryRunner, fs, "/etc/os-release", "/etc/os-release.bak")).To(Succeed())
+			data, err := fs.ReadFile("/etc/os-release.bak")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("NAME=test")))
+			raw, _ := fs.RawPath("/etc/os-release.bak")
+			exists, _ := utils.Exists(vfs.OSFS, raw)
+			Expect(exists).To(BeFalse())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanFile, Description: "copy /etc/os-release into /etc/os-release.bak"},
+			}))
+		})
+		It("records synchronizations reading the target tree from the source", func() {
+			Expect(utils.MkdirAll(fs, "/target", constants.DirPerm)).To(Succeed())
+			Expect(utils.SyncData(dryRunner, fs, "/etc", "/target", "/hostname")).To(Succeed())
+			entries, err := fs.ReadDir("/target")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name()).To(Equal("os-release"))
+			data, err := fs.ReadFile("/target/os-release")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("NAME=test")))
+			exists, _ := utils.Exists(fs, "/target/hostname")
+			Expect(exists).To(BeFalse())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanFile, Description: "sync directory /etc into /target"},
+			}))
+		})
+		It("records tarball extractions reading the target tree from the running system", func() {
+			Expect(utils.MkdirAll(fs, "/target", constants.DirPerm)).To(Succeed())
+			_, err := dryRunner.Run("tar", "--extract", "--file", "/tmp/rootfs.tar", "--directory", "/target")
+			Expect(err).ShouldNot(HaveOccurred())
+			data, err := fs.ReadFile("/target/etc/hostname")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("host")))
+			Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanImage, Description: "tar --extract --file /tmp/rootfs.tar --directory /target"},
+			}))
+		})
+		It("simulates the partition table of a disk", func() {
+			disk := part.NewDisk("/dev/loop0", part.WithRunner(dryRunner), part.WithFS(fs))
+			_, err := disk.NewPartitionTable("gpt")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(disk.GetLabel()).To(Equal("gpt"))
+			num, err := disk.AddPartition(64, "ext4", "oem")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(num).To(Equal(1))
+			num, err = disk.AddPartition(0, "ext4", "persistent")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(num).To(Equal(2))
+
+			dev, err := disk.FindPartitionDevice(2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dev).To(Equal("/dev/loop0p2"))
+			exists, _ := utils.Exists(lower, dev)
+			Expect(exists).To(BeFalse())
+
+			// Only the initial print reached the real device
+			Expect(runner.CmdsMatch([][]string{
+				{"parted", "--script", "--machine", "--", "/dev/loop0", "unit", "s", "print"},
+			})).To(Succeed())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanDisk, Description: "parted --script --machine -- /dev/loop0 unit s mklabel gpt"},
+				{Kind: v1.PlanDisk, Description: "parted --script --machine -- /dev/loop0 unit s mkpart oem ext4 2048 133119"},
+				{Kind: v1.PlanDisk, Description: "parted --script --machine -- /dev/loop0 unit s mkpart persistent ext4 133120 100%"},
+			}))
+		})
+	})
+
+	Describe("Client", func() {
+		It("records downloads without fetching them", func() {
+			client := dryrun.NewClient(fs, plan)
+			Expect(client.GetURL(v1.NewNullLogger(), "http://example.org/image.iso", "/tmp/image.iso")).To(Succeed())
+			exists, _ := utils.Exists(fs, "/tmp/image.iso")
+			Expect(exists).To(BeTrue())
+			exists, _ = utils.Exists(lower, "/tmp/image.iso")
+			Expect(exists).To(BeFalse())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanFile, Description: "download http://example.org/image.iso into /tmp/image.iso"},
+			}))
+		})
+		It("records the expected checksum of downloads", func() {
+			client := dryrun.NewClient(fs, plan)
+			checksum := "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac"
+			Expect(client.GetURLWithChecksum(v1.NewNullLogger(), "http://example.org/rootfs.tar", "/tmp/rootfs.tar", checksum)).To(Succeed())
+			exists, _ := utils.Exists(fs, "/tmp/rootfs.tar")
+			Expect(exists).To(BeTrue())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanFile, Description: "download http://example.org/rootfs.tar (" + checksum + ") into /tmp/rootfs.tar"},
+			}))
+		})
+	})
+
+	Describe("EFI variables", func() {
+		It("records written variables and reads them back", func() {
+			mock := &efibootmgr.MockEFIVariables{}
+			efivars := dryrun.NewEFIVariables(mock, plan)
+			guid := efi.MakeGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d, [...]uint8{0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c})
+			Expect(efivars.SetVariable(guid, "Boot0001", []byte("entry"), efi.AttributeNonVolatile)).To(Succeed())
+			data, _, err := efivars.GetVariable(guid, "Boot0001")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("entry")))
+			_, _, err = mock.GetVariable(guid, "Boot0001")
+			Expect(err).Should(HaveOccurred())
+
+			Expect(efibootmgr.DelVariable(efivars, guid, "Boot0001")).To(Succeed())
+			vars, err := efivars.ListVariables()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(vars).To(BeEmpty())
+			Expect(plan.Steps()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Mounter", func() {
+		It("records mounts and keeps track of them", func() {
+			mounter := dryrun.NewMounter(v1mock.NewErrorMounter(), plan)
+			Expect(mounter.Mount("/dev/loop0p1", "/run/cos/oem", "auto", []string{"rw"})).To(Succeed())
+			notMnt, err := mounter.IsLikelyNotMountPoint("/run/cos/oem")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(notMnt).To(BeFalse())
+			Expect(mounter.Unmount("/run/cos/oem")).To(Succeed())
+			Expect(mounter.IsMounted("/run/cos/oem")).To(BeFalse())
+			Expect(plan.Steps()).To(Equal([]v1.PlanStep{
+				{Kind: v1.PlanMount, Description: "mount /dev/loop0p1 on /run/cos/oem (type auto) with options rw"},
+				{Kind: v1.PlanMount, Description: "unmount /run/cos/oem"},
+			}))
+		})
+	})
+})
@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"sync"
+
+	efi "github.com/canonical/go-efilib"
+	efi_linux "github.com/canonical/go-efilib/linux"
+	"github.com/canonical/nullboot/efibootmgr"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// efiVariable is an EFI variable written during the dry run, nil data stands for a deleted variable
+type efiVariable struct {
+	data  []byte
+	attrs efi.VariableAttributes
+}
+
+// EFIVariables records the EFI variables to write and reads the real ones. Variables written
+// during the dry run are kept in memory, so boot entries can be looked up once created.
+type EFIVariables struct {
+	efivars efibootmgr.EFIVariables
+	plan    *v1.Plan
+	written map[efi.VariableDescriptor]efiVariable
+	mu      sync.Mutex
+}
+
+// NewEFIVariables returns EFI variables wrapping the given ones
+func NewEFIVariables(efivars efibootmgr.EFIVariables, plan *v1.Plan) *EFIVariables {
+	return &EFIVariables{efivars: efivars, plan: plan, written: map[efi.VariableDescriptor]efiVariable{}}
+}
+
+func (e *EFIVariables) ListVariables() ([]efi.VariableDescriptor, error) {
+	real, err := e.efivars.ListVariables()
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := []efi.VariableDescriptor{}
+	for _, v := range real {
+		if _, ok := e.written[v]; !ok {
+			list = append(list, v)
+		}
+	}
+	for v, variable := range e.written {
+		if variable.data != nil {
+			list = append(list, v)
+		}
+	}
+	return list, nil
+}
+
+func (e *EFIVariables) GetVariable(guid efi.GUID, name string) ([]byte, efi.VariableAttributes, error) {
+	e.mu.Lock()
+	variable, ok := e.written[efi.VariableDescriptor{Name: name, GUID: guid}]
+	e.mu.Unlock()
+	if !ok {
+		return e.efivars.GetVariable(guid, name)
+	}
+	if variable.data == nil {
+		return nil, 0, efi.ErrVarNotExist
+	}
+	return variable.data, variable.attrs, nil
+}
+
+func (e *EFIVariables) SetVariable(guid efi.GUID, name string, data []byte, attrs efi.VariableAttributes) error {
+	e.mu.Lock()
+	e.written[efi.VariableDescriptor{Name: name, GUID: guid}] = efiVariable{data: data, attrs: attrs}
+	e.mu.Unlock()
+	if data == nil {
+		e.plan.Record(v1.PlanGrub, "delete EFI variable %s-%s", name, guid)
+	} else {
+		e.plan.Record(v1.PlanGrub, "set EFI variable %s-%s", name, guid)
+	}
+	return nil
+}
+
+// NewFileDevicePath returns the device path of the given file, files of partitions only
+// mounted during the dry run are not in any real device, so only their path is used
+func (e *EFIVariables) NewFileDevicePath(filepath string, mode efi_linux.FileDevicePathMode) (efi.DevicePath, error) {
+	dp, err := e.efivars.NewFileDevicePath(filepath, mode)
+	if err != nil {
+		return efi.DevicePath{efi.NewFilePathDevicePathNode(filepath)}, nil
+	}
+	return dp, nil
+}
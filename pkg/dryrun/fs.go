@@ -0,0 +1,581 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/twpayne/go-vfs"
+
+	"github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+
+// standInExcludes are the paths of the running system not standing in for unknown trees
+var standInExcludes = []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
+
+// link makes a path of the lower filesystem readable from another path, so copies and
+// synchronizations are not applied but their result can still be read
+type link struct {
+	source   string
+	excludes []string
+}
+
+// FS is an overlay filesystem, reads fall through to the lower filesystem unless the path
+// was written or removed during the dry run. All writes land on an upper layer kept in a
+// temporary directory and they are recorded in the plan.
+type FS struct {
+	lower     v1.FS
+	upper     *vfs.PathFS
+	upperRoot string
+	removed   map[string]bool
+	links     map[string]link
+	plan      *v1.Plan
+	mu        sync.Mutex
+}
+
+// NewFS returns an overlay filesystem on top of the given filesystem. Close must be called
+// to release the upper layer.
+func NewFS(lower v1.FS, plan *v1.Plan) (*FS, error) {
+	upperRoot, err := os.MkdirTemp("", "elemental-dryrun")
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		lower:     lower,
+		upper:     vfs.NewPathFS(vfs.OSFS, upperRoot),
+		upperRoot: upperRoot,
+		removed:   map[string]bool{},
+		links:     map[string]link{},
+		plan:      plan,
+	}, nil
+}
+
+// Close removes the upper layer
+func (f *FS) Close() error {
+	return os.RemoveAll(f.upperRoot)
+}
+
+// LowerPath returns the path within the overlay of the given path of the upper layer,
+// paths out of the upper layer are returned as is.
+func (f *FS) LowerPath(path string) string {
+	rel, err := filepath.Rel(f.upperRoot, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+func (f *FS) inUpper(name string) bool {
+	_, err := f.upper.Lstat(name)
+	return err == nil
+}
+
+// isRemoved checks if the given path or any of its parents was removed from the lower layer
+func (f *FS) isRemoved(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for p := filepath.Clean(name); ; p = filepath.Dir(p) {
+		if f.removed[p] {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+// lowerPath returns the path of the lower layer the given path is read from. Paths within a
+// copied or synchronized tree are read from its source, unless excluded or missing there.
+func (f *FS) lowerPath(name string) string {
+	name = filepath.Clean(name)
+	f.mu.Lock()
+	var target string
+	for t := range f.links {
+		if (name == t || strings.HasPrefix(name, t+"/")) && len(t) > len(target) {
+			target = t
+		}
+	}
+	l, ok := f.links[target]
+	f.mu.Unlock()
+	if !ok {
+		return name
+	}
+	rel := strings.TrimPrefix(name, target)
+	for _, exclude := range l.excludes {
+		if rel == exclude || strings.HasPrefix(rel, exclude+"/") {
+			return name
+		}
+	}
+	source := filepath.Join(l.source, rel)
+	if _, err := f.lower.Lstat(source); err != nil {
+		return name
+	}
+	return source
+}
+
+// inLower checks if the given path is still visible from the lower layer
+func (f *FS) inLower(name string) bool {
+	if f.isRemoved(name) {
+		return false
+	}
+	_, err := f.lower.Lstat(f.lowerPath(name))
+	return err == nil
+}
+
+// addLink makes the given lower layer source readable from target
+func (f *FS) addLink(source, target string, excludes ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.removed, filepath.Clean(target))
+	f.links[filepath.Clean(target)] = link{source: filepath.Clean(source), excludes: excludes}
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// record adds the given file operation to the plan, temporary files are not recorded
+func (f *FS) record(format string, name string) {
+	if strings.HasPrefix(name, os.TempDir()) || strings.HasSuffix(name, ".tmp") {
+		return
+	}
+	f.plan.Record(v1.PlanFile, format, name)
+}
+
+// recordState adds the content of an installation state file to the plan
+func (f *FS) recordState(name string) {
+	data, _ := f.upper.ReadFile(name)
+	f.plan.RecordWithDetails(v1.PlanState, string(data), "write %s", name)
+}
+
+// upperDir makes sure the given directory exists in the upper layer
+func (f *FS) upperDir(dir string) error {
+	raw, err := f.upper.RawPath(dir)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(raw, constants.DirPerm)
+}
+
+// touchUpper creates an empty file in the upper layer, if not already there, without recording it
+func (f *FS) touchUpper(name string) error {
+	if f.inUpper(name) {
+		return nil
+	}
+	err := f.upperDir(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	return f.upper.WriteFile(name, []byte{}, constants.FilePerm)
+}
+
+// copyUp copies the given lower layer file to the upper layer, so it can be modified
+func (f *FS) copyUp(name string) error {
+	if f.inUpper(name) || !f.inLower(name) {
+		return nil
+	}
+	err := f.upperDir(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	fi, err := f.lower.Stat(f.lowerPath(name))
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return f.upperDir(name)
+	}
+	src, err := f.lower.Open(f.lowerPath(name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := f.upper.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (f *FS) Open(name string) (*os.File, error) {
+	if f.inUpper(name) {
+		fi, err := f.upper.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		// Images created during the dry run are sparse files, do not copy their apparent size around
+		if isSparse(fi) {
+			return os.Open(os.DevNull)
+		}
+		return f.upper.Open(name)
+	}
+	if f.isRemoved(name) {
+		return nil, notExist("open", name)
+	}
+	return f.lower.Open(f.lowerPath(name))
+}
+
+// isSparse checks if the given file has no data allocated at all
+func isSparse(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && !fi.IsDir() && fi.Size() > 0 && st.Blocks == 0
+}
+
+func (f *FS) Chmod(name string, mode os.FileMode) error {
+	err := f.copyUp(name)
+	if err != nil {
+		return err
+	}
+	return f.upper.Chmod(name, mode)
+}
+
+func (f *FS) Create(name string) (*os.File, error) {
+	err := f.upperDir(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	f.record("create %s", name)
+	return f.upper.Create(name)
+}
+
+func (f *FS) Mkdir(name string, perm os.FileMode) error {
+	if f.inUpper(name) || f.inLower(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	err := f.upperDir(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	return f.upper.Mkdir(name, perm)
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	if f.inUpper(name) {
+		return f.upper.Stat(name)
+	}
+	if f.isRemoved(name) {
+		return nil, notExist("stat", name)
+	}
+	return f.lower.Stat(f.lowerPath(name))
+}
+
+func (f *FS) Lstat(name string) (os.FileInfo, error) {
+	if f.inUpper(name) {
+		return f.upper.Lstat(name)
+	}
+	if f.isRemoved(name) {
+		return nil, notExist("lstat", name)
+	}
+	return f.lower.Lstat(f.lowerPath(name))
+}
+
+func (f *FS) remove(name string, all bool) error {
+	var err error
+	inLower := f.inLower(name)
+	if f.inUpper(name) {
+		if all {
+			err = f.upper.RemoveAll(name)
+		} else {
+			err = f.upper.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	} else if !inLower {
+		if all {
+			return nil
+		}
+		return notExist("remove", name)
+	}
+	if inLower {
+		f.mu.Lock()
+		f.removed[filepath.Clean(name)] = true
+		f.mu.Unlock()
+		f.record("remove %s", name)
+	}
+	return nil
+}
+
+func (f *FS) RemoveAll(path string) error {
+	return f.remove(path, true)
+}
+
+func (f *FS) Remove(name string) error {
+	return f.remove(name, false)
+}
+
+func (f *FS) ReadFile(filename string) ([]byte, error) {
+	if f.inUpper(filename) {
+		return f.upper.ReadFile(filename)
+	}
+	if f.isRemoved(filename) {
+		return nil, notExist("open", filename)
+	}
+	return f.lower.ReadFile(f.lowerPath(filename))
+}
+
+func (f *FS) Readlink(name string) (string, error) {
+	if f.inUpper(name) {
+		return f.upper.Readlink(name)
+	}
+	if f.isRemoved(name) {
+		return "", notExist("readlink", name)
+	}
+	return f.lower.Readlink(f.lowerPath(name))
+}
+
+// RawPath returns the path within the upper layer, so any direct access to the returned
+// path never modifies the lower filesystem
+func (f *FS) RawPath(name string) (string, error) {
+	return f.upper.RawPath(name)
+}
+
+func (f *FS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries := map[string]os.FileInfo{}
+	var found bool
+
+	if f.inLower(dirname) {
+		lowerEntries, err := f.lowerEntries(dirname)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range lowerEntries {
+			if !f.isRemoved(filepath.Join(dirname, e.Name())) {
+				entries[e.Name()] = e
+			}
+		}
+	}
+	if f.inUpper(dirname) {
+		upperEntries, err := f.upper.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range upperEntries {
+			entries[e.Name()] = e
+		}
+	}
+	if !found {
+		return nil, notExist("open", dirname)
+	}
+
+	list := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// lowerEntries lists the lower layer content of the given folder, including the content of
+// the source tree if it was synchronized
+func (f *FS) lowerEntries(dirname string) ([]os.FileInfo, error) {
+	dirs := []string{filepath.Clean(dirname)}
+	if source := f.lowerPath(dirname); source != dirs[0] {
+		dirs = append(dirs, source)
+	}
+	entries := []os.FileInfo{}
+	for _, dir := range dirs {
+		if fi, err := f.lower.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		list, err := f.lower.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		fromSource := dir != dirs[0]
+		for _, e := range list {
+			// Entries are listed from where they are read, so excluded entries of the source are skipped
+			name := filepath.Join(dirname, e.Name())
+			if (f.lowerPath(name) != name) != fromSource {
+				continue
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	err := f.copyUp(oldpath)
+	if err != nil {
+		return err
+	}
+	if !f.inUpper(oldpath) {
+		return notExist("rename", oldpath)
+	}
+	err = f.upperDir(filepath.Dir(newpath))
+	if err != nil {
+		return err
+	}
+	inLower := f.inLower(oldpath)
+	err = f.upper.Rename(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	if inLower {
+		f.mu.Lock()
+		f.removed[filepath.Clean(oldpath)] = true
+		f.mu.Unlock()
+	}
+	switch {
+	case filepath.Base(newpath) == constants.InstallStateFile:
+		f.recordState(newpath)
+	case oldpath == newpath+".tmp":
+		// Files written atomically through a temporary file
+		f.record("write %s", newpath)
+	default:
+		f.plan.Record(v1.PlanFile, "rename %s to %s", oldpath, newpath)
+	}
+	return nil
+}
+
+func (f *FS) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	if flag&writeFlags == 0 {
+		if f.inUpper(name) {
+			return f.upper.OpenFile(name, flag, perm)
+		}
+		if f.isRemoved(name) {
+			return nil, notExist("open", name)
+		}
+		return f.lower.OpenFile(f.lowerPath(name), flag, perm)
+	}
+	if flag&os.O_TRUNC == 0 {
+		err := f.copyUp(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := f.upperDir(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	f.record("write %s", name)
+	return f.upper.OpenFile(name, flag, perm)
+}
+
+func (f *FS) WriteFile(filename string, data []byte, perm os.FileMode) error {
+	err := f.upperDir(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	err = f.upper.WriteFile(filename, data, perm)
+	if err != nil {
+		return err
+	}
+	if filepath.Base(filename) == constants.InstallStateFile {
+		f.recordState(filename)
+	} else {
+		f.record("write %s", filename)
+	}
+	return nil
+}
+
+// copyFile records the copy of the given file. Files of the lower layer are not copied, the
+// target is read from the source file instead. Files of the upper layer are copied keeping
+// images sparse.
+func (f *FS) copyFile(source string, target string) error {
+	if !f.inUpper(source) {
+		if !f.inLower(source) {
+			return notExist("open", source)
+		}
+		if f.inUpper(target) {
+			err := f.upper.Remove(target)
+			if err != nil {
+				return err
+			}
+		}
+		f.addLink(f.lowerPath(source), target)
+		f.plan.Record(v1.PlanFile, "copy %s into %s", source, target)
+		return nil
+	}
+
+	fi, err := f.upper.Stat(source)
+	if err != nil {
+		return err
+	}
+	err = f.upperDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	dst, err := f.upper.Create(target)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if isSparse(fi) {
+		err = dst.Truncate(fi.Size())
+	} else {
+		var src *os.File
+		src, err = f.upper.Open(source)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	delete(f.links, filepath.Clean(target))
+	f.mu.Unlock()
+	f.plan.Record(v1.PlanFile, "copy %s into %s", source, target)
+	return nil
+}
+
+// syncData records the synchronization of the given folders. The target tree is not copied,
+// it is read from the source tree instead.
+func (f *FS) syncData(source string, target string, mirror bool, excludes ...string) error {
+	if mirror {
+		f.plan.Record(v1.PlanFile, "mirror directory %s into %s", source, target)
+	} else {
+		f.plan.Record(v1.PlanFile, "sync directory %s into %s", source, target)
+	}
+	// Sources read from another tree are linked to it
+	f.mu.Lock()
+	l, ok := f.links[filepath.Clean(source)]
+	f.mu.Unlock()
+	if ok {
+		source = l.source
+		excludes = append(excludes, l.excludes...)
+	} else {
+		source = f.lowerPath(source)
+	}
+	f.addLink(source, target, excludes...)
+	return nil
+}
+
+// StandIn makes the tree of the running system readable from the given folder. It stands in for
+// content the dry run does not fetch, such as the tree of a container image, so later steps
+// reading the deployed tree can still be planned.
+func (f *FS) StandIn(target string) {
+	f.addLink("/", target, standInExcludes...)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// Luet records the images to unpack, image metadata is still read from the registry. Images are
+// not fetched, the running system tree stands in for their content.
+type Luet struct {
+	luet v1.LuetInterface
+	fs   *FS
+	plan *v1.Plan
+}
+
+// NewLuet returns a luet client wrapping the given one
+func NewLuet(luet v1.LuetInterface, fs *FS, plan *v1.Plan) *Luet {
+	return &Luet{luet: luet, fs: fs, plan: plan}
+}
+
+func (l *Luet) Unpack(target string, image string, local bool) (*v1.DockerImageMeta, error) {
+	l.fs.StandIn(target)
+	meta, err := l.luet.GetImageMeta(image, local)
+	if err != nil || meta == nil {
+		l.plan.Record(v1.PlanImage, "unpack image %s into %s", image, target)
+		return nil, nil
+	}
+	l.plan.Record(v1.PlanImage, "unpack image %s (%s) into %s", image, meta.Digest, target)
+	return meta, nil
+}
+
+func (l *Luet) GetImageMeta(image string, local bool) (*v1.DockerImageMeta, error) {
+	return l.luet.GetImageMeta(image, local)
+}
+
+// UnpackLayers records the layers to apply, the target keeps its current content
+func (l *Luet) UnpackLayers(target string, image string, local bool, from int) (*v1.DockerImageMeta, error) {
+	meta, err := l.luet.GetImageMeta(image, local)
+	if err != nil || meta == nil {
+		l.plan.Record(v1.PlanImage, "apply layers of image %s from layer %d into %s", image, from, target)
+		return nil, nil
+	}
+	l.plan.Record(v1.PlanImage, "apply %d of %d layers of image %s (%s) into %s", len(meta.Layers)-from, len(meta.Layers), image, meta.Digest, target)
+	return meta, nil
+}
+
+// UnpackArchive records the image archive to unpack, the archive is not read
+func (l *Luet) UnpackArchive(target string, src *v1.ImageSource) (*v1.DockerImageMeta, error) {
+	l.fs.StandIn(target)
+	l.plan.Record(v1.PlanImage, "unpack image %s into %s", src.String(), target)
+	return nil, nil
+}
+
+func (l *Luet) UnpackFromChannel(target string, pkg string, repositories ...v1.Repository) (*v1.ChannelImageMeta, error) {
+	l.fs.StandIn(target)
+	l.plan.Record(v1.PlanImage, "unpack package %s into %s", pkg, target)
+	return nil, nil
+}
+
+func (l *Luet) PackageVersions(pkg string, repositories ...v1.Repository) ([]string, error) {
+	return l.luet.PackageVersions(pkg, repositories...)
+}
+
+func (l *Luet) SetPlugins(plugins ...string) {
+	l.luet.SetPlugins(plugins...)
+}
+
+func (l *Luet) GetPlugins() []string {
+	return l.luet.GetPlugins()
+}
+
+func (l *Luet) SetArch(arch string) {
+	l.luet.SetArch(arch)
+}
+
+func (l *Luet) SetTempDir(tmpdir string) {
+	l.luet.SetTempDir(tmpdir)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/mount-utils"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// Mounter records mount and unmount calls and keeps track of the simulated mount points
+type Mounter struct {
+	mounter   mount.Interface
+	plan      *v1.Plan
+	mounted   map[string]mount.MountPoint
+	unmounted map[string]bool
+	mu        sync.Mutex
+}
+
+// NewMounter returns a mounter wrapping the given one
+func NewMounter(mounter mount.Interface, plan *v1.Plan) *Mounter {
+	return &Mounter{
+		mounter:   mounter,
+		plan:      plan,
+		mounted:   map[string]mount.MountPoint{},
+		unmounted: map[string]bool{},
+	}
+}
+
+// IsMounted checks if the given path is a simulated mount point
+func (m *Mounter) IsMounted(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.mounted[filepath.Clean(path)]
+	return ok
+}
+
+// isUnder checks if the given path is within any simulated mount point
+func (m *Mounter) isUnder(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	for target := range m.mounted {
+		if path == target || strings.HasPrefix(path, target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mounter) Mount(source string, target string, fstype string, options []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target = filepath.Clean(target)
+	m.mounted[target] = mount.MountPoint{Device: source, Path: target, Type: fstype, Opts: options}
+	delete(m.unmounted, target)
+	desc := fmt.Sprintf("mount %s on %s", source, target)
+	if fstype != "" {
+		desc = fmt.Sprintf("%s (type %s)", desc, fstype)
+	}
+	if len(options) > 0 {
+		desc = fmt.Sprintf("%s with options %s", desc, strings.Join(options, ","))
+	}
+	m.plan.Record(v1.PlanMount, "%s", desc)
+	return nil
+}
+
+func (m *Mounter) MountSensitive(source string, target string, fstype string, options []string, _ []string) error {
+	return m.Mount(source, target, fstype, options)
+}
+
+func (m *Mounter) MountSensitiveWithoutSystemd(source string, target string, fstype string, options []string, _ []string) error {
+	return m.Mount(source, target, fstype, options)
+}
+
+func (m *Mounter) MountSensitiveWithoutSystemdWithMountFlags(source string, target string, fstype string, options []string, _ []string, _ []string) error {
+	return m.Mount(source, target, fstype, options)
+}
+
+func (m *Mounter) Unmount(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target = filepath.Clean(target)
+	if _, ok := m.mounted[target]; ok {
+		delete(m.mounted, target)
+	} else {
+		m.unmounted[target] = true
+	}
+	m.plan.Record(v1.PlanMount, "unmount %s", target)
+	return nil
+}
+
+func (m *Mounter) List() ([]mount.MountPoint, error) {
+	real, err := m.mounter.List()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []mount.MountPoint{}
+	for _, mp := range real {
+		if _, ok := m.mounted[filepath.Clean(mp.Path)]; !ok && !m.unmounted[filepath.Clean(mp.Path)] {
+			list = append(list, mp)
+		}
+	}
+	for _, mp := range m.mounted {
+		list = append(list, mp)
+	}
+	return list, nil
+}
+
+func (m *Mounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	m.mu.Lock()
+	_, mounted := m.mounted[filepath.Clean(file)]
+	unmounted := m.unmounted[filepath.Clean(file)]
+	m.mu.Unlock()
+	if mounted {
+		return false, nil
+	}
+	if unmounted {
+		return true, nil
+	}
+	return m.mounter.IsLikelyNotMountPoint(file)
+}
+
+func (m *Mounter) GetMountRefs(pathname string) ([]string, error) {
+	return m.mounter.GetMountRefs(pathname)
+}
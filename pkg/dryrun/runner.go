@@ -0,0 +1,379 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+var (
+	partedHeaderRegexp = regexp.MustCompile(`^(.*):(\d+)s:(.*):(\d+):(\d+):(.*):(.*):(.*);$`)
+	partedPartRegexp   = regexp.MustCompile(`^(\d+):(\d+)s:(\d+)s:(\d+)s:(.*):(.*):(.*);$`)
+	endsWithDigit      = regexp.MustCompile(`.*\d+$`)
+)
+
+// readOnlyCmds are the commands executed for real on dry runs as they do not modify the system
+var readOnlyCmds = map[string]bool{
+	"cat": true, "tty": true, "test": true, "uname": true, "blkid": true,
+	"lsblk": true, "findmnt": true, "cosign": true,
+}
+
+// silentCmds are the commands neither executed nor recorded on dry runs
+var silentCmds = map[string]bool{"sync": true, "udevadm": true}
+
+// diskPart is a partition of a simulated partition table
+type diskPart struct {
+	number int
+	start  uint
+	end    uint
+	fs     string
+	name   string
+}
+
+// disk is a simulated partition table, the geometry is read from the real device
+type disk struct {
+	header []string
+	lastS  uint
+	parts  []diskPart
+}
+
+// Runner records the commands modifying the system and runs the read only ones. Partition
+// tables are simulated, so the sectors reported to the partitioner match the ones planned.
+type Runner struct {
+	runner v1.Runner
+	fs     *FS
+	plan   *v1.Plan
+	disks  map[string]*disk
+	loops  int
+	mu     sync.Mutex
+}
+
+// NewRunner returns a runner wrapping the given one
+func NewRunner(runner v1.Runner, fs *FS, plan *v1.Plan) *Runner {
+	return &Runner{runner: runner, fs: fs, plan: plan, disks: map[string]*disk{}}
+}
+
+func (r *Runner) InitCmd(command string, args ...string) *exec.Cmd {
+	return r.runner.InitCmd(command, args...)
+}
+
+func (r *Runner) Run(command string, args ...string) ([]byte, error) {
+	switch {
+	case readOnlyCmds[command]:
+		return r.runner.Run(command, args...)
+	case silentCmds[command]:
+		return []byte{}, nil
+	case command == "parted":
+		return r.parted(args...)
+	case command == "losetup":
+		return r.losetup(args...)
+	case command == "cp":
+		return r.cp(args...)
+	case command == "rsync":
+		return r.rsync(args...)
+	case command == "tar":
+		return r.tar(args...)
+	case command == "grub2-editenv" && len(args) == 2 && args[1] == "list":
+		return r.runner.Run(command, r.realPath(args[0]), args[1])
+	}
+	r.plan.Record(cmdKind(command), "%s", strings.Join(append([]string{command}, args...), " "))
+	return []byte{}, nil
+}
+
+func (r *Runner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
+	// Synchronizations following the rsync progress are recorded as any other one
+	if len(cmd.Args) > 0 && cmd.Args[0] == "rsync" {
+		return r.rsync(cmd.Args[1:]...)
+	}
+	r.plan.Record(v1.PlanRun, "%s", strings.Join(cmd.Args, " "))
+	return []byte{}, nil
+}
+
+func (r *Runner) GetLogger() v1.Logger {
+	return r.runner.GetLogger()
+}
+
+func (r *Runner) SetLogger(logger v1.Logger) {
+	r.runner.SetLogger(logger)
+}
+
+// cmdKind returns the plan step kind of the given command
+func cmdKind(command string) string {
+	switch {
+	case command == "sgdisk" || command == "wipefs" || command == "blkdeactivate",
+		command == "blkdiscard" || command == "dd",
+		command == "pvcreate" || command == "vgcreate" || command == "lvcreate" || command == "vgchange":
+		return v1.PlanDisk
+	case strings.HasPrefix(command, "mkfs") || command == "cryptsetup" || command == "btrfs":
+		return v1.PlanFormat
+	case strings.HasPrefix(command, "grub2-"):
+		return v1.PlanGrub
+	default:
+		return v1.PlanRun
+	}
+}
+
+// realPath returns the path where the given file of the overlay can be read from
+func (r *Runner) realPath(path string) string {
+	if r.fs.inUpper(path) {
+		if raw, err := r.fs.RawPath(path); err == nil {
+			return raw
+		}
+	}
+	return path
+}
+
+// cp records file copies, see FS.copyFile. Paths are given as raw paths of the overlay.
+func (r *Runner) cp(args ...string) ([]byte, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, r.fs.LowerPath(arg))
+		}
+	}
+	if len(paths) != 2 {
+		return nil, fmt.Errorf("unsupported cp call on dry run: %v", args)
+	}
+	return []byte{}, r.fs.copyFile(paths[0], paths[1])
+}
+
+// rsync records folder synchronizations, see FS.syncData. Paths are given as raw paths of the overlay.
+func (r *Runner) rsync(args ...string) ([]byte, error) {
+	var paths, excludes []string
+	var mirror bool
+	for _, arg := range args {
+		switch {
+		case arg == "--delete":
+			mirror = true
+		case strings.HasPrefix(arg, "--exclude="):
+			excludes = append(excludes, strings.TrimPrefix(arg, "--exclude="))
+		case !strings.HasPrefix(arg, "-"):
+			paths = append(paths, r.fs.LowerPath(arg))
+		}
+	}
+	if len(paths) != 2 {
+		return nil, fmt.Errorf("unsupported rsync call on dry run: %v", args)
+	}
+	return []byte{}, r.fs.syncData(paths[0], paths[1], mirror, excludes...)
+}
+
+// tar records the extraction of a tarball, the running system stands in for its content
+func (r *Runner) tar(args ...string) ([]byte, error) {
+	for i, arg := range args {
+		if arg == "--directory" && i+1 < len(args) {
+			r.fs.StandIn(args[i+1])
+		}
+	}
+	r.plan.Record(v1.PlanImage, "tar %s", strings.Join(args, " "))
+	return []byte{}, nil
+}
+
+// losetup simulates the setup of loop devices
+func (r *Runner) losetup(args ...string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "-d" {
+		return []byte{}, nil
+	}
+	r.mu.Lock()
+	loop := fmt.Sprintf("/dev/loop-dryrun%d", r.loops)
+	r.loops++
+	r.mu.Unlock()
+	r.plan.Record(v1.PlanRun, "losetup %s", strings.Join(args, " "))
+	return []byte(loop), nil
+}
+
+// parted simulates parted calls in machine mode over a partition table kept in memory
+func (r *Runner) parted(args ...string) ([]byte, error) {
+	var dev string
+	var ops []string
+	for i, arg := range args {
+		if arg == "--" && i+1 < len(args) {
+			dev = args[i+1]
+			ops = args[i+2:]
+			break
+		}
+	}
+	if len(ops) >= 2 && ops[0] == "unit" {
+		ops = ops[2:]
+	}
+	if dev == "" || len(ops) == 0 {
+		return nil, fmt.Errorf("unsupported parted call on dry run: %v", args)
+	}
+
+	d, err := r.disk(dev)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 1 && ops[0] == "print" {
+		return []byte(d.print()), nil
+	}
+
+	r.plan.Record(v1.PlanDisk, "parted %s", strings.Join(args, " "))
+	err = d.apply(ops)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range d.parts {
+		err = r.fs.touchUpper(partitionDevice(dev, p.number))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte{}, nil
+}
+
+// disk returns the simulated partition table of the given device, it is initiated from the real device
+func (r *Runner) disk(dev string) (*disk, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.disks[dev]; ok {
+		return d, nil
+	}
+	out, err := r.runner.Run("parted", "--script", "--machine", "--", dev, "unit", "s", "print")
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseDisk(string(out))
+	if err != nil {
+		return nil, err
+	}
+	r.disks[dev] = d
+	return d, nil
+}
+
+// partitionDevice returns the device of the given partition number, as the partitioner expects it
+func partitionDevice(dev string, num int) string {
+	if endsWithDigit.MatchString(dev) {
+		return fmt.Sprintf("%sp%d", dev, num)
+	}
+	return fmt.Sprintf("%s%d", dev, num)
+}
+
+// parseDisk parses the output of parted print in machine mode
+func parseDisk(out string) (*disk, error) {
+	d := &disk{}
+	scanner := bufio.NewScanner(strings.NewReader(strings.TrimSpace(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := partedPartRegexp.FindStringSubmatch(line); match != nil {
+			num, _ := strconv.Atoi(match[1])
+			start, _ := strconv.ParseUint(match[2], 10, 0)
+			end, _ := strconv.ParseUint(match[3], 10, 0)
+			d.parts = append(d.parts, diskPart{number: num, start: uint(start), end: uint(end), fs: match[5], name: match[6]})
+		} else if match := partedHeaderRegexp.FindStringSubmatch(line); match != nil {
+			last, _ := strconv.ParseUint(match[2], 10, 0)
+			d.lastS = uint(last)
+			d.header = match[1:]
+		}
+	}
+	if d.header == nil {
+		return nil, fmt.Errorf("failed parsing parted header data")
+	}
+	return d, nil
+}
+
+// print renders the partition table as parted print does in machine mode
+func (d *disk) print() string {
+	var b strings.Builder
+	b.WriteString("BYT;\n")
+	fmt.Fprintf(&b, "%s:%ds:%s;\n", d.header[0], d.lastS, strings.Join(d.header[2:], ":"))
+	for _, p := range d.parts {
+		fmt.Fprintf(&b, "%d:%ds:%ds:%ds:%s:%s:;\n", p.number, p.start, p.end, p.end-p.start+1, p.fs, p.name)
+	}
+	return b.String()
+}
+
+// apply updates the partition table with the given parted operations
+func (d *disk) apply(ops []string) error {
+	for len(ops) > 0 {
+		switch ops[0] {
+		case "mklabel":
+			if len(ops) < 2 {
+				return fmt.Errorf("missing partition table label")
+			}
+			d.header[5] = ops[1]
+			d.parts = nil
+			ops = ops[2:]
+		case "rm":
+			if len(ops) < 2 {
+				return fmt.Errorf("missing partition number")
+			}
+			num, err := strconv.Atoi(ops[1])
+			if err != nil {
+				return err
+			}
+			for i, p := range d.parts {
+				if p.number == num {
+					d.parts = append(d.parts[:i], d.parts[i+1:]...)
+					break
+				}
+			}
+			ops = ops[2:]
+		case "mkpart":
+			if len(ops) < 5 {
+				return fmt.Errorf("missing partition data")
+			}
+			start, err := strconv.ParseUint(ops[3], 10, 0)
+			if err != nil {
+				return err
+			}
+			// Leave room for the backup GPT header at the end of the disk
+			end := uint64(d.lastS - 34)
+			if ops[4] != "100%" {
+				end, err = strconv.ParseUint(ops[4], 10, 0)
+				if err != nil {
+					return err
+				}
+			}
+			d.parts = append(d.parts, diskPart{
+				number: d.nextNumber(), start: uint(start), end: uint(end), fs: ops[2], name: ops[1],
+			})
+			ops = ops[5:]
+		case "set":
+			if len(ops) < 4 {
+				return fmt.Errorf("missing partition flag data")
+			}
+			ops = ops[4:]
+		default:
+			return fmt.Errorf("unsupported parted operation on dry run: %s", ops[0])
+		}
+	}
+	return nil
+}
+
+// nextNumber returns the lowest unused partition number
+func (d *disk) nextNumber() int {
+	for num := 1; ; num++ {
+		used := false
+		for _, p := range d.parts {
+			if p.number == num {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return num
+		}
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dryrun
+
+import (
+	"math"
+	"syscall"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// Syscall skips chroot calls and reports the available space of simulated mount points
+// as unlimited, as it can't be known until the filesystem is really created
+type Syscall struct {
+	syscall v1.SyscallInterface
+	fs      *FS
+	mounter *Mounter
+}
+
+// NewSyscall returns a syscall interface wrapping the given one
+func NewSyscall(s v1.SyscallInterface, fs *FS, mounter *Mounter) *Syscall {
+	return &Syscall{syscall: s, fs: fs, mounter: mounter}
+}
+
+func (s *Syscall) Chroot(path string) error {
+	return nil
+}
+
+func (s *Syscall) Chdir(path string) error {
+	return nil
+}
+
+func (s *Syscall) Statfs(path string, buf *syscall.Statfs_t) error {
+	path = s.fs.LowerPath(path)
+	if s.mounter.isUnder(path) {
+		*buf = syscall.Statfs_t{Bsize: 1, Bavail: math.MaxInt64}
+		return nil
+	}
+	return s.syscall.Statfs(path, buf)
+}
@@ -17,10 +17,15 @@ limitations under the License.
 package elemental
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/name"
 
 	cnst "github.com/rancher/elemental-cli/pkg/constants"
 	"github.com/rancher/elemental-cli/pkg/partitioner"
@@ -31,11 +36,14 @@ import (
 // Elemental is the struct meant to self-contain most utils and actions related to Elemental, like installing or applying selinux
 type Elemental struct {
 	config *v1.Config
+	// estimates keeps the estimated sizes of the images checked so far indexed by file
+	estimates map[string]int64
 }
 
 func NewElemental(config *v1.Config) *Elemental {
 	return &Elemental{
-		config: config,
+		config:    config,
+		estimates: map[string]int64{},
 	}
 }
 
@@ -47,61 +55,463 @@ func (e *Elemental) FormatPartition(part *v1.Partition, opts ...string) error {
 
 // PartitionAndFormatDevice creates a new empty partition table on target disk
 // and applies the configured disk layout by creating and formatting all
-// required partitions
+// required partitions. Mirrored installations apply it on all target disks.
 func (e *Elemental) PartitionAndFormatDevice(i *v1.InstallSpec) error {
+	if i.Mirror != "" {
+		return e.partitionAndFormatMirror(i)
+	}
+
+	disk, err := e.newPartitionTable(i.Target, i.PartTable, i.Wipe)
+	if err != nil {
+		return err
+	}
+
+	if i.VolumeGroup != nil {
+		return e.createVolumeGroupLayout(disk, i)
+	}
+
+	parts := i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)
+	return e.createPartitions(disk, parts)
+}
+
+// FormatExistingLayout formats in place the partitions of the elemental layout already present in the
+// target disk, except the kept partitions which are left untouched. Partitions are matched by label.
+func (e *Elemental) FormatExistingLayout(i *v1.InstallSpec) error {
+	parts, err := utils.GetAllPartitions()
+	if err != nil {
+		return fmt.Errorf("could not read host partitions: %w", err)
+	}
+	var diskParts v1.PartitionList
+	for _, part := range parts {
+		if part.Disk == filepath.Clean(i.Target) {
+			diskParts = append(diskParts, part)
+		}
+	}
+	existing := v1.NewElementalPartitionsFromList(diskParts)
+	if existing.State == nil || existing.Recovery == nil {
+		return fmt.Errorf("no elemental layout found on %s", i.Target)
+	}
+
+	detected := map[*v1.Partition]*v1.Partition{
+		i.Partitions.EFI:        existing.EFI,
+		i.Partitions.OEM:        existing.OEM,
+		i.Partitions.Recovery:   existing.Recovery,
+		i.Partitions.State:      existing.State,
+		i.Partitions.Persistent: existing.Persistent,
+	}
+	// The BIOS boot partition has no filesystem to format
+	for _, part := range i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions, i.Partitions.BIOS) {
+		if current := diskParts.GetByLabel(part.FilesystemLabel); current != nil {
+			detected[part] = current
+		}
+		if detected[part] == nil {
+			return fmt.Errorf("partition %s not found on %s", part.Name, i.Target)
+		}
+		part.Path = detected[part].Path
+	}
+	kept := i.KeptPartitions()
+	for _, part := range kept {
+		e.config.Logger.Infof("Keeping partition %s on %s", part.Name, part.Path)
+		part.FS = detected[part].FS
+	}
+	skipped := append(kept, i.Partitions.BIOS)
+	for _, part := range i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions, skipped...) {
+		if part.FS == "" {
+			continue
+		}
+		err = e.formatPartition(nil, part, part.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createVolumeGroupLayout creates the elemental partitions followed by a last partition holding
+// the volume group, which includes the persistent and extra partitions as logical volumes.
+func (e *Elemental) createVolumeGroupLayout(disk *partitioner.Disk, i *v1.InstallSpec) error {
+	pv := &v1.Partition{Name: cnst.LVMPartName, Flags: []string{"lvm"}}
+	parts := append(i.Partitions.PartitionsByInstallOrder(v1.PartitionList{}, i.Partitions.Persistent), pv)
+	err := e.createPartitions(disk, parts)
+	if err != nil {
+		return err
+	}
+
+	vg := i.VolumeGroup.Name
+	e.config.Logger.Infof("Creating volume group %s on %s", vg, pv.Path)
+	err = partitioner.CreateVolumeGroup(e.config.Runner, vg, pv.Path)
+	if err != nil {
+		return err
+	}
+
+	volumes := v1.ElementalPartitions{Persistent: i.Partitions.Persistent}.PartitionsByInstallOrder(i.ExtraPartitions)
+	for _, vol := range volumes {
+		e.config.Logger.Debugf("Adding logical volume %s", vol.Name)
+		dev, err := partitioner.CreateLogicalVolume(e.config.Runner, vg, vol.Name, vol.Size)
+		if err != nil {
+			e.config.Logger.Errorf("Failed creating %s logical volume", vol.Name)
+			return err
+		}
+		if vol.Encryption != nil {
+			dev, err = e.encryptPartition(vol, dev)
+			if err != nil {
+				return err
+			}
+		}
+		err = e.formatPartition(disk, vol, dev)
+		if err != nil {
+			return err
+		}
+		vol.Path = dev
+	}
+	return nil
+}
+
+// partitionAndFormatMirror partitions all the target disks with the same layout and builds
+// a RAID1 array for each partition including a filesystem. EFI and BIOS partitions are not
+// part of any array, they are created and formatted on each disk so any of them can boot alone.
+func (e *Elemental) partitionAndFormatMirror(i *v1.InstallSpec) error {
+	var disks []*partitioner.Disk
+
+	for _, target := range i.Targets {
+		disk, err := e.newPartitionTable(target, i.PartTable, i.Wipe)
+		if err != nil {
+			return err
+		}
+		disks = append(disks, disk)
+	}
+
+	for _, part := range i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions) {
+		part.Members = []string{}
+		for _, disk := range disks {
+			partDev, err := e.createPartition(disk, part)
+			if err != nil {
+				return err
+			}
+			part.Members = append(part.Members, partDev)
+		}
+
+		if part.FS == "" || part.Name == cnst.EfiPartName {
+			for idx, member := range part.Members {
+				memberPart := *part
+				if idx > 0 {
+					// Only the first member is labeled, so label lookups are not ambiguous
+					memberPart.FilesystemLabel = ""
+				}
+				err := e.formatPartition(disks[idx], &memberPart, member)
+				if err != nil {
+					return err
+				}
+			}
+			part.Path = part.Members[0]
+			continue
+		}
+
+		e.config.Logger.Debugf("Creating %s mirror of partition %s", i.Mirror, part.Name)
+		mdDev, err := partitioner.CreateRAID1(e.config.Runner, part.Name, part.Members...)
+		if err != nil {
+			e.config.Logger.Errorf("Failed creating mirror of partition %s", part.Name)
+			return err
+		}
+		if part.Encryption != nil {
+			mdDev, err = e.encryptPartition(part, mdDev)
+			if err != nil {
+				return err
+			}
+		}
+		err = e.formatPartition(disks[0], part, mdDev)
+		if err != nil {
+			return err
+		}
+		part.Path = mdDev
+	}
+	return nil
+}
+
+// newPartitionTable creates a new partition table of the given type on the target device, the
+// device is wiped first if a wipe mode is given
+func (e *Elemental) newPartitionTable(target string, partTable string, wipe string) (*partitioner.Disk, error) {
 	disk := partitioner.NewDisk(
-		i.Target,
+		target,
 		partitioner.WithRunner(e.config.Runner),
 		partitioner.WithFS(e.config.Fs),
 		partitioner.WithLogger(e.config.Logger),
 	)
 
 	if !disk.Exists() {
-		e.config.Logger.Errorf("Disk %s does not exist", i.Target)
-		return fmt.Errorf("disk %s does not exist", i.Target)
+		e.config.Logger.Errorf("Disk %s does not exist", target)
+		return nil, fmt.Errorf("disk %s does not exist", target)
 	}
 
-	e.config.Logger.Infof("Partitioning device...")
-	out, err := disk.NewPartitionTable(i.PartTable)
+	if wipe != "" {
+		e.config.Logger.Infof("Wiping device %s (%s)...", target, wipe)
+		err := disk.Wipe(wipe)
+		if err != nil {
+			e.config.Logger.Errorf("Failed wiping device %s: %v", target, err)
+			return nil, err
+		}
+	}
+
+	e.config.Logger.Infof("Partitioning device %s...", target)
+	out, err := disk.NewPartitionTable(partTable)
 	if err != nil {
 		e.config.Logger.Errorf("Failed creating new partition table: %s", out)
+		return nil, err
+	}
+	return disk, nil
+}
+
+func (e *Elemental) createAndFormatPartition(disk *partitioner.Disk, part *v1.Partition) error {
+	partDev, err := e.createPartition(disk, part)
+	if err != nil {
 		return err
 	}
+	if part.Encryption != nil {
+		partDev, err = e.encryptPartition(part, partDev)
+		if err != nil {
+			return err
+		}
+	}
+	err = e.formatPartition(disk, part, partDev)
+	if err != nil {
+		return err
+	}
+	part.Path = partDev
+	return nil
+}
 
-	parts := i.Partitions.PartitionsByInstallOrder(i.ExtraPartitions)
-	return e.createPartitions(disk, parts)
+// encryptPartition formats the given device as a LUKS volume and unlocks it. Returns the unlocked
+// device to be formatted with the partition filesystem.
+func (e *Elemental) encryptPartition(part *v1.Partition, partDev string) (string, error) {
+	keyFile, cleanKey, err := e.luksKeyFile(part.Encryption)
+	if err != nil {
+		return "", err
+	}
+	defer cleanKey()
+
+	e.config.Logger.Infof("Encrypting partition %s", part.Name)
+	err = partitioner.LuksFormat(e.config.Runner, partDev, keyFile)
+	if err != nil {
+		e.config.Logger.Errorf("Failed encrypting partition %s", part.Name)
+		return "", err
+	}
+	part.Encryption.UUID, err = partitioner.LuksUUID(e.config.Runner, partDev)
+	if err != nil {
+		return "", err
+	}
+	return partitioner.LuksOpen(e.config.Runner, partDev, part.Name, keyFile)
 }
 
-func (e *Elemental) createAndFormatPartition(disk *partitioner.Disk, part *v1.Partition) error {
-	e.config.Logger.Debugf("Adding partition %s", part.Name)
-	num, err := disk.AddPartition(part.Size, part.FS, part.Name, part.Flags...)
+// luksKeyFile returns the key file to unlock the given encryption. Passphrases are written without
+// the trailing new line into a temporary key file, so they match the passphrase typed on boot.
+func (e *Elemental) luksKeyFile(enc *v1.PartitionEncryption) (string, func(), error) {
+	if enc.KeyFile != "" {
+		return enc.KeyFile, func() {}, nil
+	}
+	passphrase, err := e.config.Fs.ReadFile(enc.PassphraseFrom)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed reading passphrase: %w", err)
+	}
+	tmpDir, err := utils.TempDir(e.config.Fs, "", "elemental-luks")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanKey := func() { _ = e.config.Fs.RemoveAll(tmpDir) }
+	keyFile := filepath.Join(tmpDir, "key")
+	err = e.config.Fs.WriteFile(keyFile, bytes.TrimRight(passphrase, "\r\n"), 0600)
+	if err != nil {
+		cleanKey()
+		return "", nil, err
+	}
+	return keyFile, cleanKey, nil
+}
+
+// UnlockPartition unlocks the given encrypted partition, if not unlocked yet, and sets its path to
+// the unlocked device. Returns a function to lock it again, which does nothing if it was already unlocked.
+func (e Elemental) UnlockPartition(part *v1.Partition) (func() error, error) {
+	mapperDev := partitioner.LuksMapperDevice(part.Name)
+	if exists, _ := utils.Exists(e.config.Fs, mapperDev); exists {
+		e.config.Logger.Debugf("Partition %s already unlocked", part.Name)
+		part.Path = mapperDev
+		return func() error { return nil }, nil
+	}
+
+	keyFile, cleanKey, err := e.luksKeyFile(part.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanKey()
+
+	e.config.Logger.Infof("Unlocking partition %s", part.Name)
+	part.Path, err = partitioner.LuksOpen(e.config.Runner, part.Path, part.Name, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return func() error { return e.LockPartition(part) }, nil
+}
+
+// LockPartition locks again the given unlocked encrypted partition
+func (e Elemental) LockPartition(part *v1.Partition) error {
+	e.config.Logger.Debugf("Locking partition %s", part.Name)
+	return partitioner.LuksClose(e.config.Runner, part.Name)
+}
+
+// WriteCrypttab writes the crypttab of the given encrypted partitions into the root tree and, if an
+// oemDir is given, the cloud-config unlocking them on boot before the persistent paths are mounted.
+func (e Elemental) WriteCrypttab(rootDir, oemDir string, parts v1.PartitionList) error {
+	var crypttab, cmds string
+	for _, part := range parts {
+		key := part.Encryption.KeyFile
+		if key == "" {
+			key = "none"
+		}
+		name := partitioner.LuksMapperName(part.Name)
+		crypttab += fmt.Sprintf("%s UUID=%s %s luks\n", name, part.Encryption.UUID, key)
+		cmds += fmt.Sprintf(
+			"        - systemd-cryptsetup attach %s /dev/disk/by-uuid/%s %s luks\n", name, part.Encryption.UUID, key,
+		)
+	}
+
+	crypttabFile := filepath.Join(rootDir, cnst.CrypttabFile)
+	e.config.Logger.Debugf("Writing %s", crypttabFile)
+	err := utils.MkdirAll(e.config.Fs, filepath.Dir(crypttabFile), cnst.DirPerm)
 	if err != nil {
-		e.config.Logger.Errorf("Failed creating %s partition", part.Name)
 		return err
 	}
-	partDev, err := disk.FindPartitionDevice(num)
+	err = e.config.Fs.WriteFile(crypttabFile, []byte(crypttab), cnst.FilePerm)
 	if err != nil {
 		return err
 	}
+
+	if oemDir == "" {
+		e.config.Logger.Warnf("No OEM partition, encrypted partitions are not unlocked on boot")
+		return nil
+	}
+	unlockFile := filepath.Join(oemDir, cnst.UnlockConfigFile)
+	e.config.Logger.Debugf("Writing %s", unlockFile)
+	return e.config.Fs.WriteFile(unlockFile, []byte(unlockConfig+cmds), cnst.FilePerm)
+}
+
+// unlockConfig is the cloud-config header unlocking the encrypted partitions on boot
+const unlockConfig = `# Autogenerated file by elemental client, do not edit
+name: "Elemental encrypted partitions"
+stages:
+  rootfs.before:
+    - name: "Unlock encrypted partitions"
+      commands:
+`
+
+// createPartition adds the given partition to the disk and returns its device
+func (e *Elemental) createPartition(disk *partitioner.Disk, part *v1.Partition) (string, error) {
+	e.config.Logger.Debugf("Adding partition %s", part.Name)
+	num, err := disk.AddPartition(part.Size, part.FS, part.Name, part.Flags...)
+	if err != nil {
+		e.config.Logger.Errorf("Failed creating %s partition", part.Name)
+		return "", err
+	}
+	return disk.FindPartitionDevice(num)
+}
+
+// formatPartition formats the given device with the partition filesystem or wipes any
+// filesystem on it if the partition has no filesystem
+func (e *Elemental) formatPartition(disk *partitioner.Disk, part *v1.Partition, partDev string) error {
 	if part.FS != "" {
 		e.config.Logger.Debugf("Formatting partition with label %s", part.FilesystemLabel)
-		err = partitioner.FormatDevice(e.config.Runner, partDev, part.FS, part.FilesystemLabel)
+		err := partitioner.FormatDevice(e.config.Runner, partDev, part.FS, part.FilesystemLabel)
 		if err != nil {
 			e.config.Logger.Errorf("Failed formatting partition %s", part.Name)
 			return err
 		}
+		if len(part.Subvolumes) > 0 {
+			return e.CreateSubvolumes(part, partDev)
+		}
 	} else {
 		e.config.Logger.Debugf("Wipe file system on %s", part.Name)
-		err = disk.WipeFsOnPartition(partDev)
+		err := disk.WipeFsOnPartition(partDev)
 		if err != nil {
 			e.config.Logger.Errorf("Failed to wipe filesystem of partition %s", partDev)
 			return err
 		}
 	}
-	part.Path = partDev
 	return nil
 }
 
+// CreateSubvolumes creates the subvolumes of the given btrfs partition on the given device
+func (e Elemental) CreateSubvolumes(part *v1.Partition, device string) error {
+	return e.withMountedDevice(device, part.FS, func(root string) error {
+		return e.createSubvolumes(part, root)
+	})
+}
+
+// ResetSubvolumes removes all data of the given btrfs partition and creates its subvolumes again,
+// instead of formatting the whole device
+func (e Elemental) ResetSubvolumes(part *v1.Partition) error {
+	e.config.Logger.Infof("Resetting subvolumes of '%s' partition", part.Name)
+	return e.withMountedDevice(part.Path, part.FS, func(root string) error {
+		// Nested subvolumes are deleted before their parents
+		for i := len(part.Subvolumes) - 1; i >= 0; i-- {
+			path := filepath.Join(root, part.Subvolumes[i].Path)
+			if exists, _ := utils.Exists(e.config.Fs, path); !exists {
+				continue
+			}
+			err := partitioner.DeleteSubvolume(e.config.Runner, path)
+			if err != nil {
+				return err
+			}
+		}
+		entries, err := e.config.Fs.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = e.config.Fs.RemoveAll(filepath.Join(root, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return e.createSubvolumes(part, root)
+	})
+}
+
+func (e Elemental) createSubvolumes(part *v1.Partition, root string) error {
+	for _, subvol := range part.Subvolumes {
+		e.config.Logger.Debugf("Creating subvolume %s on %s partition", subvol.Path, part.Name)
+		path := filepath.Join(root, subvol.Path)
+		err := partitioner.CreateSubvolume(e.config.Runner, path)
+		if err != nil {
+			return err
+		}
+		if subvol.Compression != "" {
+			err = partitioner.SetCompression(e.config.Runner, path, subvol.Compression)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withMountedDevice mounts the given device on a temporary directory while running the given function
+func (e Elemental) withMountedDevice(device, fileSystem string, f func(root string) error) (err error) {
+	tmpDir, err := utils.TempDir(e.config.Fs, "", "elemental-mount")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.config.Fs.RemoveAll(tmpDir) }()
+
+	err = e.config.Mounter.Mount(device, tmpDir, fileSystem, []string{"rw"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		uErr := e.config.Mounter.Unmount(tmpDir)
+		if err == nil {
+			err = uErr
+		}
+	}()
+	return f(tmpDir)
+}
+
 func (e *Elemental) createPartitions(disk *partitioner.Disk, parts v1.PartitionList) error {
 	for _, part := range parts {
 		err := e.createAndFormatPartition(disk, part)
@@ -208,6 +618,86 @@ func (e Elemental) UnmountPartition(part *v1.Partition) error {
 	return e.config.Mounter.Unmount(part.MountPoint)
 }
 
+// SyncPartitionMembers copies the content of the given mounted partition to the rest of its
+// members. Used on mirrored installations for partitions replicated on each disk out of any RAID array.
+// The optional synced callback is called with the mount point of each member once it is in sync.
+func (e Elemental) SyncPartitionMembers(part *v1.Partition, synced func(mountPoint string) error) error {
+	for _, member := range part.Members {
+		if member == part.Path {
+			continue
+		}
+		e.config.Logger.Infof("Syncing %s partition to %s", part.Name, member)
+		err := e.syncPartitionMember(part, member, synced)
+		if err != nil {
+			e.config.Logger.Errorf("Failed syncing %s partition to %s", part.Name, member)
+			return err
+		}
+	}
+	return nil
+}
+
+func (e Elemental) syncPartitionMember(part *v1.Partition, member string, synced func(string) error) (err error) {
+	tmpDir, err := utils.TempDir(e.config.Fs, "", "elemental-member")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.config.Fs.RemoveAll(tmpDir) }()
+
+	err = e.config.Mounter.Mount(member, tmpDir, "auto", []string{"rw"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		uErr := e.config.Mounter.Unmount(tmpDir)
+		if err == nil {
+			err = uErr
+		}
+	}()
+	err = utils.MirrorData(e.config.Runner, e.config.Fs, part.MountPoint, tmpDir)
+	if err != nil || synced == nil {
+		return err
+	}
+	return synced(tmpDir)
+}
+
+// AttachDiskImage creates the given disk image file as a sparse file of the given size in bytes and
+// attaches it to a loop device scanning its partitions. Returns the loop device.
+func (e Elemental) AttachDiskImage(file string, size int64) (string, error) {
+	e.config.Logger.Infof("Creating disk image %s of %s", file, units.BytesSize(float64(size)))
+	err := utils.MkdirAll(e.config.Fs, filepath.Dir(file), cnst.DirPerm)
+	if err != nil {
+		return "", err
+	}
+	img, err := e.config.Fs.Create(file)
+	if err != nil {
+		return "", err
+	}
+	err = img.Truncate(size)
+	if err != nil {
+		img.Close()
+		return "", err
+	}
+	err = img.Close()
+	if err != nil {
+		return "", err
+	}
+	out, err := e.config.Runner.Run("losetup", "--show", "-f", "--partscan", file)
+	if err != nil {
+		return "", fmt.Errorf("failed attaching disk image %s: %s: %w", file, string(out), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// DetachDiskImage detaches the given loop device of a disk image
+func (e Elemental) DetachDiskImage(loop string) error {
+	e.config.Logger.Debugf("Detaching disk image from %s", loop)
+	out, err := e.config.Runner.Run("losetup", "-d", loop)
+	if err != nil {
+		return fmt.Errorf("failed detaching %s: %s: %w", loop, string(out), err)
+	}
+	return nil
+}
+
 // MountImage mounts an image with the given mount options
 func (e Elemental) MountImage(img *v1.Image, opts ...string) error {
 	e.config.Logger.Debugf("Mounting image %s", img.Label)
@@ -285,7 +775,9 @@ func (e Elemental) CreateFileSystemImage(img *v1.Image) error {
 // creates the filesystem image file, mounts it and unmounts it as needed.
 func (e *Elemental) DeployImage(img *v1.Image, leaveMounted bool) (info interface{}, err error) {
 	target := img.MountPoint
-	if !img.Source.IsFile() {
+	// Prebuilt images fetched over http are deployed as image files
+	isFile := img.Source.IsFile() || img.Source.IsRawImage()
+	if !isFile {
 		if img.FS != cnst.SquashFs {
 			err = e.CreateFileSystemImage(img)
 			if err != nil {
@@ -312,7 +804,7 @@ func (e *Elemental) DeployImage(img *v1.Image, leaveMounted bool) (info interfac
 		_ = e.UnmountImage(img)
 		return nil, err
 	}
-	if !img.Source.IsFile() {
+	if !isFile {
 		err = utils.CreateDirStructure(e.config.Fs, target)
 		if err != nil {
 			return nil, err
@@ -332,7 +824,8 @@ func (e *Elemental) DeployImage(img *v1.Image, leaveMounted bool) (info interfac
 			return nil, err
 		}
 	}
-	if leaveMounted && img.Source.IsFile() {
+	// Squashfs images are read only and never left mounted, regardless of the source
+	if leaveMounted && isFile && img.FS != cnst.SquashFs {
 		err = e.MountImage(img, "rw")
 		if err != nil {
 			return nil, err
@@ -347,29 +840,307 @@ func (e *Elemental) DeployImage(img *v1.Image, leaveMounted bool) (info interfac
 	return info, nil
 }
 
+// ErrNoDelta is returned when an image can't be deployed as a delta of the given base image
+var ErrNoDelta = errors.New("the image is not a delta of the base image")
+
+// DeployImageDelta deploys the given filesystem image on top of a copy of the base image file, the
+// image file is grown to the image size if needed and it is left mounted. Container image sources
+// only pull and apply the layers added on top of the layers of the base image, ErrNoDelta is returned
+// if the base image was not deployed from a container image or its layers are not the first layers of
+// the source image. Directory sources are mirrored into the copied tree, so only the differing files
+// are written. Other sources return ErrNoDelta.
+func (e *Elemental) DeployImageDelta(img *v1.Image, base string, baseState *v1.ImageState) (info interface{}, err error) {
+	if !strings.HasPrefix(img.FS, "ext") {
+		return nil, fmt.Errorf("delta deployments require an ext filesystem image")
+	}
+
+	var from int
+	switch {
+	case img.Source.IsDocker():
+		from, err = e.deltaLayers(img.Source.Value(), baseState)
+		if err != nil {
+			return nil, err
+		}
+		err = e.verifyImage(img.Source.Value())
+		if err != nil {
+			return nil, err
+		}
+	case img.Source.IsDir():
+		if ok, _ := utils.IsDir(e.config.Fs, img.Source.Value()); !ok {
+			return nil, fmt.Errorf("source directory %s not found", img.Source.Value())
+		}
+	default:
+		return nil, ErrNoDelta
+	}
+
+	err = e.seedImage(img, base)
+	if err != nil {
+		return nil, err
+	}
+	err = e.MountImage(img, "rw")
+	if err != nil {
+		_ = e.config.Fs.Remove(img.File)
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = e.UnmountImage(img)
+			_ = e.config.Fs.Remove(img.File)
+		}
+	}()
+
+	if img.Source.IsDocker() {
+		info, err = e.config.Luet.UnpackLayers(img.MountPoint, img.Source.Value(), e.config.LocalImage, from)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = e.mirrorDir(img.Source.Value(), img.MountPoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = utils.CreateDirStructure(e.config.Fs, img.MountPoint)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// deltaLayers returns the number of layers the given image shares with the base image, ErrNoDelta is
+// returned if the base image layers are not the first layers of the image. The base image is looked
+// up by the digest kept in its state, so tags moved since its deployment do not matter.
+func (e *Elemental) deltaLayers(image string, baseState *v1.ImageState) (int, error) {
+	if baseState == nil || baseState.Source == nil || !baseState.Source.IsDocker() {
+		return 0, ErrNoDelta
+	}
+	baseMeta, ok := baseState.SourceMetadata.(*v1.DockerImageMeta)
+	if !ok || baseMeta.Digest == "" {
+		return 0, ErrNoDelta
+	}
+	ref, err := name.ParseReference(baseState.Source.Value())
+	if err != nil {
+		return 0, err
+	}
+	baseMeta, err = e.config.Luet.GetImageMeta(ref.Context().Digest(baseMeta.Digest).String(), e.config.LocalImage)
+	if err != nil {
+		e.config.Logger.Warnf("Could not read the layers of the base image %s: %v", baseState.Source.Value(), err)
+		return 0, ErrNoDelta
+	}
+	meta, err := e.config.Luet.GetImageMeta(image, e.config.LocalImage)
+	if err != nil {
+		return 0, err
+	}
+	if baseMeta == nil || meta == nil || len(baseMeta.Layers) == 0 || len(meta.Layers) < len(baseMeta.Layers) {
+		return 0, ErrNoDelta
+	}
+	for i, layer := range baseMeta.Layers {
+		if meta.Layers[i] != layer {
+			return 0, ErrNoDelta
+		}
+	}
+	e.config.Logger.Infof(
+		"Image %s shares %d layers with the base image, applying %d layers",
+		image, len(baseMeta.Layers), len(meta.Layers)-len(baseMeta.Layers),
+	)
+	return len(baseMeta.Layers), nil
+}
+
+// mirrorDir mirrors the source directory into the target tree. The paths excluded from directory
+// sources are emptied, so the tree matches the one of a full deployment.
+func (e *Elemental) mirrorDir(source, target string) error {
+	// Filesystem internals of the base image are not part of the tree, so they are kept
+	excludes := append([]string{"/lost+found"}, cnst.GetDirSourceExcludes()...)
+	e.config.Logger.Infof("Mirroring %s into %s", source, target)
+	err := utils.MirrorData(e.config.Runner, e.config.Fs, source, target, excludes...)
+	if err != nil {
+		return err
+	}
+	for _, dir := range cnst.GetDirSourceExcludes() {
+		err = e.config.Fs.RemoveAll(filepath.Join(target, dir))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedImage copies the base image file into the given image file, growing and labeling it as needed
+func (e *Elemental) seedImage(img *v1.Image, base string) error {
+	e.config.Logger.Infof("Seeding image %s from %s", img.File, base)
+	fi, err := e.config.Fs.Stat(base)
+	if err != nil {
+		return err
+	}
+	err = utils.MkdirAll(e.config.Fs, filepath.Dir(img.File), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	err = utils.CopyImageFile(e.config.Runner, e.config.Fs, base, img.File)
+	if err != nil {
+		return err
+	}
+
+	if size := int64(img.Size * 1024 * 1024); size > fi.Size() {
+		e.config.Logger.Infof("Growing image %s to %dMiB", img.File, img.Size)
+		_, err = e.config.Runner.Run("e2fsck", "-fy", img.File)
+		if err != nil {
+			_ = e.config.Fs.Remove(img.File)
+			return err
+		}
+		_, err = e.config.Runner.Run("resize2fs", img.File, fmt.Sprintf("%dM", img.Size))
+		if err != nil {
+			_ = e.config.Fs.Remove(img.File)
+			return err
+		}
+	}
+	if img.Label != "" {
+		_, err = e.config.Runner.Run("tune2fs", "-L", img.Label, img.File)
+		if err != nil {
+			_ = e.config.Fs.Remove(img.File)
+			return err
+		}
+	}
+	return nil
+}
+
+// EstimateImageSize returns the estimated size in bytes the given image takes once deployed.
+// Filesystem images take their configured size while squashfs images and images copied from a
+// file are estimated from the source. Zero is returned if the source size can't be estimated.
+func (e *Elemental) EstimateImageSize(img *v1.Image) (int64, error) {
+	var size int64
+
+	src, err := e.estimateSourceSize(img.Source)
+	if err != nil {
+		return 0, err
+	}
+
+	if img.Source.IsFile() || img.Source.IsRawImage() || img.FS == cnst.SquashFs {
+		size = src
+	} else {
+		size = int64(img.Size) * 1024 * 1024
+		if src > size {
+			return 0, fmt.Errorf(
+				"image %s of %s is too small for its source of %s", img.File,
+				units.BytesSize(float64(size)), units.BytesSize(float64(src)),
+			)
+		}
+	}
+	e.estimates[img.File] = size
+	return size, nil
+}
+
+// estimateSourceSize returns the estimated size in bytes of the given source content. For container
+// images it is the compressed layer sizes listed in the image manifest scaled by the expected
+// decompression ratio. Zero is returned if the manifest can't be fetched, so the deployment is
+// not blocked by a registry that only fails the metadata request.
+func (e *Elemental) estimateSourceSize(src *v1.ImageSource) (int64, error) {
+	switch {
+	case src.IsDocker():
+		meta, err := e.config.Luet.GetImageMeta(src.Value(), e.config.LocalImage)
+		if err != nil {
+			e.config.Logger.Warnf("Could not read image manifest of %s, skipping its size estimate: %v", src.Value(), err)
+			return 0, nil
+		}
+		if meta == nil {
+			return 0, nil
+		}
+		return meta.LayersSize * cnst.LayersExpansionFactor, nil
+	case src.IsOCILayout():
+		path, _ := src.OCILayoutRef()
+		size, err := utils.DirSize(e.config.Fs, path)
+		if err != nil {
+			e.config.Logger.Warnf("Could not read OCI layout %s, skipping its size estimate: %v", src.Value(), err)
+			return 0, nil
+		}
+		return size * cnst.LayersExpansionFactor, nil
+	case src.IsArchive():
+		info, err := e.config.Fs.Stat(src.Value())
+		if err != nil {
+			return 0, nil
+		}
+		return info.Size() * cnst.LayersExpansionFactor, nil
+	case src.IsDir():
+		return utils.DirSize(e.config.Fs, src.Value())
+	case src.IsFile():
+		// The source might be another image not deployed yet
+		if size, ok := e.estimates[src.Value()]; ok {
+			return size, nil
+		}
+		info, err := e.config.Fs.Stat(src.Value())
+		if err != nil {
+			return 0, nil
+		}
+		return info.Size(), nil
+	default:
+		e.config.Logger.Debugf("Size of %s can't be estimated", src.Value())
+		return 0, nil
+	}
+}
+
+// CheckAvailableSpace verifies the given images fit within the free space of the filesystem mounted
+// at the given path. It fails reporting the estimated size of each image if they do not fit.
+func (e *Elemental) CheckAvailableSpace(path string, imgs ...*v1.Image) error {
+	var required int64
+	var report strings.Builder
+
+	for _, img := range imgs {
+		size, err := e.EstimateImageSize(img)
+		if err != nil {
+			return err
+		}
+		required += size
+		fmt.Fprintf(&report, "\n  %s: %s", img.File, units.BytesSize(float64(size)))
+	}
+
+	rawPath, err := e.config.Fs.RawPath(path)
+	if err != nil {
+		return err
+	}
+	stat := &syscall.Statfs_t{}
+	err = e.config.Syscall.Statfs(rawPath, stat)
+	if err != nil {
+		e.config.Logger.Errorf("Failed checking available space in %s: %v", path, err)
+		return err
+	}
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+
+	e.config.Logger.Infof(
+		"Space required in %s: %s, available: %s%s", path, units.BytesSize(float64(required)),
+		units.BytesSize(float64(available)), report.String(),
+	)
+	if required > available {
+		return fmt.Errorf(
+			"not enough space in %s, %s required and %s available:%s", path,
+			units.BytesSize(float64(required)), units.BytesSize(float64(available)), report.String(),
+		)
+	}
+	return nil
+}
+
 // DumpSource sets the image data according to the image source type
 func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info interface{}, err error) { // nolint:gocyclo
 	e.config.Logger.Infof("Copying %s source...", imgSrc.Value())
 
 	if imgSrc.IsDocker() {
-		if e.config.Cosign {
-			e.config.Logger.Infof("Running cosing verification for %s", imgSrc.Value())
-			out, err := utils.CosignVerify(
-				e.config.Fs, e.config.Runner, imgSrc.Value(),
-				e.config.CosignPubKey, v1.IsDebugLevel(e.config.Logger),
-			)
-			if err != nil {
-				e.config.Logger.Errorf("Cosign verification failed: %s", out)
-				return nil, err
-			}
+		err = e.verifyImage(imgSrc.Value())
+		if err != nil {
+			return nil, err
 		}
 		info, err = e.config.Luet.Unpack(target, imgSrc.Value(), e.config.LocalImage)
 		if err != nil {
 			return nil, err
 		}
+	} else if imgSrc.IsArchive() {
+		info, err = e.config.Luet.UnpackArchive(target, imgSrc)
+		if err != nil {
+			return nil, err
+		}
 	} else if imgSrc.IsDir() {
-		excludes := []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
-		err = utils.SyncData(e.config.Logger, e.config.Fs, imgSrc.Value(), target, excludes...)
+		err = utils.SyncDataWithProgress(
+			e.config.Runner, e.config.Fs, e.config.Progress, imgSrc.Value(), target, cnst.GetDirSourceExcludes()...,
+		)
 		if err != nil {
 			return nil, err
 		}
@@ -378,12 +1149,17 @@ func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info inte
 		if err != nil {
 			return nil, err
 		}
+	} else if imgSrc.IsHTTP() {
+		info, err = e.dumpHTTPSource(target, imgSrc)
+		if err != nil {
+			return nil, err
+		}
 	} else if imgSrc.IsFile() {
 		err := utils.MkdirAll(e.config.Fs, filepath.Dir(target), cnst.DirPerm)
 		if err != nil {
 			return nil, err
 		}
-		err = utils.CopyFile(e.config.Fs, imgSrc.Value(), target)
+		err = utils.CopyImageFile(e.config.Runner, e.config.Fs, imgSrc.Value(), target)
 		if err != nil {
 			return nil, err
 		}
@@ -394,6 +1170,73 @@ func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info inte
 	return info, nil
 }
 
+// dumpHTTPSource fetches the given http source verifying its checksum, if any. Prebuilt images are
+// downloaded as the target image file and tarballs are extracted into the target tree.
+func (e *Elemental) dumpHTTPSource(target string, src *v1.ImageSource) (*v1.HTTPImageMeta, error) {
+	file := target
+	if src.IsTarball() {
+		tmpDir, err := utils.TempDir(e.config.Fs, "", "elemental-http")
+		if err != nil {
+			return nil, err
+		}
+		defer e.config.Fs.RemoveAll(tmpDir) // nolint:errcheck
+		file = filepath.Join(tmpDir, "rootfs.tar")
+	} else {
+		err := utils.MkdirAll(e.config.Fs, filepath.Dir(target), cnst.DirPerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := e.config.Client.GetURLWithChecksum(e.config.Logger, src.Value(), file, src.Checksum())
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching %s: %w", src.Value(), err)
+	}
+	meta := &v1.HTTPImageMeta{URL: src.Value(), Checksum: src.Checksum()}
+	info, err := e.config.Fs.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	meta.Size = info.Size()
+	if meta.Checksum == "" {
+		checksum, err := utils.CalcFileChecksum(e.config.Fs, file)
+		if err != nil {
+			return nil, err
+		}
+		meta.Checksum = fmt.Sprintf("sha256:%s", checksum)
+	}
+
+	if src.IsTarball() {
+		e.config.Logger.Infof("Extracting %s into %s", src.Value(), target)
+		// tar detects the gzip, xz or zstd compression of the file on its own
+		out, err := e.config.Runner.Run(
+			"tar", "--extract", "--preserve-permissions", "--numeric-owner", "--xattrs",
+			"--xattrs-include=*", "--file", file, "--directory", target,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed extracting %s: %s: %w", src.Value(), string(out), err)
+		}
+	}
+	return meta, nil
+}
+
+// verifyImage runs the cosign verification of the given container image if enabled
+func (e *Elemental) verifyImage(image string) error {
+	if !e.config.Cosign {
+		return nil
+	}
+	e.config.Logger.Infof("Running cosing verification for %s", image)
+	out, err := utils.CosignVerify(
+		e.config.Fs, e.config.Runner, image,
+		e.config.CosignPubKey, v1.IsDebugLevel(e.config.Logger),
+	)
+	if err != nil {
+		e.config.Logger.Errorf("Cosign verification failed: %s", out)
+		return err
+	}
+	return nil
+}
+
 // CopyCloudConfig will check if there is a cloud init in the config and store it on the target
 func (e *Elemental) CopyCloudConfig(cloudInit []string) (err error) {
 	for i, ci := range cloudInit {
@@ -467,7 +1310,7 @@ func (e *Elemental) GetIso(iso string) (tmpDir string, err error) {
 	isoMnt := filepath.Join(tmpDir, "iso")
 	rootfsMnt := filepath.Join(tmpDir, "rootfs")
 
-	tmpFile := filepath.Join(tmpDir, "cOs.iso")
+	tmpFile := filepath.Join(tmpDir, cnst.IsoFile)
 	err = utils.GetSource(e.config, iso, tmpFile)
 	if err != nil {
 		return "", err
@@ -496,6 +1339,31 @@ func (e *Elemental) GetIso(iso string) (tmpDir string, err error) {
 	return tmpDir, err
 }
 
+// GetIsoMeta returns the metadata of the given ISO, including its checksum, once it is downloaded
+// and mounted in workDir by GetIso
+func (e Elemental) GetIsoMeta(iso string, workDir string) (*v1.IsoImageMeta, error) {
+	checksum, err := utils.CalcFileChecksum(e.config.Fs, filepath.Join(workDir, cnst.IsoFile))
+	if err != nil {
+		e.config.Logger.Errorf("Failed computing checksum of %s: %v", iso, err)
+		return nil, err
+	}
+	return &v1.IsoImageMeta{Iso: iso, Checksum: fmt.Sprintf("sha256:%s", checksum)}, nil
+}
+
+// UnmountIso unmounts the ISO and its squashed rootfs mounted in workDir by GetIso
+func (e Elemental) UnmountIso(workDir string) error {
+	for _, mnt := range []string{filepath.Join(workDir, "rootfs"), filepath.Join(workDir, "iso")} {
+		if notMnt, _ := e.config.Mounter.IsLikelyNotMountPoint(mnt); notMnt {
+			continue
+		}
+		err := e.config.Mounter.Unmount(mnt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateSourcesFormDownloadedISO checks a downaloaded and mounted ISO in workDir and updates the active and recovery image
 // descriptions to use the squashed rootfs from the downloaded ISO.
 func (e Elemental) UpdateSourcesFormDownloadedISO(workDir string, activeImg *v1.Image, recoveryImg *v1.Image) error {
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/jaypipes/ghw/pkg/block"
@@ -43,6 +44,23 @@ const printOutput = `BYT;
 const partTmpl = `
 %d:%ss:%ss:2048s:ext4::type=83;`
 
+// populatedMounter creates the given directories on the mount point when mounting
+type populatedMounter struct {
+	*v1mock.ErrorMounter
+	fs   v1.FS
+	dirs []string
+}
+
+func (m populatedMounter) Mount(source string, target string, fstype string, options []string) error {
+	for _, dir := range m.dirs {
+		err := utils.MkdirAll(m.fs, filepath.Join(target, dir), cnst.DirPerm)
+		if err != nil {
+			return err
+		}
+	}
+	return m.ErrorMounter.Mount(source, target, fstype, options)
+}
+
 func TestElementalSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Elemental test suite")
@@ -419,6 +437,72 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(runner.MatchMilestones(append(efiPartCmds, partCmds...))).To(BeNil())
 			})
 
+			It("Encrypts the persistent partition before formatting it", Label("encryption"), func() {
+				Expect(fs.WriteFile("/passphrase", []byte("secret\n"), cnst.FilePerm)).To(Succeed())
+				install.PartTable = v1.GPT
+				install.Firmware = v1.EFI
+				install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)
+				install.Partitions.Persistent.Encryption = &v1.PartitionEncryption{PassphraseFrom: "/passphrase"}
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "cryptsetup" && args[0] == "luksUUID" {
+						return []byte("1234-5678\n"), nil
+					}
+					return runFunc(cmd, args...)
+				}
+				Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+				Expect(runner.MatchMilestones([][]string{
+					{"mkfs.ext4", "-L", "COS_STATE", "/some/device4"},
+					{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file"},
+					{"cryptsetup", "luksUUID", "/some/device5"},
+					{"cryptsetup", "open", "--key-file"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/mapper/cos_persistent"},
+				})).To(BeNil())
+				Expect(install.Partitions.Persistent.Path).To(Equal("/dev/mapper/cos_persistent"))
+				Expect(install.Partitions.Persistent.Encryption.UUID).To(Equal("1234-5678"))
+			})
+
+			It("Creates the persistent and extra partitions as logical volumes", Label("lvm"), func() {
+				install.PartTable = v1.GPT
+				install.Firmware = v1.EFI
+				install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)
+				install.VolumeGroup = &v1.VolumeGroup{Name: "elemental"}
+				install.ExtraPartitions = v1.PartitionList{
+					{Name: "data", FilesystemLabel: "DATA", Size: 1024, FS: "xfs"},
+				}
+				Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+				Expect(runner.MatchMilestones([][]string{
+					{"mkfs.ext4", "-L", "COS_STATE", "/some/device4"},
+					{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "mkpart", "lvm"},
+					{"wipefs", "--all", "/some/device5"},
+					{"pvcreate", "--yes", "/some/device5"},
+					{"vgcreate", "--yes", "elemental", "/some/device5"},
+					{"lvcreate", "--yes", "--wipesignatures", "y", "--name", "data", "--size", "1024M", "elemental"},
+					{"mkfs.xfs", "-L", "DATA", "/dev/elemental/data"},
+					{"lvcreate", "--yes", "--wipesignatures", "y", "--name", "persistent", "--extents", "100%FREE", "elemental"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/elemental/persistent"},
+				})).To(BeNil())
+				Expect(install.Partitions.Persistent.Path).To(Equal("/dev/elemental/persistent"))
+				Expect(install.ExtraPartitions[0].Path).To(Equal("/dev/elemental/data"))
+			})
+
+			It("Wipes the target before partitioning it", Label("wipe"), func() {
+				install.PartTable = v1.GPT
+				install.Firmware = v1.EFI
+				install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)
+				install.Wipe = v1.WipeSignatures
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "lsblk" {
+						return []byte("/some/device disk 10737418240\n/some/device1 part 1073741824\n"), nil
+					}
+					return runFunc(cmd, args...)
+				}
+				Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+				Expect(runner.MatchMilestones(append([][]string{
+					{"wipefs", "--all", "/some/device1"},
+					{"wipefs", "--all", "/some/device"},
+				}, efiPartCmds...))).To(BeNil())
+			})
+
 			It("Successfully creates partitions and formats them, BIOS boot", func() {
 				install.PartTable = v1.GPT
 				install.Firmware = v1.BIOS
@@ -428,6 +512,69 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			})
 		})
 
+		Describe("Mirrored run", func() {
+			BeforeEach(func() {
+				_, err := fs.Create("/some/mirror")
+				Expect(err).ToNot(HaveOccurred())
+				install.Mirror = v1.RAID1
+				install.Targets = []string{"/some/device", "/some/mirror"}
+				install.PartTable = v1.GPT
+				install.Firmware = v1.EFI
+				install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)
+
+				// Keep a simulated partition table per disk
+				prints := map[string]string{}
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd != "parted" {
+						return []byte{}, nil
+					}
+					dev := args[3]
+					if _, ok := prints[dev]; !ok {
+						prints[dev] = printOutput
+					}
+					for i, arg := range args {
+						if arg == "mkpart" {
+							partNum := strings.Count(prints[dev], "\n")
+							prints[dev] += fmt.Sprintf(partTmpl, partNum, args[i+3], args[i+4])
+							_, _ = fs.Create(fmt.Sprintf("%s%d", dev, partNum))
+							break
+						}
+					}
+					return []byte(prints[dev]), nil
+				}
+			})
+
+			It("Partitions both disks and mirrors the data partitions", func() {
+				Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+				Expect(runner.MatchMilestones([][]string{
+					{"parted", "--script", "--machine", "--", "/some/device", "unit", "s", "mklabel", "gpt"},
+					{"parted", "--script", "--machine", "--", "/some/mirror", "unit", "s", "mklabel", "gpt"},
+					{"mkfs.vfat", "-n", "COS_GRUB", "/some/device1"},
+					{"mkfs.vfat", "/some/mirror1"},
+					{
+						"mdadm", "--create", "/dev/md/oem", "--run", "--level=1", "--metadata=1.2",
+						"--raid-devices=2", "--name=oem", "/some/device2", "/some/mirror2",
+					},
+					{"mkfs.ext4", "-L", "COS_OEM", "/dev/md/oem"},
+					{"mdadm", "--create", "/dev/md/recovery"},
+					{"mkfs.ext4", "-L", "COS_RECOVERY", "/dev/md/recovery"},
+					{"mdadm", "--create", "/dev/md/state"},
+					{"mkfs.ext4", "-L", "COS_STATE", "/dev/md/state"},
+					{"mdadm", "--create", "/dev/md/persistent"},
+					{"mkfs.ext4", "-L", "COS_PERSISTENT", "/dev/md/persistent"},
+				})).To(BeNil())
+				Expect(install.Partitions.EFI.Path).To(Equal("/some/device1"))
+				Expect(install.Partitions.EFI.Members).To(Equal([]string{"/some/device1", "/some/mirror1"}))
+				Expect(install.Partitions.State.Path).To(Equal("/dev/md/state"))
+				Expect(install.Partitions.State.Members).To(Equal([]string{"/some/device4", "/some/mirror4"}))
+			})
+
+			It("Fails if any of the target disks does not exist", func() {
+				install.Targets = []string{"/some/device", "/some/missing"}
+				Expect(el.PartitionAndFormatDevice(install)).NotTo(BeNil())
+			})
+		})
+
 		Describe("Run with failures", func() {
 			var runFunc func(cmd string, args ...string) ([]byte, error)
 			BeforeEach(func() {
@@ -475,6 +622,20 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				// Failed to format first partition
 				Expect(partNum).To(Equal(1))
 			})
+
+			It("Fails wiping the target", Label("wipe"), func() {
+				failPart = false
+				install.Wipe = v1.WipeDiscard
+				runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+					if cmd == "blkdiscard" {
+						return []byte{}, errors.New("Failure")
+					}
+					return runFunc(cmd, args...)
+				}
+				Expect(el.PartitionAndFormatDevice(install)).NotTo(BeNil())
+				// No partition table was created
+				Expect(runner.IncludesCmds([][]string{{"parted"}})).NotTo(BeNil())
+			})
 		})
 	})
 	Describe("DeployImage", Label("DeployImage"), func() {
@@ -534,6 +695,20 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			img.MountPoint = destDir
 			Expect(el.DeployImage(img, true)).To(BeNil())
 		})
+		It("Deploys a prebuilt image fetched over http as the image file", Label("http"), func() {
+			client.SideEffect = func(url, destination string) error {
+				return fs.WriteFile(destination, []byte("image"), constants.FilePerm)
+			}
+			img.Source = v1.NewHTTPSrc("https://example.org/active.img", "")
+			info, err := el.DeployImage(img, false)
+			Expect(err).To(BeNil())
+			Expect(info.(*v1.HTTPImageMeta).Size).To(Equal(int64(5)))
+			data, err := fs.ReadFile(img.File)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("image"))
+			Expect(runner.IncludesCmds([][]string{{"tune2fs", "-L", "some_label", img.File}})).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).NotTo(BeNil())
+		})
 		It("Deploys a file image and fails to mount it", func() {
 			sourceImg := "/source.img"
 			_, err := fs.Create(sourceImg)
@@ -591,6 +766,201 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("DeployImageDelta", Label("DeployImage", "delta"), func() {
+		var el *elemental.Elemental
+		var luet *v1mock.FakeLuet
+		var img *v1.Image
+		var base string
+		BeforeEach(func() {
+			luet = v1mock.NewFakeLuet()
+			config.Luet = luet
+			el = elemental.NewElemental(config)
+			sourceDir, err := utils.TempDir(fs, "", "elemental")
+			Expect(err).ShouldNot(HaveOccurred())
+			destDir, err := utils.TempDir(fs, "", "elemental")
+			Expect(err).ShouldNot(HaveOccurred())
+			base = "/state/cOS/active.img"
+			Expect(utils.MkdirAll(fs, filepath.Dir(base), cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(base, []byte("active"), cnst.FilePerm)).To(Succeed())
+			img = &v1.Image{
+				FS:         cnst.LinuxImgFs,
+				Size:       16,
+				Source:     v1.NewDirSrc(sourceDir),
+				MountPoint: destDir,
+				File:       "/state/cOS/transition.img",
+				Label:      "some_label",
+			}
+		})
+		It("Mirrors a directory source into the seeded image", func() {
+			Expect(utils.MkdirAll(fs, filepath.Join(img.MountPoint, "tmp"), cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(img.MountPoint, "tmp", "stale"), []byte("stale"), cnst.FilePerm)).To(Succeed())
+
+			_, err := el.DeployImageDelta(img, base, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			rawBase, _ := fs.RawPath(base)
+			rawFile, _ := fs.RawPath(img.File)
+			Expect(runner.IncludesCmds([][]string{
+				{"cp", "--sparse=always", rawBase, rawFile},
+				{"e2fsck", "-fy", img.File},
+				{"resize2fs", img.File, "16M"},
+				{"tune2fs", "-L", img.Label, img.File},
+				{"rsync", "--archive", "--xattrs", "--acls", "--delete", "--checksum", "--hard-links", "--exclude=/lost+found", "--exclude=/mnt"},
+			})).To(Succeed())
+
+			// Excluded paths of the base tree are emptied
+			exists, _ := utils.Exists(fs, filepath.Join(img.MountPoint, "tmp", "stale"))
+			Expect(exists).To(BeFalse())
+			exists, _ = utils.Exists(fs, filepath.Join(img.MountPoint, "tmp"))
+			Expect(exists).To(BeTrue())
+		})
+		It("Applies the container image layers added on top of the base image", Label("docker"), func() {
+			img.Source = v1.NewDockerSrc("registry.org/my/image:new")
+			baseDigest := "sha256:" + strings.Repeat("a", 64)
+			baseState := &v1.ImageState{
+				Source:         v1.NewDockerSrc("registry.org/my/image:old"),
+				SourceMetadata: &v1.DockerImageMeta{Digest: baseDigest},
+			}
+			luet.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+				if image == "registry.org/my/image@"+baseDigest {
+					return &v1.DockerImageMeta{Layers: []string{"sha256:one", "sha256:two"}}, nil
+				}
+				return &v1.DockerImageMeta{Layers: []string{"sha256:one", "sha256:two", "sha256:three"}}, nil
+			}
+			var from int
+			luet.UnpackLayersSideEffect = func(target, image string, local bool, f int) (*v1.DockerImageMeta, error) {
+				Expect(target).To(Equal(img.MountPoint))
+				from = f
+				return &v1.DockerImageMeta{Digest: "sha256:new"}, nil
+			}
+
+			info, err := el.DeployImageDelta(img, base, baseState)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info).To(Equal(&v1.DockerImageMeta{Digest: "sha256:new"}))
+			Expect(from).To(Equal(2))
+			Expect(luet.UnpackCalled()).To(BeFalse())
+		})
+		It("Fails with ErrNoDelta if the base image layers are not reused", Label("docker"), func() {
+			img.Source = v1.NewDockerSrc("registry.org/my/image:new")
+			baseState := &v1.ImageState{
+				Source:         v1.NewDockerSrc("registry.org/my/image:old"),
+				SourceMetadata: &v1.DockerImageMeta{Digest: "sha256:" + strings.Repeat("a", 64)},
+			}
+			luet.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+				return &v1.DockerImageMeta{Layers: []string{"sha256:" + image}}, nil
+			}
+
+			_, err := el.DeployImageDelta(img, base, baseState)
+			Expect(errors.Is(err, elemental.ErrNoDelta)).To(BeTrue())
+			Expect(luet.UnpackLayersCalled()).To(BeFalse())
+			Expect(runner.IncludesCmds([][]string{{"cp"}})).NotTo(Succeed())
+		})
+		It("Fails with ErrNoDelta if the base image was not deployed from a container image", Label("docker"), func() {
+			img.Source = v1.NewDockerSrc("registry.org/my/image:new")
+			baseState := &v1.ImageState{Source: v1.NewChannelSrc("system/cos")}
+			_, err := el.DeployImageDelta(img, base, baseState)
+			Expect(errors.Is(err, elemental.ErrNoDelta)).To(BeTrue())
+		})
+		It("Fails with ErrNoDelta for channel sources", Label("channel"), func() {
+			img.Source = v1.NewChannelSrc("system/cos")
+			_, err := el.DeployImageDelta(img, base, nil)
+			Expect(errors.Is(err, elemental.ErrNoDelta)).To(BeTrue())
+		})
+		It("Fails for squashfs images", func() {
+			img.FS = cnst.SquashFs
+			_, err := el.DeployImageDelta(img, base, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, elemental.ErrNoDelta)).To(BeFalse())
+		})
+		It("Removes the image file if mirroring fails", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "rsync" {
+					return []byte{}, errors.New("rsync failed")
+				}
+				if cmd == "cp" {
+					return []byte{}, fs.WriteFile(img.File, []byte("active"), cnst.FilePerm)
+				}
+				return []byte{}, nil
+			}
+			_, err := el.DeployImageDelta(img, base, nil)
+			Expect(err).To(HaveOccurred())
+			exists, _ := utils.Exists(fs, img.File)
+			Expect(exists).To(BeFalse())
+		})
+	})
+	Describe("CheckAvailableSpace", Label("space"), func() {
+		var e *elemental.Elemental
+		var luet *v1mock.FakeLuet
+		var active, passive *v1.Image
+		BeforeEach(func() {
+			luet = v1mock.NewFakeLuet()
+			config.Luet = luet
+			e = elemental.NewElemental(config)
+			Expect(utils.MkdirAll(fs, "/state/cOS", cnst.DirPerm)).To(Succeed())
+			active = &v1.Image{
+				File:   "/state/cOS/active.img",
+				Size:   16,
+				FS:     cnst.LinuxImgFs,
+				Source: v1.NewDockerSrc("registry.org/my/image:tag"),
+			}
+			passive = &v1.Image{
+				File:   "/state/cOS/passive.img",
+				FS:     cnst.LinuxImgFs,
+				Source: v1.NewFileSrc(active.File),
+			}
+		})
+		It("Succeeds if images fit in the available space", func() {
+			syscall.(*v1mock.FakeSyscall).FreeSpace = 32 * 1024 * 1024
+			Expect(e.CheckAvailableSpace("/state", active, passive)).To(Succeed())
+		})
+		It("Fails if images do not fit in the available space", func() {
+			syscall.(*v1mock.FakeSyscall).FreeSpace = 31 * 1024 * 1024
+			err := e.CheckAvailableSpace("/state", active, passive)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not enough space in /state"))
+			Expect(err.Error()).To(ContainSubstring("/state/cOS/passive.img: 16MiB"))
+		})
+		It("Fails if the image size is too small for the container image layers", func() {
+			luet.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+				return &v1.DockerImageMeta{LayersSize: 17 * 1024 * 1024}, nil
+			}
+			err := e.CheckAvailableSpace("/state", active)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("too small"))
+		})
+		It("Estimates squashfs images from the container image layers", func() {
+			luet.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+				return &v1.DockerImageMeta{LayersSize: 1024}, nil
+			}
+			active.FS = cnst.SquashFs
+			size, err := e.EstimateImageSize(active)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(1024 * cnst.LayersExpansionFactor)))
+		})
+		It("Does not fail if the image manifest can't be fetched", func() {
+			luet.ImageMetaSideEffect = func(image string, local bool) (*v1.DockerImageMeta, error) {
+				return nil, errors.New("manifest unknown")
+			}
+			active.FS = cnst.SquashFs
+			size, err := e.EstimateImageSize(active)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(0)))
+			Expect(e.CheckAvailableSpace("/state", active)).To(Succeed())
+		})
+		It("Estimates images from directories", func() {
+			Expect(utils.MkdirAll(fs, "/source", cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/source/file", []byte("data"), cnst.FilePerm)).To(Succeed())
+			active.FS = cnst.SquashFs
+			active.Source = v1.NewDirSrc("/source")
+			size, err := e.EstimateImageSize(active)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(int64(4)))
+		})
+		It("Fails if the available space can't be checked", func() {
+			syscall.(*v1mock.FakeSyscall).ErrorOnStatfs = true
+			Expect(e.CheckAvailableSpace("/state", active)).NotTo(Succeed())
+		})
+	})
 	Describe("DumpSource", Label("dump"), func() {
 		var e *elemental.Elemental
 		var destDir string
@@ -618,6 +988,64 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).To(BeNil())
 			Expect(luet.UnpackCalled()).To(BeTrue())
 		})
+		It("Unpacks a local container image archive to target", Label("archive"), func() {
+			luet.UnpackArchiveSideEffect = func(target string, src *v1.ImageSource) (*v1.DockerImageMeta, error) {
+				return &v1.DockerImageMeta{Digest: "sha256:aaaa"}, nil
+			}
+			info, err := e.DumpSource(destDir, v1.NewOCIArchiveSrc("/images/os.tar"))
+			Expect(err).To(BeNil())
+			Expect(luet.UnpackArchiveCalled()).To(BeTrue())
+			Expect(luet.UnpackCalled()).To(BeFalse())
+			Expect(info.(*v1.DockerImageMeta).Digest).To(Equal("sha256:aaaa"))
+		})
+		It("Fails to unpack a local container image archive", Label("archive"), func() {
+			luet.OnUnpackError = true
+			_, err := e.DumpSource(destDir, v1.NewOCILayoutSrc("/images/layout:v1"))
+			Expect(err).NotTo(BeNil())
+		})
+		It("Extracts a rootfs tarball fetched over http", Label("http"), func() {
+			checksum := "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac"
+			client.SideEffect = func(url, destination string) error {
+				return fs.WriteFile(destination, []byte("rootfs"), constants.FilePerm)
+			}
+			var tarball string
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "tar" {
+					tarball = args[len(args)-3]
+					Expect(args[len(args)-2:]).To(Equal([]string{"--directory", destDir}))
+				}
+				return []byte{}, nil
+			}
+			info, err := e.DumpSource(destDir, v1.NewHTTPSrc("https://example.org/rootfs.tar.xz", checksum))
+			Expect(err).To(BeNil())
+			Expect(client.WasGetCalledWith("https://example.org/rootfs.tar.xz")).To(BeTrue())
+			Expect(runner.IncludesCmds([][]string{{"tar", "--extract"}})).To(BeNil())
+			// The downloaded tarball is removed once extracted
+			Expect(tarball).NotTo(BeEmpty())
+			exists, _ := utils.Exists(fs, tarball)
+			Expect(exists).To(BeFalse())
+			Expect(info).To(Equal(&v1.HTTPImageMeta{URL: "https://example.org/rootfs.tar.xz", Checksum: checksum, Size: 6}))
+		})
+		It("Downloads a prebuilt image over http into the target file", Label("http"), func() {
+			client.SideEffect = func(url, destination string) error {
+				return fs.WriteFile(destination, []byte("image"), constants.FilePerm)
+			}
+			target := filepath.Join(destDir, "images", "active.img")
+			info, err := e.DumpSource(target, v1.NewHTTPSrc("https://example.org/active.img", ""))
+			Expect(err).To(BeNil())
+			data, err := fs.ReadFile(target)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("image"))
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+			checksum, _ := utils.CalcFileChecksum(fs, target)
+			Expect(info.(*v1.HTTPImageMeta).Checksum).To(Equal("sha256:" + checksum))
+		})
+		It("Fails to fetch an http source", Label("http"), func() {
+			client.Error = true
+			_, err := e.DumpSource(destDir, v1.NewHTTPSrc("https://example.org/rootfs.tar.gz", ""))
+			Expect(err).NotTo(BeNil())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
 		It("Unpacks a docker image to target with cosign validation", Label("docker", "cosign"), func() {
 			config.Cosign = true
 			_, err := e.DumpSource(destDir, v1.NewDockerSrc("docker/image:latest"))
@@ -647,8 +1075,9 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).NotTo(BeNil())
 			_, err = e.DumpSource(destFile, v1.NewFileSrc(sourceImg))
 			Expect(err).To(BeNil())
-			_, err = fs.Stat(destFile)
-			Expect(err).To(BeNil())
+			rawSource, _ := fs.RawPath(sourceImg)
+			rawDest, _ := fs.RawPath(destFile)
+			Expect(runner.CmdsMatch([][]string{{"cp", "--sparse=always", rawSource, rawDest}})).To(Succeed())
 		})
 		It("Fails to copy, source file is not present", func() {
 			_, err := e.DumpSource("whatever", v1.NewFileSrc("/source.img"))
@@ -819,6 +1248,33 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err.Error()).To(ContainSubstring("mount error"))
 		})
 	})
+	Describe("GetIsoMeta", Label("GetIso", "iso"), func() {
+		It("Returns the checksum of the downloaded iso and unmounts it", func() {
+			e := elemental.NewElemental(config)
+			tmpDir, err := utils.TempDir(fs, "", "elemental-test")
+			Expect(err).To(BeNil())
+			iso := filepath.Join(tmpDir, "fake.iso")
+			Expect(fs.WriteFile(iso, []byte("iso"), cnst.FilePerm)).To(Succeed())
+			isoDir, err := e.GetIso(iso)
+			Expect(err).To(BeNil())
+
+			meta, err := e.GetIsoMeta(iso, isoDir)
+			Expect(err).To(BeNil())
+			Expect(meta).To(Equal(&v1.IsoImageMeta{
+				Iso:      iso,
+				Checksum: "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac",
+			}))
+
+			Expect(e.UnmountIso(isoDir)).To(Succeed())
+			mnts, _ := mounter.FakeMounter.List()
+			Expect(mnts).To(BeEmpty())
+		})
+		It("Fails if the iso was not downloaded", func() {
+			e := elemental.NewElemental(config)
+			_, err := e.GetIsoMeta("/some/fake.iso", "/some/dir")
+			Expect(err).NotTo(BeNil())
+		})
+	})
 	Describe("UpdateSourcesFormDownloadedISO", Label("iso"), func() {
 		var e *elemental.Elemental
 		var activeImg, recoveryImg *v1.Image
@@ -918,6 +1374,142 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(el.SetDefaultGrubEntry("/mountpoint", "/imgMountPoint", "default_entry")).NotTo(BeNil())
 		})
 	})
+	Describe("SyncPartitionMembers", Label("mirror"), func() {
+		var part *v1.Partition
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, constants.EfiDir, constants.DirPerm)).To(Succeed())
+			part = &v1.Partition{
+				Name:       constants.EfiPartName,
+				Path:       "/some/device1",
+				MountPoint: constants.EfiDir,
+				Members:    []string{"/some/device1", "/some/mirror1"},
+			}
+		})
+		It("Mirrors the partition into the other members", func() {
+			var synced []string
+			el := elemental.NewElemental(config)
+			Expect(el.SyncPartitionMembers(part, func(mountPoint string) error {
+				synced = append(synced, mountPoint)
+				return nil
+			})).To(Succeed())
+			Expect(synced).To(HaveLen(1))
+			Expect(runner.MatchMilestones([][]string{{"rsync"}})).To(BeNil())
+			notMnt, _ := mounter.IsLikelyNotMountPoint(synced[0])
+			Expect(notMnt).To(BeTrue())
+		})
+		It("Fails if a member can't be mounted", func() {
+			mounter.ErrorOnMount = true
+			el := elemental.NewElemental(config)
+			Expect(el.SyncPartitionMembers(part, nil)).NotTo(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+	})
+	Describe("Encryption", Label("encryption"), func() {
+		var part *v1.Partition
+		BeforeEach(func() {
+			part = &v1.Partition{
+				Name:       constants.PersistentPartName,
+				Path:       "/dev/disk/by-uuid/1234",
+				Encryption: &v1.PartitionEncryption{KeyFile: "/keyfile", UUID: "1234"},
+			}
+		})
+		It("Unlocks and locks again an encrypted partition", func() {
+			el := elemental.NewElemental(config)
+			lock, err := el.UnlockPartition(part)
+			Expect(err).To(BeNil())
+			Expect(part.Path).To(Equal("/dev/mapper/cos_persistent"))
+			Expect(lock()).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"cryptsetup", "open", "--key-file", "/keyfile", "/dev/disk/by-uuid/1234", "cos_persistent"},
+				{"cryptsetup", "close", "cos_persistent"},
+			})).To(BeNil())
+		})
+		It("Does nothing if the partition is already unlocked", func() {
+			Expect(utils.MkdirAll(fs, "/dev/mapper", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/dev/mapper/cos_persistent")
+			Expect(err).To(BeNil())
+			el := elemental.NewElemental(config)
+			lock, err := el.UnlockPartition(part)
+			Expect(err).To(BeNil())
+			Expect(part.Path).To(Equal("/dev/mapper/cos_persistent"))
+			Expect(lock()).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+		It("Fails to unlock without the passphrase file", func() {
+			part.Encryption = &v1.PartitionEncryption{PassphraseFrom: "/missing"}
+			el := elemental.NewElemental(config)
+			_, err := el.UnlockPartition(part)
+			Expect(err).NotTo(BeNil())
+		})
+		It("Writes the crypttab and the cloud-config unlocking the partitions on boot", func() {
+			Expect(utils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+			data := &v1.Partition{Name: "data", Encryption: &v1.PartitionEncryption{PassphraseFrom: "/pass", UUID: "5678"}}
+			el := elemental.NewElemental(config)
+			Expect(el.WriteCrypttab("/root", "/oem", v1.PartitionList{part, data})).To(Succeed())
+			crypttab, err := fs.ReadFile("/root/etc/crypttab")
+			Expect(err).To(BeNil())
+			Expect(string(crypttab)).To(Equal(
+				"cos_persistent UUID=1234 /keyfile luks\ncos_data UUID=5678 none luks\n",
+			))
+			unlock, err := fs.ReadFile(filepath.Join("/oem", constants.UnlockConfigFile))
+			Expect(err).To(BeNil())
+			Expect(string(unlock)).To(ContainSubstring("rootfs.before:"))
+			Expect(string(unlock)).To(ContainSubstring("systemd-cryptsetup attach cos_data /dev/disk/by-uuid/5678 none luks\n"))
+		})
+	})
+	Describe("Subvolumes", Label("btrfs", "subvolumes"), func() {
+		var part *v1.Partition
+		BeforeEach(func() {
+			part = &v1.Partition{
+				Name: constants.PersistentPartName,
+				Path: "/dev/device5",
+				FS:   constants.Btrfs,
+				Subvolumes: []*v1.Subvolume{
+					{Path: "@home", Compression: "zstd"}, {Path: "@var"},
+				},
+			}
+		})
+		It("Creates the subvolumes of a partition", func() {
+			el := elemental.NewElemental(config)
+			Expect(el.CreateSubvolumes(part, part.Path)).To(Succeed())
+			Expect(runner.MatchMilestones([][]string{
+				{"btrfs", "subvolume", "create"},
+				{"btrfs", "property", "set"},
+				{"btrfs", "subvolume", "create"},
+			})).To(BeNil())
+			lst, _ := mounter.List()
+			Expect(lst).To(BeEmpty())
+		})
+		It("Resets the subvolumes and removes any other data of the partition", func() {
+			config.Mounter = populatedMounter{ErrorMounter: mounter, fs: fs, dirs: []string{"@home", "leftover"}}
+			var deleted, created []string
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "btrfs" && args[0] == "subvolume" {
+					switch args[1] {
+					case "delete":
+						deleted = append(deleted, filepath.Base(args[2]))
+						Expect(fs.RemoveAll(args[2])).To(Succeed())
+					case "create":
+						created = append(created, filepath.Base(args[2]))
+						exists, _ := utils.Exists(fs, filepath.Join(filepath.Dir(args[2]), "leftover"))
+						Expect(exists).To(BeFalse())
+					}
+				}
+				return []byte{}, nil
+			}
+			el := elemental.NewElemental(config)
+			Expect(el.ResetSubvolumes(part)).To(Succeed())
+			Expect(deleted).To(Equal([]string{"@home"}))
+			Expect(created).To(Equal([]string{"@home", "@var"}))
+		})
+		It("Fails if a subvolume can't be created", func() {
+			runner.ReturnError = errors.New("btrfs failed")
+			el := elemental.NewElemental(config)
+			Expect(el.CreateSubvolumes(part, part.Path)).NotTo(Succeed())
+			lst, _ := mounter.List()
+			Expect(lst).To(BeEmpty())
+		})
+	})
 	Describe("FindKernelInitrd", Label("find"), func() {
 		BeforeEach(func() {
 			err := utils.MkdirAll(fs, "/path/boot", constants.DirPerm)
@@ -953,6 +1545,73 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Describe("FormatExistingLayout", Label("keep-persistent", "format"), func() {
+		var ghwTest v1mock.GhwMock
+		var install *v1.InstallSpec
+		BeforeEach(func() {
+			ghwTest = v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "device",
+				Partitions: []*block.Partition{
+					{Name: "device1", FilesystemLabel: constants.EfiLabel, Type: "vfat"},
+					{Name: "device2", FilesystemLabel: constants.OEMLabel, Type: "ext4"},
+					{Name: "device3", FilesystemLabel: constants.RecoveryLabel, Type: "ext4"},
+					{Name: "device4", FilesystemLabel: constants.StateLabel, Type: "ext4"},
+					{Name: "device5", FilesystemLabel: constants.PersistentLabel, Type: "xfs"},
+					{Name: "device6", FilesystemLabel: "DATA", Type: "ext4"},
+				},
+			})
+			ghwTest.AddDisk(block.Disk{
+				Name:       "other",
+				Partitions: []*block.Partition{{Name: "other1", FilesystemLabel: constants.StateLabel, Type: "ext4"}},
+			})
+			ghwTest.CreateDevices()
+			install = conf.NewInstallSpec(*config)
+			install.Target = "/dev/device"
+			install.Firmware = v1.EFI
+			install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)
+			install.ExtraPartitions = v1.PartitionList{
+				{Name: "data", FilesystemLabel: "DATA", FS: "ext4", Size: 100},
+			}
+			install.KeepPersistent = true
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("Formats the existing partitions except the kept ones", func() {
+			el := elemental.NewElemental(config)
+			Expect(el.FormatExistingLayout(install)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"mkfs.vfat", "-n", constants.EfiLabel, "/dev/device1"},
+				{"mkfs.ext4", "-L", constants.OEMLabel, "/dev/device2"},
+				{"mkfs.ext4", "-L", constants.RecoveryLabel, "/dev/device3"},
+				{"mkfs.ext4", "-L", constants.StateLabel, "/dev/device4"},
+				{"mkfs.ext4", "-L", "DATA", "/dev/device6"},
+			})).To(BeNil())
+			Expect(install.Partitions.Persistent.Path).To(Equal("/dev/device5"))
+			Expect(install.Partitions.Persistent.FS).To(Equal("xfs"))
+		})
+		It("Keeps the chosen extra partitions", func() {
+			install.KeepPartitions = []string{"data"}
+			el := elemental.NewElemental(config)
+			Expect(el.FormatExistingLayout(install)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", "DATA"}})).NotTo(BeNil())
+			Expect(install.ExtraPartitions[0].Path).To(Equal("/dev/device6"))
+		})
+		It("Fails if there is no elemental layout on the target", func() {
+			install.Target = "/dev/missing"
+			el := elemental.NewElemental(config)
+			Expect(el.FormatExistingLayout(install)).NotTo(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+		It("Fails if a partition of the layout is missing", func() {
+			install.ExtraPartitions[0].FilesystemLabel = "MISSING"
+			el := elemental.NewElemental(config)
+			err := el.FormatExistingLayout(install)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("partition data not found"))
+		})
+	})
 	Describe("DeactivateDevices", Label("blkdeactivate"), func() {
 		It("calls blkdeactivat", func() {
 			el := elemental.NewElemental(config)
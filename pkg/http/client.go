@@ -17,7 +17,11 @@ limitations under the License.
 package http
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/cavaliergopher/grab/v3"
@@ -26,7 +30,8 @@ import (
 )
 
 type Client struct {
-	client *grab.Client
+	client   *grab.Client
+	progress *v1.Progress
 }
 
 func NewClient() *Client {
@@ -35,6 +40,11 @@ func NewClient() *Client {
 	return &Client{client: client}
 }
 
+// SetProgress sets the progress the percent of the downloads is reported to
+func (c *Client) SetProgress(progress *v1.Progress) {
+	c.progress = progress
+}
+
 // GetURL attempts to download the contents of the given URL to the given destination
 func (c Client) GetURL(log v1.Logger, url string, destination string) error { // nolint:revive
 	req, err := grab.NewRequest(destination, url)
@@ -42,9 +52,36 @@ func (c Client) GetURL(log v1.Logger, url string, destination string) error { //
 		log.Errorf("Failed creating a request to '%s'", url)
 		return err
 	}
+	return c.download(log, req)
+}
+
+// GetURLWithChecksum attempts to download the contents of the given URL to the given destination
+// and verifies them against the given 'sha256:<hex digest>' checksum, if any
+func (c Client) GetURLWithChecksum(log v1.Logger, url string, destination string, checksum string) error { // nolint:revive
+	req, err := grab.NewRequest(destination, url)
+	if err != nil {
+		log.Errorf("Failed creating a request to '%s'", url)
+		return err
+	}
+	if checksum != "" {
+		parts := strings.SplitN(checksum, ":", 2)
+		if len(parts) != 2 || parts[0] != "sha256" {
+			return fmt.Errorf("unsupported checksum '%s'", checksum)
+		}
+		sum, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid checksum '%s': %w", checksum, err)
+		}
+		req.SetChecksum(sha256.New(), sum, true)
+	}
+	return c.download(log, req)
+}
 
+// download runs the given request logging its progress
+func (c Client) download(log v1.Logger, req *grab.Request) error {
 	// start download
-	log.Infof("Downloading %v...\n", req.URL())
+	url := req.URL().String()
+	log.Infof("Downloading %v...\n", url)
 	resp := c.client.Do(req)
 
 	// start UI loop
@@ -59,6 +96,7 @@ Loop:
 				resp.BytesComplete(),
 				resp.Size,
 				100*resp.Progress())
+			c.progress.Percent(url, int(100*resp.Progress()))
 
 		case <-resp.Done:
 			// download is complete
@@ -72,6 +110,7 @@ Loop:
 		return err
 	}
 
+	c.progress.Percent(url, 100)
 	log.Debugf("Download saved to ./%v \n", resp.Filename)
 	return nil
 }
@@ -17,6 +17,10 @@ limitations under the License.
 package http_test
 
 import (
+	"crypto/sha256"
+	"fmt"
+	gohttp "net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 
@@ -61,6 +65,27 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		source := "http://nonexisting.stuff"
 		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
 	})
+	It("Verifies the checksum of the downloaded file", func() {
+		server := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+			_, _ = w.Write([]byte("rootfs"))
+		}))
+		defer server.Close()
+		sum := sha256.Sum256([]byte("rootfs"))
+		checksum := fmt.Sprintf("sha256:%x", sum)
+		dest := filepath.Join(destDir, "rootfs.tar")
+
+		Expect(client.GetURLWithChecksum(log, server.URL, dest, checksum)).To(Succeed())
+		_, err := os.Stat(dest)
+		Expect(err).To(BeNil())
+
+		wrong := filepath.Join(destDir, "wrong.tar")
+		checksum = "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac"
+		Expect(client.GetURLWithChecksum(log, server.URL, wrong, checksum)).NotTo(Succeed())
+		_, err = os.Stat(wrong)
+		Expect(err).NotTo(BeNil())
+
+		Expect(client.GetURLWithChecksum(log, server.URL, wrong, "md5:abcd")).NotTo(Succeed())
+	})
 	It("Fails to download a broken url", func() {
 		source := "scp://23412342341234.wqer.234|@#~ł€@¶|@~#"
 		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
@@ -20,19 +20,30 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
 	dockTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/mudler/luet/pkg/api/core/bus"
 	"github.com/mudler/luet/pkg/api/core/context"
 	gc "github.com/mudler/luet/pkg/api/core/garbagecollector"
+	luetimages "github.com/mudler/luet/pkg/api/core/image"
 	luetTypes "github.com/mudler/luet/pkg/api/core/types"
 	"github.com/mudler/luet/pkg/database"
 	"github.com/mudler/luet/pkg/helpers/docker"
 	"github.com/mudler/luet/pkg/installer"
+	version "github.com/mudler/luet/pkg/versioner"
 	"github.com/twpayne/go-vfs"
 	"gopkg.in/yaml.v3"
 
@@ -41,6 +52,9 @@ import (
 	"github.com/rancher/elemental-cli/pkg/utils"
 )
 
+// ociRefNameAnnotation is the annotation holding the tag of the images listed in an OCI layout index
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
 type Luet struct {
 	log               v1.Logger
 	context           *context.Context
@@ -190,6 +204,231 @@ func (l Luet) Unpack(target string, image string, local bool) (*v1.DockerImageMe
 	return meta, nil
 }
 
+// GetImageMeta returns the image digest, the layer digests and the accumulated size of its compressed
+// layers as listed in the image manifest of the configured arch, without pulling or unpacking any layer
+func (l Luet) GetImageMeta(image string, local bool) (*v1.DockerImageMeta, error) {
+	img, err := l.image(image, local)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := imageMeta(img)
+	if err != nil {
+		return nil, err
+	}
+	l.log.Debugf("Image %s layers size: %s", image, units.BytesSize(float64(meta.LayersSize)))
+	return meta, nil
+}
+
+// UnpackLayers applies the layers of the given image, starting at the given layer index, on top of the
+// tree in target. The tree is expected to be the result of applying the layers below the given index.
+// Only the applied layers are pulled.
+func (l Luet) UnpackLayers(target string, image string, local bool, from int) (*v1.DockerImageMeta, error) {
+	img, err := l.image(image, local)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := imageMeta(img)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > len(layers) {
+		return nil, fmt.Errorf("invalid layer index %d, image %s has %d layers", from, image, len(layers))
+	}
+
+	l.log.Infof("Applying %d of %d layers of %s", len(layers)-from, len(layers), image)
+	err = l.applyLayers(target, layers[from:], meta.Layers[from:])
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// UnpackArchive unpacks the container image stored in the archive or the OCI layout directory
+// of the given source into target. OCI layouts holding several images require the tag of the
+// image to unpack, as in '/path/to/layout:tag'.
+func (l Luet) UnpackArchive(target string, src *v1.ImageSource) (*v1.DockerImageMeta, error) {
+	l.log.Infof("Unpacking a container image from %s", src.String())
+	var img gcrv1.Image
+	var err error
+
+	switch {
+	case src.IsDockerArchive():
+		img, err = tarball.ImageFromPath(src.Value(), nil)
+	case src.IsOCIArchive():
+		var layoutDir string
+		layoutDir, err = os.MkdirTemp(l.TmpDir, "elemental-oci-archive")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(layoutDir)
+		err = untarFile(src.Value(), layoutDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed extracting OCI archive %s: %w", src.Value(), err)
+		}
+		img, err = l.layoutImage(layoutDir, "")
+	case src.IsOCILayout():
+		img, err = l.layoutImage(src.OCILayoutRef())
+	default:
+		return nil, fmt.Errorf("%s is not a container image archive", src.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := imageMeta(img)
+	if err != nil {
+		return nil, err
+	}
+	meta.Size, err = img.Size()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	err = l.applyLayers(target, layers, meta.Layers)
+	if err != nil {
+		return nil, err
+	}
+	l.log.Infof("Unpacked: %s %s", meta.Digest, src.Value())
+	return meta, nil
+}
+
+// applyLayers applies the given layers in order on top of the tree in target
+func (l Luet) applyLayers(target string, layers []gcrv1.Layer, digests []string) error {
+	for i, layer := range layers {
+		l.log.Debugf("Applying layer %s", digests[i])
+		reader, err := layer.Uncompressed()
+		if err != nil {
+			return err
+		}
+		// Whiteouts of the layer remove the matching files of the underlying tree
+		_, _, err = luetimages.ExtractReader(l.context, reader, target, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layoutImage returns the image of the OCI layout at the given path with the given tag. Without
+// a tag the layout must hold a single image, image indexes resolve to the image of the configured arch.
+func (l Luet) layoutImage(path, tag string) (gcrv1.Image, error) {
+	lp, err := layout.FromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := lp.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var descs []gcrv1.Descriptor
+	for _, desc := range manifest.Manifests {
+		if tag == "" || desc.Annotations[ociRefNameAnnotation] == tag {
+			descs = append(descs, desc)
+		}
+	}
+	switch {
+	case len(descs) == 0 && tag != "":
+		return nil, fmt.Errorf("no image tagged as %s in %s", tag, path)
+	case len(descs) == 0:
+		return nil, fmt.Errorf("no image found in %s", path)
+	case len(descs) > 1:
+		return nil, fmt.Errorf("%s holds %d images, a tag is required to select one", path, len(descs))
+	case descs[0].MediaType.IsIndex():
+		child, err := idx.ImageIndex(descs[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		return l.platformImage(child)
+	}
+	return idx.Image(descs[0].Digest)
+}
+
+// platformImage returns the image of the configured arch from the given image index
+func (l Luet) platformImage(idx gcrv1.ImageIndex) (gcrv1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	arch := l.arch
+	if goArch, err := utils.ArchToGolangArch(l.arch); err == nil {
+		arch = goArch
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "linux" && desc.Platform.Architecture == arch {
+			return idx.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no image for the %s arch found", arch)
+}
+
+// untarFile extracts the given tar file into the given directory
+func untarFile(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return archive.Untar(f, dir, &archive.TarOptions{NoLchown: true})
+}
+
+// image returns the given image from the local daemon or from its remote registry
+func (l Luet) image(image string, local bool) (gcrv1.Image, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		return daemon.Image(ref)
+	}
+	opts := []remote.Option{remote.WithAuth(authn.FromConfig(authn.AuthConfig{
+		Username:      l.auth.Username,
+		Password:      l.auth.Password,
+		Auth:          l.auth.Auth,
+		IdentityToken: l.auth.IdentityToken,
+		RegistryToken: l.auth.RegistryToken,
+	}))}
+	// Multi-arch references resolve to the manifest of the configured arch
+	arch := l.arch
+	if goArch, err := utils.ArchToGolangArch(l.arch); err == nil {
+		arch = goArch
+	}
+	if arch != "" {
+		opts = append(opts, remote.WithPlatform(gcrv1.Platform{OS: "linux", Architecture: arch}))
+	}
+	return remote.Image(ref, opts...)
+}
+
+// imageMeta returns the metadata of the given image as listed in its manifest
+func imageMeta(img gcrv1.Image) (*v1.DockerImageMeta, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &v1.DockerImageMeta{Digest: digest.String()}
+	for _, layer := range manifest.Layers {
+		meta.LayersSize += layer.Size
+		meta.Layers = append(meta.Layers, layer.Digest.String())
+	}
+	return meta, nil
+}
+
 // initLuetRepository returns a Luet repository from a given v1.Repository. It runs heuristics
 // to determine the type from the URL if this is not provided:
 // 1. Repo type is disk if the URL is an existing local path
@@ -258,22 +497,9 @@ func (l Luet) UnpackFromChannel(target string, pkg string, repositories ...v1.Re
 
 	toInstall = append(toInstall, l.parsePackage(pkg))
 
-	repos := l.context.Config.SystemRepositories
-	if len(repositories) > 0 {
-		repos = luetTypes.LuetRepositories{}
-		for _, r := range repositories {
-			// If the repository has no arch assigned matches all
-			if r.Arch != "" && l.arch != r.Arch {
-				l.log.Debugf("skipping repository '%s' for arch '%s'", r.Name, r.Arch)
-				continue
-			}
-
-			repo, err := l.initLuetRepository(r)
-			if err != nil {
-				return nil, err
-			}
-			repos = append(repos, repo)
-		}
+	repos, err := l.luetRepositories(repositories...)
+	if err != nil {
+		return nil, err
 	}
 
 	inst := installer.NewLuetInstaller(installer.LuetInstallerOptions{
@@ -294,11 +520,12 @@ func (l Luet) UnpackFromChannel(target string, pkg string, repositories ...v1.Re
 		Database: database.NewInMemoryDatabase(false),
 		Target:   target,
 	}
-	err := inst.Install(toInstall, system)
+	err = inst.Install(toInstall, system)
 	if err != nil {
 		return nil, err
 	}
-	pkgs, err := system.Database.FindPackageMatch(pkg)
+	// Drop the version selector, if any, to match the installed package
+	pkgs, err := system.Database.FindPackageMatch(strings.Split(pkg, "@")[0])
 	if err != nil {
 		l.log.Error(err.Error())
 		return nil, err
@@ -328,6 +555,61 @@ func (l Luet) UnpackFromChannel(target string, pkg string, repositories ...v1.Re
 	return meta, nil
 }
 
+// PackageVersions returns the sorted list of versions of the given package available in the given repositories,
+// the version selector of the package, if any, is ignored
+func (l Luet) PackageVersions(pkg string, repositories ...v1.Repository) ([]string, error) {
+	l.InitPlugins()
+
+	repos, err := l.luetRepositories(repositories...)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := installer.NewLuetInstaller(installer.LuetInstallerOptions{
+		PackageRepositories: repos,
+		Context:             l.context,
+	})
+	synced, err := inst.SyncRepositories()
+	if err != nil {
+		return nil, err
+	}
+
+	p := l.parsePackage(pkg)
+	found := map[string]bool{}
+	versions := []string{}
+	for _, candidate := range synced.World() {
+		if candidate.GetCategory() != p.Category || candidate.GetName() != p.Name || found[candidate.GetVersion()] {
+			continue
+		}
+		found[candidate.GetVersion()] = true
+		versions = append(versions, candidate.GetVersion())
+	}
+	return version.DefaultVersioner().Sort(versions), nil
+}
+
+// luetRepositories returns the Luet repositories of the given repositories matching the current arch,
+// if no repository is given the system repositories are returned
+func (l Luet) luetRepositories(repositories ...v1.Repository) (luetTypes.LuetRepositories, error) {
+	if len(repositories) == 0 {
+		return l.context.Config.SystemRepositories, nil
+	}
+	repos := luetTypes.LuetRepositories{}
+	for _, r := range repositories {
+		// If the repository has no arch assigned matches all
+		if r.Arch != "" && l.arch != r.Arch {
+			l.log.Debugf("skipping repository '%s' for arch '%s'", r.Name, r.Arch)
+			continue
+		}
+
+		repo, err := l.initLuetRepository(r)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
 func (l Luet) parsePackage(p string) *luetTypes.Package {
 	var cat, name string
 	ver := ">=0"
@@ -17,8 +17,10 @@ limitations under the License.
 package luet_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"path/filepath"
 	"testing"
 
 	"github.com/rancher/elemental-cli/pkg/constants"
@@ -26,6 +28,13 @@ import (
 
 	dockTypes "github.com/docker/docker/api/types"
 	dockClient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/mudler/go-pluggable"
 	"github.com/mudler/luet/pkg/api/core/bus"
 	"github.com/twpayne/go-vfs"
@@ -96,6 +105,105 @@ var _ = Describe("Types", Label("luet", "types"), func() {
 			_, err = l.Unpack(target, image, true)
 			Expect(err).To(BeNil())
 		})
+		Describe("UnpackLayers", Label("unpack", "layers"), func() {
+			It("Check that luet applies the top layers of the remote image", Label("root"), func() {
+				image := "registry.opensuse.org/opensuse/redis"
+				meta, err := l.GetImageMeta(image, false)
+				Expect(err).To(BeNil())
+				Expect(meta.Layers).ToNot(BeEmpty())
+				applied, err := l.UnpackLayers(target, image, false, len(meta.Layers)-1)
+				Expect(err).To(BeNil())
+				Expect(applied.Digest).To(Equal(meta.Digest))
+			})
+			It("Fails to apply layers from an index out of the image layers", func() {
+				image := "registry.opensuse.org/opensuse/redis"
+				meta, err := l.GetImageMeta(image, false)
+				Expect(err).To(BeNil())
+				_, err = l.UnpackLayers(target, image, false, len(meta.Layers)+1)
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("invalid layer index"))
+			})
+		})
+		Describe("UnpackArchive", Label("unpack", "archive"), func() {
+			var img gcrv1.Image
+			var archiveDir string
+
+			BeforeEach(func() {
+				var err error
+				archiveDir, err = os.MkdirTemp("", "elemental-archive")
+				Expect(err).To(BeNil())
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				data := []byte("NAME=elemental")
+				Expect(tw.WriteHeader(&tar.Header{Name: "etc/os-release", Mode: 0644, Size: int64(len(data))})).To(Succeed())
+				_, err = tw.Write(data)
+				Expect(err).To(BeNil())
+				Expect(tw.Close()).To(Succeed())
+				layer, err := tarball.LayerFromReader(&buf)
+				Expect(err).To(BeNil())
+				img, err = mutate.AppendLayers(empty.Image, layer)
+				Expect(err).To(BeNil())
+			})
+			AfterEach(func() {
+				Expect(os.RemoveAll(archiveDir)).To(Succeed())
+			})
+			It("Unpacks the tagged image of an OCI layout", func() {
+				lp, err := layout.Write(filepath.Join(archiveDir, "layout"), empty.Index)
+				Expect(err).To(BeNil())
+				Expect(lp.AppendImage(empty.Image, layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": "v0"}))).To(Succeed())
+				Expect(lp.AppendImage(img, layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": "v1"}))).To(Succeed())
+
+				meta, err := l.UnpackArchive(target, v1.NewOCILayoutSrc(filepath.Join(archiveDir, "layout:v1")))
+				Expect(err).To(BeNil())
+				digest, _ := img.Digest()
+				Expect(meta.Digest).To(Equal(digest.String()))
+				Expect(meta.Layers).To(HaveLen(1))
+				data, err := os.ReadFile(filepath.Join(target, "etc/os-release"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(Equal("NAME=elemental"))
+
+				// Fails to pick an image without a tag
+				_, err = l.UnpackArchive(target, v1.NewOCILayoutSrc(filepath.Join(archiveDir, "layout")))
+				Expect(err).NotTo(BeNil())
+				_, err = l.UnpackArchive(target, v1.NewOCILayoutSrc(filepath.Join(archiveDir, "layout:v2")))
+				Expect(err).NotTo(BeNil())
+			})
+			It("Unpacks the image of an OCI archive", func() {
+				_, err := layout.Write(filepath.Join(archiveDir, "layout"), empty.Index)
+				Expect(err).To(BeNil())
+				lp, err := layout.FromPath(filepath.Join(archiveDir, "layout"))
+				Expect(err).To(BeNil())
+				Expect(lp.AppendImage(img)).To(Succeed())
+				reader, err := archive.Tar(filepath.Join(archiveDir, "layout"), archive.Uncompressed)
+				Expect(err).To(BeNil())
+				defer reader.Close()
+				data, err := io.ReadAll(reader)
+				Expect(err).To(BeNil())
+				Expect(os.WriteFile(filepath.Join(archiveDir, "image.tar"), data, constants.FilePerm)).To(Succeed())
+
+				meta, err := l.UnpackArchive(target, v1.NewOCIArchiveSrc(filepath.Join(archiveDir, "image.tar")))
+				Expect(err).To(BeNil())
+				digest, _ := img.Digest()
+				Expect(meta.Digest).To(Equal(digest.String()))
+				Expect(filepath.Join(target, "etc/os-release")).To(BeAnExistingFile())
+			})
+			It("Unpacks the image of a docker archive", func() {
+				file := filepath.Join(archiveDir, "image.tar")
+				Expect(tarball.WriteToFile(file, name.MustParseReference("elemental:latest"), img)).To(Succeed())
+
+				meta, err := l.UnpackArchive(target, v1.NewDockerArchiveSrc(file))
+				Expect(err).To(BeNil())
+				Expect(meta.Digest).NotTo(BeEmpty())
+				Expect(filepath.Join(target, "etc/os-release")).To(BeAnExistingFile())
+			})
+			It("Fails to unpack a missing archive", func() {
+				_, err := l.UnpackArchive(target, v1.NewDockerArchiveSrc(filepath.Join(archiveDir, "missing.tar")))
+				Expect(err).NotTo(BeNil())
+				_, err = l.UnpackArchive(target, v1.NewDockerSrc("some/image"))
+				Expect(err).NotTo(BeNil())
+			})
+		})
 		Describe("UnpackFromChannel", Label("unpack", "channel"), func() {
 			It("Check that luet can unpack from channel", Label("root"), func() {
 				repo := v1.Repository{URI: "quay.io/costoolkit/releases-teal", Arch: constants.Archx86}
@@ -138,6 +246,20 @@ var _ = Describe("Types", Label("luet", "types"), func() {
 			})
 		})
 
+		Describe("PackageVersions", Label("channel", "versions"), func() {
+			It("Fails to list versions with a repository with no URI", func() {
+				repo := v1.Repository{Arch: constants.Archx86}
+				_, err := l.PackageVersions("utils/gomplate", repo)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("no URI is provided"))
+			})
+			It("Fails to list versions with a strange repository that cant get the type for", func() {
+				repo := v1.Repository{URI: "is:this:real:life", Arch: constants.Archx86}
+				_, err := l.PackageVersions("utils/gomplate", repo)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Invalid Luet repository URI"))
+			})
+		})
 		Describe("Luet config", Label("config"), func() {
 			It("Create empty config if there is no luet.yaml", func() {
 				memLog := bytes.Buffer{}
@@ -0,0 +1,50 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// CreateSubvolume creates a btrfs subvolume at the given path within a mounted btrfs filesystem
+func CreateSubvolume(runner v1.Runner, path string) error {
+	out, err := runner.Run("btrfs", "subvolume", "create", path)
+	if err != nil {
+		return fmt.Errorf("failed creating subvolume %s: %s: %w", path, string(out), err)
+	}
+	return nil
+}
+
+// DeleteSubvolume deletes the btrfs subvolume at the given path
+func DeleteSubvolume(runner v1.Runner, path string) error {
+	out, err := runner.Run("btrfs", "subvolume", "delete", path)
+	if err != nil {
+		return fmt.Errorf("failed deleting subvolume %s: %s: %w", path, string(out), err)
+	}
+	return nil
+}
+
+// SetCompression sets the compression algorithm of the data written to the given btrfs path
+func SetCompression(runner v1.Runner, path, compression string) error {
+	out, err := runner.Run("btrfs", "property", "set", path, "compression", compression)
+	if err != nil {
+		return fmt.Errorf("failed setting %s compression on %s: %s: %w", compression, path, string(out), err)
+	}
+	return nil
+}
@@ -396,30 +396,15 @@ func (dev Disk) expandFilesystem(device string) (string, error) {
 		}
 	case "xfs":
 		// to grow an xfs fs it needs to be mounted :/
-		tmpDir, err := utils.TempDir(dev.fs, "", "partitioner")
-		defer func(fs v1.FS, path string) {
-			_ = fs.RemoveAll(path)
-		}(dev.fs, tmpDir)
-
-		if err != nil {
-			return string(out), err
-		}
-		out, err = dev.runner.Run("mount", "-t", "xfs", device, tmpDir)
-		if err != nil {
-			return string(out), err
-		}
-		_, err = dev.runner.Run("xfs_growfs", tmpDir)
+		out, err := dev.growMountedFilesystem(device, "xfs", "xfs_growfs")
 		if err != nil {
-			// If we error out, try to umount the dir to not leave it hanging
-			out, err2 := dev.runner.Run("umount", tmpDir)
-			if err2 != nil {
-				return string(out), err2
-			}
-			return string(out), err
+			return out, err
 		}
-		out, err = dev.runner.Run("umount", tmpDir)
+	case "btrfs":
+		// btrfs is also resized online
+		out, err := dev.growMountedFilesystem(device, "btrfs", "btrfs", "filesystem", "resize", "max")
 		if err != nil {
-			return string(out), err
+			return out, err
 		}
 	default:
 		return "", fmt.Errorf("could not find filesystem for %s, not resizing the filesystem", device)
@@ -427,3 +412,36 @@ func (dev Disk) expandFilesystem(device string) (string, error) {
 
 	return "", nil
 }
+
+// growMountedFilesystem mounts the given device on a temporary directory and runs the given grow
+// command with the mount point as the last argument
+func (dev Disk) growMountedFilesystem(device, fileSystem, command string, args ...string) (string, error) {
+	var out []byte
+
+	tmpDir, err := utils.TempDir(dev.fs, "", "partitioner")
+	defer func(fs v1.FS, path string) {
+		_ = fs.RemoveAll(path)
+	}(dev.fs, tmpDir)
+
+	if err != nil {
+		return string(out), err
+	}
+	out, err = dev.runner.Run("mount", "-t", fileSystem, device, tmpDir)
+	if err != nil {
+		return string(out), err
+	}
+	_, err = dev.runner.Run(command, append(args, tmpDir)...)
+	if err != nil {
+		// If we error out, try to umount the dir to not leave it hanging
+		out, err2 := dev.runner.Run("umount", tmpDir)
+		if err2 != nil {
+			return string(out), err2
+		}
+		return string(out), err
+	}
+	out, err = dev.runner.Run("umount", tmpDir)
+	if err != nil {
+		return string(out), err
+	}
+	return "", nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+const (
+	mapperDir    = "/dev/mapper"
+	mapperPrefix = "cos_"
+)
+
+// LuksMapperName returns the device mapper name of the given encrypted partition once unlocked
+func LuksMapperName(partName string) string {
+	return mapperPrefix + strings.ToLower(partName)
+}
+
+// LuksMapperDevice returns the device of the given encrypted partition once unlocked
+func LuksMapperDevice(partName string) string {
+	return filepath.Join(mapperDir, LuksMapperName(partName))
+}
+
+// LuksFormat formats the given device as a LUKS2 volume which is unlocked with the given key file
+func LuksFormat(runner v1.Runner, device, keyFile string) error {
+	out, err := runner.Run(
+		"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", keyFile, device,
+	)
+	if err != nil {
+		return fmt.Errorf("failed encrypting %s: %s: %w", device, string(out), err)
+	}
+	return nil
+}
+
+// LuksUUID returns the UUID of the given LUKS volume
+func LuksUUID(runner v1.Runner, device string) (string, error) {
+	out, err := runner.Run("cryptsetup", "luksUUID", device)
+	if err != nil {
+		return "", fmt.Errorf("failed reading the LUKS UUID of %s: %s: %w", device, string(out), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// LuksOpen unlocks the given LUKS volume of the given partition and returns the unlocked device
+func LuksOpen(runner v1.Runner, device, partName, keyFile string) (string, error) {
+	out, err := runner.Run("cryptsetup", "open", "--key-file", keyFile, device, LuksMapperName(partName))
+	if err != nil {
+		return "", fmt.Errorf("failed unlocking %s: %s: %w", device, string(out), err)
+	}
+	return LuksMapperDevice(partName), nil
+}
+
+// LuksClose locks again the unlocked LUKS volume of the given partition
+func LuksClose(runner v1.Runner, partName string) error {
+	out, err := runner.Run("cryptsetup", "close", LuksMapperName(partName))
+	if err != nil {
+		return fmt.Errorf("failed locking %s: %s: %w", LuksMapperDevice(partName), string(out), err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"path/filepath"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// LogicalVolumeDevice returns the device of the given logical volume
+func LogicalVolumeDevice(vg, name string) string {
+	return filepath.Join("/dev", vg, name)
+}
+
+// CreateVolumeGroup initializes the given devices as LVM physical volumes and creates
+// a volume group with the given name over them
+func CreateVolumeGroup(runner v1.Runner, name string, devices ...string) error {
+	if len(devices) == 0 {
+		return fmt.Errorf("a volume group requires at least one device")
+	}
+	out, err := runner.Run("pvcreate", append([]string{"--yes"}, devices...)...)
+	if err != nil {
+		return fmt.Errorf("failed creating physical volumes: %s: %w", string(out), err)
+	}
+	out, err = runner.Run("vgcreate", append([]string{"--yes", name}, devices...)...)
+	if err != nil {
+		return fmt.Errorf("failed creating volume group %s: %s: %w", name, string(out), err)
+	}
+	return nil
+}
+
+// CreateLogicalVolume creates a logical volume of the given size in MiB within the given volume
+// group, a zero size takes over all the free space left. Returns the device of the logical volume.
+func CreateLogicalVolume(runner v1.Runner, vg, name string, size uint) (string, error) {
+	args := []string{"--yes", "--wipesignatures", "y", "--name", name}
+	if size == 0 {
+		args = append(args, "--extents", "100%FREE", vg)
+	} else {
+		args = append(args, "--size", fmt.Sprintf("%dM", size), vg)
+	}
+	out, err := runner.Run("lvcreate", args...)
+	if err != nil {
+		return "", fmt.Errorf("failed creating logical volume %s: %s: %w", name, string(out), err)
+	}
+	return LogicalVolumeDevice(vg, name), nil
+}
+
+// DeactivateVolumeGroup deactivates all the logical volumes of the given volume group
+func DeactivateVolumeGroup(runner v1.Runner, name string) error {
+	out, err := runner.Run("vgchange", "--activate", "n", name)
+	if err != nil {
+		return fmt.Errorf("failed deactivating volume group %s: %s: %w", name, string(out), err)
+	}
+	return nil
+}
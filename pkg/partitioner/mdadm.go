@@ -0,0 +1,55 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"path/filepath"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+const mdDir = "/dev/md"
+
+// CreateRAID1 creates a RAID1 md array with the given name over the given devices and returns
+// the path of the array device. The md superblock is stored at the start of the members (metadata 1.2),
+// so members are never probed as plain filesystems carrying the labels of the array.
+func CreateRAID1(runner v1.Runner, name string, devices ...string) (string, error) {
+	if len(devices) < 2 {
+		return "", fmt.Errorf("a RAID1 array requires at least two devices")
+	}
+	device := filepath.Join(mdDir, name)
+	args := []string{
+		"--create", device, "--run", "--level=1", "--metadata=1.2",
+		fmt.Sprintf("--raid-devices=%d", len(devices)), fmt.Sprintf("--name=%s", name),
+	}
+	args = append(args, devices...)
+	out, err := runner.Run("mdadm", args...)
+	if err != nil {
+		return "", fmt.Errorf("failed creating RAID1 array %s: %s: %w", device, string(out), err)
+	}
+	return device, nil
+}
+
+// ScanRAIDArrays returns the mdadm.conf ARRAY lines of all the currently active md arrays
+func ScanRAIDArrays(runner v1.Runner) (string, error) {
+	out, err := runner.Run("mdadm", "--detail", "--scan")
+	if err != nil {
+		return "", fmt.Errorf("failed scanning RAID arrays: %s: %w", string(out), err)
+	}
+	return string(out), nil
+}
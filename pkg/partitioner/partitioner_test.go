@@ -26,6 +26,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/rancher/elemental-cli/pkg/constants"
 	part "github.com/rancher/elemental-cli/pkg/partitioner"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
 	"github.com/rancher/elemental-cli/pkg/utils"
 	mocks "github.com/rancher/elemental-cli/tests/mocks"
 	"github.com/twpayne/go-vfs"
@@ -195,12 +196,125 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 			cmds := [][]string{{"mkfs.vfat", "-n", "EFI", "/dev/device"}}
 			Expect(runner.CmdsMatch(cmds)).To(BeNil())
 		})
+		It("Successfully formats a partition with btrfs", func() {
+			mkfs := part.NewMkfsCall("/dev/device", "btrfs", "PERSISTENT", runner)
+			_, err := mkfs.Apply()
+			Expect(err).To(BeNil())
+			cmds := [][]string{{"mkfs.btrfs", "-L", "PERSISTENT", "/dev/device"}}
+			Expect(runner.CmdsMatch(cmds)).To(BeNil())
+		})
 		It("Fails for unsupported filesystem", func() {
-			mkfs := part.NewMkfsCall("/dev/device", "btrfs", "OEM", runner)
+			mkfs := part.NewMkfsCall("/dev/device", "zfs", "OEM", runner)
 			_, err := mkfs.Apply()
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("Mdadm tests", Label("mdadm", "raid"), func() {
+		It("Creates a RAID1 array", func() {
+			dev, err := part.CreateRAID1(runner, "state", "/dev/sda4", "/dev/sdb4")
+			Expect(err).To(BeNil())
+			Expect(dev).To(Equal("/dev/md/state"))
+			cmds := [][]string{{
+				"mdadm", "--create", "/dev/md/state", "--run", "--level=1", "--metadata=1.2",
+				"--raid-devices=2", "--name=state", "/dev/sda4", "/dev/sdb4",
+			}}
+			Expect(runner.CmdsMatch(cmds)).To(BeNil())
+		})
+		It("Fails to create a RAID1 array with a single device", func() {
+			_, err := part.CreateRAID1(runner, "state", "/dev/sda4")
+			Expect(err).NotTo(BeNil())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+		It("Fails if mdadm fails", func() {
+			runner.ReturnError = errors.New("mdadm failed")
+			_, err := part.CreateRAID1(runner, "state", "/dev/sda4", "/dev/sdb4")
+			Expect(err).NotTo(BeNil())
+		})
+		It("Scans the active RAID arrays", func() {
+			runner.ReturnValue = []byte("ARRAY /dev/md/state metadata=1.2 name=any:state UUID=1234\n")
+			conf, err := part.ScanRAIDArrays(runner)
+			Expect(err).To(BeNil())
+			Expect(conf).To(ContainSubstring("ARRAY /dev/md/state"))
+			Expect(runner.CmdsMatch([][]string{{"mdadm", "--detail", "--scan"}})).To(BeNil())
+		})
+	})
+	Describe("LUKS tests", Label("luks", "encryption"), func() {
+		It("Encrypts and unlocks a device", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "cryptsetup" && args[0] == "luksUUID" {
+					return []byte("1234-5678\n"), nil
+				}
+				return []byte{}, nil
+			}
+			Expect(part.LuksFormat(runner, "/dev/sda5", "/keyfile")).To(Succeed())
+			uuid, err := part.LuksUUID(runner, "/dev/sda5")
+			Expect(err).To(BeNil())
+			Expect(uuid).To(Equal("1234-5678"))
+			dev, err := part.LuksOpen(runner, "/dev/sda5", "persistent", "/keyfile")
+			Expect(err).To(BeNil())
+			Expect(dev).To(Equal("/dev/mapper/cos_persistent"))
+			Expect(part.LuksClose(runner, "persistent")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "/keyfile", "/dev/sda5"},
+				{"cryptsetup", "luksUUID", "/dev/sda5"},
+				{"cryptsetup", "open", "--key-file", "/keyfile", "/dev/sda5", "cos_persistent"},
+				{"cryptsetup", "close", "cos_persistent"},
+			})).To(BeNil())
+		})
+		It("Fails if cryptsetup fails", func() {
+			runner.ReturnError = errors.New("cryptsetup failed")
+			Expect(part.LuksFormat(runner, "/dev/sda5", "/keyfile")).NotTo(Succeed())
+			_, err := part.LuksOpen(runner, "/dev/sda5", "persistent", "/keyfile")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Describe("LVM tests", Label("lvm"), func() {
+		It("Creates a volume group with its logical volumes", func() {
+			Expect(part.CreateVolumeGroup(runner, "elemental", "/dev/sda5")).To(Succeed())
+			dev, err := part.CreateLogicalVolume(runner, "elemental", "data", 1024)
+			Expect(err).To(BeNil())
+			Expect(dev).To(Equal("/dev/elemental/data"))
+			dev, err = part.CreateLogicalVolume(runner, "elemental", "persistent", 0)
+			Expect(err).To(BeNil())
+			Expect(dev).To(Equal("/dev/elemental/persistent"))
+			Expect(part.DeactivateVolumeGroup(runner, "elemental")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"pvcreate", "--yes", "/dev/sda5"},
+				{"vgcreate", "--yes", "elemental", "/dev/sda5"},
+				{"lvcreate", "--yes", "--wipesignatures", "y", "--name", "data", "--size", "1024M", "elemental"},
+				{"lvcreate", "--yes", "--wipesignatures", "y", "--name", "persistent", "--extents", "100%FREE", "elemental"},
+				{"vgchange", "--activate", "n", "elemental"},
+			})).To(BeNil())
+		})
+		It("Fails to create a volume group without devices", func() {
+			Expect(part.CreateVolumeGroup(runner, "elemental")).NotTo(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+		})
+		It("Fails if LVM commands fail", func() {
+			runner.ReturnError = errors.New("lvm failed")
+			Expect(part.CreateVolumeGroup(runner, "elemental", "/dev/sda5")).NotTo(Succeed())
+			_, err := part.CreateLogicalVolume(runner, "elemental", "data", 1024)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Describe("Btrfs tests", Label("btrfs", "subvolumes"), func() {
+		It("Creates and deletes subvolumes", func() {
+			Expect(part.CreateSubvolume(runner, "/mnt/@home")).To(Succeed())
+			Expect(part.SetCompression(runner, "/mnt/@home", "zstd")).To(Succeed())
+			Expect(part.DeleteSubvolume(runner, "/mnt/@home")).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"btrfs", "subvolume", "create", "/mnt/@home"},
+				{"btrfs", "property", "set", "/mnt/@home", "compression", "zstd"},
+				{"btrfs", "subvolume", "delete", "/mnt/@home"},
+			})).To(BeNil())
+		})
+		It("Fails if btrfs fails", func() {
+			runner.ReturnError = errors.New("btrfs failed")
+			Expect(part.CreateSubvolume(runner, "/mnt/@home")).NotTo(Succeed())
+			Expect(part.SetCompression(runner, "/mnt/@home", "zstd")).NotTo(Succeed())
+			Expect(part.DeleteSubvolume(runner, "/mnt/@home")).NotTo(Succeed())
+		})
+	})
 	Describe("Disk tests", Label("mkfs", "filesystem"), func() {
 		var dev *part.Disk
 		var cmds [][]string
@@ -340,6 +454,73 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 				runner.ReturnError = errors.New("some error")
 				Expect(dev.WipeFsOnPartition("/dev/device1")).NotTo(BeNil())
 			})
+			Describe("Wiping the disk", Label("wipe"), func() {
+				lsblkCmd := []string{
+					"lsblk", "--noheadings", "--list", "--paths", "--bytes", "--output", "NAME,TYPE,SIZE", "/dev/device",
+				}
+				BeforeEach(func() {
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						if cmd == "lsblk" {
+							return []byte("/dev/device disk 10485760\n/dev/device1 part 1048576\n/dev/device2 part 8388608\n"), nil
+						}
+						return []byte{}, nil
+					}
+				})
+				It("Wipes the signatures of the disk and its old partitions", func() {
+					Expect(dev.Wipe(v1.WipeSignatures)).To(Succeed())
+					Expect(runner.CmdsMatch([][]string{
+						lsblkCmd,
+						{"wipefs", "--all", "/dev/device1"},
+						{"wipefs", "--all", "/dev/device2"},
+						{"wipefs", "--all", "/dev/device"},
+					})).To(Succeed())
+				})
+				It("Discards all the blocks of the disk", func() {
+					Expect(dev.Wipe(v1.WipeDiscard)).To(Succeed())
+					Expect(runner.CmdsMatch([][]string{{"blkdiscard", "/dev/device"}})).To(Succeed())
+				})
+				It("Zeroes the start and the end of the disk", func() {
+					Expect(dev.Wipe(v1.WipeZeroHeaders)).To(Succeed())
+					Expect(runner.CmdsMatch([][]string{
+						lsblkCmd,
+						{
+							"dd", "if=/dev/zero", "of=/dev/device", "bs=4M", "iflag=count_bytes",
+							"oflag=seek_bytes", "seek=0", "count=1048576", "conv=fsync",
+						},
+						{
+							"dd", "if=/dev/zero", "of=/dev/device", "bs=4M", "iflag=count_bytes",
+							"oflag=seek_bytes", "seek=9437184", "count=1048576", "conv=fsync",
+						},
+					})).To(Succeed())
+				})
+				It("Overwrites the whole disk", func() {
+					Expect(dev.Wipe(v1.WipeFull)).To(Succeed())
+					Expect(runner.CmdsMatch([][]string{
+						lsblkCmd,
+						{
+							"dd", "if=/dev/zero", "of=/dev/device", "bs=4M", "iflag=count_bytes",
+							"oflag=seek_bytes", "seek=0", "count=10485760", "conv=fsync",
+						},
+					})).To(Succeed())
+				})
+				It("Fails on unknown disk sizes", func() {
+					runner.SideEffect = nil
+					Expect(dev.Wipe(v1.WipeFull)).NotTo(Succeed())
+					Expect(runner.IncludesCmds([][]string{{"dd"}})).NotTo(Succeed())
+				})
+				It("Fails on unsupported wipe modes", func() {
+					Expect(dev.Wipe("shred")).NotTo(Succeed())
+				})
+				It("Fails if wipefs fails", func() {
+					runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+						if cmd == "wipefs" {
+							return []byte{}, errors.New("wipefs error")
+						}
+						return []byte{}, nil
+					}
+					Expect(dev.Wipe(v1.WipeSignatures)).NotTo(Succeed())
+				})
+			})
 			Describe("Expanding partitions", func() {
 				BeforeEach(func() {
 					cmds = [][]string{
@@ -398,6 +579,26 @@ var _ = Describe("Partitioner", Label("disk", "partition", "partitioner"), func(
 					Expect(err).To(BeNil())
 					Expect(runner.CmdsMatch(append(cmds, xfsCmds...))).To(BeNil())
 				})
+				It("Expands btrfs partition", func() {
+					_, err := fs.Create("/dev/device4")
+					Expect(err).To(BeNil())
+					btrfsCmds := [][]string{
+						{"mount", "-t", "btrfs"}, {"btrfs", "filesystem", "resize", "max"}, {"umount"},
+					}
+					ghwTest := mocks.GhwMock{}
+					disk := block.Disk{Name: "device", Partitions: []*block.Partition{
+						{
+							Name: "device4",
+							Type: "btrfs",
+						},
+					}}
+					ghwTest.AddDisk(disk)
+					ghwTest.CreateDevices()
+					defer ghwTest.Clean()
+					_, err = dev.ExpandLastPartition(0)
+					Expect(err).To(BeNil())
+					Expect(runner.CmdsMatch(append(cmds, btrfsCmds...))).To(BeNil())
+				})
 			})
 		})
 	})
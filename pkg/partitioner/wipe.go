@@ -0,0 +1,141 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// headerBytes is the size zeroed at the start and at the end of the disk to wipe partition table headers
+const headerBytes = 1024 * 1024
+
+// Wipe clears the data of the disk with the given wipe mode. It is meant
+// to run before creating a new partition table, so no stale signature of previous
+// filesystems, RAID arrays or LVM volumes survives within the new partitions.
+func (dev *Disk) Wipe(mode string) error {
+	switch mode {
+	case v1.WipeSignatures:
+		return dev.wipeSignatures()
+	case v1.WipeDiscard:
+		dev.logger.Infof("Discarding all blocks of %s", dev)
+		out, err := dev.runner.Run("blkdiscard", dev.device)
+		if err != nil {
+			return fmt.Errorf("failed discarding %s: %s: %w", dev, string(out), err)
+		}
+		return nil
+	case v1.WipeZeroHeaders:
+		return dev.zeroHeaders()
+	case v1.WipeFull:
+		size, err := dev.size()
+		if err != nil {
+			return err
+		}
+		dev.logger.Infof("Overwriting %s with zeros, this can take a while", dev)
+		return dev.zero(0, size)
+	default:
+		return fmt.Errorf("unsupported wipe mode: %s", mode)
+	}
+}
+
+// wipeSignatures erases the signatures of all the current partitions and the ones of the disk itself
+func (dev *Disk) wipeSignatures() error {
+	_, parts, err := dev.blockDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range append(parts, dev.device) {
+		dev.logger.Infof("Wiping signatures of %s", device)
+		out, err := dev.runner.Run("wipefs", "--all", device)
+		if err != nil {
+			return fmt.Errorf("failed wiping signatures of %s: %s: %w", device, string(out), err)
+		}
+	}
+	return nil
+}
+
+// zeroHeaders overwrites with zeros the start and the end of the disk, where partition tables live
+func (dev *Disk) zeroHeaders() error {
+	size, err := dev.size()
+	if err != nil {
+		return err
+	}
+	dev.logger.Infof("Zeroing the start and the end of %s", dev)
+	if size <= 2*headerBytes {
+		return dev.zero(0, size)
+	}
+	err = dev.zero(0, headerBytes)
+	if err != nil {
+		return err
+	}
+	return dev.zero(size-headerBytes, headerBytes)
+}
+
+// zero overwrites with zeros the given amount of bytes of the disk from the given offset
+func (dev *Disk) zero(offset, count uint64) error {
+	out, err := dev.runner.Run(
+		"dd", "if=/dev/zero", fmt.Sprintf("of=%s", dev.device), "bs=4M", "iflag=count_bytes",
+		"oflag=seek_bytes", fmt.Sprintf("seek=%d", offset), fmt.Sprintf("count=%d", count), "conv=fsync",
+	)
+	if err != nil {
+		return fmt.Errorf("failed zeroing %s: %s: %w", dev, string(out), err)
+	}
+	return nil
+}
+
+// size returns the size in bytes of the disk
+func (dev *Disk) size() (uint64, error) {
+	size, _, err := dev.blockDevices()
+	if err == nil && size == 0 {
+		err = fmt.Errorf("could not determine the size of %s", dev)
+	}
+	return size, err
+}
+
+// blockDevices returns the size in bytes of the disk and the devices of its current partitions.
+// The disk itself is the first device listed by lsblk.
+func (dev *Disk) blockDevices() (uint64, []string, error) {
+	out, err := dev.runner.Run(
+		"lsblk", "--noheadings", "--list", "--paths", "--bytes", "--output", "NAME,TYPE,SIZE", dev.device,
+	)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed listing block devices of %s: %s: %w", dev, string(out), err)
+	}
+	var size uint64
+	var parts []string
+	first := true
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case first:
+			first = false
+			size, err = strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed parsing the size of %s: %w", dev, err)
+			}
+		case fields[1] == "part":
+			parts = append(parts, fields[0])
+		}
+	}
+	return size, parts, nil
+}
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
@@ -32,12 +34,26 @@ const (
 	file    = "file"
 	dir     = "dir"
 	channel = "channel"
+
+	ociArchive    = "oci-archive"
+	dockerArchive = "docker-archive"
+	ociLayout     = "oci-layout"
+
+	httpSrc = "http"
 )
 
+// checksumRegexp matches the supported checksums of http sources
+var checksumRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// tarballExtensions are the file extensions of http sources extracted as a rootfs tarball,
+// any other http source is a prebuilt filesystem image
+var tarballExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.zst", ".tar.zstd", ".tzst"}
+
 // ImageSource represents the source from where an image is created for easy identification
 type ImageSource struct {
-	source  string
-	srcType string
+	source   string
+	srcType  string
+	checksum string
 }
 
 func (i ImageSource) Value() string {
@@ -60,6 +76,65 @@ func (i ImageSource) IsFile() bool {
 	return i.srcType == file
 }
 
+func (i ImageSource) IsOCIArchive() bool {
+	return i.srcType == ociArchive
+}
+
+func (i ImageSource) IsDockerArchive() bool {
+	return i.srcType == dockerArchive
+}
+
+func (i ImageSource) IsOCILayout() bool {
+	return i.srcType == ociLayout
+}
+
+// IsArchive checks if the source is a container image stored locally in an archive or
+// in an OCI layout directory
+func (i ImageSource) IsArchive() bool {
+	return i.IsOCIArchive() || i.IsDockerArchive() || i.IsOCILayout()
+}
+
+func (i ImageSource) IsHTTP() bool {
+	return i.srcType == httpSrc
+}
+
+// IsTarball checks if the source is a rootfs tarball fetched over http
+func (i ImageSource) IsTarball() bool {
+	if !i.IsHTTP() {
+		return false
+	}
+	u, err := url.Parse(i.source)
+	if err != nil {
+		return false
+	}
+	for _, ext := range tarballExtensions {
+		if strings.HasSuffix(u.Path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRawImage checks if the source is a prebuilt filesystem image fetched over http
+func (i ImageSource) IsRawImage() bool {
+	return i.IsHTTP() && !i.IsTarball()
+}
+
+// Checksum returns the expected checksum of http sources, empty if none was given
+func (i ImageSource) Checksum() string {
+	return i.checksum
+}
+
+// OCILayoutRef splits the value of an OCI layout source into the layout path and the optional
+// tag of the image within the layout
+func (i ImageSource) OCILayoutRef() (string, string) {
+	idx := strings.LastIndex(i.source, ":")
+	if idx < 0 || strings.Contains(i.source[idx+1:], "/") {
+		return i.source, ""
+	}
+	return i.source[:idx], i.source[idx+1:]
+}
+
 func (i ImageSource) IsEmpty() bool {
 	if i.srcType == "" {
 		return true
@@ -74,6 +149,12 @@ func (i ImageSource) String() string {
 	if i.IsEmpty() {
 		return ""
 	}
+	if i.IsHTTP() {
+		if i.checksum != "" {
+			return fmt.Sprintf("%s#%s", i.source, i.checksum)
+		}
+		return i.source
+	}
 	return fmt.Sprintf("%s://%s", i.srcType, i.source)
 }
 
@@ -99,6 +180,7 @@ func (i *ImageSource) updateFromURI(uri string) error {
 	if err != nil {
 		return err
 	}
+	i.checksum = ""
 	scheme := u.Scheme
 	value := u.Opaque
 	if value == "" {
@@ -116,6 +198,19 @@ func (i *ImageSource) updateFromURI(uri string) error {
 	case file:
 		i.srcType = file
 		i.source = value
+	case ociArchive, dockerArchive, ociLayout:
+		i.srcType = scheme
+		i.source = value
+	case "http", "https":
+		// The checksum is given as the URL fragment, so it is never sent to the server
+		checksum := strings.ToLower(u.Fragment)
+		if checksum != "" && !checksumRegexp.MatchString(checksum) {
+			return fmt.Errorf("invalid checksum '%s', expected 'sha256:<hex digest>'", u.Fragment)
+		}
+		u.Fragment = ""
+		i.srcType = httpSrc
+		i.source = u.String()
+		i.checksum = checksum
 	default:
 		return i.parseImageReference(uri)
 	}
@@ -159,3 +254,19 @@ func NewChannelSrc(src string) *ImageSource {
 func NewDirSrc(src string) *ImageSource {
 	return &ImageSource{source: src, srcType: dir}
 }
+
+func NewHTTPSrc(src string, checksum string) *ImageSource {
+	return &ImageSource{source: src, srcType: httpSrc, checksum: checksum}
+}
+
+func NewOCIArchiveSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: ociArchive}
+}
+
+func NewDockerArchiveSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: dockerArchive}
+}
+
+func NewOCILayoutSrc(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: ociLayout}
+}
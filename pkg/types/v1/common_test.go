@@ -84,6 +84,54 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			Expect(o.IsDocker()).To(BeTrue())
 			Expect(o.Value()).To(Equal("registry.company.org/my/image:tag"))
 		})
+		It("unmarshals local container image archives and layouts", func() {
+			o := v1.NewEmptySrc()
+			_, err := o.CustomUnmarshal("oci-archive:/some/image.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsOCIArchive()).To(BeTrue())
+			Expect(o.IsArchive()).To(BeTrue())
+			Expect(o.IsDocker()).To(BeFalse())
+			Expect(o.Value()).To(Equal("/some/image.tar"))
+			_, err = o.CustomUnmarshal("docker-archive:some/image.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsDockerArchive()).To(BeTrue())
+			Expect(o.Value()).To(Equal("some/image.tar"))
+			_, err = o.CustomUnmarshal("oci-layout:/some/layout:v1.0")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsOCILayout()).To(BeTrue())
+			Expect(o.Value()).To(Equal("/some/layout:v1.0"))
+			path, tag := o.OCILayoutRef()
+			Expect(path).To(Equal("/some/layout"))
+			Expect(tag).To(Equal("v1.0"))
+			path, tag = v1.NewOCILayoutSrc("../some/layout").OCILayoutRef()
+			Expect(path).To(Equal("../some/layout"))
+			Expect(tag).To(BeEmpty())
+
+			o, err = v1.NewSrcFromURI(v1.NewOCILayoutSrc("/some/layout:v1.0").String())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsOCILayout()).To(BeTrue())
+			Expect(o.Value()).To(Equal("/some/layout:v1.0"))
+		})
+		It("unmarshals http sources with an optional checksum", Label("http"), func() {
+			checksum := "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac"
+			o := v1.NewEmptySrc()
+			_, err := o.CustomUnmarshal("https://example.org/os/rootfs.tar.zst#" + checksum)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsHTTP()).To(BeTrue())
+			Expect(o.IsTarball()).To(BeTrue())
+			Expect(o.Value()).To(Equal("https://example.org/os/rootfs.tar.zst"))
+			Expect(o.Checksum()).To(Equal(checksum))
+			Expect(o.String()).To(Equal("https://example.org/os/rootfs.tar.zst#" + checksum))
+
+			_, err = o.CustomUnmarshal("http://example.org/os/active.squashfs?arch=x86_64")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsRawImage()).To(BeTrue())
+			Expect(o.Checksum()).To(BeEmpty())
+			Expect(o.String()).To(Equal("http://example.org/os/active.squashfs?arch=x86_64"))
+
+			_, err = o.CustomUnmarshal("https://example.org/os/rootfs.tar.gz#md5:abcd")
+			Expect(err).Should(HaveOccurred())
+		})
 		It("convertion to string URI works are expected", func() {
 			o := v1.NewDirSrc("/some/dir")
 			Expect(o.IsDir()).To(BeTrue())
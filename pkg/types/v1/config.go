@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"path/filepath"
 	"sort"
+	"strings"
 
+	"github.com/canonical/nullboot/efibootmgr"
+	"github.com/docker/go-units"
 	"github.com/rancher/elemental-cli/pkg/constants"
 	"gopkg.in/yaml.v3"
 	"k8s.io/mount-utils"
@@ -31,11 +34,27 @@ const (
 	BIOS  = "bios"
 	MSDOS = "msdos"
 	EFI   = "efi"
+	RAID1 = "raid1"
 	esp   = "esp"
 	bios  = "bios_grub"
 	boot  = "boot"
 )
 
+// Target selector policies
+const (
+	SelectFirst    = "first"
+	SelectSmallest = "smallest"
+	SelectLargest  = "largest"
+)
+
+// Disk wipe modes applied before partitioning
+const (
+	WipeSignatures  = "signatures"
+	WipeDiscard     = "discard"
+	WipeZeroHeaders = "zero-headers"
+	WipeFull        = "full"
+)
+
 // Config is the struct that includes basic and generic configuration of elemental binary runtime.
 // It mostly includes the interfaces used around many methods in elemental code
 type Config struct {
@@ -47,6 +66,8 @@ type Config struct {
 	CloudInitRunner           CloudInitRunner
 	Luet                      LuetInterface
 	Client                    HTTPClient
+	EFIVariables              efibootmgr.EFIVariables
+	Progress                  *Progress
 	Cosign                    bool         `yaml:"cosign,omitempty" mapstructure:"cosign"`
 	Verify                    bool         `yaml:"verify,omitempty" mapstructure:"verify"`
 	CosignPubKey              string       `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
@@ -66,12 +87,12 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 
 	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
 
-	err = c.Fs.WriteFile(statePath, data, constants.FilePerm)
+	err = c.writeFileAtomic(statePath, data)
 	if err != nil {
 		return err
 	}
 
-	err = c.Fs.WriteFile(recoveryPath, data, constants.FilePerm)
+	err = c.writeFileAtomic(recoveryPath, data)
 	if err != nil {
 		return err
 	}
@@ -79,6 +100,33 @@ func (c Config) WriteInstallState(i *InstallState, statePath, recoveryPath strin
 	return nil
 }
 
+// writeFileAtomic writes the given data to a temporary file which is then renamed to the given path,
+// so the file is either fully updated or not updated at all
+func (c Config) writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := c.Fs.WriteFile(tmpPath, data, constants.FilePerm)
+	if err != nil {
+		return err
+	}
+	err = c.Fs.Rename(tmpPath, path)
+	if err != nil {
+		_ = c.Fs.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// WriteUpgradeJournal atomically stores the given upgrade journal into the given path
+func (c Config) WriteUpgradeJournal(j *UpgradeJournal, path string) error {
+	data, err := yaml.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
+	return c.writeFileAtomic(path, data)
+}
+
 // LoadInstallState loads the state.yaml file and unmarshals it to an InstallState object
 func (c Config) LoadInstallState() (*InstallState, error) {
 	installState := &InstallState{}
@@ -132,10 +180,13 @@ func (r *RunConfig) Sanitize() error {
 // InstallSpec struct represents all the installation action details
 type InstallSpec struct {
 	Target           string              `yaml:"target,omitempty" mapstructure:"target"`
+	Targets          []string            `yaml:"targets,omitempty" mapstructure:"targets"`
+	Mirror           string              `yaml:"mirror,omitempty" mapstructure:"mirror"`
 	Firmware         string              `yaml:"firmware,omitempty" mapstructure:"firmware"`
 	PartTable        string              `yaml:"part-table,omitempty" mapstructure:"part-table"`
 	Partitions       ElementalPartitions `yaml:"partitions,omitempty" mapstructure:"partitions"`
 	ExtraPartitions  PartitionList       `yaml:"extra-partitions,omitempty" mapstructure:"extra-partitions"`
+	VolumeGroup      *VolumeGroup        `yaml:"volume-group,omitempty" mapstructure:"volume-group"`
 	NoFormat         bool                `yaml:"no-format,omitempty" mapstructure:"no-format"`
 	Force            bool                `yaml:"force,omitempty" mapstructure:"force"`
 	CloudInit        []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
@@ -147,6 +198,16 @@ type InstallSpec struct {
 	Passive          Image
 	GrubConf         string
 	DisableBootEntry bool `yaml:"disable-boot-entry,omitempty" mapstructure:"disable-boot-entry"`
+	// ImageSize of the disk image file created as target, e.g. '20G'. Empty for target devices.
+	ImageSize      string          `yaml:"image-size,omitempty" mapstructure:"image-size"`
+	TargetSelector *TargetSelector `yaml:"target-selector,omitempty" mapstructure:"target-selector"`
+	// KeepPersistent and KeepPartitions, the names of extra partitions, preserve those partitions
+	// of an existing layout on the target while the rest of partitions are formatted in place
+	KeepPersistent bool     `yaml:"keep-persistent,omitempty" mapstructure:"keep-persistent"`
+	KeepPartitions []string `yaml:"keep-partitions,omitempty" mapstructure:"keep-partitions"`
+	// Wipe mode applied to the target disks before partitioning them, e.g. 'signatures'
+	Wipe         string              `yaml:"wipe,omitempty" mapstructure:"wipe"`
+	Requirements InstallRequirements `yaml:"requirements,omitempty" mapstructure:"requirements"`
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -158,6 +219,54 @@ func (i *InstallSpec) Sanitize() error {
 	if i.Partitions.State == nil || i.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
+	err := i.sanitizeMirror()
+	if err != nil {
+		return err
+	}
+	err = i.sanitizeImageSize()
+	if err != nil {
+		return err
+	}
+	if i.TargetSelector != nil {
+		if i.Target != "" || len(i.Targets) > 0 || i.ImageSize != "" {
+			return fmt.Errorf("target-selector is not compatible with a given target or disk image")
+		}
+		err = i.TargetSelector.Sanitize()
+		if err != nil {
+			return fmt.Errorf("invalid target-selector: %w", err)
+		}
+	}
+	err = i.sanitizeKeptPartitions()
+	if err != nil {
+		return err
+	}
+	err = i.sanitizeWipe()
+	if err != nil {
+		return err
+	}
+	err = i.Requirements.Sanitize()
+	if err != nil {
+		return fmt.Errorf("invalid requirements: %w", err)
+	}
+	err = i.sanitizeEncryption()
+	if err != nil {
+		return err
+	}
+	err = i.sanitizeSubvolumes()
+	if err != nil {
+		return err
+	}
+	if i.VolumeGroup != nil {
+		if i.Mirror != "" || i.NoFormat {
+			return fmt.Errorf("volume groups are not compatible with mirrored installations or no-format")
+		}
+		if i.Partitions.Persistent == nil {
+			return fmt.Errorf("volume groups require a persistent partition")
+		}
+		if i.VolumeGroup.Name == "" {
+			i.VolumeGroup.Name = constants.VolumeGroupName
+		}
+	}
 	// Set the image file name depending on the filesystem
 	recoveryMnt := constants.RecoveryDir
 	if i.Partitions.Recovery != nil && i.Partitions.Recovery.MountPoint != "" {
@@ -187,6 +296,224 @@ func (i *InstallSpec) Sanitize() error {
 	return i.Partitions.SetFirmwarePartitions(i.Firmware, i.PartTable)
 }
 
+// sanitizeMirror checks the target disks are consistent with the mirroring mode. Mirrored
+// installations are done over the list of targets, the first one being the primary target.
+func (i *InstallSpec) sanitizeMirror() error {
+	switch i.Mirror {
+	case "":
+		if len(i.Targets) > 1 {
+			return fmt.Errorf("multiple target devices require a mirroring mode")
+		}
+		if len(i.Targets) == 1 && i.Target == "" {
+			i.Target = i.Targets[0]
+		}
+	case RAID1:
+		if len(i.Targets) != 2 {
+			return fmt.Errorf("%s mirroring requires exactly two target devices", RAID1)
+		}
+		if i.Targets[0] == i.Targets[1] {
+			return fmt.Errorf("mirror target devices must be different")
+		}
+		if i.NoFormat {
+			return fmt.Errorf("mirrored installations are not compatible with no-format")
+		}
+		i.Target = i.Targets[0]
+	default:
+		return fmt.Errorf("unsupported mirroring mode: %s", i.Mirror)
+	}
+	return nil
+}
+
+// sanitizeWipe checks the wipe mode, disks are only wiped when a new partition table is created on them
+func (i *InstallSpec) sanitizeWipe() error {
+	switch i.Wipe {
+	case "":
+		return nil
+	case WipeSignatures, WipeDiscard, WipeZeroHeaders, WipeFull:
+	default:
+		return fmt.Errorf("unsupported wipe mode: %s", i.Wipe)
+	}
+	if i.NoFormat || i.ImageSize != "" || len(i.KeptPartitions()) > 0 {
+		return fmt.Errorf("wipe is not compatible with no-format, disk images or kept partitions")
+	}
+	return nil
+}
+
+// InstallRequirements defines the host requirements checked before any destructive installation
+// step. The minimum memory is given with units, e.g. '2G'. The Secure Boot state is only required
+// if set. The target size, CPU architecture and firmware are always checked against the spec.
+type InstallRequirements struct {
+	MinMemory  string `yaml:"min-memory,omitempty" mapstructure:"min-memory"`
+	SecureBoot *bool  `yaml:"secure-boot,omitempty" mapstructure:"secure-boot"`
+}
+
+// Sanitize checks the minimum memory size
+func (ir *InstallRequirements) Sanitize() error {
+	if ir.MinMemory == "" {
+		return nil
+	}
+	size, err := units.RAMInBytes(ir.MinMemory)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid min-memory '%s'", ir.MinMemory)
+	}
+	return nil
+}
+
+// VolumeGroup defines an LVM volume group created on a last partition taking over the persistent
+// space of the disk. The persistent and extra partitions are created as logical volumes of the group.
+type VolumeGroup struct {
+	Name string `yaml:"name,omitempty" mapstructure:"name"`
+}
+
+// TargetSelector defines the rules to select the target disk among the host disks. Model, serial
+// and WWN are matched as shell patterns and sizes are given with units, e.g. '20G'. The policy
+// chooses among the matching disks, defaults to the first one.
+type TargetSelector struct {
+	MinSize    string `yaml:"min-size,omitempty" mapstructure:"min-size"`
+	MaxSize    string `yaml:"max-size,omitempty" mapstructure:"max-size"`
+	Rotational *bool  `yaml:"rotational,omitempty" mapstructure:"rotational"`
+	Bus        string `yaml:"bus,omitempty" mapstructure:"bus"`
+	Model      string `yaml:"model,omitempty" mapstructure:"model"`
+	Serial     string `yaml:"serial,omitempty" mapstructure:"serial"`
+	WWN        string `yaml:"wwn,omitempty" mapstructure:"wwn"`
+	Policy     string `yaml:"policy,omitempty" mapstructure:"policy"`
+}
+
+// Sanitize checks the selector sizes, patterns and policy
+func (ts *TargetSelector) Sanitize() error {
+	for _, size := range []string{ts.MinSize, ts.MaxSize} {
+		if size == "" {
+			continue
+		}
+		if _, err := units.RAMInBytes(size); err != nil {
+			return fmt.Errorf("invalid size '%s'", size)
+		}
+	}
+	for _, pattern := range []string{ts.Model, ts.Serial, ts.WWN} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s'", pattern)
+		}
+	}
+	switch ts.Policy {
+	case "":
+		ts.Policy = SelectFirst
+	case SelectFirst, SelectSmallest, SelectLargest:
+	default:
+		return fmt.Errorf("unsupported policy '%s'", ts.Policy)
+	}
+	return nil
+}
+
+// sanitizeImageSize checks the size of the disk image to install to. There are no boot entries
+// for disk images as they are not booted by the host firmware.
+func (i *InstallSpec) sanitizeImageSize() error {
+	if i.ImageSize == "" {
+		return nil
+	}
+	if i.Mirror != "" || i.NoFormat {
+		return fmt.Errorf("disk images are not compatible with mirrored installations or no-format")
+	}
+	size, err := units.RAMInBytes(i.ImageSize)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid image size '%s'", i.ImageSize)
+	}
+	i.DisableBootEntry = true
+	return nil
+}
+
+// KeptPartitions returns the partitions of the existing layout to preserve on install
+func (i InstallSpec) KeptPartitions() PartitionList {
+	var kept PartitionList
+	if i.KeepPersistent && i.Partitions.Persistent != nil {
+		kept = append(kept, i.Partitions.Persistent)
+	}
+	for _, name := range i.KeepPartitions {
+		if part := i.ExtraPartitions.GetByName(name); part != nil {
+			kept = append(kept, part)
+		}
+	}
+	return kept
+}
+
+// sanitizeKeptPartitions checks the partitions to keep are defined and can be preserved as they are
+func (i *InstallSpec) sanitizeKeptPartitions() error {
+	if !i.KeepPersistent && len(i.KeepPartitions) == 0 {
+		return nil
+	}
+	if i.KeepPersistent && i.Partitions.Persistent == nil {
+		return fmt.Errorf("undefined persistent partition to keep")
+	}
+	for _, name := range i.KeepPartitions {
+		if i.ExtraPartitions.GetByName(name) == nil {
+			return fmt.Errorf("undefined extra partition %s to keep", name)
+		}
+	}
+	if i.NoFormat || i.Mirror != "" || i.VolumeGroup != nil || i.ImageSize != "" {
+		return fmt.Errorf("kept partitions are not compatible with no-format, mirrors, volume groups or disk images")
+	}
+	for _, part := range i.KeptPartitions() {
+		if part.Encryption != nil {
+			return fmt.Errorf("kept partition %s can't be encrypted", part.Name)
+		}
+	}
+	return nil
+}
+
+// sanitizeEncryption checks only the persistent and extra partitions are encrypted, as the rest
+// are required unlocked by the bootloader or before the encrypted partitions can be unlocked.
+func (i *InstallSpec) sanitizeEncryption() error {
+	for _, part := range []*Partition{i.Partitions.OEM, i.Partitions.Recovery, i.Partitions.State} {
+		if part != nil && part.Encryption != nil {
+			return fmt.Errorf("only persistent and extra partitions can be encrypted")
+		}
+	}
+	parts := append(PartitionList{i.Partitions.Persistent}, i.ExtraPartitions...)
+	for _, part := range parts {
+		if part == nil || part.Encryption == nil {
+			continue
+		}
+		if i.NoFormat {
+			return fmt.Errorf("encrypted partitions are not compatible with no-format")
+		}
+		if part.FS == "" {
+			return fmt.Errorf("encrypted partition %s requires a filesystem", part.Name)
+		}
+		err := part.Encryption.Sanitize()
+		if err != nil {
+			return fmt.Errorf("invalid %s partition: %w", part.Name, err)
+		}
+	}
+	return nil
+}
+
+// sanitizeSubvolumes checks subvolumes are only declared on btrfs persistent and extra partitions
+func (i *InstallSpec) sanitizeSubvolumes() error {
+	for _, part := range []*Partition{i.Partitions.OEM, i.Partitions.Recovery, i.Partitions.State} {
+		if part != nil && len(part.Subvolumes) > 0 {
+			return fmt.Errorf("only persistent and extra partitions can declare subvolumes")
+		}
+	}
+	parts := append(PartitionList{i.Partitions.Persistent}, i.ExtraPartitions...)
+	for _, part := range parts {
+		if part == nil || len(part.Subvolumes) == 0 {
+			continue
+		}
+		if i.NoFormat {
+			return fmt.Errorf("subvolumes are not compatible with no-format")
+		}
+		if part.FS != constants.Btrfs {
+			return fmt.Errorf("partition %s requires a btrfs filesystem to declare subvolumes", part.Name)
+		}
+		for _, subvol := range part.Subvolumes {
+			err := subvol.Sanitize()
+			if err != nil {
+				return fmt.Errorf("invalid %s partition: %w", part.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
 // ResetSpec struct represents all the reset action details
 type ResetSpec struct {
 	FormatPersistent bool `yaml:"reset-persistent,omitempty" mapstructure:"reset-persistent"`
@@ -218,9 +545,20 @@ func (r *ResetSpec) Sanitize() error {
 
 type UpgradeSpec struct {
 	RecoveryUpgrade bool   `yaml:"recovery,omitempty" mapstructure:"recovery"`
+	All             bool   `yaml:"all,omitempty" mapstructure:"all"`
 	Active          Image  `yaml:"system,omitempty" mapstructure:"system"`
 	Recovery        Image  `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
 	GrubDefEntry    string `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
+	BootAssessTries int    `yaml:"boot-assessment-tries,omitempty" mapstructure:"boot-assessment-tries"`
+	Recover         bool   `yaml:"recover,omitempty" mapstructure:"recover"`
+	Snapshots       int    `yaml:"snapshots,omitempty" mapstructure:"snapshots"`
+	Iso             string `yaml:"iso,omitempty" mapstructure:"iso"`
+	Delta           bool   `yaml:"delta,omitempty" mapstructure:"delta"`
+	Version         string `yaml:"version,omitempty" mapstructure:"version"`
+	ListVersions    bool   `yaml:"list-versions,omitempty" mapstructure:"list-versions"`
+	Stage           bool   `yaml:"stage,omitempty" mapstructure:"stage"`
+	ApplyStaged     bool   `yaml:"apply-staged,omitempty" mapstructure:"apply-staged"`
+	DiscardStaged   bool   `yaml:"discard-staged,omitempty" mapstructure:"discard-staged"`
 	Passive         Image
 	Partitions      ElementalPartitions
 	State           *InstallState
@@ -229,24 +567,214 @@ type UpgradeSpec struct {
 // Sanitize checks the consistency of the struct, returns error
 // if unsolvable inconsistencies are found
 func (u *UpgradeSpec) Sanitize() error {
-	if u.RecoveryUpgrade {
+	modes := 0
+	for _, mode := range []bool{u.Recover, u.ListVersions, u.Stage, u.ApplyStaged, u.DiscardStaged} {
+		if mode {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("recover, list-versions, stage, apply-staged and discard-staged are mutually exclusive")
+	}
+	// Only pending or staged upgrade transactions are handled in recover, apply-staged and discard-staged modes
+	if u.Recover || u.ApplyStaged || u.DiscardStaged {
+		if u.Partitions.State == nil || u.Partitions.State.MountPoint == "" {
+			return fmt.Errorf("undefined state partition")
+		}
+		if u.Partitions.Recovery == nil || u.Partitions.Recovery.MountPoint == "" {
+			return fmt.Errorf("undefined recovery partition")
+		}
+		return nil
+	}
+	// Listing versions only queries the repositories, sources are optional
+	if u.ListVersions {
+		return nil
+	}
+	if u.All {
+		if u.RecoveryUpgrade {
+			return fmt.Errorf("recovery and all upgrades are mutually exclusive")
+		}
 		if u.Partitions.Recovery == nil || u.Partitions.Recovery.MountPoint == "" {
 			return fmt.Errorf("undefined recovery partition")
 		}
+		// Keep the recovery image in sync with the system image unless a source is given
 		if u.Recovery.Source.IsEmpty() {
+			u.Recovery.Source = u.Active.Source
+		}
+	}
+	upgradeSrc := u.Active.Source
+	if u.RecoveryUpgrade {
+		upgradeSrc = u.Recovery.Source
+		if u.Partitions.Recovery == nil || u.Partitions.Recovery.MountPoint == "" {
+			return fmt.Errorf("undefined recovery partition")
+		}
+		if u.Recovery.Source.IsEmpty() && u.Iso == "" {
 			return fmt.Errorf("undefined upgrade source")
 		}
 	} else {
 		if u.Partitions.State == nil || u.Partitions.State.MountPoint == "" {
 			return fmt.Errorf("undefined state partition")
 		}
-		if u.Active.Source.IsEmpty() {
+		if u.Active.Source.IsEmpty() && u.Iso == "" {
 			return fmt.Errorf("undefined upgrade source")
 		}
+		// The passive image is always retained
+		if u.Snapshots < 1 {
+			u.Snapshots = 1
+		}
+	}
+	if u.Version != "" && (u.Iso != "" || !upgradeSrc.IsChannel() || (u.All && !u.Recovery.Source.IsChannel())) {
+		return fmt.Errorf("a version can only be pinned for channel upgrade sources")
+	}
+	return nil
+}
+
+// BootAssessSpec struct represents all the boot assessment action details
+type BootAssessSpec struct {
+	Partitions ElementalPartitions
+	State      *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (b *BootAssessSpec) Sanitize() error {
+	if b.Partitions.State == nil || b.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if b.Partitions.Recovery == nil || b.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	return nil
+}
+
+// RollbackSpec struct represents all the rollback action details
+type RollbackSpec struct {
+	GrubDefEntry string `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
+	Active       Image
+	Passive      Image
+	Partitions   ElementalPartitions
+	State        *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (r *RollbackSpec) Sanitize() error {
+	if r.Partitions.State == nil || r.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if r.Partitions.Recovery == nil || r.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	if r.Active.File == "" || r.Passive.File == "" {
+		return fmt.Errorf("undefined active or passive images")
 	}
 	return nil
 }
 
+// SnapshotsSpec struct represents all the details to manage the retained system snapshots
+type SnapshotsSpec struct {
+	Partitions ElementalPartitions
+	State      *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (s *SnapshotsSpec) Sanitize() error {
+	if s.Partitions.State == nil || s.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if s.Partitions.Recovery == nil || s.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	return nil
+}
+
+// PackageVersion represents a version of a channel package available in the configured repositories
+type PackageVersion struct {
+	Package   string
+	Version   string
+	Installed bool
+}
+
+// RecoveryBackupSpec struct represents all the recovery backup action details
+type RecoveryBackupSpec struct {
+	Partitions ElementalPartitions
+	State      *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (r *RecoveryBackupSpec) Sanitize() error {
+	if r.Partitions.State == nil || r.Partitions.State.MountPoint == "" {
+		return fmt.Errorf("undefined state partition")
+	}
+	if r.Partitions.Recovery == nil || r.Partitions.Recovery.MountPoint == "" {
+		return fmt.Errorf("undefined recovery partition")
+	}
+	return nil
+}
+
+// StatusSpec struct represents all the status action details
+type StatusSpec struct {
+	Partitions PartitionList
+	State      *InstallState
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (s *StatusSpec) Sanitize() error {
+	if len(s.Partitions) == 0 {
+		return fmt.Errorf("no partitions found")
+	}
+	return nil
+}
+
+// SystemStatus represents the state of a deployed system as reported by the status command
+type SystemStatus struct {
+	BootedFrom   string             `json:"booted-from,omitempty" yaml:"booted-from,omitempty"`
+	Date         string             `json:"date,omitempty" yaml:"date,omitempty"`
+	DefaultEntry string             `json:"default-entry,omitempty" yaml:"default-entry,omitempty"`
+	Images       []*ImageStatus     `json:"images,omitempty" yaml:"images,omitempty"`
+	Partitions   []*PartitionStatus `json:"partitions,omitempty" yaml:"partitions,omitempty"`
+	Staged       *StagedStatus      `json:"staged,omitempty" yaml:"staged,omitempty"`
+}
+
+// StagedStatus represents an upgrade staged to be applied later as reported by the status command
+type StagedStatus struct {
+	Date   string         `json:"date,omitempty" yaml:"date,omitempty"`
+	Images []*ImageStatus `json:"images,omitempty" yaml:"images,omitempty"`
+}
+
+// ImageStatus represents a deployed image as reported by the status command
+type ImageStatus struct {
+	Name      string `json:"name" yaml:"name"`
+	Partition string `json:"partition" yaml:"partition"`
+	Label     string `json:"label,omitempty" yaml:"label,omitempty"`
+	Source    string `json:"source,omitempty" yaml:"source,omitempty"`
+	Digest    string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Version   string `json:"version,omitempty" yaml:"version,omitempty"`
+}
+
+// PartitionStatus represents a host partition as reported by the status command, sizes in MiB
+type PartitionStatus struct {
+	Name       string `json:"name" yaml:"name"`
+	Label      string `json:"label,omitempty" yaml:"label,omitempty"`
+	Device     string `json:"device" yaml:"device"`
+	FS         string `json:"fs,omitempty" yaml:"fs,omitempty"`
+	MountPoint string `json:"mountpoint,omitempty" yaml:"mountpoint,omitempty"`
+	Size       uint   `json:"size" yaml:"size"`
+	Free       uint   `json:"free,omitempty" yaml:"free,omitempty"`
+}
+
+// Snapshot represents a system image stored in the state partition
+type Snapshot struct {
+	Name    string
+	File    string
+	Label   string
+	Source  *ImageSource
+	Default bool
+}
+
 // Partition struct represents a partition with its commonly configurable values, size in MiB
 type Partition struct {
 	Name            string
@@ -257,6 +785,51 @@ type Partition struct {
 	MountPoint      string
 	Path            string
 	Disk            string
+	// Members are the partition devices of each disk of a mirrored installation
+	Members    []string
+	Encryption *PartitionEncryption `yaml:"encryption,omitempty" mapstructure:"encryption"`
+	Subvolumes []*Subvolume         `yaml:"subvolumes,omitempty" mapstructure:"subvolumes"`
+}
+
+// Subvolume defines a btrfs subvolume created at the given path, relative to the top level
+// volume of the partition, with an optional compression algorithm for the data written to it.
+type Subvolume struct {
+	Path        string `yaml:"path" mapstructure:"path"`
+	Compression string `yaml:"compression,omitempty" mapstructure:"compression"`
+}
+
+// Sanitize checks the subvolume path is relative to the partition and the compression is supported
+func (s *Subvolume) Sanitize() error {
+	if s.Path == "" || filepath.IsAbs(s.Path) || filepath.Clean(s.Path) != s.Path || strings.HasPrefix(s.Path, "..") {
+		return fmt.Errorf("invalid subvolume path '%s', it must be a clean path relative to the partition", s.Path)
+	}
+	switch s.Compression {
+	case "", "zlib", "lzo", "zstd":
+	default:
+		return fmt.Errorf("unsupported compression '%s' of subvolume %s", s.Compression, s.Path)
+	}
+	return nil
+}
+
+// PartitionEncryption defines the LUKS encryption of a partition. The partition is unlocked
+// either with a key file, which must also be available at boot on the same path, or with a
+// passphrase read from a file at install time and requested on boot.
+type PartitionEncryption struct {
+	KeyFile        string `yaml:"keyfile,omitempty" mapstructure:"keyfile"`
+	PassphraseFrom string `yaml:"passphrase-from,omitempty" mapstructure:"passphrase-from"`
+	// UUID of the LUKS volume, set once the partition is encrypted
+	UUID string `yaml:"uuid,omitempty" mapstructure:"-"`
+}
+
+// Sanitize checks the consistency of the encryption settings
+func (pe *PartitionEncryption) Sanitize() error {
+	if pe.KeyFile == "" && pe.PassphraseFrom == "" {
+		return fmt.Errorf("encryption requires a keyfile or a passphrase-from file")
+	}
+	if pe.KeyFile != "" && pe.PassphraseFrom != "" {
+		return fmt.Errorf("encryption keyfile and passphrase-from are mutually exclusive")
+	}
+	return nil
 }
 
 type PartitionList []*Partition
@@ -354,7 +927,7 @@ func NewElementalPartitionsFromList(pl PartitionList) ElementalPartitions {
 }
 
 // PartitionsByInstallOrder sorts partitions according to the default layout
-// nil partitons are ignored
+// nil partitons and excluded partitions, including extra partitions, are ignored
 // partition with 0 size is set last
 func (ep ElementalPartitions) PartitionsByInstallOrder(extraPartitions PartitionList, excludes ...*Partition) PartitionList {
 	partitions := PartitionList{}
@@ -393,6 +966,9 @@ func (ep ElementalPartitions) PartitionsByInstallOrder(extraPartitions Partition
 		}
 	}
 	for _, p := range extraPartitions {
+		if inExcludes(p, excludes...) {
+			continue
+		}
 		// Check if we have to set this partition the latest due size == 0
 		// Also check that we didn't set already the persistent to last in which case ignore this
 		// InstallConfig.Sanitize should have already taken care of failing if this is the case, so this is extra protection
@@ -537,14 +1113,64 @@ type RawDiskPackage struct {
 
 // InstallState tracks the installation data of the whole system
 type InstallState struct {
-	Date       string                     `yaml:"date,omitempty"`
-	Partitions map[string]*PartitionState `yaml:",omitempty,inline"`
+	Date           string                     `yaml:"date,omitempty"`
+	BootAssessment *BootAssessmentState       `yaml:"boot-assessment,omitempty"`
+	Target         *DiskState                 `yaml:"target,omitempty"`
+	Partitions     map[string]*PartitionState `yaml:",omitempty,inline"`
+}
+
+// DiskState represents the disk chosen by the target selector at install time
+type DiskState struct {
+	Device string `yaml:"device"`
+	Size   uint64 `yaml:"size,omitempty"`
+	Model  string `yaml:"model,omitempty"`
+	Serial string `yaml:"serial,omitempty"`
+	WWN    string `yaml:"wwn,omitempty"`
+}
+
+// UpgradeJournal tracks the images swap of an ongoing upgrade transaction, so it can be
+// resumed or reverted if interrupted. Image paths are relative to the root of the partition
+// holding the images, which is the state partition or the recovery partition for recovery upgrades.
+type UpgradeJournal struct {
+	Phase           string        `yaml:"phase"`
+	Date            string        `yaml:"date,omitempty"`
+	RecoveryUpgrade bool          `yaml:"recovery,omitempty"`
+	Transition      string        `yaml:"transition"`
+	Target          string        `yaml:"target"`
+	Passive         string        `yaml:"passive,omitempty"`
+	Snapshots       int           `yaml:"snapshots,omitempty"`
+	State           *InstallState `yaml:"state,omitempty"`
+	// Recovery image swap of transactions upgrading both the system and the recovery images,
+	// paths are relative to the root of the recovery partition
+	RecoveryTransition string `yaml:"recovery-transition,omitempty"`
+	RecoveryTarget     string `yaml:"recovery-target,omitempty"`
+	// Backup of the current recovery image, relative to the root of the recovery partition
+	RecoveryBackup string `yaml:"recovery-backup,omitempty"`
+	// Set once the transaction starts replacing any previous recovery backup
+	RecoveryBackedUp bool `yaml:"recovery-backed-up,omitempty"`
+	// Images deployed by a staged transaction, the upgraded installation state is computed
+	// from them and the installation state in place once the transaction is applied
+	Images map[string]*ImageState `yaml:"images,omitempty"`
+}
+
+// BootAssessmentState tracks the boot assessment of the active image
+type BootAssessmentState struct {
+	Tries  int    `yaml:"tries,omitempty"`
+	Status string `yaml:"status,omitempty"`
+	Date   string `yaml:"date,omitempty"`
 }
 
 // PartState tracks installation data of a partition
 type PartitionState struct {
-	FSLabel string                 `yaml:"label,omitempty"`
-	Images  map[string]*ImageState `yaml:",omitempty,inline"`
+	FSLabel string   `yaml:"label,omitempty"`
+	Members []string `yaml:"members,omitempty"`
+	// FS is only recorded for encrypted partitions and logical volumes, as they are not
+	// probed among the host partitions, and for partitions with subvolumes
+	FS          string                 `yaml:"fs,omitempty"`
+	Encryption  *PartitionEncryption   `yaml:"encryption,omitempty"`
+	VolumeGroup string                 `yaml:"volume-group,omitempty"`
+	Subvolumes  []*Subvolume           `yaml:"subvolumes,omitempty"`
+	Images      map[string]*ImageState `yaml:",omitempty,inline"`
 }
 
 // ImageState represents data of a deployed image
@@ -578,6 +1204,12 @@ func (i *ImageState) UnmarshalYAML(value *yaml.Node) error {
 
 	i.SourceMetadata = nil
 	if srcMeta != nil {
+		h := &HTTPImageMeta{}
+		err = srcMeta.Decode(h)
+		if err == nil && h.URL != "" {
+			i.SourceMetadata = h
+			return nil
+		}
 		d := &DockerImageMeta{}
 		err = srcMeta.Decode(d)
 		if err == nil && (d.Digest != "" || d.Size != 0) {
@@ -588,6 +1220,12 @@ func (i *ImageState) UnmarshalYAML(value *yaml.Node) error {
 		err = srcMeta.Decode(c)
 		if err == nil && c.Name != "" {
 			i.SourceMetadata = c
+			return nil
+		}
+		iso := &IsoImageMeta{}
+		err = srcMeta.Decode(iso)
+		if err == nil && iso.Checksum != "" {
+			i.SourceMetadata = iso
 		}
 	}
 
@@ -596,8 +1234,23 @@ func (i *ImageState) UnmarshalYAML(value *yaml.Node) error {
 
 // DockerImageMeta represents metadata of a docker container image type
 type DockerImageMeta struct {
-	Digest string `yaml:"digest,omitempty"`
-	Size   int64  `yaml:"size,omitempty"`
+	Digest     string   `yaml:"digest,omitempty"`
+	Size       int64    `yaml:"size,omitempty"`
+	LayersSize int64    `yaml:"layers-size,omitempty"`
+	Layers     []string `yaml:"-"`
+}
+
+// HTTPImageMeta represents metadata of an image fetched over http
+type HTTPImageMeta struct {
+	URL      string `yaml:"url,omitempty"`
+	Checksum string `yaml:"checksum,omitempty"`
+	Size     int64  `yaml:"size,omitempty"`
+}
+
+// IsoImageMeta represents metadata of an image extracted from an ISO
+type IsoImageMeta struct {
+	Iso      string `yaml:"iso,omitempty"`
+	Checksum string `yaml:"checksum,omitempty"`
 }
 
 // ChannelImageMeta represents metadata of a channel image type
@@ -29,6 +29,7 @@ import (
 	v1mocks "github.com/rancher/elemental-cli/tests/mocks"
 	"github.com/twpayne/go-vfs"
 	"github.com/twpayne/go-vfs/vfst"
+	"gopkg.in/yaml.v3"
 )
 
 var _ = Describe("Types", Label("types", "config"), func() {
@@ -84,6 +85,15 @@ var _ = Describe("Types", Label("types", "config"), func() {
 						FSLabel: "state_label",
 						Images: map[string]*v1.ImageState{
 							"active": dockerState,
+							"passive": {
+								Source: v1.NewDirSrc("/tmp/elemental/rootfs"),
+								Label:  "passive_label",
+								FS:     "ext2",
+								SourceMetadata: &v1.IsoImageMeta{
+									Iso:      "https://example.org/elemental.iso",
+									Checksum: "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac",
+								},
+							},
 						},
 					},
 					"recovery": {
@@ -132,6 +142,33 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			_, err = config.LoadInstallState()
 			Expect(err).Should(HaveOccurred())
 		})
+		It("Writes and loads the metadata of http sources", Label("http"), func() {
+			installState.Partitions["state"].Images["active"] = &v1.ImageState{
+				Source: v1.NewHTTPSrc("https://example.org/rootfs.tar.xz", ""),
+				Label:  "active_label",
+				FS:     "ext2",
+				SourceMetadata: &v1.HTTPImageMeta{
+					URL:      "https://example.org/rootfs.tar.xz",
+					Checksum: "sha256:e0e4548df88a35d5854d052281c5deedad16f286f82cb2c23f2f9dea494834ac",
+					Size:     1024,
+				},
+			}
+			err = config.WriteInstallState(installState, statePath, recoveryPath)
+			Expect(err).ShouldNot(HaveOccurred())
+			data, err := fs.ReadFile(statePath)
+			Expect(err).ShouldNot(HaveOccurred())
+			loaded := &v1.InstallState{}
+			Expect(yaml.Unmarshal(data, loaded)).To(Succeed())
+			Expect(loaded.Partitions["state"].Images["active"]).To(Equal(installState.Partitions["state"].Images["active"]))
+		})
+		It("Does not leave temporary files behind", func() {
+			err = config.WriteInstallState(installState, statePath, recoveryPath)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Stat(statePath + ".tmp")
+			Expect(err).Should(HaveOccurred())
+			_, err = fs.Stat(recoveryPath + ".tmp")
+			Expect(err).Should(HaveOccurred())
+		})
 	})
 	Describe("ElementalPartitions", func() {
 		var p v1.PartitionList
@@ -246,6 +283,13 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				Expect(lst[1].Name == "persistent").To(BeTrue())
 				Expect(lst[2].Name == "extra").To(BeTrue())
 			})
+			It("with excluded extra parts", func() {
+				ep := v1.NewElementalPartitionsFromList(p)
+				extra := &v1.Partition{Name: "extra", Size: 5}
+				lst := ep.PartitionsByInstallOrder(v1.PartitionList{extra}, extra, ep.Persistent)
+				Expect(len(lst)).To(Equal(1))
+				Expect(lst[0].Name == "oem").To(BeTrue())
+			})
 			It("with several extra parts with size == 0 and persistent.Size > 0", func() {
 				ep := v1.NewElementalPartitionsFromList(p)
 				ep.Persistent.Size = 10
@@ -422,6 +466,257 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					Expect(err).ToNot(HaveOccurred())
 				})
 			})
+			Describe("with mirrored targets", func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("sets the first target as the primary target", func() {
+					spec.Mirror = v1.RAID1
+					spec.Targets = []string{"/dev/sda", "/dev/sdb"}
+					err := spec.Sanitize()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(spec.Target).To(Equal("/dev/sda"))
+				})
+				It("fails if the number of targets does not match the mirroring mode", func() {
+					spec.Mirror = v1.RAID1
+					spec.Targets = []string{"/dev/sda"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.Targets = []string{"/dev/sda", "/dev/sda"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with multiple targets and no mirroring mode", func() {
+					spec.Targets = []string{"/dev/sda", "/dev/sdb"}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("require a mirroring mode"))
+				})
+				It("fails with an unsupported mirroring mode or with no-format", func() {
+					spec.Targets = []string{"/dev/sda", "/dev/sdb"}
+					spec.Mirror = "raid5"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.Mirror = v1.RAID1
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with encrypted partitions", func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("accepts encrypted persistent and extra partitions", func() {
+					spec.Partitions.Persistent.Encryption = &v1.PartitionEncryption{KeyFile: "/keyfile"}
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &v1.Partition{
+						Name: "data", Size: 10, FS: "ext4", Encryption: &v1.PartitionEncryption{PassphraseFrom: "/pass"},
+					})
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails to encrypt any other partition", func() {
+					spec.Partitions.State.Encryption = &v1.PartitionEncryption{KeyFile: "/keyfile"}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("only persistent and extra partitions"))
+				})
+				It("fails without a single key source", func() {
+					spec.Partitions.Persistent.Encryption = &v1.PartitionEncryption{}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.Partitions.Persistent.Encryption = &v1.PartitionEncryption{KeyFile: "/keyfile", PassphraseFrom: "/pass"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with no-format or without a filesystem", func() {
+					spec.ExtraPartitions = append(spec.ExtraPartitions, &v1.Partition{
+						Name: "data", Size: 10, Encryption: &v1.PartitionEncryption{KeyFile: "/keyfile"},
+					})
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.ExtraPartitions[0].FS = "ext4"
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with subvolumes", Label("btrfs"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("accepts subvolumes on a btrfs persistent partition", func() {
+					spec.Partitions.Persistent.FS = constants.Btrfs
+					spec.Partitions.Persistent.Subvolumes = []*v1.Subvolume{
+						{Path: "@home", Compression: "zstd"}, {Path: "@var"},
+					}
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails on other partitions or filesystems", func() {
+					spec.Partitions.State.FS = constants.Btrfs
+					spec.Partitions.State.Subvolumes = []*v1.Subvolume{{Path: "@home"}}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.Partitions.State.Subvolumes = nil
+					spec.Partitions.Persistent.Subvolumes = []*v1.Subvolume{{Path: "@home"}}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("requires a btrfs filesystem"))
+				})
+				It("fails with invalid paths or compression", func() {
+					spec.Partitions.Persistent.FS = constants.Btrfs
+					for _, path := range []string{"", "/@home", "../@home", "@home/"} {
+						spec.Partitions.Persistent.Subvolumes = []*v1.Subvolume{{Path: path}}
+						Expect(spec.Sanitize()).To(HaveOccurred())
+					}
+					spec.Partitions.Persistent.Subvolumes = []*v1.Subvolume{{Path: "@home", Compression: "gzip"}}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with a disk image target", Label("image"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+					spec.Target = "disk.img"
+				})
+				It("disables the boot entry of disk images", func() {
+					spec.ImageSize = "20G"
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.DisableBootEntry).To(BeTrue())
+				})
+				It("fails with an invalid size", func() {
+					spec.ImageSize = "big"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.ImageSize = "0"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with no-format", func() {
+					spec.ImageSize = "20G"
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with a target selector", Label("target-selector"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("sets the default policy", func() {
+					spec.TargetSelector = &v1.TargetSelector{MinSize: "20G", Model: "Samsung*"}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.TargetSelector.Policy).To(Equal(v1.SelectFirst))
+				})
+				It("fails with a given target", func() {
+					spec.Target = "/dev/sda"
+					spec.TargetSelector = &v1.TargetSelector{}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with invalid sizes, patterns or policies", func() {
+					spec.TargetSelector = &v1.TargetSelector{MinSize: "big"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.TargetSelector = &v1.TargetSelector{Serial: "[abc"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.TargetSelector = &v1.TargetSelector{Policy: "random"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("keeping partitions", Label("keep-persistent"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+					spec.ExtraPartitions = v1.PartitionList{{Name: "data", FS: "ext4", Size: 100}}
+				})
+				It("lists the kept partitions", func() {
+					spec.KeepPersistent = true
+					spec.KeepPartitions = []string{"data"}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.KeptPartitions()).To(Equal(v1.PartitionList{spec.Partitions.Persistent, spec.ExtraPartitions[0]}))
+				})
+				It("fails with undefined partitions", func() {
+					spec.KeepPartitions = []string{"missing"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.KeepPartitions = nil
+					spec.KeepPersistent = true
+					spec.Partitions.Persistent = nil
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with no-format, volume groups or encryption", func() {
+					spec.KeepPersistent = true
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.NoFormat = false
+					spec.VolumeGroup = &v1.VolumeGroup{}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.VolumeGroup = nil
+					spec.Partitions.Persistent.Encryption = &v1.PartitionEncryption{KeyFile: "/keyfile"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with a volume group", Label("lvm"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("sets the default volume group name", func() {
+					spec.VolumeGroup = &v1.VolumeGroup{}
+					Expect(spec.Sanitize()).To(Succeed())
+					Expect(spec.VolumeGroup.Name).To(Equal(constants.VolumeGroupName))
+				})
+				It("fails without a persistent partition", func() {
+					spec.VolumeGroup = &v1.VolumeGroup{Name: "vg"}
+					spec.Partitions.Persistent = nil
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with mirrored targets or no-format", func() {
+					spec.VolumeGroup = &v1.VolumeGroup{Name: "vg"}
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.NoFormat = false
+					spec.Mirror = v1.RAID1
+					spec.Targets = []string{"/dev/sda", "/dev/sdb"}
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("wiping the target", Label("wipe"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("accepts the supported wipe modes", func() {
+					for _, mode := range []string{v1.WipeSignatures, v1.WipeDiscard, v1.WipeZeroHeaders, v1.WipeFull} {
+						spec.Wipe = mode
+						Expect(spec.Sanitize()).To(Succeed())
+					}
+				})
+				It("fails with an unsupported wipe mode", func() {
+					spec.Wipe = "shred"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+				It("fails with no-format, disk images or kept partitions", func() {
+					spec.Wipe = v1.WipeSignatures
+					spec.NoFormat = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.NoFormat = false
+					spec.KeepPersistent = true
+					Expect(spec.Sanitize()).To(HaveOccurred())
+
+					spec.KeepPersistent = false
+					spec.Target = "/tmp/disk.img"
+					spec.ImageSize = "20G"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
+			Describe("with requirements", Label("requirements"), func() {
+				BeforeEach(func() {
+					spec.Active.Source = v1.NewDirSrc("/dir")
+				})
+				It("accepts a minimum memory with units", func() {
+					spec.Requirements.MinMemory = "2G"
+					Expect(spec.Sanitize()).To(Succeed())
+				})
+				It("fails with an invalid minimum memory", func() {
+					spec.Requirements.MinMemory = "lots"
+					Expect(spec.Sanitize()).To(HaveOccurred())
+				})
+			})
 		})
 	})
 	Describe("ResetSpec", func() {
@@ -470,12 +765,80 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			}
 			err := spec.Sanitize()
 			Expect(err).ShouldNot(HaveOccurred())
+			// Passive image is always retained
+			Expect(spec.Snapshots).To(Equal(1))
 
 			//Fails on empty source for active upgrade
 			spec.Active.Source = v1.NewEmptySrc()
 			err = spec.Sanitize()
 			Expect(err).Should(HaveOccurred())
 
+			//Succeeds on empty source for active upgrade from an ISO
+			spec.Iso = "/some/elemental.iso"
+			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.Iso = ""
+
+			//Fails pinning a version of a non channel source
+			spec.Active.Source = v1.NewDirSrc("/dir")
+			spec.Version = "1.2.0"
+			err = spec.Sanitize()
+			Expect(err).Should(HaveOccurred())
+
+			//Succeeds pinning a version of a channel source
+			spec.Active.Source = v1.NewChannelSrc("system/cos")
+			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.Version = ""
+
+			//Succeeds listing versions without source
+			spec.Active.Source = v1.NewEmptySrc()
+			spec.ListVersions = true
+			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+			spec.ListVersions = false
+
+			//Succeeds applying a staged upgrade without source
+			spec.ApplyStaged = true
+			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			//Fails applying and discarding a staged upgrade at once
+			spec.DiscardStaged = true
+			err = spec.Sanitize()
+			Expect(err).Should(HaveOccurred())
+			spec.ApplyStaged = false
+
+			//Fails discarding a staged upgrade without recovery partition
+			recoveryPart := spec.Partitions.Recovery
+			spec.Partitions.Recovery = nil
+			err = spec.Sanitize()
+			Expect(err).Should(HaveOccurred())
+			spec.DiscardStaged = false
+
+			//Fails recovering a pending upgrade without recovery partition
+			spec.Recover = true
+			err = spec.Sanitize()
+			Expect(err).Should(HaveOccurred())
+			spec.Recover = false
+			spec.Partitions.Recovery = recoveryPart
+
+			//Upgrading all defaults the recovery source to the system source
+			spec.Active.Source = v1.NewDockerSrc("some/image")
+			spec.Recovery.Source = v1.NewEmptySrc()
+			spec.All = true
+			err = spec.Sanitize()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.Recovery.Source.Value()).To(Equal("some/image"))
+
+			//Fails upgrading all and recovery at once
+			spec.RecoveryUpgrade = true
+			err = spec.Sanitize()
+			Expect(err).Should(HaveOccurred())
+			spec.RecoveryUpgrade = false
+			spec.All = false
+			spec.Active.Source = v1.NewEmptySrc()
+
 			//Fails on missing state partition for active upgrade
 			spec.Partitions.State = nil
 			err = spec.Sanitize()
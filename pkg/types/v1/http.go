@@ -18,4 +18,7 @@ package v1
 
 type HTTPClient interface {
 	GetURL(log Logger, url string, destination string) error
+	// GetURLWithChecksum downloads the given URL verifying it matches the given 'sha256:<hex digest>'
+	// checksum, the destination is removed on mismatch. An empty checksum skips the verification.
+	GetURLWithChecksum(log Logger, url string, destination string, checksum string) error
 }
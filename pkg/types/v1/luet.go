@@ -18,7 +18,11 @@ package v1
 
 type LuetInterface interface {
 	Unpack(string, string, bool) (*DockerImageMeta, error)
+	GetImageMeta(string, bool) (*DockerImageMeta, error)
+	UnpackLayers(string, string, bool, int) (*DockerImageMeta, error)
+	UnpackArchive(string, *ImageSource) (*DockerImageMeta, error)
 	UnpackFromChannel(string, string, ...Repository) (*ChannelImageMeta, error)
+	PackageVersions(string, ...Repository) ([]string, error)
 	SetPlugins(...string)
 	GetPlugins() []string
 	SetArch(string)
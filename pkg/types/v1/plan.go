@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Plan step kinds
+const (
+	PlanDisk   = "disk"
+	PlanFormat = "format"
+	PlanMount  = "mount"
+	PlanImage  = "image"
+	PlanHook   = "hook"
+	PlanGrub   = "grub"
+	PlanFile   = "file"
+	PlanState  = "state"
+	PlanRun    = "run"
+)
+
+// PlanStep is a single operation of a dry run plan
+type PlanStep struct {
+	Kind        string
+	Description string
+	Details     string
+}
+
+// Plan collects, in order, the operations an action would apply if it was not a dry run
+type Plan struct {
+	mu    sync.Mutex
+	steps []PlanStep
+}
+
+func NewPlan() *Plan {
+	return &Plan{steps: []PlanStep{}}
+}
+
+// Record appends a new step of the given kind to the plan
+func (p *Plan) Record(kind string, format string, args ...interface{}) {
+	p.RecordWithDetails(kind, "", format, args...)
+}
+
+// RecordWithDetails appends a new step of the given kind including some extra multi-line details
+func (p *Plan) RecordWithDetails(kind string, details string, format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, PlanStep{Kind: kind, Description: fmt.Sprintf(format, args...), Details: details})
+}
+
+// Steps returns a copy of the recorded steps
+func (p *Plan) Steps() []PlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PlanStep{}, p.steps...)
+}
+
+// Print writes the numbered list of steps to the given writer
+func (p *Plan) Print(w io.Writer) error {
+	for i, step := range p.Steps() {
+		_, err := fmt.Fprintf(w, "%3d. [%s] %s\n", i+1, step.Kind, step.Description)
+		if err != nil {
+			return err
+		}
+		if step.Details == "" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(step.Details, "\n"), "\n") {
+			_, err = fmt.Fprintf(w, "       %s\n", line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
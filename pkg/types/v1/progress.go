@@ -0,0 +1,178 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress event types
+const (
+	EventStart      = "start"
+	EventPhaseStart = "phase-start"
+	EventPhaseEnd   = "phase-end"
+	EventProgress   = "progress"
+	EventHook       = "hook"
+	EventError      = "error"
+	EventEnd        = "end"
+)
+
+// Progress event results
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Action phases reported as progress events
+const (
+	PhaseRequirements = "requirements"
+	PhaseDownload     = "download"
+	PhasePartition    = "partition"
+	PhaseMount        = "mount"
+	PhaseDeploy       = "deploy"
+	PhaseBootloader   = "bootloader"
+	PhaseRecovery     = "recovery"
+	PhasePassive      = "passive"
+	PhaseFinalize     = "finalize"
+	PhaseImage        = "image"
+)
+
+// ProgressEvent is a single machine readable progress event of an action. Percents are only
+// set on progress events, results on the end of phases, hooks and actions.
+type ProgressEvent struct {
+	Time    string `json:"time"`
+	Action  string `json:"action"`
+	Event   string `json:"event"`
+	Phase   string `json:"phase,omitempty"`
+	Hook    string `json:"hook,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Percent *int   `json:"percent,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Progress writes the progress events of an action as JSON lines. All methods are no-ops on a
+// nil Progress, so actions report their progress regardless of any consumer. Write errors are
+// ignored, a consumer going away must not break the action.
+type Progress struct {
+	mu      sync.Mutex
+	w       io.Writer
+	action  string
+	phase   string
+	percent map[string]int
+}
+
+func NewProgress(w io.Writer) *Progress {
+	return &Progress{w: w, percent: map[string]int{}}
+}
+
+// Start reports the start of the given action, following events refer to it
+func (p *Progress) Start(action string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.action, p.phase = action, ""
+	p.emit(ProgressEvent{Event: EventStart})
+}
+
+// Phase reports the end of the current phase, if any, and the start of the given one
+func (p *Progress) Phase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endPhase(nil)
+	p.phase = phase
+	p.emit(ProgressEvent{Event: EventPhaseStart, Phase: phase})
+}
+
+// Percent reports the completed percent of the given target of the current phase, e.g. a download.
+// Only changes of the percent are reported.
+func (p *Progress) Percent(target string, percent int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.percent[target]; ok && last == percent {
+		return
+	}
+	p.percent[target] = percent
+	p.emit(ProgressEvent{Event: EventProgress, Phase: p.phase, Target: target, Percent: &percent})
+}
+
+// Hook reports the result of the given hook
+func (p *Progress) Hook(hook string, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit(withResult(ProgressEvent{Event: EventHook, Phase: p.phase, Hook: hook}, err))
+}
+
+// Done reports the end of the current phase and of the action with the given error, if any
+func (p *Progress) Done(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	phase := p.phase
+	p.endPhase(err)
+	if err != nil {
+		p.emit(ProgressEvent{Event: EventError, Phase: phase, Error: err.Error()})
+	}
+	p.emit(withResult(ProgressEvent{Event: EventEnd}, err))
+}
+
+// endPhase reports the end of the current phase, if any
+func (p *Progress) endPhase(err error) {
+	if p.phase == "" {
+		return
+	}
+	p.emit(withResult(ProgressEvent{Event: EventPhaseEnd, Phase: p.phase}, err))
+	p.phase = ""
+	p.percent = map[string]int{}
+}
+
+// emit writes the given event as a single JSON line
+func (p *Progress) emit(event ProgressEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	event.Action = p.action
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	_, _ = p.w.Write(append(data, '\n'))
+}
+
+// withResult sets the result of the given event and the error, if any
+func withResult(event ProgressEvent, err error) ProgressEvent {
+	event.Result = ResultSuccess
+	if err != nil {
+		event.Result = ResultFailure
+		event.Error = err.Error()
+	}
+	return event
+}
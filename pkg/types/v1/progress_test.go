@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// readEvents parses the JSON lines of progress events written to the given buffer
+func readEvents(buf *bytes.Buffer) []v1.ProgressEvent {
+	var events []v1.ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event v1.ProgressEvent
+		ExpectWithOffset(1, json.Unmarshal([]byte(line), &event)).To(Succeed())
+		ExpectWithOffset(1, event.Time).NotTo(BeEmpty())
+		event.Time = ""
+		events = append(events, event)
+	}
+	return events
+}
+
+func percent(p int) *int {
+	return &p
+}
+
+var _ = Describe("Progress", Label("types", "progress"), func() {
+	var buf *bytes.Buffer
+	var progress *v1.Progress
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		progress = v1.NewProgress(buf)
+	})
+	It("does nothing on a nil progress", func() {
+		var nilProgress *v1.Progress
+		nilProgress.Start("install")
+		nilProgress.Phase(v1.PhaseDeploy)
+		nilProgress.Percent("target", 50)
+		nilProgress.Hook("before-install", nil)
+		nilProgress.Done(errors.New("failed"))
+	})
+	It("writes the events of a successful action as JSON lines", func() {
+		progress.Start("install")
+		progress.Phase(v1.PhaseDownload)
+		progress.Percent("http://example.org/image.iso", 10)
+		progress.Percent("http://example.org/image.iso", 10)
+		progress.Percent("http://example.org/image.iso", 100)
+		progress.Phase(v1.PhaseDeploy)
+		progress.Hook("before-install", nil)
+		progress.Done(nil)
+
+		Expect(readEvents(buf)).To(Equal([]v1.ProgressEvent{
+			{Action: "install", Event: v1.EventStart},
+			{Action: "install", Event: v1.EventPhaseStart, Phase: v1.PhaseDownload},
+			{Action: "install", Event: v1.EventProgress, Phase: v1.PhaseDownload, Target: "http://example.org/image.iso", Percent: percent(10)},
+			{Action: "install", Event: v1.EventProgress, Phase: v1.PhaseDownload, Target: "http://example.org/image.iso", Percent: percent(100)},
+			{Action: "install", Event: v1.EventPhaseEnd, Phase: v1.PhaseDownload, Result: v1.ResultSuccess},
+			{Action: "install", Event: v1.EventPhaseStart, Phase: v1.PhaseDeploy},
+			{Action: "install", Event: v1.EventHook, Phase: v1.PhaseDeploy, Hook: "before-install", Result: v1.ResultSuccess},
+			{Action: "install", Event: v1.EventPhaseEnd, Phase: v1.PhaseDeploy, Result: v1.ResultSuccess},
+			{Action: "install", Event: v1.EventEnd, Result: v1.ResultSuccess},
+		}))
+	})
+	It("reports the percent of each phase from scratch", func() {
+		progress.Start("upgrade")
+		progress.Phase(v1.PhaseDeploy)
+		progress.Percent("/run/cos/state", 100)
+		progress.Phase(v1.PhaseRecovery)
+		progress.Percent("/run/cos/state", 100)
+
+		events := readEvents(buf)
+		Expect(events).To(HaveLen(6))
+		Expect(events[5]).To(Equal(v1.ProgressEvent{
+			Action: "upgrade", Event: v1.EventProgress, Phase: v1.PhaseRecovery, Target: "/run/cos/state", Percent: percent(100),
+		}))
+	})
+	It("writes the events of a failed action", func() {
+		progress.Start("reset")
+		progress.Phase(v1.PhaseBootloader)
+		progress.Hook("after-reset-chroot", errors.New("hook failed"))
+		progress.Done(errors.New("grub failed"))
+
+		Expect(readEvents(buf)).To(Equal([]v1.ProgressEvent{
+			{Action: "reset", Event: v1.EventStart},
+			{Action: "reset", Event: v1.EventPhaseStart, Phase: v1.PhaseBootloader},
+			{Action: "reset", Event: v1.EventHook, Phase: v1.PhaseBootloader, Hook: "after-reset-chroot", Result: v1.ResultFailure, Error: "hook failed"},
+			{Action: "reset", Event: v1.EventPhaseEnd, Phase: v1.PhaseBootloader, Result: v1.ResultFailure, Error: "grub failed"},
+			{Action: "reset", Event: v1.EventError, Phase: v1.PhaseBootloader, Error: "grub failed"},
+			{Action: "reset", Event: v1.EventEnd, Result: v1.ResultFailure, Error: "grub failed"},
+		}))
+	})
+})
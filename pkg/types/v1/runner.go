@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	"bytes"
 	"os/exec"
 	"strings"
 )
@@ -37,8 +38,18 @@ func (r RealRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	return exec.Command(command, args...)
 }
 
+// RunCmd runs the given command and returns its combined output. If the standard output of the
+// command is already set, e.g. to follow its progress, only the standard error is returned.
 func (r RealRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
-	return cmd.CombinedOutput()
+	if cmd.Stdout == nil {
+		return cmd.CombinedOutput()
+	}
+	stderr := &bytes.Buffer{}
+	if cmd.Stderr == nil {
+		cmd.Stderr = stderr
+	}
+	err := cmd.Run()
+	return stderr.Bytes(), err
 }
 
 func (r RealRunner) Run(command string, args ...string) ([]byte, error) {
@@ -61,4 +61,14 @@ var _ = Describe("Runner", Label("types", "runner"), func() {
 		Expect(err).ToNot(BeNil()) // Command will fail
 		Expect(memLog.String()).To(ContainSubstring("command with args"))
 	})
+	It("returns only the standard error of commands with the standard output set", func() {
+		r := v1.RealRunner{}
+		stdout := &bytes.Buffer{}
+		cmd := r.InitCmd("sh", "-c", "echo out; echo err >&2")
+		cmd.Stdout = stdout
+		out, err := r.RunCmd(cmd)
+		Expect(err).To(BeNil())
+		Expect(string(out)).To(Equal("err\n"))
+		Expect(stdout.String()).To(Equal("out\n"))
+	})
 })
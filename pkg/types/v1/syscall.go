@@ -23,6 +23,7 @@ import (
 type SyscallInterface interface {
 	Chroot(string) error
 	Chdir(string) error
+	Statfs(string, *syscall.Statfs_t) error
 }
 
 type RealSyscall struct{}
@@ -34,3 +35,7 @@ func (r *RealSyscall) Chroot(path string) error {
 func (r *RealSyscall) Chdir(path string) error {
 	return syscall.Chdir(path)
 }
+
+func (r *RealSyscall) Statfs(path string, buf *syscall.Statfs_t) error {
+	return syscall.Statfs(path, buf)
+}
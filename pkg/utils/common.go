@@ -28,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -35,7 +36,6 @@ import (
 	"github.com/distribution/distribution/reference"
 	"github.com/joho/godotenv"
 	"github.com/twpayne/go-vfs"
-	"github.com/zloylos/grsync"
 
 	cnst "github.com/rancher/elemental-cli/pkg/constants"
 	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
@@ -88,6 +88,25 @@ func CopyFile(fs v1.FS, source string, target string) (err error) {
 	return ConcatFiles(fs, []string{source}, target)
 }
 
+// CopyImageFile copies the given image file to target file with cp, so holes of sparse
+// images are kept. The target file is expected to be a file path.
+func CopyImageFile(runner v1.Runner, fs v1.FS, source string, target string) error {
+	if _, err := fs.Stat(source); err != nil {
+		return err
+	}
+	if s, err := fs.RawPath(source); err == nil {
+		source = s
+	}
+	if t, err := fs.RawPath(target); err == nil {
+		target = t
+	}
+	out, err := runner.Run("cp", "--sparse=always", source, target)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, string(out))
+	}
+	return nil
+}
+
 // ConcatFiles Copies source files to target file using Fs interface.
 // Source files are concatenated into target file in the given order.
 // If target is a directory source is copied into that directory using
@@ -159,8 +178,32 @@ func CreateDirStructure(fs v1.FS, target string) error {
 
 // SyncData rsync's source folder contents to a target folder content,
 // both are expected to exist before hand.
-func SyncData(log v1.Logger, fs v1.FS, source string, target string, excludes ...string) error {
+func SyncData(runner v1.Runner, fs v1.FS, source string, target string, excludes ...string) error {
+	return rsync(runner, fs, nil, source, target, false, excludes...)
+}
+
+// SyncDataWithProgress is SyncData reporting the overall transfer percent to the given progress
+func SyncDataWithProgress(runner v1.Runner, fs v1.FS, progress *v1.Progress, source string, target string, excludes ...string) error {
+	return rsync(runner, fs, progress, source, target, false, excludes...)
+}
+
+// MirrorData rsync's source folder contents to a target folder content, so both
+// end up with identical trees. Files are compared by checksum, hard links are preserved
+// and files not present in source are deleted from target, unless excluded.
+// Both folders are expected to exist before hand.
+func MirrorData(runner v1.Runner, fs v1.FS, source string, target string, excludes ...string) error {
+	return rsync(runner, fs, nil, source, target, true, excludes...)
+}
+
+func rsync(runner v1.Runner, fs v1.FS, progress *v1.Progress, source string, target string, mirror bool, excludes ...string) error {
+	// Progress is reported for the target as given, not for its raw path
+	progressTarget := target
 	if fs != nil {
+		for _, dir := range []string{source, target} {
+			if ok, _ := IsDir(fs, dir); !ok {
+				return fmt.Errorf("rsync requires existing directories, %s is not", dir)
+			}
+		}
 		if s, err := fs.RawPath(source); err == nil {
 			source = s
 		}
@@ -177,48 +220,61 @@ func SyncData(log v1.Logger, fs v1.FS, source string, target string, excludes ..
 		target = fmt.Sprintf("%s/", target)
 	}
 
-	task := grsync.NewTask(
-		source,
-		target,
-		grsync.RsyncOptions{
-			Quiet:   false,
-			Archive: true,
-			XAttrs:  true,
-			ACLs:    true,
-			Exclude: excludes,
-		},
-	)
-
-	quit := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-quit:
-				return
-			case <-time.After(5 * time.Second):
-				state := task.State()
-				log.Debugf(
-					"progress rsync %s to %s: %.2f / rem. %d / tot. %d / sp. %s",
-					source,
-					target,
-					state.Progress,
-					state.Remain,
-					state.Total,
-					state.Speed,
-				)
-			}
+	args := []string{"--archive", "--xattrs", "--acls"}
+	if mirror {
+		args = append(args, "--delete", "--checksum", "--hard-links")
+	}
+	for _, e := range excludes {
+		args = append(args, fmt.Sprintf("--exclude=%s", e))
+	}
+	var out []byte
+	var err error
+	runner.GetLogger().Debugf("rsync %s to %s", source, target)
+	if progress == nil {
+		out, err = runner.Run("rsync", append(args, source, target)...)
+	} else {
+		// The overall progress is parsed from the output while rsync runs
+		args = append(args, "--info=progress2", "--no-inc-recursive", source, target)
+		cmd := runner.InitCmd("rsync", args...)
+		if cmd != nil {
+			cmd.Stdout = &rsyncProgress{progress: progress, target: progressTarget}
 		}
-	}()
-
-	err := task.Run()
-	quit <- true
+		out, err = runner.RunCmd(cmd)
+	}
 	if err != nil {
-		return fmt.Errorf("%w: %s", err, strings.Join([]string{task.Log().Stderr, task.Log().Stdout}, "\n"))
+		return fmt.Errorf("%w: %s", err, string(out))
 	}
 
 	return nil
 }
 
+// rsyncProgressRegexp matches the overall percent of the rsync --info=progress2 output lines
+var rsyncProgressRegexp = regexp.MustCompile(`\s(\d+)%\s`)
+
+// rsyncProgress parses the output of rsync reporting the overall transfer percent
+type rsyncProgress struct {
+	progress *v1.Progress
+	target   string
+	line     []byte
+}
+
+func (r *rsyncProgress) Write(p []byte) (int, error) {
+	for _, b := range p {
+		// progress lines are overwritten with carriage returns
+		if b != '\r' && b != '\n' {
+			r.line = append(r.line, b)
+			continue
+		}
+		if match := rsyncProgressRegexp.FindSubmatch(r.line); match != nil {
+			if percent, err := strconv.Atoi(string(match[1])); err == nil {
+				r.progress.Percent(r.target, percent)
+			}
+		}
+		r.line = r.line[:0]
+	}
+	return len(p), nil
+}
+
 // Reboot reboots the system afater the given delay (in seconds) time passed.
 func Reboot(runner v1.Runner, delay time.Duration) error {
 	time.Sleep(delay * time.Second)
@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/jaypipes/ghw"
+	"github.com/jaypipes/ghw/pkg/block"
+	ghwUtil "github.com/jaypipes/ghw/pkg/util"
+
+	cnst "github.com/rancher/elemental-cli/pkg/constants"
+	v1 "github.com/rancher/elemental-cli/pkg/types/v1"
+)
+
+// SelectDisk returns the host disk matching the given target selector according to its policy.
+// Optical drives and disks with mounted partitions, such as the installation media, are never selected.
+func SelectDisk(selector *v1.TargetSelector) (*v1.DiskState, error) {
+	blockDevices, err := block.New(ghw.WithDisableTools(), ghw.WithDisableWarnings())
+	if err != nil {
+		return nil, err
+	}
+
+	var selected *block.Disk
+	for _, disk := range blockDevices.Disks {
+		match, err := matchDisk(selector, disk)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		switch {
+		case selected == nil:
+			selected = disk
+		case selector.Policy == v1.SelectSmallest && disk.SizeBytes < selected.SizeBytes:
+			selected = disk
+		case selector.Policy == v1.SelectLargest && disk.SizeBytes > selected.SizeBytes:
+			selected = disk
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no disk matches the target selector")
+	}
+	return &v1.DiskState{
+		Device: filepath.Join("/dev", selected.Name),
+		Size:   selected.SizeBytes,
+		Model:  ghwValue(selected.Model),
+		Serial: ghwValue(selected.SerialNumber),
+		WWN:    ghwValue(selected.WWN),
+	}, nil
+}
+
+// matchDisk checks if the given disk matches all the rules of the given selector
+func matchDisk(selector *v1.TargetSelector, disk *block.Disk) (bool, error) {
+	if disk.DriveType == block.DRIVE_TYPE_ODD || disk.SizeBytes == 0 {
+		return false, nil
+	}
+	for _, part := range disk.Partitions {
+		if part.MountPoint != "" {
+			return false, nil
+		}
+	}
+	if selector.MinSize != "" {
+		size, err := units.RAMInBytes(selector.MinSize)
+		if err != nil || disk.SizeBytes < uint64(size) {
+			return false, err
+		}
+	}
+	if selector.MaxSize != "" {
+		size, err := units.RAMInBytes(selector.MaxSize)
+		if err != nil || disk.SizeBytes > uint64(size) {
+			return false, err
+		}
+	}
+	if selector.Rotational != nil && *selector.Rotational != (disk.DriveType == block.DRIVE_TYPE_HDD) {
+		return false, nil
+	}
+	if selector.Bus != "" && !strings.EqualFold(selector.Bus, diskBus(disk)) {
+		return false, nil
+	}
+	patterns := [][2]string{
+		{selector.Model, disk.Model}, {selector.Serial, disk.SerialNumber}, {selector.WWN, disk.WWN},
+	}
+	for _, p := range patterns {
+		if p[0] == "" {
+			continue
+		}
+		match, err := filepath.Match(p[0], ghwValue(p[1]))
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// diskBus returns the bus of the given disk, USB disks are identified by their bus path
+func diskBus(disk *block.Disk) string {
+	if strings.Contains(disk.BusPath, "-usb-") {
+		return "usb"
+	}
+	return disk.StorageController.String()
+}
+
+// ghwValue returns the given ghw value or an empty string if unknown
+func ghwValue(value string) string {
+	if value == ghwUtil.UNKNOWN {
+		return ""
+	}
+	return value
+}
+
+// DiskSize returns the size in bytes of the given block device as reported by sysfs, symlinks
+// to the device such as the ones in /dev/disk/by-id are resolved.
+func DiskSize(fs v1.FS, device string) (uint64, error) {
+	if fi, err := fs.Lstat(device); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		device, err = fs.Readlink(device)
+		if err != nil {
+			return 0, err
+		}
+	}
+	sizeFile := filepath.Join(cnst.SysBlockDir, filepath.Base(device), "size")
+	data, err := fs.ReadFile(sizeFile)
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing %s: %w", sizeFile, err)
+	}
+	// sysfs sizes are always given in 512 bytes sectors
+	return sectors * 512, nil
+}
@@ -20,8 +20,10 @@ import (
 	"bytes"
 	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	efi "github.com/canonical/go-efilib"
@@ -48,26 +50,14 @@ func NewGrub(config *v1.Config) *Grub {
 
 // Install installs grub into the device, copy the config file and add any extra TTY to grub
 func (g Grub) Install(target, rootDir, bootDir, grubConf, tty string, efi bool, stateLabel string, disableBootEntry bool, clearBootEntries bool) (err error) { // nolint:gocyclo
-	var grubargs []string
 	var grubdir, finalContent string
+
 	// only install grub on non-efi systems
 	if !efi {
-		g.config.Logger.Info("Installing GRUB..")
-
-		grubargs = append(
-			grubargs,
-			fmt.Sprintf("--root-directory=%s", rootDir),
-			fmt.Sprintf("--boot-directory=%s", bootDir),
-			"--target=i386-pc",
-			target,
-		)
-		g.config.Logger.Debugf("Running grub with the following args: %s", grubargs)
-		out, err := g.config.Runner.Run("grub2-install", grubargs...)
+		err = g.InstallBIOS(target, rootDir, bootDir)
 		if err != nil {
-			g.config.Logger.Errorf(string(out))
 			return err
 		}
-		g.config.Logger.Infof("Grub install to device %s complete", target)
 	}
 
 	// At this point the active mountpoint has all the data from the installation source, so we should be able to use
@@ -116,6 +106,9 @@ func (g Grub) Install(target, rootDir, bootDir, grubConf, tty string, efi bool,
 		finalContent = string(grubCfg)
 	}
 
+	// Source the scripts elemental writes into the state partition
+	finalContent = withScriptsInclude(finalContent, stateLabel)
+
 	g.config.Logger.Infof("Copying grub contents from %s to %s", grubdir, filepath.Join(bootDir, "grub2/grub.cfg"))
 	_, err = grubConfTarget.WriteString(finalContent)
 	if err != nil {
@@ -272,7 +265,7 @@ func (g Grub) Install(target, rootDir, bootDir, grubConf, tty string, efi bool,
 		}
 
 		if !disableBootEntry {
-			efivars := efibootmgr.RealEFIVariables{}
+			efivars := g.efiVariables()
 			if clearBootEntries {
 				err = g.ClearBootEntry(efivars)
 				if err != nil {
@@ -288,6 +281,69 @@ func (g Grub) Install(target, rootDir, bootDir, grubConf, tty string, efi bool,
 	return nil
 }
 
+// efiVariables returns the EFI variables of the configuration or the ones of the running system
+func (g Grub) efiVariables() efibootmgr.EFIVariables {
+	if g.config.EFIVariables != nil {
+		return g.config.EFIVariables
+	}
+	return efibootmgr.RealEFIVariables{}
+}
+
+// CreateMemberBootEntry creates an EFI boot entry for the shim installed in the EFI partition mounted
+// at efiDir. Used on mirrored installations to register the EFI partition of each disk.
+func (g Grub) CreateMemberBootEntry(efiDir string) error {
+	elementalDir := filepath.Join(efiDir, "EFI/elemental")
+	shim, err := FindFileWithPrefix(g.config.Fs, elementalDir, "shim")
+	if err != nil {
+		return err
+	}
+	return g.CreateBootEntry(filepath.Base(shim), elementalDir, g.efiVariables())
+}
+
+// SetEFIModules makes the grub.cfg files of the EFI partition mounted at efiDir load the given modules
+// before searching for the state partition, so it can also be found on md arrays.
+func (g Grub) SetEFIModules(efiDir string, modules ...string) error {
+	var inserts string
+	for _, module := range modules {
+		inserts += fmt.Sprintf("insmod %s\n", module)
+	}
+	for _, cfg := range []string{"EFI/boot/grub.cfg", "EFI/elemental/grub.cfg"} {
+		cfgFile := filepath.Join(efiDir, cfg)
+		content, err := g.config.Fs.ReadFile(cfgFile)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(string(content), inserts) {
+			continue
+		}
+		err = g.config.Fs.WriteFile(cfgFile, append([]byte(inserts), content...), cnst.FilePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstallBIOS installs grub on the boot sector of the given target device for non-efi systems
+func (g Grub) InstallBIOS(target, rootDir, bootDir string) error {
+	g.config.Logger.Info("Installing GRUB..")
+
+	grubargs := []string{
+		fmt.Sprintf("--root-directory=%s", rootDir),
+		fmt.Sprintf("--boot-directory=%s", bootDir),
+		"--target=i386-pc",
+		target,
+	}
+	g.config.Logger.Debugf("Running grub with the following args: %s", grubargs)
+	out, err := g.config.Runner.Run("grub2-install", grubargs...)
+	if err != nil {
+		g.config.Logger.Errorf(string(out))
+		return err
+	}
+	g.config.Logger.Infof("Grub install to device %s complete", target)
+	return nil
+}
+
 // ClearBootEntry will go over the BootXXXX efi vars and remove any that matches our name
 // Used in install as we re-create the partitions, so the UUID of those partitions is no longer valid for the old entry
 // And we don't want to leave a broken entry around
@@ -295,7 +351,7 @@ func (g Grub) ClearBootEntry(efiVariables efibootmgr.EFIVariables) error {
 	variables, _ := efiVariables.ListVariables()
 	for _, v := range variables {
 		if regexp.MustCompile(`Boot[0-9a-fA-F]{4}`).MatchString(v.Name) {
-			variable, _, _ := efi.ReadVariable(v.Name, v.GUID)
+			variable, _, _ := efiVariables.GetVariable(v.GUID, v.Name)
 			option, err := efi.ReadLoadOption(bytes.NewReader(variable))
 			if err != nil {
 				continue
@@ -354,3 +410,230 @@ func (g Grub) SetPersistentVariables(grubEnvFile string, vars map[string]string)
 	}
 	return nil
 }
+
+// UnsetPersistentVariables removes the given keys from the given grub environment file
+func (g Grub) UnsetPersistentVariables(grubEnvFile string, keys ...string) error {
+	for _, key := range keys {
+		g.config.Logger.Debugf("Running grub2-editenv with params: %s unset %s", grubEnvFile, key)
+		out, err := g.config.Runner.Run("grub2-editenv", grubEnvFile, "unset", key)
+		if err != nil {
+			g.config.Logger.Errorf(fmt.Sprintf("Failed unsetting grub variables: %s", out))
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPersistentVariables returns the key value pairs stored in the given grub environment file
+func (g Grub) ReadPersistentVariables(grubEnvFile string) (map[string]string, error) {
+	vars := map[string]string{}
+	out, err := g.config.Runner.Run("grub2-editenv", grubEnvFile, "list")
+	if err != nil {
+		g.config.Logger.Errorf(fmt.Sprintf("Failed reading grub variables: %s", out))
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			vars[kv[0]] = kv[1]
+		}
+	}
+	return vars, nil
+}
+
+// SetBootAssessment writes the boot assessment script into the given state partition root and
+// arms the boot attempts counter of the grub environment file with the given number of tries.
+// The installed grub.cfg sources the script, on each boot it decrements the counter and, once
+// exhausted, it selects the fallback entry. Zero tries disables any ongoing boot assessment.
+func (g Grub) SetBootAssessment(stateDir, stateLabel string, tries int) error {
+	grubEnvFile := filepath.Join(stateDir, cnst.GrubOEMEnv)
+
+	if tries <= 0 {
+		if exists, _ := Exists(g.config.Fs, grubEnvFile); !exists {
+			return nil
+		}
+		return g.UnsetPersistentVariables(grubEnvFile, cnst.BootAssessTriesVar, cnst.BootAssessFailedVar)
+	}
+
+	var counter strings.Builder
+	for i := 1; i <= tries; i++ {
+		fmt.Fprintf(&counter, "  elif [ \"${boot_assessment_tries}\" = \"%d\" ]; then\n    set boot_assessment_tries=%d\n", i, i-1)
+	}
+	script := fmt.Sprintf(bootAssessmentTmpl, stateLabel, cnst.GrubOEMEnv, counter.String())
+	g.config.Logger.Infof("Setting boot assessment with %d boot attempts", tries)
+	err := g.config.Fs.WriteFile(filepath.Join(stateDir, cnst.GrubBootAssessment), []byte(script), cnst.FilePerm)
+	if err != nil {
+		g.config.Logger.Errorf("Failed writing boot assessment script: %v", err)
+		return err
+	}
+
+	return g.SetPersistentVariables(grubEnvFile, map[string]string{
+		cnst.BootAssessTriesVar:  strconv.Itoa(tries),
+		cnst.BootAssessFailedVar: "no",
+	})
+}
+
+// SetSnapshotsMenu writes the grub snapshots script with a menu entry per given snapshot index into the
+// given state partition root. Each entry loop mounts the snapshot image from the state partition and
+// boots it with the passive kernel command line. The installed grub.cfg sources the script, so entries
+// show up after the default ones. No indexes removes any previous snapshots script.
+func (g Grub) SetSnapshotsMenu(stateDir, stateLabel string, indexes ...int) error {
+	menuFile := filepath.Join(stateDir, cnst.GrubSnapshots)
+
+	if len(indexes) == 0 {
+		if exists, _ := Exists(g.config.Fs, menuFile); exists {
+			return g.config.Fs.Remove(menuFile)
+		}
+		return nil
+	}
+
+	var menu strings.Builder
+	menu.WriteString("# Autogenerated file by elemental client, do not edit\n")
+	for _, i := range indexes {
+		fmt.Fprintf(
+			&menu, snapshotEntryTmpl, i, fmt.Sprintf(cnst.SnapshotImgName, i), stateLabel,
+			fmt.Sprintf(cnst.SnapshotImgFile, i), fmt.Sprintf(cnst.SnapshotLabel, i),
+		)
+	}
+	g.config.Logger.Infof("Setting grub menu entries for %d snapshots", len(indexes))
+	err := g.config.Fs.WriteFile(menuFile, []byte(menu.String()), cnst.FilePerm)
+	if err != nil {
+		g.config.Logger.Errorf("Failed writing snapshots grub script: %v", err)
+	}
+	return err
+}
+
+// SetRecoveryBackupMenu writes the grub recovery backup script into the given state partition root. Its
+// single entry loop mounts the given backup image file from the recovery partition and boots it with the
+// recovery kernel command line, the backup label is only set for filesystem images as squashfs images have
+// none. An empty backup file removes any previous recovery backup script.
+func (g Grub) SetRecoveryBackupMenu(stateDir, recoveryLabel, backupFile, backupLabel string) error {
+	menuFile := filepath.Join(stateDir, cnst.GrubRecoveryBackup)
+
+	if backupFile == "" {
+		if exists, _ := Exists(g.config.Fs, menuFile); exists {
+			return g.config.Fs.Remove(menuFile)
+		}
+		return nil
+	}
+
+	menu := fmt.Sprintf(
+		recoveryBackupEntryTmpl, cnst.RecoveryBackupImgName, recoveryLabel,
+		filepath.Base(backupFile), recoveryLabel, backupLabel,
+	)
+	g.config.Logger.Infof("Setting grub menu entry for the recovery backup")
+	err := g.config.Fs.WriteFile(menuFile, []byte(menu), cnst.FilePerm)
+	if err != nil {
+		g.config.Logger.Errorf("Failed writing recovery backup grub script: %v", err)
+	}
+	return err
+}
+
+// SetScriptsInclude adds the include of the elemental grub scripts to the grub.cfg of the given state
+// partition root, or refreshes it if already there. It brings the scripts to systems installed before
+// grub.cfg included them. A missing grub.cfg is left untouched.
+func (g Grub) SetScriptsInclude(stateDir, stateLabel string) error {
+	grubCfg := filepath.Join(stateDir, "grub2/grub.cfg")
+	content, err := g.config.Fs.ReadFile(grubCfg)
+	if os.IsNotExist(err) {
+		g.config.Logger.Warnf("%s not found, not including the elemental grub scripts", grubCfg)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	updated := withScriptsInclude(string(content), stateLabel)
+	if updated == string(content) {
+		return nil
+	}
+	g.config.Logger.Infof("Including the elemental grub scripts into %s", grubCfg)
+	tmp := fmt.Sprintf("%s.tmp", grubCfg)
+	err = g.config.Fs.WriteFile(tmp, []byte(updated), cnst.FilePerm)
+	if err != nil {
+		return err
+	}
+	return g.config.Fs.Rename(tmp, grubCfg)
+}
+
+// withScriptsInclude returns the given grub.cfg content with the include of the elemental grub scripts at
+// its end, any previous include is replaced
+func withScriptsInclude(content, stateLabel string) string {
+	if i := strings.Index(content, grubScriptsBegin); i >= 0 {
+		end := len(content)
+		if j := strings.Index(content[i:], grubScriptsEnd); j >= 0 {
+			end = i + j + len(grubScriptsEnd)
+		}
+		content = content[:i] + strings.TrimPrefix(content[end:], "\n")
+	}
+	include := fmt.Sprintf(grubScriptsTmpl, grubScriptsBegin, stateLabel, strings.Join(grubScripts, " "), grubScriptsEnd)
+	return fmt.Sprintf("%s\n\n%s", strings.TrimRight(content, "\n"), include)
+}
+
+// grubScripts are the grub scripts elemental writes into the state partition root
+var grubScripts = []string{cnst.GrubBootAssessment, cnst.GrubSnapshots, cnst.GrubRecoveryBackup}
+
+// grubScriptsBegin and grubScriptsEnd delimit the include of the elemental grub scripts within grub.cfg
+const (
+	grubScriptsBegin = "# Begin of elemental client grub scripts, autogenerated, do not edit"
+	grubScriptsEnd   = "# End of elemental client grub scripts"
+)
+
+// grubScriptsTmpl is appended to the installed grub.cfg to source any of the elemental grub scripts found in
+// the state partition, the begin marker, the state partition label, the space separated script names and the
+// end marker are expected to be formatted into it
+const grubScriptsTmpl = `%s
+search --no-floppy --label --set=elemental_blk %s
+for elemental_script in %s; do
+  if [ -f (${elemental_blk})/${elemental_script} ]; then
+    source (${elemental_blk})/${elemental_script}
+  fi
+done
+%s
+`
+
+// snapshotEntryTmpl is the grub menu entry booting a snapshot image, the snapshot index, the entry
+// id, the state partition label, the image file name and the image label are expected to be formatted into it
+const snapshotEntryTmpl = `menuentry "${default_menu_entry} (snapshot %d)" --id %s {
+  search --no-floppy --label --set=root %s
+  set img=/cOS/%s
+  set label=%s
+  loopback loop0 /$img
+  set root=($root)
+  source (loop0)/etc/cos/bootargs.cfg
+  $linux (loop0)$kernel $kernelcmd ${extra_cmdline} ${extra_passive_cmdline}
+  $initramfs (loop0)$initramfs
+}
+`
+
+// recoveryBackupEntryTmpl is the grub script with the menu entry booting the recovery backup image, the entry id,
+// the recovery partition label, the image file name, the recovery partition label and the image label are expected
+// to be formatted into it
+const recoveryBackupEntryTmpl = `# Autogenerated file by elemental client, do not edit
+menuentry "${default_menu_entry} recovery (backup)" --id %s {
+  search --no-floppy --label --set=root %s
+  set img=/cOS/%s
+  set recoverylabel=%s
+  set label=%s
+  loopback loop0 /$img
+  set root=($root)
+  source (loop0)/etc/cos/bootargs.cfg
+  $linux (loop0)$kernel $kernelcmd ${extra_cmdline} ${extra_recovery_cmdline}
+  $initramfs (loop0)$initramfs
+}
+`
+
+// bootAssessmentTmpl is the grub script handling the boot attempts counter, stateLabel, the grub
+// environment file name and the counter decrement conditions are expected to be formatted into it
+const bootAssessmentTmpl = `# Autogenerated file by elemental client, do not edit
+search --no-floppy --label --set=bootassess_blk %[1]s
+if [ -n "${bootassess_blk}" ]; then
+  load_env -f (${bootassess_blk})/%[2]s boot_assessment_tries
+  if [ "${boot_assessment_tries}" = "0" ]; then
+    set boot_assessment_failed=yes
+    set default=fallback
+%[3]s  fi
+  if [ -n "${boot_assessment_tries}" ]; then
+    save_env -f (${bootassess_blk})/%[2]s boot_assessment_tries boot_assessment_failed
+  fi
+fi
+`
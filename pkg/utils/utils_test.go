@@ -258,6 +258,88 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(partNames).To(ContainElement("sdb1Test"))
 		})
 	})
+	Describe("SelectDisk", Label("disks", "target-selector"), func() {
+		var ghwTest v1mock.GhwMock
+		var selector *v1.TargetSelector
+		BeforeEach(func() {
+			ghwTest = v1mock.GhwMock{}
+			ghwTest.AddDisk(block.Disk{
+				Name: "sda", SizeBytes: 500 * 1024 * 1024 * 1024, DriveType: block.DRIVE_TYPE_HDD,
+				Model: "WDC_WD5000", SerialNumber: "WD-1234", BusPath: "pci-0000:00:1f.2-ata-1",
+			})
+			ghwTest.AddDisk(block.Disk{
+				Name: "nvme0n1", SizeBytes: 250 * 1024 * 1024 * 1024,
+				Model: "Samsung_SSD_970", SerialNumber: "S4EV", WWN: "eui.0025385",
+			})
+			ghwTest.AddDisk(block.Disk{
+				Name: "sdb", SizeBytes: 16 * 1024 * 1024 * 1024, Model: "Flash_Disk",
+				BusPath:    "pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0",
+				Partitions: []*block.Partition{{Name: "sdb1", MountPoint: "/run/initramfs/live"}},
+			})
+			ghwTest.CreateDevices()
+			selector = &v1.TargetSelector{Policy: v1.SelectFirst}
+		})
+		AfterEach(func() {
+			ghwTest.Clean()
+		})
+		It("selects the disk according to the policy skipping disks in use", func() {
+			selector.Policy = v1.SelectSmallest
+			disk, err := utils.SelectDisk(selector)
+			Expect(err).To(BeNil())
+			Expect(disk.Device).To(Equal("/dev/nvme0n1"))
+			Expect(disk.Serial).To(Equal("S4EV"))
+			Expect(disk.WWN).To(Equal("eui.0025385"))
+			Expect(disk.Size).To(Equal(uint64(250 * 1024 * 1024 * 1024)))
+
+			selector.Policy = v1.SelectLargest
+			disk, err = utils.SelectDisk(selector)
+			Expect(err).To(BeNil())
+			Expect(disk.Device).To(Equal("/dev/sda"))
+			Expect(disk.Model).To(Equal("WDC_WD5000"))
+		})
+		It("selects the disk matching the rules", func() {
+			rotational := false
+			selector.Rotational = &rotational
+			disk, err := utils.SelectDisk(selector)
+			Expect(err).To(BeNil())
+			Expect(disk.Device).To(Equal("/dev/nvme0n1"))
+
+			selector = &v1.TargetSelector{Bus: "SCSI", Model: "WDC_*", MinSize: "300G", Policy: v1.SelectFirst}
+			disk, err = utils.SelectDisk(selector)
+			Expect(err).To(BeNil())
+			Expect(disk.Device).To(Equal("/dev/sda"))
+
+			selector = &v1.TargetSelector{MaxSize: "300G", Policy: v1.SelectFirst}
+			disk, err = utils.SelectDisk(selector)
+			Expect(err).To(BeNil())
+			Expect(disk.Device).To(Equal("/dev/nvme0n1"))
+		})
+		It("fails if no disk matches", func() {
+			_, err := utils.SelectDisk(&v1.TargetSelector{Bus: "usb", Policy: v1.SelectFirst})
+			Expect(err).NotTo(BeNil())
+
+			_, err = utils.SelectDisk(&v1.TargetSelector{Serial: "missing", Policy: v1.SelectFirst})
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Describe("DiskSize", Label("disks", "requirements"), func() {
+		BeforeEach(func() {
+			Expect(utils.MkdirAll(fs, "/sys/class/block/sda", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/sys/class/block/sda/size", []byte("2097152\n"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, "/dev/disk/by-id", constants.DirPerm)).To(Succeed())
+			Expect(fs.Symlink("../../sda", "/dev/disk/by-id/ata-disk")).To(Succeed())
+		})
+		It("returns the size of a device", func() {
+			Expect(utils.DiskSize(fs, "/dev/sda")).To(Equal(uint64(1024 * 1024 * 1024)))
+		})
+		It("resolves symlinks to the device", func() {
+			Expect(utils.DiskSize(fs, "/dev/disk/by-id/ata-disk")).To(Equal(uint64(1024 * 1024 * 1024)))
+		})
+		It("fails on unknown devices", func() {
+			_, err := utils.DiskSize(fs, "/dev/sdb")
+			Expect(err).NotTo(BeNil())
+		})
+	})
 	Describe("GetPartitionFS", Label("lsblk", "partitions"), func() {
 		var ghwTest v1mock.GhwMock
 		BeforeEach(func() {
@@ -422,6 +504,21 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).NotTo(BeNil())
 		})
 	})
+	Describe("CopyImageFile", Label("CopyFile"), func() {
+		It("Copies the image file keeping it sparse", func() {
+			Expect(utils.MkdirAll(fs, "/some", constants.DirPerm)).To(Succeed())
+			_, err := fs.Create("/some/file.img")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(utils.CopyImageFile(runner, fs, "/some/file.img", "/some/other.img")).To(Succeed())
+			source, _ := fs.RawPath("/some/file.img")
+			target, _ := fs.RawPath("/some/other.img")
+			Expect(runner.CmdsMatch([][]string{{"cp", "--sparse=always", source, target}})).To(Succeed())
+		})
+		It("Fails if the source file does not exist", func() {
+			Expect(utils.CopyImageFile(runner, fs, "/some/file.img", "/some/other.img")).NotTo(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+		})
+	})
 	Describe("CreateDirStructure", Label("CreateDirStructure"), func() {
 		It("Creates essential directories", func() {
 			dirList := []string{"sys", "proc", "dev", "tmp", "boot", "usr/local", "oem"}
@@ -458,7 +555,7 @@ var _ = Describe("Utils", Label("utils"), func() {
 				_, _ = utils.TempFile(fs, sourceDir, "file*")
 			}
 
-			Expect(utils.SyncData(logger, fs, sourceDir, destDir)).To(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, fs, sourceDir, destDir)).To(BeNil())
 
 			filesDest, err := fs.ReadDir(destDir)
 			Expect(err).To(BeNil())
@@ -489,7 +586,7 @@ var _ = Describe("Utils", Label("utils"), func() {
 				_, _ = utils.TempFile(fs, sourceDir, "file*")
 			}
 
-			Expect(utils.SyncData(logger, fs, sourceDir, destDir, "host", "run")).To(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, fs, sourceDir, destDir, "host", "run")).To(BeNil())
 
 			filesDest, err := fs.ReadDir(destDir)
 			Expect(err).To(BeNil())
@@ -527,7 +624,7 @@ var _ = Describe("Utils", Label("utils"), func() {
 			utils.MkdirAll(fs, filepath.Join(sourceDir, "var", "run"), constants.DirPerm)
 			utils.MkdirAll(fs, filepath.Join(sourceDir, "tmp", "host"), constants.DirPerm)
 
-			Expect(utils.SyncData(logger, fs, sourceDir, destDir, "/host", "/run")).To(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, fs, sourceDir, destDir, "/host", "/run")).To(BeNil())
 
 			filesDest, err := fs.ReadDir(destDir)
 			Expect(err).To(BeNil())
@@ -553,19 +650,61 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			destDir, err := utils.TempDir(fs, "", "elementaltarget")
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(utils.SyncData(logger, fs, sourceDir, destDir)).To(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, fs, sourceDir, destDir)).To(BeNil())
 		})
 		It("should fail if destination does not exist", func() {
 			sourceDir, err := os.MkdirTemp("", "elemental")
 			Expect(err).To(BeNil())
 			defer os.RemoveAll(sourceDir)
-			Expect(utils.SyncData(logger, nil, sourceDir, "/welp")).NotTo(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, nil, sourceDir, "/welp")).NotTo(BeNil())
 		})
 		It("should fail if source does not exist", func() {
 			destDir, err := os.MkdirTemp("", "elemental")
 			Expect(err).To(BeNil())
 			defer os.RemoveAll(destDir)
-			Expect(utils.SyncData(logger, nil, "/welp", destDir)).NotTo(BeNil())
+			Expect(utils.SyncData(&v1.RealRunner{Logger: logger}, nil, "/welp", destDir)).NotTo(BeNil())
+		})
+		It("Reports the transfer percent", func() {
+			sourceDir, err := utils.TempDir(fs, "", "elementalsource")
+			Expect(err).ShouldNot(HaveOccurred())
+			destDir, err := utils.TempDir(fs, "", "elementaltarget")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = utils.TempFile(fs, sourceDir, "file*")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			events := &bytes.Buffer{}
+			progress := v1.NewProgress(events)
+			progress.Start("install")
+			progress.Phase(v1.PhaseDeploy)
+			Expect(utils.SyncDataWithProgress(&v1.RealRunner{Logger: logger}, fs, progress, sourceDir, destDir)).To(BeNil())
+
+			Expect(events.String()).To(ContainSubstring(
+				fmt.Sprintf(`"event":"progress","phase":"deploy","target":"%s","percent":100`, destDir),
+			))
+		})
+	})
+	Describe("MirrorData", Label("MirrorData"), func() {
+		It("Makes target identical to source", func() {
+			sourceDir, err := utils.TempDir(fs, "", "elementalsource")
+			Expect(err).ShouldNot(HaveOccurred())
+			destDir, err := utils.TempDir(fs, "", "elementaltarget")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(fs.WriteFile(filepath.Join(sourceDir, "changed"), []byte("new"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(sourceDir, "added"), []byte("added"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(destDir, "changed"), []byte("old"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(destDir, "stale"), []byte("stale"), constants.FilePerm)).To(Succeed())
+			Expect(utils.MkdirAll(fs, filepath.Join(destDir, "lost+found"), constants.DirPerm)).To(Succeed())
+
+			Expect(utils.MirrorData(&v1.RealRunner{Logger: logger}, fs, sourceDir, destDir, "/lost+found")).To(Succeed())
+
+			data, err := fs.ReadFile(filepath.Join(destDir, "changed"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("new")))
+			Expect(utils.Exists(fs, filepath.Join(destDir, "added"))).To(BeTrue())
+			Expect(utils.Exists(fs, filepath.Join(destDir, "stale"))).To(BeFalse())
+			// Excluded paths are kept
+			Expect(utils.Exists(fs, filepath.Join(destDir, "lost+found"))).To(BeTrue())
 		})
 	})
 	Describe("IsLocalURI", Label("uri"), func() {
@@ -804,6 +943,8 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(err).To(BeNil())
 				// Should not be modified at all
 				Expect(targetGrub).To(ContainSubstring("console=tty1"))
+				// Sources the elemental grub scripts
+				Expect(targetGrub).To(ContainSubstring("for elemental_script in grub_boot_assessment grub_snapshots grub_recovery_backup"))
 
 			})
 			It("installs with efi firmware", Label("efi"), func() {
@@ -921,6 +1062,204 @@ var _ = Describe("Utils", Label("utils"), func() {
 				})).To(BeNil())
 			})
 		})
+		Describe("UnsetPersistentVariables", func() {
+			It("Unsets the given keys from the grub environment file", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.UnsetPersistentVariables("somefile", "key1", "key2")).To(BeNil())
+				Expect(runner.CmdsMatch([][]string{
+					{"grub2-editenv", "somefile", "unset", "key1"},
+					{"grub2-editenv", "somefile", "unset", "key2"},
+				})).To(BeNil())
+			})
+		})
+		Describe("ReadPersistentVariables", func() {
+			It("Reads the grub environment file", func() {
+				runner.ReturnValue = []byte("key1=value1\nkey2=value=2\n")
+				grub := utils.NewGrub(config)
+				vars, err := grub.ReadPersistentVariables("somefile")
+				Expect(err).To(BeNil())
+				Expect(vars).To(Equal(map[string]string{"key1": "value1", "key2": "value=2"}))
+				Expect(runner.CmdsMatch([][]string{
+					{"grub2-editenv", "somefile", "list"},
+				})).To(BeNil())
+			})
+			It("Fails running grub2-editenv", func() {
+				runner.ReturnError = errors.New("grub error")
+				grub := utils.NewGrub(config)
+				_, err := grub.ReadPersistentVariables("somefile")
+				Expect(err).NotTo(BeNil())
+			})
+		})
+		Describe("SetBootAssessment", func() {
+			BeforeEach(func() {
+				Expect(utils.MkdirAll(fs, "/state", constants.DirPerm)).To(Succeed())
+			})
+			It("Writes the boot assessment script and arms the counter", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetBootAssessment("/state", constants.StateLabel, 2)).To(BeNil())
+				script, err := fs.ReadFile(filepath.Join("/state", constants.GrubBootAssessment))
+				Expect(err).To(BeNil())
+				Expect(string(script)).To(ContainSubstring("--set=bootassess_blk COS_STATE"))
+				Expect(string(script)).To(ContainSubstring("set default=fallback"))
+				Expect(string(script)).To(ContainSubstring("= \"2\" ]; then\n    set boot_assessment_tries=1\n"))
+				Expect(string(script)).To(ContainSubstring("= \"1\" ]; then\n    set boot_assessment_tries=0\n"))
+				Expect(string(script)).To(ContainSubstring("load_env -f (${bootassess_blk})/grub_oem_env boot_assessment_tries"))
+				Expect(runner.IncludesCmds([][]string{
+					{"grub2-editenv", "/state/grub_oem_env", "set", "boot_assessment_tries=2"},
+					{"grub2-editenv", "/state/grub_oem_env", "set", "boot_assessment_failed=no"},
+				})).To(BeNil())
+			})
+			It("Clears the counter if no tries are given", func() {
+				Expect(fs.WriteFile("/state/grub_oem_env", []byte{}, constants.FilePerm)).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetBootAssessment("/state", constants.StateLabel, 0)).To(BeNil())
+				Expect(runner.CmdsMatch([][]string{
+					{"grub2-editenv", "/state/grub_oem_env", "unset", "boot_assessment_tries"},
+					{"grub2-editenv", "/state/grub_oem_env", "unset", "boot_assessment_failed"},
+				})).To(BeNil())
+			})
+			It("Does nothing if no tries are given and there is no grub environment file", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetBootAssessment("/state", constants.StateLabel, 0)).To(BeNil())
+				Expect(runner.CmdsMatch([][]string{})).To(BeNil())
+			})
+		})
+		Describe("SetScriptsInclude", func() {
+			BeforeEach(func() {
+				Expect(utils.MkdirAll(fs, "/state/grub2", constants.DirPerm)).To(Succeed())
+			})
+			It("Adds the include to a grub.cfg without it", func() {
+				Expect(fs.WriteFile("/state/grub2/grub.cfg", []byte("set timeout=10\n"), constants.FilePerm)).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetScriptsInclude("/state", constants.StateLabel)).To(BeNil())
+				grubCfg, err := fs.ReadFile("/state/grub2/grub.cfg")
+				Expect(err).To(BeNil())
+				Expect(string(grubCfg)).To(HavePrefix("set timeout=10\n\n"))
+				Expect(string(grubCfg)).To(ContainSubstring("search --no-floppy --label --set=elemental_blk COS_STATE"))
+				Expect(string(grubCfg)).To(ContainSubstring("for elemental_script in grub_boot_assessment grub_snapshots grub_recovery_backup"))
+			})
+			It("Refreshes a previous include", func() {
+				Expect(fs.WriteFile("/state/grub2/grub.cfg", []byte("set timeout=10\n"), constants.FilePerm)).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetScriptsInclude("/state", "OLD_STATE")).To(BeNil())
+				Expect(grub.SetScriptsInclude("/state", constants.StateLabel)).To(BeNil())
+				grubCfg, err := fs.ReadFile("/state/grub2/grub.cfg")
+				Expect(err).To(BeNil())
+				Expect(strings.Count(string(grubCfg), "for elemental_script in")).To(Equal(1))
+				Expect(string(grubCfg)).NotTo(ContainSubstring("OLD_STATE"))
+				Expect(string(grubCfg)).To(ContainSubstring("--set=elemental_blk COS_STATE"))
+
+				// Refreshing an up to date include does not change grub.cfg
+				Expect(grub.SetScriptsInclude("/state", constants.StateLabel)).To(BeNil())
+				current, err := fs.ReadFile("/state/grub2/grub.cfg")
+				Expect(err).To(BeNil())
+				Expect(current).To(Equal(grubCfg))
+			})
+			It("Does nothing without a grub.cfg", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetScriptsInclude("/state", constants.StateLabel)).To(BeNil())
+				_, err := fs.Stat("/state/grub2/grub.cfg")
+				Expect(err).NotTo(BeNil())
+			})
+		})
+		Describe("SetSnapshotsMenu", func() {
+			BeforeEach(func() {
+				Expect(utils.MkdirAll(fs, "/state", constants.DirPerm)).To(Succeed())
+			})
+			It("Writes a menu entry for each snapshot", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetSnapshotsMenu("/state", constants.StateLabel, 1, 2)).To(BeNil())
+				menu, err := fs.ReadFile(filepath.Join("/state", constants.GrubSnapshots))
+				Expect(err).To(BeNil())
+				Expect(string(menu)).To(ContainSubstring("(snapshot 1)\" --id snapshot-1 {"))
+				Expect(string(menu)).To(ContainSubstring("set img=/cOS/snapshot-2.img\n  set label=COS_SNAPSHOT_2\n"))
+				Expect(string(menu)).To(ContainSubstring("--set=root COS_STATE"))
+			})
+			It("Removes the menu if there are no snapshots", func() {
+				Expect(fs.WriteFile(filepath.Join("/state", constants.GrubSnapshots), []byte{}, constants.FilePerm)).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetSnapshotsMenu("/state", constants.StateLabel)).To(BeNil())
+				_, err := fs.Stat(filepath.Join("/state", constants.GrubSnapshots))
+				Expect(err).NotTo(BeNil())
+			})
+		})
+		Describe("SetRecoveryBackupMenu", func() {
+			BeforeEach(func() {
+				Expect(utils.MkdirAll(fs, "/state", constants.DirPerm)).To(Succeed())
+			})
+			It("Writes a menu entry for the recovery backup", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetRecoveryBackupMenu(
+					"/state", constants.RecoveryLabel, "/recovery/cOS/recovery-backup.img", constants.SystemLabel,
+				)).To(BeNil())
+				menu, err := fs.ReadFile(filepath.Join("/state", constants.GrubRecoveryBackup))
+				Expect(err).To(BeNil())
+				Expect(string(menu)).To(ContainSubstring("recovery (backup)\" --id recovery-backup {"))
+				Expect(string(menu)).To(ContainSubstring("set img=/cOS/recovery-backup.img\n"))
+				Expect(string(menu)).To(ContainSubstring("--set=root COS_RECOVERY"))
+				Expect(string(menu)).To(ContainSubstring("set label=COS_SYSTEM"))
+			})
+			It("Removes the menu if there is no recovery backup", func() {
+				Expect(fs.WriteFile(filepath.Join("/state", constants.GrubRecoveryBackup), []byte{}, constants.FilePerm)).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetRecoveryBackupMenu("/state", constants.RecoveryLabel, "", "")).To(BeNil())
+				_, err := fs.Stat(filepath.Join("/state", constants.GrubRecoveryBackup))
+				Expect(err).NotTo(BeNil())
+			})
+		})
+		Describe("SetEFIModules", func() {
+			BeforeEach(func() {
+				Expect(utils.MkdirAll(fs, "/efi/EFI/boot", constants.DirPerm)).To(Succeed())
+				Expect(utils.MkdirAll(fs, "/efi/EFI/elemental", constants.DirPerm)).To(Succeed())
+				for _, cfg := range []string{"/efi/EFI/boot/grub.cfg", "/efi/EFI/elemental/grub.cfg"} {
+					Expect(fs.WriteFile(cfg, []byte("search --no-floppy --label --set=root COS_STATE\n"), constants.FilePerm)).To(Succeed())
+				}
+			})
+			It("Loads the modules before searching the state partition", func() {
+				grub := utils.NewGrub(config)
+				Expect(grub.SetEFIModules("/efi", "mdraid1x")).To(Succeed())
+				// Setting them again does not duplicate them
+				Expect(grub.SetEFIModules("/efi", "mdraid1x")).To(Succeed())
+				for _, cfg := range []string{"/efi/EFI/boot/grub.cfg", "/efi/EFI/elemental/grub.cfg"} {
+					content, err := fs.ReadFile(cfg)
+					Expect(err).To(BeNil())
+					Expect(string(content)).To(Equal("insmod mdraid1x\nsearch --no-floppy --label --set=root COS_STATE\n"))
+				}
+			})
+			It("Fails without a grub.cfg", func() {
+				Expect(fs.Remove("/efi/EFI/boot/grub.cfg")).To(Succeed())
+				grub := utils.NewGrub(config)
+				Expect(grub.SetEFIModules("/efi", "mdraid1x")).NotTo(Succeed())
+			})
+		})
+		Describe("CreateMemberBootEntry", Label("bootentry"), func() {
+			It("Creates an entry for the shim of the given EFI partition", func() {
+				Expect(utils.MkdirAll(fs, "/efi/EFI/elemental", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/efi/EFI/elemental/shim.efi", []byte(""), constants.FilePerm)).To(Succeed())
+				Expect(fs.WriteFile("/efi/EFI/elemental/grub.efi", []byte(""), constants.FilePerm)).To(Succeed())
+				efiDir, _ := fs.RawPath("/efi")
+				efivars := &efibootmgr.MockEFIVariables{}
+				// Boot manager works on real paths
+				config.Fs = vfs.OSFS
+				config.EFIVariables = efivars
+
+				grub := utils.NewGrub(config)
+				Expect(grub.CreateMemberBootEntry(efiDir)).To(Succeed())
+				vars, _ := efivars.ListVariables()
+				Expect(len(vars)).To(Equal(2))
+				variable, _, err := efivars.GetVariable(vars[0].GUID, "Boot0000")
+				Expect(err).ToNot(HaveOccurred())
+				option, err := efi.ReadLoadOption(bytes.NewReader(variable))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(option.FilePath.String()).To(ContainSubstring(`\EFI\elemental\shim.efi`))
+			})
+			It("Fails if there is no shim", func() {
+				Expect(utils.MkdirAll(fs, "/efi/EFI/elemental", constants.DirPerm)).To(Succeed())
+				config.EFIVariables = &efibootmgr.MockEFIVariables{}
+				grub := utils.NewGrub(config)
+				Expect(grub.CreateMemberBootEntry("/efi")).NotTo(Succeed())
+			})
+		})
 		Describe("CreateBootEntry", Label("bootentry"), func() {
 			var efivars efibootmgr.EFIVariables
 			var relativeTo string
@@ -81,6 +81,7 @@ func (g *GhwMock) CreateDevices() {
 		// For each dir we create the /sys/block/DISK_NAME
 		diskPath := filepath.Join(g.paths.SysBlock, disk.Name)
 		_ = os.Mkdir(diskPath, 0755)
+		g.createDiskAttributes(indexDisk, disk)
 		for indexPart, partition := range disk.Partitions {
 			// For each partition we create the /sys/block/DISK_NAME/PARTITION_NAME
 			_ = os.Mkdir(filepath.Join(diskPath, partition.Name), 0755)
@@ -109,6 +110,31 @@ func (g *GhwMock) CreateDevices() {
 	_ = ioutil.WriteFile(g.paths.ProcMounts, []byte(strings.Join(g.mounts, "")), 0644)
 }
 
+// createDiskAttributes creates the sysfs and udev files describing the size, rotational flag, model,
+// serial, WWN and bus path of the given disk, if any of them is set
+func (g *GhwMock) createDiskAttributes(indexDisk int, disk block.Disk) {
+	diskPath := filepath.Join(g.paths.SysBlock, disk.Name)
+	if disk.SizeBytes > 0 {
+		_ = ioutil.WriteFile(filepath.Join(diskPath, "size"), []byte(fmt.Sprintf("%d\n", disk.SizeBytes/512)), 0644)
+	}
+	if disk.DriveType == block.DRIVE_TYPE_HDD {
+		_ = os.MkdirAll(filepath.Join(diskPath, "queue"), 0755)
+		_ = ioutil.WriteFile(filepath.Join(diskPath, "queue", "rotational"), []byte("1\n"), 0644)
+	}
+	var data []string
+	for key, value := range map[string]string{
+		"ID_MODEL": disk.Model, "ID_SERIAL": disk.SerialNumber, "ID_WWN": disk.WWN, "ID_PATH": disk.BusPath,
+	} {
+		if value != "" {
+			data = append(data, fmt.Sprintf("E:%s=%s\n", key, value))
+		}
+	}
+	if len(data) > 0 {
+		_ = ioutil.WriteFile(filepath.Join(diskPath, "dev"), []byte(fmt.Sprintf("%d:0\n", indexDisk)), 0644)
+		_ = ioutil.WriteFile(filepath.Join(g.paths.RunUdevData, fmt.Sprintf("b%d:0", indexDisk)), []byte(strings.Join(data, "")), 0644)
+	}
+}
+
 // RemoveDisk will remove the files for a disk. It makes no effort to check if the disk exists or not
 func (g *GhwMock) RemoveDisk(disk string) {
 	// This could be simpler I think, just removing the /sys/block/DEVICE should make ghw not find anything and not search
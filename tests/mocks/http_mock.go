@@ -27,6 +27,8 @@ import (
 type FakeHTTPClient struct {
 	ClientCalls []string
 	Error       bool
+	// SideEffect runs on each download, so tests can write the downloaded file
+	SideEffect func(url string, destination string) error
 }
 
 // GetURL will return a FakeHttpBody and store the url call into ClientCalls
@@ -36,9 +38,17 @@ func (m *FakeHTTPClient) GetURL(log v1.Logger, url string, destination string) e
 	if m.Error {
 		return errors.New("fake http error")
 	}
+	if m.SideEffect != nil {
+		return m.SideEffect(url, destination)
+	}
 	return nil
 }
 
+// GetURLWithChecksum behaves as GetURL, the checksum is not verified
+func (m *FakeHTTPClient) GetURLWithChecksum(log v1.Logger, url string, destination string, checksum string) error {
+	return m.GetURL(log, url, destination)
+}
+
 // WasGetCalledWith is a helper method to confirm that the client wazs called with the give url
 func (m *FakeHTTPClient) WasGetCalledWith(url string) bool {
 	for _, c := range m.ClientCalls {
@@ -28,8 +28,14 @@ type FakeLuet struct {
 	OnUnpackFromChannelError    bool
 	UnpackSideEffect            func(string, string, bool) (*v1.DockerImageMeta, error)
 	UnpackFromChannelSideEffect func(string, string, ...v1.Repository) (*v1.ChannelImageMeta, error)
+	ImageMetaSideEffect         func(string, bool) (*v1.DockerImageMeta, error)
+	UnpackLayersSideEffect      func(string, string, bool, int) (*v1.DockerImageMeta, error)
+	UnpackArchiveSideEffect     func(string, *v1.ImageSource) (*v1.DockerImageMeta, error)
+	PackageVersionsSideEffect   func(string, ...v1.Repository) ([]string, error)
 	unpackCalled                bool
 	unpackFromChannelCalled     bool
+	unpackLayersCalled          bool
+	unpackArchiveCalled         bool
 	plugins                     []string
 	arch                        string
 }
@@ -49,6 +55,35 @@ func (l *FakeLuet) Unpack(target string, image string, local bool) (*v1.DockerIm
 	return nil, nil
 }
 
+func (l *FakeLuet) GetImageMeta(image string, local bool) (*v1.DockerImageMeta, error) {
+	if l.ImageMetaSideEffect != nil {
+		return l.ImageMetaSideEffect(image, local)
+	}
+	return nil, nil
+}
+
+func (l *FakeLuet) UnpackLayers(target string, image string, local bool, from int) (*v1.DockerImageMeta, error) {
+	l.unpackLayersCalled = true
+	if l.OnUnpackError {
+		return nil, errors.New("Luet install error")
+	}
+	if l.UnpackLayersSideEffect != nil {
+		return l.UnpackLayersSideEffect(target, image, local, from)
+	}
+	return nil, nil
+}
+
+func (l *FakeLuet) UnpackArchive(target string, src *v1.ImageSource) (*v1.DockerImageMeta, error) {
+	l.unpackArchiveCalled = true
+	if l.OnUnpackError {
+		return nil, errors.New("Luet install error")
+	}
+	if l.UnpackArchiveSideEffect != nil {
+		return l.UnpackArchiveSideEffect(target, src)
+	}
+	return nil, nil
+}
+
 func (l *FakeLuet) UnpackFromChannel(target string, pkg string, repos ...v1.Repository) (*v1.ChannelImageMeta, error) {
 	l.unpackFromChannelCalled = true
 	if l.OnUnpackFromChannelError {
@@ -60,6 +95,13 @@ func (l *FakeLuet) UnpackFromChannel(target string, pkg string, repos ...v1.Repo
 	return nil, nil
 }
 
+func (l *FakeLuet) PackageVersions(pkg string, repos ...v1.Repository) ([]string, error) {
+	if l.PackageVersionsSideEffect != nil {
+		return l.PackageVersionsSideEffect(pkg, repos...)
+	}
+	return []string{}, nil
+}
+
 func (l FakeLuet) UnpackCalled() bool {
 	return l.unpackCalled
 }
@@ -68,6 +110,14 @@ func (l FakeLuet) UnpackChannelCalled() bool {
 	return l.unpackFromChannelCalled
 }
 
+func (l FakeLuet) UnpackLayersCalled() bool {
+	return l.unpackLayersCalled
+}
+
+func (l FakeLuet) UnpackArchiveCalled() bool {
+	return l.unpackArchiveCalled
+}
+
 func (l FakeLuet) OverrideConfig(config *luetTypes.LuetConfig) {}
 
 func (l *FakeLuet) SetPlugins(plugins ...string) {
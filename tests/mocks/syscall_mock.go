@@ -16,13 +16,18 @@ limitations under the License.
 
 package mocks
 
-import "errors"
+import (
+	"errors"
+	"syscall"
+)
 
 // FakeSyscall is a test helper method to track calls to syscall
 // It can also fail on Chroot command
 type FakeSyscall struct {
 	chrootHistory []string // Track calls to chroot
 	ErrorOnChroot bool
+	ErrorOnStatfs bool
+	FreeSpace     uint64 // Bytes reported as available by Statfs, plenty if not set
 }
 
 // Chroot will store the chroot call
@@ -39,6 +44,20 @@ func (f *FakeSyscall) Chdir(path string) error {
 	return nil
 }
 
+// Statfs reports FreeSpace bytes as available space
+// It can return a failure if ErrorOnStatfs is true
+func (f *FakeSyscall) Statfs(path string, buf *syscall.Statfs_t) error {
+	if f.ErrorOnStatfs {
+		return errors.New("statfs error")
+	}
+	buf.Bsize = 1
+	buf.Bavail = f.FreeSpace
+	if f.FreeSpace == 0 {
+		buf.Bavail = 1 << 50
+	}
+	return nil
+}
+
 // WasChrootCalledWith is a helper method to check if Chroot was called with the given path
 func (f *FakeSyscall) WasChrootCalledWith(path string) bool {
 	for _, c := range f.chrootHistory {